@@ -0,0 +1,228 @@
+package acl
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"filemanager/auth"
+	"filemanager/config"
+	"filemanager/utils"
+)
+
+// Permission is an action a caller can be granted on a source
+type Permission string
+
+const (
+	Read   Permission = "read"
+	Write  Permission = "write"
+	Delete Permission = "delete"
+	Share  Permission = "share"
+)
+
+var allPermissions = []Permission{Read, Write, Delete, Share}
+
+// Identity is who a request runs as
+type Identity struct {
+	Username string
+	Admin    bool
+	Groups   []string
+}
+
+type rule struct {
+	source string
+	path   string
+	users  map[string]bool
+	groups map[string]bool
+	perms  map[Permission]bool
+}
+
+type policy struct {
+	open   bool
+	groups map[string][]string
+	rules  []rule
+}
+
+var (
+	mu      sync.RWMutex
+	current = &policy{open: true}
+)
+
+// Load replaces the active rules. A nil config allows every signed in user
+// everything, which is how the server behaves without an access section.
+func Load(cfg *config.AccessConfig) error {
+	p, err := compile(cfg)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	current = p
+	mu.Unlock()
+	return nil
+}
+
+func init() {
+	config.OnReload(func(_, cur *config.Config) {
+		if err := Load(cur.Access); err != nil {
+			utils.Errorf("❌ Keeping the previous access rules: %v", err)
+		}
+	})
+}
+
+func compile(cfg *config.AccessConfig) (*policy, error) {
+	if cfg == nil {
+		return &policy{open: true}, nil
+	}
+
+	p := &policy{groups: map[string][]string{}}
+	for group, members := range cfg.Groups {
+		for _, member := range members {
+			user := strings.ToLower(member)
+			p.groups[user] = append(p.groups[user], group)
+		}
+	}
+
+	for i, r := range cfg.Rules {
+		if r.Source == "" {
+			return nil, fmt.Errorf("access rule %d: missing source", i+1)
+		}
+		if len(r.Users) == 0 && len(r.Groups) == 0 {
+			return nil, fmt.Errorf("access rule %d: needs users or groups", i+1)
+		}
+
+		compiled := rule{
+			source: strings.ToLower(r.Source),
+			path:   cleanPath(r.Path),
+			users:  map[string]bool{},
+			groups: map[string]bool{},
+			perms:  map[Permission]bool{},
+		}
+		for _, u := range r.Users {
+			compiled.users[strings.ToLower(u)] = true
+		}
+		for _, g := range r.Groups {
+			compiled.groups[g] = true
+		}
+		for _, perm := range r.Permissions {
+			perm = strings.ToLower(perm)
+			if perm == "all" {
+				for _, p := range allPermissions {
+					compiled.perms[p] = true
+				}
+				continue
+			}
+			if !isPermission(Permission(perm)) {
+				return nil, fmt.Errorf("access rule %d: unknown permission %q", i+1, perm)
+			}
+			compiled.perms[Permission(perm)] = true
+		}
+		p.rules = append(p.rules, compiled)
+	}
+	return p, nil
+}
+
+func isPermission(perm Permission) bool {
+	for _, p := range allPermissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+}
+
+// For builds the identity of a signed in user
+func For(user *auth.User) Identity {
+	if user == nil {
+		return Identity{}
+	}
+
+	mu.RLock()
+	groups := current.groups[strings.ToLower(user.Username)]
+	mu.RUnlock()
+
+	return Identity{Username: user.Username, Admin: user.Admin, Groups: groups}
+}
+
+func (r *rule) appliesTo(id Identity, sourceID string) bool {
+	if r.source != "*" && r.source != strings.ToLower(sourceID) {
+		if src, ok := config.GetSource(sourceID); !ok || r.source != strings.ToLower(src.Name) {
+			return false
+		}
+	}
+	if id.Username == "" {
+		return false
+	}
+	if r.users["*"] || r.users[strings.ToLower(id.Username)] {
+		return true
+	}
+	for _, g := range id.Groups {
+		if r.groups[g] {
+			return true
+		}
+	}
+	return false
+}
+
+// within reports whether name is p or lies below it
+func within(name, p string) bool {
+	return p == "/" || name == p || strings.HasPrefix(name, p+"/")
+}
+
+// Allowed reports whether id holds perm on name inside a source
+func Allowed(id Identity, sourceID, name string, perm Permission) bool {
+	name = cleanPath(name)
+	return anyRule(id, sourceID, func(r *rule) bool {
+		return r.perms[perm] && within(name, r.path)
+	})
+}
+
+// CanTraverse reports whether name is a folder above a path that id was
+// granted something on. Such folders can be listed even without read
+// access, showing only the entries that are Visible.
+func CanTraverse(id Identity, sourceID, name string) bool {
+	name = cleanPath(name)
+	return anyRule(id, sourceID, func(r *rule) bool {
+		return r.path != name && within(r.path, name)
+	})
+}
+
+// Visible reports whether name should show up for id at all: it is inside
+// a granted path or leads to one
+func Visible(id Identity, sourceID, name string) bool {
+	name = cleanPath(name)
+	return anyRule(id, sourceID, func(r *rule) bool {
+		return within(name, r.path) || within(r.path, name)
+	})
+}
+
+// CanSeeSource reports whether id was granted anything on a source
+func CanSeeSource(id Identity, sourceID string) bool {
+	return Visible(id, sourceID, "/")
+}
+
+func anyRule(id Identity, sourceID string, match func(r *rule) bool) bool {
+	if id.Admin {
+		return true
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if current.open {
+		return id.Username != ""
+	}
+
+	for i := range current.rules {
+		r := &current.rules[i]
+		if len(r.perms) > 0 && r.appliesTo(id, sourceID) && match(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package acl
+
+import (
+	"testing"
+
+	"filemanager/config"
+)
+
+// useAccess loads cfg until the test ends
+func useAccess(t *testing.T, cfg *config.AccessConfig) {
+	t.Helper()
+	if err := Load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Load(nil) })
+}
+
+func TestAllowed(t *testing.T) {
+	useAccess(t, &config.AccessConfig{
+		Groups: map[string][]string{"family": {"Alice", "bob"}},
+		Rules: []config.AccessRule{
+			{Source: "images", Groups: []string{"family"}, Permissions: []string{"read"}},
+			{Source: "docs", Path: "/shared", Users: []string{"bob"}, Permissions: []string{"read", "write"}},
+			{Source: "docs", Path: "\\team\\", Users: []string{"*"}, Permissions: []string{"all"}},
+			{Source: "*", Path: "/public", Users: []string{"carol"}, Permissions: []string{"read"}},
+			{Source: "docs", Users: []string{"dave"}},
+		},
+	})
+	alice := Identity{Username: "alice", Groups: []string{"family"}}
+	bob := Identity{Username: "bob", Groups: []string{"family"}}
+	carol := Identity{Username: "carol"}
+	dave := Identity{Username: "dave"}
+	admin := Identity{Username: "root", Admin: true}
+
+	tests := []struct {
+		name   string
+		id     Identity
+		source string
+		path   string
+		perm   Permission
+		want   bool
+	}{
+		{"group read", alice, "images", "/a.jpg", Read, true},
+		{"group no write", alice, "images", "/a.jpg", Write, false},
+		{"source ids ignore case", alice, "Images", "/a.jpg", Read, true},
+		{"other source", alice, "docs", "/a.txt", Read, false},
+		{"sub-path", bob, "docs", "/shared/a.txt", Write, true},
+		{"sub-path itself", bob, "docs", "/shared", Read, true},
+		{"outside sub-path", bob, "docs", "/private/a.txt", Read, false},
+		{"prefix is not a parent", bob, "docs", "/shared-not/a.txt", Read, false},
+		{"dot-dot out of sub-path", bob, "docs", "/shared/../private/a.txt", Read, false},
+		{"no delete granted", bob, "docs", "/shared/a.txt", Delete, false},
+		{"everyone, all permissions", carol, "docs", "/team/a.txt", Delete, true},
+		{"backslash path", carol, "docs", "/team/sub/a.txt", Share, true},
+		{"any source", carol, "images", "/public/a.jpg", Read, true},
+		{"rule without permissions", dave, "docs", "/a.txt", Read, false},
+		{"admin", admin, "docs", "/private/a.txt", Delete, true},
+		{"anonymous", Identity{}, "docs", "/team/a.txt", Read, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Allowed(tt.id, tt.source, tt.path, tt.perm); got != tt.want {
+				t.Errorf("Allowed(%s, %s, %s, %s) = %v, want %v", tt.id.Username, tt.source, tt.path, tt.perm, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTraverseAndVisible(t *testing.T) {
+	useAccess(t, &config.AccessConfig{
+		Rules: []config.AccessRule{
+			{Source: "docs", Path: "/a/b", Users: []string{"bob"}, Permissions: []string{"read"}},
+		},
+	})
+	bob := Identity{Username: "bob"}
+
+	tests := []struct {
+		path     string
+		traverse bool
+		visible  bool
+	}{
+		{"/", true, true},
+		{"/a", true, true},
+		{"/a/b", false, true},
+		{"/a/b/c", false, true},
+		{"/a/c", false, false},
+		{"/x", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := CanTraverse(bob, "docs", tt.path); got != tt.traverse {
+				t.Errorf("CanTraverse = %v, want %v", got, tt.traverse)
+			}
+			if got := Visible(bob, "docs", tt.path); got != tt.visible {
+				t.Errorf("Visible = %v, want %v", got, tt.visible)
+			}
+		})
+	}
+	if CanSeeSource(bob, "images") {
+		t.Error("bob can see a source without rules")
+	}
+}
+
+func TestOpenWithoutAccessSection(t *testing.T) {
+	useAccess(t, nil)
+	if !Allowed(Identity{Username: "bob"}, "docs", "/a", Delete) {
+		t.Error("signed in user refused without an access section")
+	}
+	if Allowed(Identity{}, "docs", "/a", Read) {
+		t.Error("anonymous caller allowed")
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		rule config.AccessRule
+	}{
+		{"missing source", config.AccessRule{Users: []string{"bob"}, Permissions: []string{"read"}}},
+		{"nobody", config.AccessRule{Source: "docs", Permissions: []string{"read"}}},
+		{"unknown permission", config.AccessRule{Source: "docs", Users: []string{"bob"}, Permissions: []string{"execute"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Load(&config.AccessConfig{Rules: []config.AccessRule{tt.rule}}); err == nil {
+				Load(nil)
+				t.Error("rule accepted")
+			}
+		})
+	}
+}
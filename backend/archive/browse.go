@@ -0,0 +1,571 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"filemanager/storage"
+)
+
+const (
+	// maxCached is how many opened archives are kept between requests
+	maxCached = 8
+	// cacheIdle is how long an unused archive stays open
+	cacheIdle = 10 * time.Minute
+)
+
+var ErrReadOnly = errors.New("archive contents are read-only")
+
+// Browse resolves a path that leads through an archive, like
+// /backups/site.zip/css/main.css, to a read-only view of the archive and the
+// path inside it. Other paths come back unchanged.
+func Browse(drv storage.Driver, sourceID, name string) (storage.Driver, string, error) {
+	if _, err := drv.Stat(name); err == nil {
+		return drv, name, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	for i := range parts {
+		prefix := "/" + strings.Join(parts[:i+1], "/")
+		info, err := drv.Stat(prefix)
+		if err != nil {
+			break
+		}
+		if info.IsDir() {
+			continue
+		}
+		if !Browsable(prefix, info) {
+			break
+		}
+		v, err := Open(drv, sourceID, prefix)
+		if err != nil {
+			return nil, "", err
+		}
+		return v, "/" + strings.Join(parts[i+1:], "/"), nil
+	}
+	return drv, name, nil
+}
+
+// Browsable reports whether a file can be opened as a folder
+func Browsable(name string, info fs.FileInfo) bool {
+	_, _, err := Detect(name)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// View is an opened archive. It implements storage.Driver with the archive
+// root as "/"; everything that would change it fails with ErrReadOnly.
+type View struct {
+	drv   storage.Driver
+	name  string
+	kind  Kind
+	size  int64
+	mtime time.Time
+	nodes map[string]*node
+
+	// Zip archives keep their file open for random access. Drivers whose
+	// files cannot ReadAt share one seekReaderAt, whose lock keeps the
+	// seek and read of every caller together.
+	file storage.File
+	ra   io.ReaderAt
+	zr   *zip.Reader
+
+	mu       sync.Mutex
+	refs     int
+	evicted  bool
+	lastUsed time.Time
+}
+
+// node is a file or folder inside an archive
+type node struct {
+	name     string
+	isDir    bool
+	size     int64
+	mode     fs.FileMode
+	modTime  time.Time
+	children []*node
+
+	zf      *zip.File
+	ordinal int
+}
+
+func (n *node) Name() string       { return path.Base(n.name) }
+func (n *node) Size() int64        { return n.size }
+func (n *node) ModTime() time.Time { return n.modTime }
+func (n *node) IsDir() bool        { return n.isDir }
+func (n *node) Sys() any           { return nil }
+
+func (n *node) Mode() fs.FileMode {
+	if n.isDir {
+		return fs.ModeDir | 0755
+	}
+	return n.mode.Perm()
+}
+
+var (
+	cacheMu sync.Mutex
+	cache   = map[string]*View{}
+	janitor sync.Once
+)
+
+// Open returns the view of an archive file, reusing a cached one while the
+// file is unchanged
+func Open(drv storage.Driver, sourceID, name string) (*View, error) {
+	info, err := drv.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	kind, _, err := Detect(name)
+	if err != nil {
+		return nil, err
+	}
+
+	janitor.Do(func() { go sweep() })
+
+	key := sourceID + ":" + name
+	cacheMu.Lock()
+	v, ok := cache[key]
+	if ok && v.size == info.Size() && v.mtime.Equal(info.ModTime()) {
+		v.touch()
+		cacheMu.Unlock()
+		return v, nil
+	}
+	if ok {
+		delete(cache, key)
+		v.evict()
+	}
+	cacheMu.Unlock()
+
+	v = &View{
+		drv:   drv,
+		name:  name,
+		kind:  kind,
+		size:  info.Size(),
+		mtime: info.ModTime(),
+		nodes: map[string]*node{},
+	}
+	v.nodes["/"] = &node{name: "/", isDir: true, modTime: info.ModTime()}
+	if err := v.index(); err != nil {
+		v.evict()
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	v.touch()
+
+	cacheMu.Lock()
+	if old, ok := cache[key]; ok {
+		old.evict()
+	}
+	cache[key] = v
+	trim()
+	cacheMu.Unlock()
+	return v, nil
+}
+
+// trim closes the least recently used views above maxCached; callers hold
+// cacheMu
+func trim() {
+	for len(cache) > maxCached {
+		var oldest string
+		var at time.Time
+		for key, v := range cache {
+			if t := v.used(); oldest == "" || t.Before(at) {
+				oldest, at = key, t
+			}
+		}
+		cache[oldest].evict()
+		delete(cache, oldest)
+	}
+}
+
+// sweep closes views that have not been used for a while
+func sweep() {
+	for range time.Tick(time.Minute) {
+		cutoff := time.Now().Add(-cacheIdle)
+		cacheMu.Lock()
+		for key, v := range cache {
+			if v.used().Before(cutoff) {
+				v.evict()
+				delete(cache, key)
+			}
+		}
+		cacheMu.Unlock()
+	}
+}
+
+func (v *View) touch() {
+	v.mu.Lock()
+	v.lastUsed = time.Now()
+	v.mu.Unlock()
+}
+
+func (v *View) used() time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.lastUsed
+}
+
+// evict drops the view from use; the archive file is closed once no member
+// is open anymore
+func (v *View) evict() {
+	v.mu.Lock()
+	v.evicted = true
+	closeNow := v.refs == 0
+	v.mu.Unlock()
+
+	if closeNow && v.file != nil {
+		v.file.Close()
+	}
+}
+
+func (v *View) acquire() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.evicted {
+		return fs.ErrClosed
+	}
+	v.refs++
+	v.lastUsed = time.Now()
+	return nil
+}
+
+func (v *View) release() {
+	v.mu.Lock()
+	v.refs--
+	closeNow := v.evicted && v.refs == 0
+	v.mu.Unlock()
+
+	if closeNow && v.file != nil {
+		v.file.Close()
+	}
+}
+
+// index reads the list of members. Folders that only show up as part of a
+// member name are added as well.
+func (v *View) index() error {
+	limit := ExtractLimits().MaxEntries
+
+	if v.kind == KindZip {
+		f, err := v.drv.Open(v.name)
+		if err != nil {
+			return err
+		}
+		v.file = f
+
+		if ra, ok := f.(io.ReaderAt); ok {
+			v.ra = ra
+		} else {
+			v.ra = &seekReaderAt{r: f}
+		}
+		if v.zr, err = zip.NewReader(v.ra, v.size); err != nil {
+			return err
+		}
+		if len(v.zr.File) > limit {
+			return ErrTooMany
+		}
+		for _, zf := range v.zr.File {
+			mode := zf.Mode()
+			if !mode.IsDir() && !mode.IsRegular() {
+				continue
+			}
+			v.add(zf.Name, mode.IsDir(), &node{
+				size:    int64(zf.UncompressedSize64),
+				mode:    mode,
+				modTime: zf.Modified,
+				zf:      zf,
+			})
+		}
+		v.sort()
+		return nil
+	}
+
+	f, err := v.drv.Open(v.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr, err := newTarReader(v.kind, f)
+	if err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if i >= limit {
+			return ErrTooMany
+		}
+		if hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		v.add(hdr.Name, hdr.Typeflag == tar.TypeDir, &node{
+			size:    hdr.Size,
+			mode:    hdr.FileInfo().Mode(),
+			modTime: hdr.ModTime,
+			ordinal: i,
+		})
+	}
+	v.sort()
+	return nil
+}
+
+// add places a member in the tree. Members with unsafe names, or that
+// clash with a folder of the same name, are left out.
+func (v *View) add(name string, isDir bool, n *node) {
+	rel, err := memberPath(name)
+	if err != nil {
+		return
+	}
+	dir := v.parent(rel)
+	if dir == nil {
+		return
+	}
+
+	n.name = rel
+	n.isDir = isDir
+	existing, ok := v.nodes[rel]
+	switch {
+	case !ok:
+		dir.children = append(dir.children, n)
+	case existing.isDir != isDir:
+		return
+	case isDir:
+		// A folder listed after its contents keeps its children
+		existing.modTime = n.modTime
+		return
+	default:
+		// Later copies of a file replace earlier ones, like unpacking would
+		for i, c := range dir.children {
+			if c == existing {
+				dir.children[i] = n
+			}
+		}
+	}
+	v.nodes[rel] = n
+}
+
+// parent returns the folder above rel, creating missing ones. It returns
+// nil when a file is in the way.
+func (v *View) parent(rel string) *node {
+	dir := path.Dir(rel)
+	if p, ok := v.nodes[dir]; ok {
+		if !p.isDir {
+			return nil
+		}
+		return p
+	}
+	above := v.parent(dir)
+	if above == nil {
+		return nil
+	}
+	p := &node{name: dir, isDir: true, modTime: v.mtime}
+	above.children = append(above.children, p)
+	v.nodes[dir] = p
+	return p
+}
+
+func (v *View) sort() {
+	for _, n := range v.nodes {
+		sort.Slice(n.children, func(i, k int) bool { return n.children[i].name < n.children[k].name })
+	}
+}
+
+func (v *View) lookup(name string) (*node, error) {
+	n, ok := v.nodes[storage.CleanPath(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return n, nil
+}
+
+// Stat describes a member. The root is described as a folder named after
+// the archive.
+func (v *View) Stat(name string) (fs.FileInfo, error) {
+	n, err := v.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if n.name == "/" {
+		root := *n
+		root.name = v.name
+		return &root, nil
+	}
+	return n, nil
+}
+
+func (v *View) ReadDir(name string) ([]fs.FileInfo, error) {
+	n, err := v.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.isDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries := make([]fs.FileInfo, len(n.children))
+	for i, c := range n.children {
+		entries[i] = c
+	}
+	return entries, nil
+}
+
+// Open reads a member straight from the archive
+func (v *View) Open(name string) (storage.File, error) {
+	n, err := v.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if n.isDir {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	if err := v.acquire(); err != nil {
+		return nil, err
+	}
+
+	// Stored zip members can be read at any offset without unpacking
+	if n.zf != nil && n.zf.Method == zip.Store {
+		if off, err := n.zf.DataOffset(); err == nil {
+			return &storedMember{SectionReader: io.NewSectionReader(v.ra, off, n.size), n: n, v: v}, nil
+		}
+	}
+
+	m := &member{n: n, v: v}
+	if n.zf != nil {
+		m.open = n.zf.Open
+	} else {
+		m.open = func() (io.ReadCloser, error) { return v.openTarMember(n.ordinal) }
+	}
+	return m, nil
+}
+
+// openTarMember unpacks a tar archive up to the member with the given
+// ordinal. Tar has no index, so every read starts from the beginning.
+func (v *View) openTarMember(ordinal int) (io.ReadCloser, error) {
+	f, err := v.drv.Open(v.name)
+	if err != nil {
+		return nil, err
+	}
+	tr, err := newTarReader(v.kind, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	for i := 0; i <= ordinal; i++ {
+		if _, err := tr.Next(); err != nil {
+			f.Close()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{tr, f}, nil
+}
+
+func (v *View) Create(name string) (io.WriteCloser, error) { return nil, ErrReadOnly }
+func (v *View) Rename(oldName, newName string) error       { return ErrReadOnly }
+func (v *View) RemoveAll(name string) error                { return ErrReadOnly }
+func (v *View) MkdirAll(name string) error                 { return ErrReadOnly }
+
+func (v *View) DiskUsage() (total, free uint64, err error) {
+	return 0, 0, ErrReadOnly
+}
+
+// storedMember is an uncompressed zip member read in place
+type storedMember struct {
+	*io.SectionReader
+	n    *node
+	v    *View
+	once sync.Once
+}
+
+func (s *storedMember) Stat() (fs.FileInfo, error) { return s.n, nil }
+
+func (s *storedMember) Close() error {
+	s.once.Do(s.v.release)
+	return nil
+}
+
+// member is a compressed member. Seeking only moves the offset; reads skip
+// ahead in the stream, or start over when they have to go back.
+type member struct {
+	n    *node
+	v    *View
+	open func() (io.ReadCloser, error)
+	rc   io.ReadCloser
+	pos  int64
+	off  int64
+	once sync.Once
+}
+
+func (m *member) Stat() (fs.FileInfo, error) { return m.n, nil }
+
+func (m *member) Read(p []byte) (int, error) {
+	if m.off >= m.n.size {
+		return 0, io.EOF
+	}
+	if m.rc == nil || m.off < m.pos {
+		if m.rc != nil {
+			m.rc.Close()
+		}
+		rc, err := m.open()
+		if err != nil {
+			m.rc = nil
+			return 0, err
+		}
+		m.rc, m.pos = rc, 0
+	}
+	if m.off > m.pos {
+		n, err := io.CopyN(io.Discard, m.rc, m.off-m.pos)
+		m.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := m.rc.Read(p)
+	m.pos += int64(n)
+	m.off = m.pos
+	return n, err
+}
+
+func (m *member) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += m.off
+	case io.SeekEnd:
+		offset += m.n.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	m.off = offset
+	return offset, nil
+}
+
+func (m *member) Close() error {
+	var err error
+	if m.rc != nil {
+		err = m.rc.Close()
+		m.rc = nil
+	}
+	m.once.Do(m.v.release)
+	return err
+}
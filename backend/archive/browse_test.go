@@ -0,0 +1,104 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"filemanager/config"
+	"filemanager/storage"
+)
+
+// seekOnly hides ReadAt of the files a driver opens, like backends that
+// can only seek
+type seekOnly struct {
+	storage.Driver
+}
+
+func (d seekOnly) Open(name string) (storage.File, error) {
+	f, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return slowSeeker{f}, nil
+}
+
+// slowSeeker lets other goroutines run between a seek and the next read
+type slowSeeker struct {
+	storage.File
+}
+
+func (f slowSeeker) Seek(offset int64, whence int) (int64, error) {
+	n, err := f.File.Seek(offset, whence)
+	time.Sleep(time.Microsecond)
+	return n, err
+}
+
+func TestViewConcurrentReads(t *testing.T) {
+	dir := t.TempDir()
+	want := map[string]string{}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i < 8; i++ {
+		method := zip.Store
+		if i%2 == 1 {
+			method = zip.Deflate
+		}
+		name := fmt.Sprintf("member%d.txt", i)
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := strings.Repeat(fmt.Sprintf("%d", i), 100_000)
+		w.Write([]byte(body))
+		want["/"+name] = body
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.zip"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	local, err := storage.NewLocal(config.Source{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := Open(seekOnly{local}, "test", "/a.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for round := 0; round < 4; round++ {
+		for name, body := range want {
+			wg.Add(1)
+			go func(name, body string) {
+				defer wg.Done()
+				f, err := v.Open(name)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer f.Close()
+				got, err := io.ReadAll(f)
+				if err != nil {
+					t.Errorf("%s: %v", name, err)
+					return
+				}
+				if string(got) != body {
+					t.Errorf("%s read back wrong", name)
+				}
+			}(name, body)
+		}
+	}
+	wg.Wait()
+}
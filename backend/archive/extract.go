@@ -0,0 +1,451 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/ulikunitz/xz"
+
+	"filemanager/config"
+	"filemanager/storage"
+)
+
+// Kind is an archive type the server can unpack
+type Kind string
+
+const (
+	KindZip   Kind = "zip"
+	KindTar   Kind = "tar"
+	KindTarGz Kind = "tar.gz"
+	KindTarBz Kind = "tar.bz2"
+	KindTarXz Kind = "tar.xz"
+)
+
+var (
+	ErrUnknownKind = errors.New("not a supported archive")
+	ErrTooBig      = errors.New("archive exceeds the extraction size limit")
+	ErrTooMany     = errors.New("archive exceeds the entry count limit")
+	errUnsafePath  = errors.New("unsafe path in archive")
+)
+
+// suffixes maps file name endings to archive kinds, longest first
+var suffixes = []struct {
+	suffix string
+	kind   Kind
+}{
+	{".tar.gz", KindTarGz},
+	{".tar.bz2", KindTarBz},
+	{".tar.xz", KindTarXz},
+	{".tgz", KindTarGz},
+	{".tbz2", KindTarBz},
+	{".txz", KindTarXz},
+	{".tar", KindTar},
+	{".zip", KindZip},
+}
+
+// Detect returns the archive kind of name and the name without its
+// archive extension
+func Detect(name string) (Kind, string, error) {
+	lower := strings.ToLower(name)
+	for _, s := range suffixes {
+		if strings.HasSuffix(lower, s.suffix) {
+			return s.kind, name[:len(name)-len(s.suffix)], nil
+		}
+	}
+	return "", "", ErrUnknownKind
+}
+
+// Progress receives updates while an archive is unpacked
+type Progress interface {
+	SetTotal(files int, bytes int64)
+	AddBytes(n int64)
+	FileDone()
+	FileFailed(name string, err error)
+}
+
+// Limits bound what a single extraction may write
+type Limits struct {
+	MaxSize    int64
+	MaxEntries int
+}
+
+// Defaults for the extraction limits
+const (
+	DefaultMaxExtractMB = 10 << 10
+	DefaultMaxEntries   = 100000
+)
+
+// ExtractLimits returns the configured extraction limits
+func ExtractLimits() Limits {
+	cfg := config.Get().Archive
+	limits := Limits{
+		MaxSize:    int64(cfg.MaxExtractMB) << 20,
+		MaxEntries: cfg.MaxEntries,
+	}
+	if limits.MaxSize <= 0 {
+		limits.MaxSize = DefaultMaxExtractMB << 20
+	}
+	if limits.MaxEntries <= 0 {
+		limits.MaxEntries = DefaultMaxEntries
+	}
+	return limits
+}
+
+// Extract unpacks the archive src into the folder dst of the same source.
+// Files that clash with existing ones get numbered names like copies do,
+// unless resume is set, in which case files that are already there with
+// the right size are skipped.
+func Extract(ctx context.Context, drv storage.Driver, src, dst string, limits Limits, resume bool, p Progress) error {
+	kind, _, err := Detect(src)
+	if err != nil {
+		return err
+	}
+
+	f, err := drv.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	x := &extractor{
+		ctx:    ctx,
+		drv:    drv,
+		dst:    dst,
+		limits: limits,
+		resume: resume,
+		p:      p,
+	}
+
+	if kind == KindZip {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		return x.zip(f, info.Size())
+	}
+	return x.tar(kind, f)
+}
+
+type extractor struct {
+	ctx    context.Context
+	drv    storage.Driver
+	dst    string
+	limits Limits
+	resume bool
+	p      Progress
+
+	entries int
+	written int64
+}
+
+// memberPath cleans the name of an archive member into a path below the
+// archive root. Names that try to leave the root are rejected.
+func memberPath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	// Absolute names, including Windows drive letters, never belong to
+	// the destination
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", errUnsafePath
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", errUnsafePath
+		}
+	}
+
+	rel := storage.CleanPath(name)
+	if rel == "/" {
+		return "", errUnsafePath
+	}
+	return rel, nil
+}
+
+// target maps an archive member name to its path in the source
+func (x *extractor) target(name string) (string, error) {
+	rel, err := memberPath(name)
+	if err != nil {
+		return "", err
+	}
+	full := path.Join(x.dst, rel)
+	if !strings.HasPrefix(full, strings.TrimSuffix(x.dst, "/")+"/") || storage.IsReserved(full) {
+		return "", errUnsafePath
+	}
+	return full, nil
+}
+
+// count checks the entry limit before an entry is written
+func (x *extractor) count() error {
+	x.entries++
+	if x.limits.MaxEntries > 0 && x.entries > x.limits.MaxEntries {
+		return ErrTooMany
+	}
+	return x.ctx.Err()
+}
+
+func (x *extractor) mkdir(name string) {
+	full, err := x.target(name)
+	if err != nil {
+		x.p.FileFailed(name, err)
+		return
+	}
+	if err := x.drv.MkdirAll(full); err != nil {
+		x.p.FileFailed(name, err)
+		return
+	}
+	x.p.FileDone()
+}
+
+// file writes one member. Going over the size limit stops the whole
+// extraction, any other failure only skips the member.
+func (x *extractor) file(name string, size int64, r io.Reader) error {
+	full, err := x.target(name)
+	if err != nil {
+		x.p.FileFailed(name, err)
+		return nil
+	}
+
+	if x.resume {
+		if info, err := x.drv.Stat(full); err == nil && !info.IsDir() && info.Size() == size {
+			x.written += size
+			x.p.AddBytes(size)
+			x.p.FileDone()
+			return nil
+		}
+	} else if full, err = storage.UniquePath(x.drv, full); err != nil {
+		x.p.FileFailed(name, err)
+		return nil
+	}
+
+	if err := x.drv.MkdirAll(path.Dir(full)); err != nil {
+		x.p.FileFailed(name, err)
+		return nil
+	}
+	w, err := x.drv.Create(full)
+	if err != nil {
+		x.p.FileFailed(name, err)
+		return nil
+	}
+
+	// Never trust the sizes an archive declares
+	budget := int64(-1)
+	if x.limits.MaxSize > 0 {
+		budget = x.limits.MaxSize - x.written
+	}
+	n, err := x.copy(w, r, budget)
+	x.written += n
+	if err != nil {
+		storage.Abort(w)
+		x.drv.RemoveAll(full)
+		if errors.Is(err, ErrTooBig) || errors.Is(err, context.Canceled) {
+			return err
+		}
+		x.p.FileFailed(name, err)
+		return nil
+	}
+	if err := w.Close(); err != nil {
+		x.p.FileFailed(name, err)
+		return nil
+	}
+	x.p.FileDone()
+	return nil
+}
+
+func (x *extractor) copy(w io.Writer, r io.Reader, budget int64) (int64, error) {
+	buf := make([]byte, 256<<10)
+	var total int64
+	for {
+		if err := x.ctx.Err(); err != nil {
+			return total, err
+		}
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			if budget >= 0 && total+int64(n) > budget {
+				return total, ErrTooBig
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return total, err
+			}
+			total += int64(n)
+			x.p.AddBytes(int64(n))
+		}
+		if rerr == io.EOF {
+			return total, nil
+		}
+		if rerr != nil {
+			return total, rerr
+		}
+	}
+}
+
+func (x *extractor) zip(f storage.File, size int64) error {
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		ra = &seekReaderAt{r: f}
+	}
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+
+	// The central directory gives the totals up front, so limits can be
+	// checked before anything is written
+	var total int64
+	for _, zf := range zr.File {
+		total += int64(zf.UncompressedSize64)
+	}
+	if x.limits.MaxEntries > 0 && len(zr.File) > x.limits.MaxEntries {
+		return ErrTooMany
+	}
+	if x.limits.MaxSize > 0 && total > x.limits.MaxSize {
+		return ErrTooBig
+	}
+	x.p.SetTotal(len(zr.File), total)
+	if err := x.drv.MkdirAll(x.dst); err != nil {
+		return err
+	}
+
+	for _, zf := range zr.File {
+		if err := x.count(); err != nil {
+			return err
+		}
+
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			x.mkdir(zf.Name)
+		case mode.IsRegular():
+			rc, err := zf.Open()
+			if err != nil {
+				x.p.FileFailed(zf.Name, err)
+				continue
+			}
+			err = x.file(zf.Name, int64(zf.UncompressedSize64), rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			// Symlinks and other special entries are left out
+			x.p.FileDone()
+		}
+	}
+	return nil
+}
+
+func (x *extractor) tar(kind Kind, f storage.File) error {
+	// Tar archives have no index; progress follows how much of the
+	// archive itself has been read
+	if info, err := f.Stat(); err == nil {
+		x.p.SetTotal(0, info.Size())
+	}
+	if err := x.drv.MkdirAll(x.dst); err != nil {
+		return err
+	}
+	counted := &countingReader{r: f}
+
+	tr, err := newTarReader(kind, counted)
+	if err != nil {
+		return err
+	}
+	progress := &tarProgress{Progress: x.p, counted: counted}
+	x.p = progress
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			// Count the padding after the last entry too
+			io.Copy(io.Discard, counted)
+			progress.sync()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := x.count(); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			x.mkdir(hdr.Name)
+		case tar.TypeReg, tar.TypeRegA:
+			if err := x.file(hdr.Name, hdr.Size, tr); err != nil {
+				return err
+			}
+		default:
+			// Links and device files are left out
+		}
+		progress.sync()
+	}
+}
+
+// newTarReader unpacks the compression around a tar stream
+func newTarReader(kind Kind, r io.Reader) (*tar.Reader, error) {
+	switch kind {
+	case KindTarGz:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	case KindTarBz:
+		r = bzip2.NewReader(r)
+	case KindTarXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		r = xr
+	}
+	return tar.NewReader(r), nil
+}
+
+// tarProgress reports the compressed bytes read instead of the bytes
+// written, to match the total set from the archive size
+type tarProgress struct {
+	Progress
+	counted  *countingReader
+	reported int64
+}
+
+func (t *tarProgress) AddBytes(int64) {}
+
+func (t *tarProgress) sync() {
+	n := t.counted.n
+	t.Progress.AddBytes(n - t.reported)
+	t.reported = n
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// seekReaderAt gives random access to files that only offer Seek
+type seekReaderAt struct {
+	mu sync.Mutex
+	r  io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s.r, p)
+}
@@ -0,0 +1,200 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"filemanager/config"
+	"filemanager/storage"
+)
+
+// recorder is a Progress that remembers the members that failed
+type recorder struct {
+	failed []string
+}
+
+func (r *recorder) SetTotal(int, int64) {}
+func (r *recorder) AddBytes(int64)      {}
+func (r *recorder) FileDone()           {}
+
+func (r *recorder) FileFailed(name string, err error) {
+	r.failed = append(r.failed, name)
+}
+
+// testMember is an archive entry for the tests; link makes it a symlink
+type testMember struct {
+	name string
+	body string
+	link string
+}
+
+func makeZip(t *testing.T, members []testMember) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, m := range members {
+		hdr := &zip.FileHeader{Name: m.name, Method: zip.Deflate}
+		body := m.body
+		if m.link != "" {
+			hdr.SetMode(fs.ModeSymlink | 0777)
+			body = m.link
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTar(t *testing.T, members []testMember) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, m := range members {
+		hdr := &tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.body)), Typeflag: tar.TypeReg}
+		if m.link != "" {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, m.link, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(m.body))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// files lists the regular files below dir as slash separated paths
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+	var names []string
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(dir, p)
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names
+}
+
+func TestExtractRefusesUnsafePaths(t *testing.T) {
+	members := []testMember{
+		{name: "ok/good.txt", body: "good"},
+		{name: "../evil.txt", body: "evil"},
+		{name: "ok/../../evil.txt", body: "evil"},
+		{name: "..\\evil.txt", body: "evil"},
+		{name: "/abs.txt", body: "evil"},
+		{name: "C:\\abs.txt", body: "evil"},
+		{name: ".zxfilebrowser/trash/evil.txt", body: "evil"},
+		{name: "link", link: "../../etc/passwd"},
+	}
+	unsafe := []string{"../evil.txt", "ok/../../evil.txt", "..\\evil.txt", "/abs.txt", "C:\\abs.txt"}
+
+	tests := []struct {
+		name    string
+		archive string
+		make    func(*testing.T, []testMember) []byte
+		dst     string
+		failed  []string
+		files   []string
+	}{
+		{"zip in root", "a.zip", makeZip, "/", append(unsafe, ".zxfilebrowser/trash/evil.txt"),
+			[]string{"a.zip", "ok/good.txt"}},
+		{"tar in root", "a.tar", makeTar, "/", append(unsafe, ".zxfilebrowser/trash/evil.txt"),
+			[]string{"a.tar", "ok/good.txt"}},
+		// Only the meta folder at the root of the source is reserved
+		{"zip in folder", "a.zip", makeZip, "/out", unsafe,
+			[]string{"a.zip", "out/.zxfilebrowser/trash/evil.txt", "out/ok/good.txt"}},
+		{"tar in folder", "a.tar", makeTar, "/out", unsafe,
+			[]string{"a.tar", "out/.zxfilebrowser/trash/evil.txt", "out/ok/good.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "source")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, tt.archive), tt.make(t, members), 0644); err != nil {
+				t.Fatal(err)
+			}
+			drv, err := storage.NewLocal(config.Source{Path: dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p := &recorder{}
+			if err := Extract(context.Background(), drv, "/"+tt.archive, tt.dst, Limits{}, false, p); err != nil {
+				t.Fatal(err)
+			}
+
+			sort.Strings(p.failed)
+			want := append([]string{}, tt.failed...)
+			sort.Strings(want)
+			if strings.Join(p.failed, "|") != strings.Join(want, "|") {
+				t.Errorf("failed members %q, want %q", p.failed, want)
+			}
+			// Nothing may land next to the source either
+			want = nil
+			for _, f := range tt.files {
+				want = append(want, "source/"+f)
+			}
+			if got := files(t, parent); strings.Join(got, "|") != strings.Join(want, "|") {
+				t.Errorf("files after extraction %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	big := strings.Repeat("x", 4096)
+	tests := []struct {
+		name   string
+		limits Limits
+		want   error
+	}{
+		{"within limits", Limits{MaxSize: 1 << 20, MaxEntries: 10}, nil},
+		{"too big", Limits{MaxSize: 4096, MaxEntries: 10}, ErrTooBig},
+		{"too many", Limits{MaxSize: 1 << 20, MaxEntries: 1}, ErrTooMany},
+	}
+	for _, tt := range tests {
+		for _, kind := range []struct {
+			archive string
+			make    func(*testing.T, []testMember) []byte
+		}{{"a.zip", makeZip}, {"a.tar", makeTar}} {
+			t.Run(tt.name+" "+kind.archive, func(t *testing.T) {
+				dir := t.TempDir()
+				data := kind.make(t, []testMember{{name: "a.txt", body: big}, {name: "b.txt", body: big}})
+				if err := os.WriteFile(filepath.Join(dir, kind.archive), data, 0644); err != nil {
+					t.Fatal(err)
+				}
+				drv, err := storage.NewLocal(config.Source{Path: dir})
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = Extract(context.Background(), drv, "/"+kind.archive, "/out", tt.limits, false, &recorder{})
+				if !errors.Is(err, tt.want) {
+					t.Errorf("got %v, want %v", err, tt.want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"filemanager/storage"
+)
+
+// Format is an archive type the server can write
+type Format string
+
+const (
+	Zip   Format = "zip"
+	TarGz Format = "tar.gz"
+)
+
+// DefaultLevel is the compression level used when none is given
+const DefaultLevel = flate.DefaultCompression
+
+// ParseFormat accepts the format names clients send
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "", "zip":
+		return Zip, nil
+	case "tar.gz", "tgz", "targz":
+		return TarGz, nil
+	}
+	return "", fmt.Errorf("unsupported archive format %q", s)
+}
+
+// Ext returns the file extension for the format
+func (f Format) Ext() string {
+	return "." + string(f)
+}
+
+// ContentType returns the MIME type of the format
+func (f Format) ContentType() string {
+	if f == TarGz {
+		return "application/gzip"
+	}
+	return "application/zip"
+}
+
+// Writer adds entries to an archive that is streamed out as it is written
+type Writer interface {
+	AddDir(name string, info fs.FileInfo) error
+	AddFile(name string, info fs.FileInfo, r io.Reader) error
+	Close() error
+}
+
+// NewWriter starts an archive on w. Level goes from 0 (store only) to 9
+// (smallest), or -1 for the default.
+func NewWriter(w io.Writer, format Format, level int) (Writer, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("invalid compression level %d", level)
+	}
+
+	switch format {
+	case Zip:
+		zw := zip.NewWriter(w)
+		zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+		method := zip.Deflate
+		if level == flate.NoCompression {
+			method = zip.Store
+		}
+		return &zipWriter{zw: zw, method: method}, nil
+	case TarGz:
+		gz, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		return &tarWriter{tw: tar.NewWriter(gz), gz: gz}, nil
+	}
+	return nil, fmt.Errorf("unsupported archive format %q", format)
+}
+
+type zipWriter struct {
+	zw     *zip.Writer
+	method uint16
+}
+
+func (z *zipWriter) AddDir(name string, info fs.FileInfo) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = strings.TrimSuffix(name, "/") + "/"
+	hdr.Method = zip.Store
+	_, err = z.zw.CreateHeader(hdr)
+	return err
+}
+
+func (z *zipWriter) AddFile(name string, info fs.FileInfo, r io.Reader) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Method = z.method
+	w, err := z.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (z *zipWriter) Close() error {
+	return z.zw.Close()
+}
+
+type tarWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (t *tarWriter) AddDir(name string, info fs.FileInfo) error {
+	return t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     strings.TrimSuffix(name, "/") + "/",
+		Mode:     int64(info.Mode().Perm() | 0700),
+		ModTime:  info.ModTime(),
+	})
+}
+
+func (t *tarWriter) AddFile(name string, info fs.FileInfo, r io.Reader) error {
+	err := t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     info.Size(),
+		Mode:     int64(info.Mode().Perm() | 0600),
+		ModTime:  info.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	// The header promised exactly Size bytes, so never write more than that
+	// even if the file grew in the meantime
+	_, err = io.CopyN(t.tw, r, info.Size())
+	return err
+}
+
+func (t *tarWriter) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
+
+// AddTree writes name and everything below it into the archive as entry.
+// Only regular files and folders are included, so symlinks can never pull
+// in anything from outside the source.
+func AddTree(aw Writer, drv storage.Driver, name, entry string) error {
+	info, err := drv.Stat(name)
+	if err != nil {
+		return err
+	}
+	return addTree(aw, drv, name, entry, info)
+}
+
+func addTree(aw Writer, drv storage.Driver, name, entry string, info fs.FileInfo) error {
+	if storage.IsReserved(name) {
+		return nil
+	}
+
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := drv.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return aw.AddFile(entry, info, f)
+	}
+
+	if err := aw.AddDir(entry, info); err != nil {
+		return err
+	}
+	children, err := drv.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := addTree(aw, drv, path.Join(name, child.Name()), path.Join(entry, child.Name()), child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EntryNames picks the archive entry for each item. Items with the same
+// name from different folders get numbered, and the source root is named
+// after rootName.
+func EntryNames(rootName string, names []string) []string {
+	used := map[string]bool{}
+	entries := make([]string, len(names))
+	for i, name := range names {
+		base := path.Base(name)
+		if name == "/" {
+			base = rootName
+		}
+		entry := base
+		ext := path.Ext(base)
+		for n := 1; used[entry]; n++ {
+			entry = fmt.Sprintf("%s(%d)%s", strings.TrimSuffix(base, ext), n, ext)
+		}
+		used[entry] = true
+		entries[i] = entry
+	}
+	return entries
+}
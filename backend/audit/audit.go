@@ -0,0 +1,251 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"filemanager/config"
+	"filemanager/utils"
+)
+
+// Outcome is how an audited operation ended
+type Outcome string
+
+const (
+	Success Outcome = "success"
+	Failure Outcome = "failure"
+	// Denied operations were refused by the access rules
+	Denied Outcome = "denied"
+	// Started operations run as a job; the job records its own outcome
+	// under the same job ID when it finishes
+	Started Outcome = "started"
+)
+
+const (
+	// DefaultMaxSizeMB is the size at which the log is rotated
+	DefaultMaxSizeMB = 10
+	// DefaultMaxFiles is how many rotated logs are kept
+	DefaultMaxFiles = 5
+)
+
+// Entry is one line of the audit log
+type Entry struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	IP         string    `json:"ip,omitempty"`
+	Op         string    `json:"op"`
+	Source     string    `json:"source,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	DestSource string    `json:"destSource,omitempty"`
+	Dest       string    `json:"dest,omitempty"`
+	Job        string    `json:"job,omitempty"`
+	Outcome    Outcome   `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Filter selects entries in Query. Empty fields match everything; Path
+// matches the entry path or destination and everything below it.
+type Filter struct {
+	User   string
+	Source string
+	Path   string
+	Op     string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+var (
+	mu   sync.Mutex
+	file string
+	out  *os.File
+	size int64
+)
+
+// Init opens the audit log in the data directory for appending
+func Init(dataDir string) error {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	file = filepath.Join(dataDir, "audit.log")
+	return open()
+}
+
+// open opens the current log file; callers hold mu
+func open() error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	out, size = f, info.Size()
+	return nil
+}
+
+func maxSize() int64 {
+	if mb := config.Get().Audit.MaxSizeMB; mb > 0 {
+		return int64(mb) << 20
+	}
+	return DefaultMaxSizeMB << 20
+}
+
+func maxFiles() int {
+	if n := config.Get().Audit.MaxFiles; n > 0 {
+		return n
+	}
+	return DefaultMaxFiles
+}
+
+// Record appends an entry to the log. Failing to write is logged but never
+// stops the operation that is being recorded.
+func Record(e Entry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	mu.Lock()
+	defer mu.Unlock()
+	if out == nil {
+		return
+	}
+
+	if size > 0 && size+int64(len(line)) > maxSize() {
+		if err := rotate(); err != nil {
+			utils.Warnf("⚠️  Failed to rotate audit log: %v", err)
+		}
+		if out == nil {
+			return
+		}
+	}
+
+	n, err := out.Write(line)
+	size += int64(n)
+	if err != nil {
+		utils.Warnf("⚠️  Failed to write audit log: %v", err)
+	}
+}
+
+// rotate moves audit.log to audit.log.1, shifting older logs up and
+// dropping the ones past the limit; callers hold mu
+func rotate() error {
+	out.Close()
+	out = nil
+
+	keep := maxFiles()
+	for i := keep; ; i++ {
+		if err := os.Remove(rotated(i)); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+	for i := keep - 1; i >= 1; i-- {
+		if err := os.Rename(rotated(i), rotated(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(file, rotated(1)); err != nil {
+		return err
+	}
+	return open()
+}
+
+func rotated(i int) string {
+	return fmt.Sprintf("%s.%d", file, i)
+}
+
+// matches reports whether an entry passes the filter
+func (f *Filter) matches(e *Entry) bool {
+	switch {
+	case f.User != "" && e.User != f.User:
+		return false
+	case f.Source != "" && e.Source != f.Source && e.DestSource != f.Source:
+		return false
+	case f.Op != "" && e.Op != f.Op:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && e.Time.After(f.Until):
+		return false
+	case f.Path != "" && !under(e.Path, f.Path) && !under(e.Dest, f.Path):
+		return false
+	}
+	return true
+}
+
+func under(name, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return name == prefix || strings.HasPrefix(name, prefix+"/") || prefix == ""
+}
+
+// Query returns the entries matching the filter, newest first, reading the
+// rotated logs as far back as needed
+func Query(f Filter) ([]Entry, error) {
+	mu.Lock()
+	names := []string{file}
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated(i)); err != nil {
+			break
+		}
+		names = append(names, rotated(i))
+	}
+	mu.Unlock()
+
+	result := make([]Entry, 0)
+	for _, name := range names {
+		entries, err := scan(name, &f)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			if f.Limit > 0 && len(result) >= f.Limit {
+				return result, nil
+			}
+			result = append(result, entries[i])
+		}
+	}
+	return result, nil
+}
+
+// scan reads the matching entries of one log file, oldest first
+func scan(name string, f *Filter) ([]Entry, error) {
+	in, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	var entries []Entry
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		var e Entry
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			continue // a line cut short by a crash
+		}
+		if f.matches(&e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, sc.Err()
+}
@@ -0,0 +1,130 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"filemanager/config"
+)
+
+// useLog opens a fresh audit log with the given audit section
+func useLog(t *testing.T, section string) string {
+	t.Helper()
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	p := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(p, []byte(fmt.Sprintf("server:\n  dataDir: %q\n%s", data, section)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.SetPath(p)
+	config.Init()
+	if err := Init(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestQuery(t *testing.T) {
+	useLog(t, "")
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	hour := func(n int) time.Time { return start.Add(time.Duration(n) * time.Hour) }
+
+	for i, e := range []Entry{
+		{User: "alice", Op: "upload", Source: "files", Path: "/docs/a.txt"},
+		{User: "bob", Op: "delete", Source: "files", Path: "/docs/sub/b.txt"},
+		{User: "alice", Op: "upload", Source: "media", Path: "/docsx/c.txt"},
+		{User: "bob", Op: "move", Source: "media", Path: "/in/d.txt", DestSource: "files", Dest: "/docs/d.txt"},
+		{User: "carol", Op: "rename", Source: "files", Path: "/docs", Dest: "/papers"},
+	} {
+		e.Time, e.Job = hour(i), strconv.Itoa(i)
+		Record(e)
+	}
+
+	// want lists the matching entries by their order of recording, newest first
+	tests := []struct {
+		name   string
+		filter Filter
+		want   string
+	}{
+		{"everything", Filter{}, "4,3,2,1,0"},
+		{"user", Filter{User: "alice"}, "2,0"},
+		{"source or destination source", Filter{Source: "files"}, "4,3,1,0"},
+		{"path prefix", Filter{Path: "/docs"}, "4,3,1,0"},
+		{"path prefix with slash", Filter{Path: "/docs/"}, "4,3,1,0"},
+		{"path below", Filter{Path: "/docs/sub"}, "1"},
+		{"destination path", Filter{Path: "/papers"}, "4"},
+		{"op", Filter{Op: "upload"}, "2,0"},
+		{"since", Filter{Since: hour(3)}, "4,3"},
+		{"until", Filter{Until: hour(1)}, "1,0"},
+		{"time range", Filter{Since: hour(1), Until: hour(2)}, "2,1"},
+		{"combined", Filter{User: "bob", Path: "/docs", Since: hour(2)}, "3"},
+		{"limit", Filter{Limit: 2}, "4,3"},
+		{"nothing", Filter{User: "dave"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := Query(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Job)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("got %s, want %s", strings.Join(got, ","), tt.want)
+			}
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	data := useLog(t, "audit:\n  maxSizeMB: 1\n  maxFiles: 2\n")
+
+	// About 100 entries fit in a file, so this fills the log four times over
+	long := "/" + strings.Repeat("x", 10<<10)
+	const count = 400
+	for i := 0; i < count; i++ {
+		Record(Entry{User: "alice", Op: "upload", Source: "files", Path: long, Job: strconv.Itoa(i)})
+	}
+
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2"} {
+		info, err := os.Stat(filepath.Join(data, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1<<20 {
+			t.Errorf("%s has %d bytes, over the 1 MB limit", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(data, "audit.log.3")); !os.IsNotExist(err) {
+		t.Errorf("audit.log.3 kept past maxFiles: %v", err)
+	}
+
+	// Queries read on into the rotated logs, newest first and without gaps
+	entries, err := Query(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 200 || len(entries) >= count {
+		t.Fatalf("got %d entries from three files", len(entries))
+	}
+	for i, e := range entries {
+		if want := strconv.Itoa(count - 1 - i); e.Job != want {
+			t.Fatalf("entry %d is %s, want %s", i, e.Job, want)
+		}
+	}
+
+	limited, err := Query(Filter{Limit: 150})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limited) != 150 || limited[149].Job != strconv.Itoa(count-150) {
+		t.Errorf("limit across files gave %d entries", len(limited))
+	}
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+
+	"filemanager/utils"
+)
+
+// basicTTL is how long verified Basic credentials are remembered. Clients
+// like WebDAV mounts send them with every request, and checking the bcrypt
+// hash each time would make browsing crawl.
+const basicTTL = 5 * time.Minute
+
+type basicEntry struct {
+	hash    string
+	expires time.Time
+}
+
+var basicCache = struct {
+	sync.Mutex
+	entries map[[32]byte]basicEntry
+}{entries: map[[32]byte]basicEntry{}}
+
+// verifyBasic checks a username and password, using the cache when the
+// same pair was verified recently and the password has not changed since
+func verifyBasic(username, password string) (User, bool) {
+	key := sha256.Sum256([]byte(normalize(username) + "\x00" + password))
+
+	basicCache.Lock()
+	entry, ok := basicCache.entries[key]
+	basicCache.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		if user, found := Users.Get(username); found && user.PasswordHash == entry.hash {
+			return user, true
+		}
+	}
+
+	user, ok := Users.Verify(username, password)
+	if !ok {
+		return User{}, false
+	}
+
+	basicCache.Lock()
+	defer basicCache.Unlock()
+	now := time.Now()
+	for k, e := range basicCache.entries {
+		if now.After(e.expires) {
+			delete(basicCache.entries, k)
+		}
+	}
+	basicCache.entries[key] = basicEntry{hash: user.PasswordHash, expires: now.Add(basicTTL)}
+	return user, true
+}
+
+// BasicMiddleware is Middleware for clients that cannot log in through
+// the API: it also accepts HTTP Basic credentials and asks for them with a
+// WWW-Authenticate challenge instead of a JSON error
+func BasicMiddleware(realm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var user User
+		ok := false
+		if username, password, basic := r.BasicAuth(); basic {
+			if user, ok = verifyBasic(username, password); !ok {
+				utils.Warnf("🔒 Failed login for %q from %s", username, r.RemoteAddr)
+			}
+		} else if sess, found := LookupSession(TokenFromRequest(r)); found {
+			user, ok = Users.Get(sess.Username)
+		}
+
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, &user)))
+	}
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"filemanager/utils"
+)
+
+// CookieName is the session cookie set by /api/login
+const CookieName = "zxfb_session"
+
+type contextKey struct{}
+
+// TokenFromRequest reads the session token from the cookie or from an
+// "Authorization: Bearer" header
+func TokenFromRequest(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	if c, err := r.Cookie(CookieName); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// Middleware rejects requests without a valid session and stores the
+// signed in user on the request context
+func Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, ok := LookupSession(TokenFromRequest(r))
+		if !ok {
+			utils.SendJSON(w, http.StatusUnauthorized, utils.Response{Success: false, Message: "Authentication required"})
+			return
+		}
+
+		user, ok := Users.Get(sess.Username)
+		if !ok {
+			EndSession(sess.Token)
+			utils.SendJSON(w, http.StatusUnauthorized, utils.Response{Success: false, Message: "Authentication required"})
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, &user)))
+	}
+}
+
+// CurrentUser returns the user a request was authenticated as
+func CurrentUser(r *http.Request) *User {
+	user, _ := r.Context().Value(contextKey{}).(*User)
+	return user
+}
+
+// AdminOnly allows a request through only for admin accounts; it must run
+// inside Middleware
+func AdminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if user := CurrentUser(r); user == nil || !user.Admin {
+			utils.SendJSON(w, http.StatusForbidden, utils.Response{Success: false, Message: "Admin access required"})
+			return
+		}
+		next(w, r)
+	}
+}
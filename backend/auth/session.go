@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// SessionTTL is how long a login stays valid
+const SessionTTL = 7 * 24 * time.Hour
+
+// Session ties a token to a signed in user
+type Session struct {
+	Token    string
+	Username string
+	Expires  time.Time
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = map[string]*Session{}
+)
+
+// NewSession signs a user in and returns the new session
+func NewSession(username string) (*Session, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	sess := &Session{
+		Token:    base64.RawURLEncoding.EncodeToString(buf),
+		Username: username,
+		Expires:  time.Now().Add(SessionTTL),
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	// Drop expired sessions while we hold the lock anyway
+	now := time.Now()
+	for token, s := range sessions {
+		if now.After(s.Expires) {
+			delete(sessions, token)
+		}
+	}
+	sessions[sess.Token] = sess
+	return sess, nil
+}
+
+// LookupSession returns the live session for a token
+func LookupSession(token string) (*Session, bool) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	sess, ok := sessions[token]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(sess.Expires) {
+		delete(sessions, token)
+		return nil, false
+	}
+	return sess, true
+}
+
+// EndSession signs a session out
+func EndSession(token string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	delete(sessions, token)
+}
+
+// EndSessions signs out every session of a user
+func EndSessions(username string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	for token, s := range sessions {
+		if normalize(s.Username) == normalize(username) {
+			delete(sessions, token)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User is an account that can sign in
+type User struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash"`
+	Admin        bool      `json:"admin"`
+	Created      time.Time `json:"created"`
+}
+
+var (
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// Store keeps the user accounts in a JSON file on disk
+type Store struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]*User
+}
+
+// dummyHash is compared against when a username is unknown, so that a
+// failed login takes as long whether or not the account exists
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("zxfilebrowser"), bcrypt.DefaultCost)
+
+// Users is the store used by the running server
+var Users *Store
+
+// Init opens the user store inside the data directory
+func Init(dataDir string) error {
+	store, err := OpenStore(filepath.Join(dataDir, "users.json"))
+	if err != nil {
+		return err
+	}
+	Users = store
+	return nil
+}
+
+// OpenStore loads the users file, starting empty if it does not exist yet
+func OpenStore(path string) (*Store, error) {
+	users, err := readUsers(path)
+	if errors.Is(err, os.ErrNotExist) {
+		users = map[string]*User{}
+	} else if err != nil {
+		return nil, err
+	}
+	return &Store{path: path, users: users}, nil
+}
+
+// readUsers reads a users file into a map keyed by normalized name
+func readUsers(path string) (map[string]*User, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*User
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	users := make(map[string]*User, len(list))
+	for _, u := range list {
+		users[normalize(u.Username)] = u
+	}
+	return users, nil
+}
+
+// Reload reads the users file again, for changes made by the user command
+// while the server runs. Accounts that were removed or got a new password
+// are signed out.
+func (s *Store) Reload() error {
+	s.mu.Lock()
+	users, err := readUsers(s.path)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	old := s.users
+	s.users = users
+	s.mu.Unlock()
+
+	for key, u := range old {
+		if cur, ok := users[key]; !ok || cur.PasswordHash != u.PasswordHash {
+			EndSessions(u.Username)
+		}
+	}
+	return nil
+}
+
+func normalize(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// Count returns the number of accounts
+func (s *Store) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users)
+}
+
+// Get returns a copy of the named user
+func (s *Store) Get(username string) (User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[normalize(username)]
+	if !ok {
+		return User{}, false
+	}
+	return *u, true
+}
+
+// List returns all users sorted by name
+func (s *Store) List() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, *u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// Add creates a new account
+func (s *Store) Add(username, password string, admin bool) error {
+	username = strings.TrimSpace(username)
+	if username == "" || strings.ContainsAny(username, ":/\\") {
+		return fmt.Errorf("invalid username %q", username)
+	}
+	if password == "" {
+		return fmt.Errorf("password must not be empty")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[normalize(username)]; ok {
+		return ErrUserExists
+	}
+	s.users[normalize(username)] = &User{
+		Username:     username,
+		PasswordHash: string(hash),
+		Admin:        admin,
+		Created:      time.Now(),
+	}
+	return s.save()
+}
+
+// SetPassword replaces the password of an existing account and signs out
+// its sessions
+func (s *Store) SetPassword(username, password string) error {
+	if password == "" {
+		return fmt.Errorf("password must not be empty")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[normalize(username)]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.PasswordHash = string(hash)
+	if err := s.save(); err != nil {
+		return err
+	}
+	EndSessions(u.Username)
+	return nil
+}
+
+// Verify checks a username and password pair
+func (s *Store) Verify(username, password string) (User, bool) {
+	u, ok := s.Get(username)
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return User{}, false
+	}
+	return u, true
+}
+
+// save writes the users file; callers hold the write lock
+func (s *Store) save() error {
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordChangeEndsSessions(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, s, other *Store)
+		alice  bool
+		bob    bool
+	}{
+		{"set password", func(t *testing.T, s, other *Store) {
+			if err := s.SetPassword("alice", "new secret"); err != nil {
+				t.Fatal(err)
+			}
+		}, false, true},
+		{"changed by another process", func(t *testing.T, s, other *Store) {
+			if err := other.SetPassword("Alice", "new secret"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Reload(); err != nil {
+				t.Fatal(err)
+			}
+		}, false, true},
+		{"user added by another process", func(t *testing.T, s, other *Store) {
+			if err := other.Add("carol", "secret123", false); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := s.Get("carol"); !ok {
+				t.Error("carol was not loaded")
+			}
+		}, true, true},
+		{"reload without changes", func(t *testing.T, s, other *Store) {
+			if err := s.Reload(); err != nil {
+				t.Fatal(err)
+			}
+		}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users.json")
+			s, err := OpenStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"alice", "bob"} {
+				if err := s.Add(name, "secret123", false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			other, err := OpenStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			alice, _ := NewSession("alice")
+			bob, _ := NewSession("bob")
+			tt.change(t, s, other)
+
+			if _, ok := LookupSession(alice.Token); ok != tt.alice {
+				t.Errorf("alice signed in: %v, want %v", ok, tt.alice)
+			}
+			if _, ok := LookupSession(bob.Token); ok != tt.bob {
+				t.Errorf("bob signed in: %v, want %v", ok, tt.bob)
+			}
+			if _, ok := s.Verify("alice", "new secret"); ok == tt.alice {
+				t.Errorf("new password accepted: %v, want %v", ok, !tt.alice)
+			}
+			EndSessions("alice")
+			EndSessions("bob")
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"filemanager/utils"
+)
+
+// settle is how long the users file has to stay quiet before it is read
+// again
+const settle = 500 * time.Millisecond
+
+// Watch reloads the user accounts whenever the users file changes or the
+// process gets SIGHUP, so that the user command takes effect on a running
+// server. A file that fails to load is reported and the accounts in
+// memory stay active.
+func Watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// The users file is replaced on every save, so its folder is watched
+	var changes <-chan fsnotify.Event
+	fsw, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = fsw.Add(filepath.Dir(Users.path))
+	}
+	if err != nil {
+		utils.Warnf("⚠️  Cannot watch %s, reload with SIGHUP: %v", Users.path, err)
+	} else {
+		changes = fsw.Events
+	}
+	name := filepath.Clean(Users.path)
+
+	go func() {
+		var timer <-chan time.Time
+		for {
+			select {
+			case <-hup:
+				reload("SIGHUP")
+			case ev := <-changes:
+				if filepath.Clean(ev.Name) == name && ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					timer = time.After(settle)
+				}
+			case <-timer:
+				timer = nil
+				reload("file change")
+			}
+		}
+	}()
+}
+
+func reload(reason string) {
+	if err := Users.Reload(); err != nil && !os.IsNotExist(err) {
+		utils.Errorf("❌ Users reload after %s failed, keeping the accounts in memory: %v", reason, err)
+	}
+}
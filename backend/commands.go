@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"filemanager/auth"
+	"filemanager/config"
+	"filemanager/search"
+	"filemanager/storage"
+	"filemanager/thumbs"
+)
+
+const usage = `Usage:
+  zxfilebrowser [FLAGS]                          start the server
+  zxfilebrowser [FLAGS] user add [-admin] NAME   create an account (the first one is always admin)
+  zxfilebrowser [FLAGS] user passwd NAME         change the password of an account and sign it out
+  zxfilebrowser [FLAGS] user list                list accounts
+  zxfilebrowser [FLAGS] config check [FILE]      check the configuration (default config.yaml)
+  zxfilebrowser [FLAGS] source encrypt ID        encrypt the files of a source in place (server stopped)
+  zxfilebrowser [FLAGS] source decrypt ID        decrypt them again before removing its encryption
+
+Flags (each wins over its environment variable, which wins over config.yaml):
+  -config FILE        configuration file           ZXFB_CONFIG
+  -addr HOST          address to listen on         ZXFB_ADDR
+  -port N             port to listen on            ZXFB_PORT
+  -data-dir DIR       accounts and server state    ZXFB_DATA_DIR
+  -log-level LEVEL    debug, info, warn or error   ZXFB_LOG_LEVEL
+
+Sources can also be set with ZXFB_SOURCE_<n>_<SETTING>, for example
+ZXFB_SOURCE_1_NAME=Media ZXFB_SOURCE_1_PATH=/srv/media. See config.yaml.
+`
+
+// parseFlags reads the flags in front of the command and returns the rest
+func parseFlags(args []string) []string {
+	fs := flag.NewFlagSet("zxfilebrowser", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	var o config.Overrides
+	fs.StringVar(&o.ConfigPath, "config", "", "configuration file")
+	fs.StringVar(&o.Address, "addr", "", "address to listen on")
+	fs.IntVar(&o.Port, "port", 0, "port to listen on")
+	fs.StringVar(&o.DataDir, "data-dir", "", "data directory")
+	fs.StringVar(&o.LogLevel, "log-level", "", "log level")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+
+	config.SetOverrides(o)
+	return fs.Args()
+}
+
+// runCommand handles the maintenance subcommands. It returns false when
+// args do not name one, so the server starts as usual.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	switch args[0] {
+	case "user":
+		exit(userCommand(args[1:]))
+	case "config":
+		exit(configCommand(args[1:]))
+	case "source":
+		exit(sourceCommand(args[1:]))
+	case "help":
+		fmt.Print(usage)
+		os.Exit(0)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", args[0], usage)
+		os.Exit(2)
+	}
+	return true
+}
+
+func exit(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func userCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing user subcommand\n\n%s", usage)
+	}
+
+	config.Init()
+	if err := auth.Init(config.Get().Server.DataDir); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("user add", flag.ContinueOnError)
+		admin := fs.Bool("admin", false, "grant admin rights")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: zxfilebrowser user add [-admin] NAME")
+		}
+
+		// Bootstrap: the very first account always gets admin rights
+		if auth.Users.Count() == 0 {
+			*admin = true
+		}
+
+		password, err := readNewPassword()
+		if err != nil {
+			return err
+		}
+		if err := auth.Users.Add(fs.Arg(0), password, *admin); err != nil {
+			return err
+		}
+		fmt.Printf("✅ Created user %s (admin: %v)\n", fs.Arg(0), *admin)
+		return nil
+
+	case "passwd":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: zxfilebrowser user passwd NAME")
+		}
+		if _, ok := auth.Users.Get(args[1]); !ok {
+			return auth.ErrUserNotFound
+		}
+		password, err := readNewPassword()
+		if err != nil {
+			return err
+		}
+		if err := auth.Users.SetPassword(args[1], password); err != nil {
+			return err
+		}
+		fmt.Printf("✅ Password changed for %s\n", args[1])
+		return nil
+
+	case "list":
+		for _, u := range auth.Users.List() {
+			role := "user"
+			if u.Admin {
+				role = "admin"
+			}
+			fmt.Printf("%-24s %-6s %s\n", u.Username, role, u.Created.Format("2006-01-02"))
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown user subcommand %q", args[0])
+}
+
+func configCommand(args []string) error {
+	if len(args) == 0 || args[0] != "check" || len(args) > 2 {
+		return fmt.Errorf("usage: zxfilebrowser config check [FILE]")
+	}
+	if len(args) == 2 {
+		config.SetPath(args[1])
+	}
+
+	problems, err := config.Check()
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %w", config.Path, err)
+	}
+	failed := 0
+	for _, p := range problems {
+		fmt.Println(p)
+		if !p.Warning {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d problem(s) found", failed)
+	}
+	fmt.Printf("✅ %s is valid\n", config.Path)
+	return nil
+}
+
+func sourceCommand(args []string) error {
+	if len(args) != 2 || (args[0] != "encrypt" && args[0] != "decrypt") {
+		return fmt.Errorf("usage: zxfilebrowser source encrypt|decrypt ID")
+	}
+
+	config.Init()
+	src, ok := config.GetSource(args[1])
+	if !ok {
+		return config.ErrSourceNotFound
+	}
+	if src.Encryption == nil {
+		return fmt.Errorf("set up encryption for %s in %s first", src.Name, config.Path)
+	}
+
+	files := 0
+	done := func(name string) {
+		files++
+		fmt.Println(name)
+	}
+	if args[0] == "encrypt" {
+		if err := storage.EncryptSource(src, done); err != nil {
+			return err
+		}
+		// What was cached while the files were plain would give them away
+		if err := thumbs.Forget(src.ID); err != nil {
+			return err
+		}
+		if err := search.Forget(src.ID); err != nil {
+			return err
+		}
+		fmt.Printf("✅ Encrypted %d files of %s\n", files, src.Name)
+		return nil
+	}
+	if err := storage.DecryptSource(src, done); err != nil {
+		return err
+	}
+	fmt.Printf("✅ Decrypted %d files of %s, now remove its encryption settings from %s\n", files, src.Name, config.Path)
+	return nil
+}
+
+// readNewPassword prompts twice on a terminal, or reads a single line
+// when the password is piped in
+func readNewPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Print("Password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	fmt.Print("Repeat password: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	if string(first) != string(second) {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return string(first), nil
+}
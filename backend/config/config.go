@@ -1,55 +1,334 @@
 package config
 
 import (
+	"bytes"
 	"log"
-	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"unicode"
 
 	"gopkg.in/yaml.v3"
+
+	"filemanager/utils"
 )
 
 type Source struct {
-	ID      string `yaml:"-" json:"id"`
-	Name    string `yaml:"name" json:"name"`
-	Path    string `yaml:"path" json:"path"`
-	Type    string `yaml:"-" json:"type"`
-	Enabled bool   `yaml:"-" json:"enabled"`
+	ID      string      `yaml:"id,omitempty" json:"id"`
+	Name    string      `yaml:"name" json:"name"`
+	Path    string      `yaml:"path" json:"path"`
+	Type    string      `yaml:"type" json:"type"`
+	Enabled bool        `yaml:"enabled" json:"enabled"`
+	S3      *S3Config   `yaml:"s3,omitempty" json:"-"`
+	SFTP    *SFTPConfig `yaml:"sftp,omitempty" json:"-"`
+	// Versioning keeps the old contents of replaced files when set
+	Versioning *VersioningConfig `yaml:"versioning,omitempty" json:"versioning,omitempty"`
+	// Encryption stores the files of the source encrypted when set
+	Encryption *EncryptionConfig `yaml:"encryption,omitempty" json:"-"`
+	// Env names the ZXFB_SOURCE_<n> variables that define or change the
+	// source, empty when it comes from the file alone
+	Env string `yaml:"-" json:"env,omitempty"`
+}
+
+// S3Config holds the connection settings of an "s3" source
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint,omitempty" json:"endpoint"`
+	Bucket    string `yaml:"bucket,omitempty" json:"bucket"`
+	Prefix    string `yaml:"prefix,omitempty" json:"prefix"`
+	Region    string `yaml:"region,omitempty" json:"region"`
+	AccessKey string `yaml:"accessKey,omitempty" json:"accessKey"`
+	SecretKey string `yaml:"secretKey,omitempty" json:"secretKey"`
+	PathStyle bool   `yaml:"pathStyle,omitempty" json:"pathStyle"`
+}
+
+// SFTPConfig holds the connection settings of an "sftp" source. Path is
+// the directory on the remote host that becomes the source root.
+type SFTPConfig struct {
+	Host       string `yaml:"host,omitempty" json:"host"`
+	Port       int    `yaml:"port,omitempty" json:"port"`
+	User       string `yaml:"user,omitempty" json:"user"`
+	Password   string `yaml:"password,omitempty" json:"password"`
+	PrivateKey string `yaml:"privateKey,omitempty" json:"privateKey"`
+	Passphrase string `yaml:"passphrase,omitempty" json:"passphrase"`
+	// KnownHosts defaults to ~/.ssh/known_hosts; connections to servers
+	// whose key is not in it are refused unless InsecureIgnoreHostKey is set
+	KnownHosts            string `yaml:"knownHosts,omitempty" json:"knownHosts"`
+	InsecureIgnoreHostKey bool   `yaml:"insecureIgnoreHostKey,omitempty" json:"insecureIgnoreHostKey"`
+	PoolSize              int    `yaml:"poolSize,omitempty" json:"poolSize"`
+}
+
+// VersioningConfig sets how many old versions of a file a source keeps
+// and for how long
+type VersioningConfig struct {
+	MaxVersions int `yaml:"maxVersions" json:"maxVersions"`
+	MaxAgeDays  int `yaml:"maxAgeDays" json:"maxAgeDays"`
+}
+
+// EncryptionConfig holds the key of an encrypted source, given as a
+// passphrase or as a file holding at least 16 bytes of random data. Names
+// encrypts file and folder names as well.
+type EncryptionConfig struct {
+	Passphrase string `yaml:"passphrase,omitempty" json:"passphrase"`
+	KeyFile    string `yaml:"keyFile,omitempty" json:"keyFile"`
+	Names      bool   `yaml:"names,omitempty" json:"names"`
 }
 
 type ServerConfig struct {
-	Port int `yaml:"port"`
+	// Address is the interface to listen on, all of them when empty
+	Address        string   `yaml:"address"`
+	Port           int      `yaml:"port"`
+	DataDir        string   `yaml:"dataDir"`
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+	// LogLevel is one of debug, info, warn and error
+	LogLevel string `yaml:"logLevel"`
+}
+
+// AccessConfig limits which sources and paths each user or group can use.
+// Without an access section every signed in user can use everything.
+type AccessConfig struct {
+	Groups map[string][]string `yaml:"groups"`
+	Rules  []AccessRule        `yaml:"rules"`
+}
+
+// AccessRule grants permissions on a source, optionally below a sub-path
+type AccessRule struct {
+	Source      string   `yaml:"source"`
+	Path        string   `yaml:"path"`
+	Users       []string `yaml:"users"`
+	Groups      []string `yaml:"groups"`
+	Permissions []string `yaml:"permissions"`
+}
+
+// TrashConfig controls the per-source recycle bin
+type TrashConfig struct {
+	RetentionDays int `yaml:"retentionDays"`
+}
+
+// ArchiveConfig limits how much a single archive extraction may write
+type ArchiveConfig struct {
+	MaxExtractMB int `yaml:"maxExtractMB"`
+	MaxEntries   int `yaml:"maxEntries"`
+}
+
+// UploadsConfig controls resumable uploads
+type UploadsConfig struct {
+	ExpiryHours int `yaml:"expiryHours"`
+}
+
+// SharesConfig sets where upload links report arriving files. The webhook
+// gets a JSON POST per file for links created with notify on.
+type SharesConfig struct {
+	WebhookURL    string `yaml:"webhookURL"`
+	WebhookSecret string `yaml:"webhookSecret"`
+}
+
+// AuditConfig controls rotation of the audit log in the data directory
+type AuditConfig struct {
+	MaxSizeMB int `yaml:"maxSizeMB"`
+	MaxFiles  int `yaml:"maxFiles"`
+}
+
+// SearchConfig controls the search index kept in the data directory
+type SearchConfig struct {
+	RescanMinutes int `yaml:"rescanMinutes"`
+	MaxTextKB     int `yaml:"maxTextKB"`
 }
 
 type Config struct {
-	Server  ServerConfig `yaml:"server"`
-	Sources []Source     `yaml:"sources"`
+	Server  ServerConfig  `yaml:"server"`
+	Sources []Source      `yaml:"sources"`
+	Access  *AccessConfig `yaml:"access"`
+	Trash   TrashConfig   `yaml:"trash"`
+	Archive ArchiveConfig `yaml:"archive"`
+	Uploads UploadsConfig `yaml:"uploads"`
+	Shares  SharesConfig  `yaml:"shares"`
+	Audit   AuditConfig   `yaml:"audit"`
+	Search  SearchConfig  `yaml:"search"`
+
+	// origin maps the settings given by a variable or flag, like
+	// "server.port", to its name
+	origin map[string]string
+}
+
+// Path is the configuration file the server reads
+var Path = "config.yaml"
+
+var (
+	mu      sync.RWMutex
+	current = &Config{}
+	// loaded is the file content current was parsed from
+	loaded []byte
+
+	hooks []func(old, cur *Config)
+)
+
+// Get returns the active configuration. A reload swaps in a new one and
+// never changes a returned Config, so a caller that holds on to it keeps a
+// consistent view; it must not be modified.
+func Get() *Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
 }
 
-var AppConfig Config
+// OnReload calls fn after every reload with the previous and the new
+// configuration
+func OnReload(fn func(old, cur *Config)) {
+	mu.Lock()
+	hooks = append(hooks, fn)
+	mu.Unlock()
+}
 
 func Init() {
-	data, err := os.ReadFile("config.yaml")
+	data, err := readFile()
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", Path, err)
+	}
+
+	cfg, err := parse(data)
+	if err != nil {
+		log.Fatalf("Failed to load %s: %v", Path, err)
+	}
+
+	mu.Lock()
+	current, loaded = cfg, data
+	mu.Unlock()
+
+	utils.Infof("Loaded %d sources from config", len(cfg.Sources))
+}
+
+// DefaultPort is used when server.port is not set
+const DefaultPort = 8080
+
+// parse reads a configuration file, applies the environment and flags,
+// fills in the defaults and checks the result, failing with a
+// ValidationError that lists every problem. Warnings are only logged.
+func parse(data []byte) (*Config, error) {
+	cfg, problems, err := load(data)
 	if err != nil {
-		log.Fatal("Failed to read config.yaml:", err)
+		return nil, err
+	}
+	var errs []Problem
+	for _, p := range problems {
+		if !p.Warning {
+			errs = append(errs, p)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Problems: errs}
+	}
+	for _, p := range problems {
+		p.Warning = false
+		utils.Warnf("⚠️  %s", p)
 	}
+	return cfg, nil
+}
 
-	if err := yaml.Unmarshal(data, &AppConfig); err != nil {
-		log.Fatal("Failed to parse config.yaml:", err)
+// load is parse that returns the problems instead of failing on them
+func load(data []byte) (*Config, []Problem, error) {
+	cfg, doc, err := decode(data)
+	if err != nil {
+		return nil, nil, err
 	}
+	problems := overlay(cfg)
+	setDefaults(cfg)
+	problems = append(problems, validate(cfg, doc)...)
+	sort.SliceStable(problems, func(i, k int) bool { return problems[i].Line < problems[k].Line })
+	return cfg, problems, nil
+}
 
-	// Auto-generate IDs and set defaults
-	for i := range AppConfig.Sources {
-		AppConfig.Sources[i].ID = generateID(AppConfig.Sources[i].Name)
-		AppConfig.Sources[i].Type = "local"
-		AppConfig.Sources[i].Enabled = true
+// decode reads a configuration file and fills in the defaults without
+// checking it or looking at the environment. The document node carries
+// the line numbers.
+func decode(data []byte) (*Config, *yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
 	}
+	var cfg Config
+	if err := doc.Decode(&cfg); err != nil && doc.Kind != 0 {
+		return nil, nil, err
+	}
+	setDefaults(&cfg)
+	return &cfg, &doc, nil
+}
+
+func setDefaults(cfg *Config) {
+	if cfg.Server.DataDir == "" {
+		cfg.Server.DataDir = ".zxfilebrowser"
+	}
+	if cfg.Server.Port == 0 {
+		cfg.Server.Port = DefaultPort
+	}
+	if cfg.Server.LogLevel == "" {
+		cfg.Server.LogLevel = "info"
+	}
+
+	// Generate missing IDs and set defaults
+	for i := range cfg.Sources {
+		if cfg.Sources[i].ID == "" {
+			cfg.Sources[i].ID = generateID(cfg.Sources[i].Name)
+		}
+		if cfg.Sources[i].Type == "" {
+			cfg.Sources[i].Type = "local"
+		}
+		if s3 := cfg.Sources[i].S3; s3 != nil && cfg.Sources[i].Path == "" {
+			cfg.Sources[i].Path = s3Path(s3)
+		}
+	}
+}
 
-	log.Printf("Loaded %d sources from config", len(AppConfig.Sources))
+func s3Path(s3 *S3Config) string {
+	return "s3://" + s3.Bucket + "/" + strings.Trim(s3.Prefix, "/")
+}
+
+// Reload reads the configuration file again and makes it active. The
+// server section only takes effect on restart.
+func Reload() error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	data, err := readFile()
+	if err != nil {
+		return err
+	}
+	mu.RLock()
+	unchanged := bytes.Equal(data, loaded)
+	mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cfg, err := parse(data)
+	if err != nil {
+		return err
+	}
+	activate(cfg, data)
+	return nil
+}
+
+// activate swaps in a new configuration and tells the hooks about it
+func activate(cfg *Config, data []byte) {
+	mu.Lock()
+	old := current
+	if !reflect.DeepEqual(cfg.Server, old.Server) {
+		utils.Warnf("⚠️  Changes to the server section take effect on restart")
+		cfg.Server = old.Server
+	}
+	current, loaded = cfg, data
+	fns := append([]func(*Config, *Config){}, hooks...)
+	mu.Unlock()
+
+	for _, fn := range fns {
+		fn(old, cfg)
+	}
+	utils.Infof("🔄 Reloaded config, %d sources", len(cfg.Sources))
 }
 
 func GetEnabledSources() []Source {
 	var enabled []Source
-	for _, src := range AppConfig.Sources {
+	for _, src := range Get().Sources {
 		if src.Enabled {
 			enabled = append(enabled, src)
 		}
@@ -57,9 +336,30 @@ func GetEnabledSources() []Source {
 	return enabled
 }
 
+func GetSource(id string) (Source, bool) {
+	for _, src := range Get().Sources {
+		if src.ID == id {
+			return src, true
+		}
+	}
+	return Source{}, false
+}
+
+// generateID turns a name into an ID: "Google Drive" -> "google-drive",
+// "One Drive - Personal" -> "one-drive-personal"
 func generateID(name string) string {
-	// Convert "Google Drive" -> "google-drive"
-	id := strings.ToLower(name)
-	id = strings.ReplaceAll(id, " ", "-")
-	return id
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
 }
@@ -0,0 +1,29 @@
+package config
+
+import "testing"
+
+func TestGenerateID(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Images", "images"},
+		{"Google Drive", "google-drive"},
+		{"One Drive - Personal", "one-drive-personal"},
+		{"Box (Work)", "box-work"},
+		{"  Test   Dir  ", "test-dir"},
+		{"snake_case", "snake_case"},
+		{"Über Fotos", "über-fotos"},
+		{"!!!", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := generateID(tt.name); got != tt.want {
+				t.Errorf("generateID(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+			if tt.want != "" && !validID(tt.want) {
+				t.Errorf("generated id %q does not pass validation", tt.want)
+			}
+		})
+	}
+}
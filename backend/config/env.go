@@ -0,0 +1,223 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Settings are taken from, in order of precedence:
+//
+//  1. command line flags (-config, -addr, -port, -data-dir, -log-level)
+//  2. environment variables (ZXFB_CONFIG, ZXFB_ADDR, ZXFB_PORT,
+//     ZXFB_DATA_DIR, ZXFB_LOG_LEVEL and ZXFB_SOURCE_<n>_<SETTING>)
+//  3. the configuration file
+//  4. the defaults
+//
+// A source from the environment whose id matches one in the file changes
+// only the settings it names, any other is added after the file's sources.
+
+const envPrefix = "ZXFB_"
+
+// Overrides are the settings given on the command line
+type Overrides struct {
+	ConfigPath string
+	Address    string
+	Port       int
+	DataDir    string
+	LogLevel   string
+}
+
+var (
+	flags Overrides
+	// pathSet is true when the configuration file was named explicitly.
+	// Without it a missing config.yaml is fine, everything may come from
+	// the environment.
+	pathSet bool
+)
+
+// SetOverrides applies command line flags on top of the environment and
+// the configuration file. Call it before Init.
+func SetOverrides(o Overrides) {
+	flags = o
+	if o.ConfigPath != "" {
+		SetPath(o.ConfigPath)
+	} else if p := os.Getenv(envPrefix + "CONFIG"); p != "" {
+		SetPath(p)
+	}
+}
+
+// SetPath names the configuration file, which then has to exist
+func SetPath(p string) {
+	Path, pathSet = p, true
+}
+
+// readFile reads the configuration file; a missing default file reads as
+// empty
+func readFile() ([]byte, error) {
+	data, err := os.ReadFile(Path)
+	if os.IsNotExist(err) && !pathSet {
+		return nil, nil
+	}
+	return data, err
+}
+
+// overlay applies the environment and then the flags to cfg, reporting
+// values it cannot use
+func overlay(cfg *Config) []Problem {
+	var problems []Problem
+	bad := func(name, format string, args ...interface{}) {
+		problems = append(problems, Problem{Env: name, Message: fmt.Sprintf(format, args...)})
+	}
+	set := func(key, name, value string, dst *string) {
+		if value != "" {
+			*dst = value
+			cfg.origin[key] = name
+		}
+	}
+
+	cfg.origin = map[string]string{}
+	set("server.address", envPrefix+"ADDR", os.Getenv(envPrefix+"ADDR"), &cfg.Server.Address)
+	if v := os.Getenv(envPrefix + "PORT"); v != "" {
+		if port, err := strconv.Atoi(v); err != nil {
+			bad(envPrefix+"PORT", "%q is not a port number", v)
+		} else {
+			cfg.Server.Port = port
+			cfg.origin["server.port"] = envPrefix + "PORT"
+		}
+	}
+	set("server.dataDir", envPrefix+"DATA_DIR", os.Getenv(envPrefix+"DATA_DIR"), &cfg.Server.DataDir)
+	set("server.logLevel", envPrefix+"LOG_LEVEL", os.Getenv(envPrefix+"LOG_LEVEL"), &cfg.Server.LogLevel)
+	problems = append(problems, envSources(cfg)...)
+
+	set("server.address", "-addr", flags.Address, &cfg.Server.Address)
+	if flags.Port != 0 {
+		cfg.Server.Port = flags.Port
+		cfg.origin["server.port"] = "-port"
+	}
+	set("server.dataDir", "-data-dir", flags.DataDir, &cfg.Server.DataDir)
+	set("server.logLevel", "-log-level", flags.LogLevel, &cfg.Server.LogLevel)
+	return problems
+}
+
+// envSources applies the ZXFB_SOURCE_<n>_<SETTING> variables, in the
+// order of n. Settings are the YAML keys in upper case with words split
+// by underscores: ZXFB_SOURCE_1_S3_ACCESS_KEY sets s3.accessKey.
+func envSources(cfg *Config) []Problem {
+	var problems []Problem
+	const prefix = envPrefix + "SOURCE_"
+
+	groups := map[int]map[string]string{}
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+		num, setting, ok := strings.Cut(rest, "_")
+		n, err := strconv.Atoi(num)
+		if !ok || err != nil || n < 1 || setting == "" {
+			problems = append(problems, Problem{Env: name, Message: "expected " + prefix + "<n>_<SETTING> with n from 1"})
+			continue
+		}
+		if groups[n] == nil {
+			groups[n] = map[string]string{}
+		}
+		groups[n][setting] = value
+	}
+
+	nums := make([]int, 0, len(groups))
+	for n := range groups {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+
+	for _, n := range nums {
+		vars := groups[n]
+		group := fmt.Sprintf("%s%d", prefix, n)
+
+		id := vars["ID"]
+		if id == "" {
+			id = generateID(vars["NAME"])
+		}
+		index := -1
+		for i := range cfg.Sources {
+			if id != "" && cfg.Sources[i].ID == id {
+				index = i
+			}
+		}
+		if index < 0 {
+			cfg.Sources = append(cfg.Sources, Source{ID: id, Enabled: true})
+			index = len(cfg.Sources) - 1
+		}
+		src := &cfg.Sources[index]
+		src.Env = group
+
+		settings := make([]string, 0, len(vars))
+		for setting := range vars {
+			settings = append(settings, setting)
+		}
+		sort.Strings(settings)
+		for _, setting := range settings {
+			if err := setField(reflect.ValueOf(src).Elem(), setting, vars[setting]); err != nil {
+				problems = append(problems, Problem{Env: group + "_" + setting, Message: err.Error()})
+			}
+		}
+	}
+	return problems
+}
+
+// setField sets the field of the struct v that setting names
+func setField(v reflect.Value, setting, value string) error {
+	for key, f := range yamlFields(v.Type()) {
+		name := envName(key)
+		field := v.FieldByIndex(f.Index)
+
+		if setting == name {
+			switch field.Kind() {
+			case reflect.String:
+				field.SetString(value)
+			case reflect.Int:
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					return fmt.Errorf("%q is not a number", value)
+				}
+				field.SetInt(int64(n))
+			case reflect.Bool:
+				b, err := strconv.ParseBool(value)
+				if err != nil {
+					return fmt.Errorf("%q is not true or false", value)
+				}
+				field.SetBool(b)
+			default:
+				return fmt.Errorf("%s cannot be set directly, set %s_<SETTING> instead", name, name)
+			}
+			return nil
+		}
+
+		if rest, ok := strings.CutPrefix(setting, name+"_"); ok && field.Kind() == reflect.Pointer && field.Type().Elem().Kind() == reflect.Struct {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			return setField(field.Elem(), rest, value)
+		}
+	}
+	return fmt.Errorf("unknown setting")
+}
+
+// envName turns a YAML key into its environment form: "accessKey" ->
+// "ACCESS_KEY"
+func envName(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,323 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrSourceNotFound = errors.New("source not found")
+	ErrSourceExists   = errors.New("a source with that name already exists")
+	ErrSourceFromEnv  = errors.New("source is set by environment variables, change it there")
+	// ErrEncryptionChange refuses to turn encryption on or off or change
+	// its key while files are stored under the old settings
+	ErrEncryptionChange = errors.New("the encryption of a source can only be changed with the server stopped, using zxfilebrowser source encrypt|decrypt")
+)
+
+// writeMu serializes reloads and changes to the configuration file
+var writeMu sync.Mutex
+
+// sourceYAML is how a source is written to the configuration file
+type sourceYAML struct {
+	ID         string            `yaml:"id,omitempty"`
+	Name       string            `yaml:"name"`
+	Path       string            `yaml:"path,omitempty"`
+	Type       string            `yaml:"type,omitempty"`
+	Enabled    *bool             `yaml:"enabled,omitempty"`
+	S3         *S3Config         `yaml:"s3,omitempty"`
+	SFTP       *SFTPConfig       `yaml:"sftp,omitempty"`
+	Versioning *VersioningConfig `yaml:"versioning,omitempty"`
+	Encryption *EncryptionConfig `yaml:"encryption,omitempty"`
+}
+
+// UnmarshalYAML reads a source; sources are enabled unless they say
+// otherwise
+func (s *Source) UnmarshalYAML(node *yaml.Node) error {
+	type plain Source
+	src := plain{Enabled: true}
+	if err := node.Decode(&src); err != nil {
+		return err
+	}
+	*s = Source(src)
+	return nil
+}
+
+// MarshalYAML leaves out what the file does not need to say
+func (s Source) MarshalYAML() (interface{}, error) {
+	out := sourceYAML{
+		ID:         s.ID,
+		Name:       s.Name,
+		Path:       s.Path,
+		Type:       s.Type,
+		S3:         s.S3,
+		SFTP:       s.SFTP,
+		Versioning: s.Versioning,
+		Encryption: s.Encryption,
+	}
+	if out.ID == generateID(s.Name) {
+		out.ID = ""
+	}
+	if out.Type == "local" {
+		out.Type = ""
+	}
+	if s.S3 != nil && s.Path == s3Path(s.S3) {
+		out.Path = ""
+	}
+	if !s.Enabled {
+		out.Enabled = new(bool)
+	}
+	return out, nil
+}
+
+// AddSource appends a source to the configuration file and makes it
+// active. Without an ID it gets one made from the name. It returns the
+// source with its ID and defaults filled in.
+func AddSource(src Source) (Source, error) {
+	var added Source
+	if src.ID == "" {
+		src.ID = generateID(src.Name)
+	}
+	if _, ok := GetSource(src.ID); ok {
+		return added, ErrSourceExists
+	}
+	err := updateSources(func(sources []Source) ([]Source, error) {
+		for _, s := range sources {
+			if s.ID == src.ID {
+				return nil, ErrSourceExists
+			}
+		}
+		return append(sources, src), nil
+	}, func(cfg *Config) {
+		added = cfg.Sources[len(cfg.Sources)-1]
+	})
+	return added, err
+}
+
+// UpdateSource replaces the settings of a source. The ID stays the same;
+// a renamed source has it written out explicitly. The encryption settings
+// must stay as they are, see ErrEncryptionChange.
+func UpdateSource(id string, src Source) (Source, error) {
+	var updated Source
+	if err := checkEditable(id); err != nil {
+		return updated, err
+	}
+	index := -1
+	src.ID = id
+	err := updateSources(func(sources []Source) ([]Source, error) {
+		for i, s := range sources {
+			if s.ID == id {
+				index = i
+			}
+		}
+		if index < 0 {
+			return nil, ErrSourceNotFound
+		}
+		if !sameEncryption(sources[index].Encryption, src.Encryption) {
+			return nil, ErrEncryptionChange
+		}
+		sources[index] = src
+		return sources, nil
+	}, func(cfg *Config) {
+		updated = cfg.Sources[index]
+	})
+	return updated, err
+}
+
+func sameEncryption(a, b *EncryptionConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// SetSourceEnabled turns a source on or off without removing it
+func SetSourceEnabled(id string, enabled bool) error {
+	if err := checkEditable(id); err != nil {
+		return err
+	}
+	return updateSources(func(sources []Source) ([]Source, error) {
+		for i := range sources {
+			if sources[i].ID == id {
+				sources[i].Enabled = enabled
+				return sources, nil
+			}
+		}
+		return nil, ErrSourceNotFound
+	}, nil)
+}
+
+// RemoveSource drops a source from the configuration file. Its files are
+// left alone.
+func RemoveSource(id string) error {
+	if err := checkEditable(id); err != nil {
+		return err
+	}
+	return updateSources(func(sources []Source) ([]Source, error) {
+		for i := range sources {
+			if sources[i].ID == id {
+				return append(sources[:i], sources[i+1:]...), nil
+			}
+		}
+		return nil, ErrSourceNotFound
+	}, nil)
+}
+
+// checkEditable refuses sources the environment has a say in, since it
+// would win over any change to the file
+func checkEditable(id string) error {
+	if src, ok := GetSource(id); ok && src.Env != "" {
+		return fmt.Errorf("%w (%s)", ErrSourceFromEnv, src.Env)
+	}
+	return nil
+}
+
+// updateSources rewrites the sources section of the configuration file
+// with what edit returns and activates the result. Sources that did not
+// change keep their place and comments in the file. done sees the new
+// configuration before it is active.
+func updateSources(edit func([]Source) ([]Source, error), done func(*Config)) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	data, err := readFile()
+	if err != nil {
+		return err
+	}
+	// Only the result has to be valid, an edit may well be fixing the file
+	cfg, doc, err := decode(data)
+	if err != nil {
+		return err
+	}
+	if doc.Kind == 0 {
+		// No file yet, everything came from the environment
+		doc.Kind = yaml.DocumentNode
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("%s is not a YAML mapping", Path)
+	}
+
+	old := cfg.Sources
+	sources, err := edit(append([]Source(nil), old...))
+	if err != nil {
+		return err
+	}
+
+	oldNodes := map[string]*yaml.Node{}
+	if seq := mappingValue(doc.Content[0], "sources"); seq != nil && seq.Kind == yaml.SequenceNode {
+		for i, n := range seq.Content {
+			if i < len(old) {
+				oldNodes[old[i].ID] = n
+			}
+		}
+	}
+	seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, src := range sources {
+		prev, ok := oldNodes[src.ID]
+		if ok && reflect.DeepEqual(src, sourceByID(old, src.ID)) {
+			seq.Content = append(seq.Content, prev)
+			continue
+		}
+		n := &yaml.Node{}
+		if err := n.Encode(src); err != nil {
+			return err
+		}
+		if prev != nil {
+			n.HeadComment, n.LineComment, n.FootComment = prev.HeadComment, prev.LineComment, prev.FootComment
+		}
+		seq.Content = append(seq.Content, n)
+	}
+	setMappingValue(doc.Content[0], "sources", seq)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	enc.Close()
+	out := buf.Bytes()
+
+	next, err := parse(out)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(out); err != nil {
+		return err
+	}
+	if done != nil {
+		done(next)
+	}
+	activate(next, out)
+	return nil
+}
+
+func sourceByID(sources []Source, id string) Source {
+	for _, s := range sources {
+		if s.ID == id {
+			return s
+		}
+	}
+	return Source{}
+}
+
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(m *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			value.HeadComment = m.Content[i+1].HeadComment
+			value.FootComment = m.Content[i+1].FootComment
+			m.Content[i+1] = value
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// writeFile replaces the configuration file in one rename
+func writeFile(data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(Path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(Path), ".config-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), Path)
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useConfig makes yaml the configuration file and loads it
+func useConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(p, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	prev := Path
+	SetPath(p)
+	t.Cleanup(func() { Path = prev })
+
+	data, err := readFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	current, loaded = cfg, data
+	mu.Unlock()
+	return p
+}
+
+func TestUpdateSourceKeepsEncryption(t *testing.T) {
+	secret, plain := t.TempDir(), t.TempDir()
+	key := &EncryptionConfig{Passphrase: "correct horse"}
+
+	tests := []struct {
+		name string
+		id   string
+		enc  *EncryptionConfig
+		err  error
+	}{
+		{"unchanged", "secret", &EncryptionConfig{Passphrase: "correct horse"}, nil},
+		{"removed", "secret", nil, ErrEncryptionChange},
+		{"new passphrase", "secret", &EncryptionConfig{Passphrase: "battery staple"}, ErrEncryptionChange},
+		{"names turned on", "secret", &EncryptionConfig{Passphrase: "correct horse", Names: true}, ErrEncryptionChange},
+		{"added", "plain", key, ErrEncryptionChange},
+		{"still plain", "plain", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, "sources:\n"+
+				"  - name: Secret\n    path: "+secret+"\n    encryption:\n      passphrase: correct horse\n"+
+				"  - name: Plain\n    path: "+plain+"\n")
+
+			src, _ := GetSource(tt.id)
+			src.Encryption = tt.enc
+			_, err := UpdateSource(tt.id, src)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("UpdateSource = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is one thing wrong with the configuration. Env names the
+// variable or flag at fault, if any. A warning does not keep the
+// configuration from loading.
+type Problem struct {
+	Line    int    `json:"line"`
+	Env     string `json:"env,omitempty"`
+	Message string `json:"message"`
+	Warning bool   `json:"warning,omitempty"`
+}
+
+func (p Problem) String() string {
+	if p.Warning {
+		p.Warning = false
+		return "warning: " + p.String()
+	}
+	switch {
+	case p.Env != "" && p.Line > 0:
+		return fmt.Sprintf("%s:%d, %s: %s", Path, p.Line, p.Env, p.Message)
+	case p.Env != "":
+		return fmt.Sprintf("%s: %s", p.Env, p.Message)
+	case p.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", Path, p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", Path, p.Message)
+}
+
+// ValidationError lists every problem found in the configuration file
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = p.String()
+	}
+	return fmt.Sprintf("%d problem(s) in config:\n  %s", len(e.Problems), strings.Join(lines, "\n  "))
+}
+
+// sourceTypes are the source types a storage driver was registered for
+var sourceTypes = map[string]bool{}
+
+// RegisterSourceType makes typ a valid source type
+func RegisterSourceType(typ string) {
+	sourceTypes[typ] = true
+}
+
+// logLevels are the values server.logLevel takes
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// Check reads the configuration file and the overrides and reports every
+// problem in them without making the result active
+func Check() ([]Problem, error) {
+	data, err := readFile()
+	if err != nil {
+		return nil, err
+	}
+	_, problems, err := load(data)
+	return problems, err
+}
+
+// pos is where a problem is: a line of the file, a variable or flag, or
+// both for a source from the file that the environment changes
+type pos struct {
+	line int
+	env  string
+}
+
+// String describes the position for a message about another problem
+func (p pos) String() string {
+	if p.env != "" {
+		return p.env
+	}
+	return fmt.Sprintf("line %d", p.line)
+}
+
+// validate checks a configuration, taking line numbers from doc
+func validate(cfg *Config, doc *yaml.Node) []Problem {
+	var problems []Problem
+	add := func(at pos, format string, args ...interface{}) {
+		problems = append(problems, Problem{Line: at.line, Env: at.env, Message: fmt.Sprintf(format, args...)})
+	}
+	warn := func(at pos, format string, args ...interface{}) {
+		add(at, format, args...)
+		problems[len(problems)-1].Warning = true
+	}
+
+	var root *yaml.Node
+	if doc != nil && len(doc.Content) > 0 {
+		root = doc.Content[0]
+	}
+	checkKeys(root, reflect.TypeOf(Config{}), "", func(line int, format string, args ...interface{}) {
+		add(pos{line: line}, format, args...)
+	})
+
+	server := func(key string) pos {
+		if name, ok := cfg.origin["server."+key]; ok {
+			return pos{env: name}
+		}
+		return pos{line: keyLine(root, "server", key)}
+	}
+	if port := cfg.Server.Port; port < 0 || port > 65535 {
+		add(server("port"), "server.port must be between 1 and 65535, got %d", port)
+	}
+	if !slices.Contains(logLevels, cfg.Server.LogLevel) {
+		add(server("logLevel"), "server.logLevel must be one of %s, got %q", strings.Join(logLevels, ", "), cfg.Server.LogLevel)
+	}
+
+	var items []*yaml.Node
+	if seq := mappingValue(root, "sources"); seq != nil && seq.Kind == yaml.SequenceNode {
+		items = seq.Content
+	}
+	line := func(i int, key string) pos {
+		at := pos{env: cfg.Sources[i].Env}
+		if i < len(items) {
+			at.line = items[i].Line
+			if l := keyLine(items[i], key); l > 0 {
+				at.line = l
+			}
+		}
+		return at
+	}
+
+	ids := map[string]pos{}
+	for i, src := range cfg.Sources {
+		label := src.Name
+		if label == "" {
+			label = fmt.Sprintf("#%d", i+1)
+		}
+
+		switch {
+		case src.Name == "":
+			add(line(i, "name"), "source %s has no name", label)
+		case src.ID == "":
+			add(line(i, "name"), "source %q gives an empty id, set one with id:", src.Name)
+		case !validID(src.ID):
+			add(line(i, "id"), "source %s: id %q may only hold lower case letters, digits, - and _", label, src.ID)
+		}
+		if src.ID != "" {
+			if first, ok := ids[src.ID]; ok {
+				add(line(i, "name"), "source %s has the same id %q as the source at %s, set a different id:", label, src.ID, first)
+			} else {
+				ids[src.ID] = line(i, "name")
+			}
+		}
+
+		if !sourceTypes[src.Type] && len(sourceTypes) > 0 {
+			add(line(i, "type"), "source %s: unknown type %q (known: %s)", label, src.Type, strings.Join(knownTypes(), ", "))
+			continue
+		}
+		switch src.Type {
+		case "s3":
+			if src.S3 == nil || src.S3.Bucket == "" {
+				add(line(i, "s3"), "source %s: s3 sources need s3.bucket", label)
+			}
+		case "sftp":
+			if src.SFTP == nil || src.SFTP.Host == "" {
+				add(line(i, "sftp"), "source %s: sftp sources need sftp.host", label)
+			}
+			if src.Path == "" {
+				add(line(i, "path"), "source %s has no path", label)
+			}
+		default:
+			if src.Path == "" {
+				add(line(i, "path"), "source %s has no path", label)
+			} else if src.Enabled && src.Type == "local" {
+				if msg := checkDir(src.Path); msg != "" {
+					warn(line(i, "path"), "source %s: %s, fix the path or set enabled: false", label, msg)
+				}
+			}
+		}
+	}
+
+	for i, src := range cfg.Sources {
+		enc := src.Encryption
+		switch {
+		case enc == nil:
+		case enc.Passphrase == "" && enc.KeyFile == "":
+			add(line(i, "encryption"), "source %s: encryption needs a passphrase or a keyFile", src.Name)
+		case enc.Passphrase != "" && enc.KeyFile != "":
+			add(line(i, "encryption"), "source %s: encryption takes a passphrase or a keyFile, not both", src.Name)
+		case enc.KeyFile != "":
+			if _, err := os.Stat(enc.KeyFile); err != nil {
+				add(line(i, "encryption"), "source %s: cannot read key file: %v", src.Name, err)
+			}
+		}
+	}
+
+	for _, o := range overlaps(cfg.Sources) {
+		add(line(o[1], "path"), "source %s lies inside source %s (%s), roots must not overlap",
+			cfg.Sources[o[1]].Name, cfg.Sources[o[0]].Name, line(o[0], "path"))
+	}
+
+	checkAccess(cfg, mappingValue(root, "access"), func(line int, format string, args ...interface{}) {
+		add(pos{line: line}, format, args...)
+	})
+	return problems
+}
+
+// accessPermissions are the values a rule's permissions take
+var accessPermissions = []string{"read", "write", "delete", "share", "all"}
+
+// checkAccess reports access rules the ACL could not use or that name a
+// source that does not exist. A rule for a removed or misspelled source
+// would silently grant nothing.
+func checkAccess(cfg *Config, node *yaml.Node, add func(int, string, ...interface{})) {
+	if cfg.Access == nil {
+		return
+	}
+	var items []*yaml.Node
+	if seq := mappingValue(node, "rules"); seq != nil && seq.Kind == yaml.SequenceNode {
+		items = seq.Content
+	}
+	line := func(i int, key string) int {
+		if i >= len(items) {
+			return 0
+		}
+		if l := keyLine(items[i], key); l > 0 {
+			return l
+		}
+		return items[i].Line
+	}
+
+	for i, r := range cfg.Access.Rules {
+		switch {
+		case r.Source == "":
+			add(line(i, "source"), "access rule #%d has no source", i+1)
+		case r.Source != "*" && !slices.ContainsFunc(cfg.Sources, func(src Source) bool { return strings.EqualFold(src.ID, r.Source) }):
+			add(line(i, "source"), "access rule #%d: unknown source %q, use a source id or *", i+1, r.Source)
+		}
+		if len(r.Users) == 0 && len(r.Groups) == 0 {
+			add(line(i, "users"), "access rule #%d needs users or groups", i+1)
+		}
+		for _, perm := range r.Permissions {
+			if !slices.Contains(accessPermissions, strings.ToLower(perm)) {
+				add(line(i, "permissions"), "access rule #%d: unknown permission %q (known: %s)", i+1, perm, strings.Join(accessPermissions, ", "))
+			}
+		}
+	}
+}
+
+// checkKeys reports the keys of node that the type t has no field for
+func checkKeys(node *yaml.Node, t reflect.Type, prefix string, add func(int, string, ...interface{})) {
+	if node == nil {
+		return
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for _, item := range node.Content {
+			checkKeys(item, t.Elem(), prefix, add)
+		}
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field, ok := fields[key.Value]
+			if !ok {
+				add(key.Line, "unknown key %q%s", prefix+key.Value, suggest(key.Value, fields))
+				continue
+			}
+			checkKeys(value, field.Type, prefix+key.Value+".", add)
+		}
+	}
+}
+
+// yamlFields maps the YAML keys of a struct to its fields
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+// suggest names a known key that differs from key only in case
+func suggest(key string, fields map[string]reflect.StructField) string {
+	for name := range fields {
+		if strings.EqualFold(name, key) {
+			return fmt.Sprintf(", did you mean %q?", name)
+		}
+	}
+	return ""
+}
+
+func knownTypes() []string {
+	types := make([]string, 0, len(sourceTypes))
+	for typ := range sourceTypes {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func validID(id string) bool {
+	for _, r := range id {
+		if !(unicode.IsLetter(r) && !unicode.IsUpper(r)) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return id != ""
+}
+
+// checkDir describes what keeps path from being used as a source root.
+// Only a warning, since a folder on a removable or network disk may come
+// back while the server runs.
+func checkDir(dir string) string {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return fmt.Sprintf("path %q does not exist", dir)
+	}
+	if err != nil {
+		return fmt.Sprintf("path %q cannot be read: %v", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Sprintf("path %q is not a folder", dir)
+	}
+	f, err := os.Open(dir)
+	if err == nil {
+		_, err = f.Readdirnames(1)
+		f.Close()
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Sprintf("path %q cannot be read: %v", dir, err)
+	}
+	return ""
+}
+
+// overlaps returns pairs of enabled sources where the second one lives
+// inside the first, on the same disk or the same SFTP server
+func overlaps(sources []Source) [][2]int {
+	type root struct {
+		index int
+		where string
+		path  string
+	}
+	var roots []root
+	for i, src := range sources {
+		if !src.Enabled || src.Path == "" {
+			continue
+		}
+		switch src.Type {
+		case "local":
+			abs, err := filepath.Abs(src.Path)
+			if err != nil {
+				continue
+			}
+			roots = append(roots, root{i, "local", filepath.Clean(abs)})
+		case "sftp":
+			if src.SFTP != nil {
+				where := fmt.Sprintf("sftp://%s@%s:%d", src.SFTP.User, src.SFTP.Host, src.SFTP.Port)
+				roots = append(roots, root{i, where, path.Clean("/" + filepath.ToSlash(src.Path))})
+			}
+		case "s3":
+			if src.S3 != nil {
+				roots = append(roots, root{i, "s3://" + src.S3.Endpoint + "/" + src.S3.Bucket, "/" + strings.Trim(src.S3.Prefix, "/")})
+			}
+		}
+	}
+
+	var pairs [][2]int
+	for _, a := range roots {
+		for _, b := range roots {
+			if a.index == b.index || a.where != b.where {
+				continue
+			}
+			if within(a.where, b.path, a.path) && (a.path != b.path || a.index < b.index) {
+				pairs = append(pairs, [2]int{a.index, b.index})
+			}
+		}
+	}
+	return pairs
+}
+
+// within reports whether p is base or lies below it; local paths use the
+// separator of the system, remote ones slashes
+func within(where, p, base string) bool {
+	if p == base {
+		return true
+	}
+	if where != "local" {
+		return strings.HasPrefix(p, strings.TrimSuffix(base, "/")+"/")
+	}
+	rel, err := filepath.Rel(base, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// keyLine returns the line of a nested key, or 0 when it is missing
+func keyLine(root *yaml.Node, keys ...string) int {
+	node := root
+	for _, key := range keys[:len(keys)-1] {
+		node = mappingValue(node, key)
+	}
+	if node == nil || node.Kind != yaml.MappingNode {
+		return 0
+	}
+	last := keys[len(keys)-1]
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == last {
+			return node.Content[i].Line
+		}
+	}
+	return 0
+}
@@ -0,0 +1,197 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMissingPathIsAWarning(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		name     string
+		path     string
+		enabled  string
+		warnings int
+	}{
+		{"existing folder", dir, "true", 0},
+		{"missing folder", missing, "true", 1},
+		{"file", file, "true", 1},
+		{"missing and disabled", missing, "false", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte("sources:\n  - name: Media\n    path: " + tt.path + "\n    enabled: " + tt.enabled + "\n")
+			_, problems, err := load(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			warnings := 0
+			for _, p := range problems {
+				if !p.Warning {
+					t.Errorf("unexpected problem %s", p)
+				}
+				warnings++
+			}
+			if warnings != tt.warnings {
+				t.Errorf("got %d warnings, want %d: %v", warnings, tt.warnings, problems)
+			}
+			if _, err := parse(data); err != nil {
+				t.Errorf("parse failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestReloadWithMissingPath(t *testing.T) {
+	dir := t.TempDir()
+	p := useConfig(t, "sources:\n  - name: Media\n    path: "+dir+"\n")
+
+	missing := filepath.Join(dir, "unplugged")
+	if err := os.WriteFile(p, []byte("sources:\n  - name: Media\n    path: "+missing+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if got := Get().Sources[0].Path; got != missing {
+		t.Errorf("path %q, want %q", got, missing)
+	}
+
+	// Real errors still keep the previous configuration
+	if err := os.WriteFile(p, []byte("sources:\n  - name: Media\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var invalid *ValidationError
+	if err := Reload(); !errors.As(err, &invalid) {
+		t.Fatalf("got %v, want a ValidationError", err)
+	}
+	if got := Get().Sources[0].Path; got != missing {
+		t.Errorf("path %q after a failed reload, want %q", got, missing)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, typ := range []string{"local", "s3", "sftp"} {
+		RegisterSourceType(typ)
+	}
+	a, b := t.TempDir(), t.TempDir()
+	key := filepath.Join(a, "key")
+	if err := os.WriteFile(key, []byte("0123456789abcdef"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// want holds "<line>: <part of the message>" for each problem
+	tests := []struct {
+		name string
+		yaml string
+		want []string
+	}{
+		{"valid", "server:\n  port: 8080\nsources:\n  - name: A\n    path: " + a + "\n  - name: B\n    path: " + b + "\n", nil},
+		{"empty file", "", nil},
+		{"bad port", "server:\n  port: 70000\n", []string{"2: server.port must be between 1 and 65535"}},
+		{"bad log level", "server:\n  logLevel: loud\n", []string{`2: server.logLevel must be one of debug, info, warn, error, got "loud"`}},
+		{"unknown key", "server:\n  prot: 80\n", []string{`2: unknown key "server.prot"`}},
+		{"wrong case", "sources:\n  - name: A\n    path: " + a + "\n    Enabled: true\n", []string{`4: unknown key "sources.Enabled", did you mean "enabled"?`}},
+		{"no name", "sources:\n  - path: " + a + "\n", []string{"2: source #1 has no name"}},
+		{"name without id", "sources:\n  - name: '!!!'\n    path: " + a + "\n", []string{`2: source "!!!" gives an empty id`}},
+		{"bad id", "sources:\n  - name: A\n    id: Big\n    path: " + a + "\n", []string{`3: source A: id "Big" may only hold`}},
+		{"same id", "sources:\n  - name: A\n    path: " + a + "\n  - name: a\n    path: " + b + "\n",
+			[]string{`4: source a has the same id "a" as the source at line 2`}},
+		{"unknown type", "sources:\n  - name: A\n    type: ftp\n    path: " + a + "\n", []string{`3: source A: unknown type "ftp" (known: local, s3, sftp)`}},
+		{"s3 without bucket", "sources:\n  - name: A\n    type: s3\n", []string{"2: source A: s3 sources need s3.bucket"}},
+		{"sftp without host", "sources:\n  - name: A\n    type: sftp\n    path: /srv\n    sftp:\n      user: u\n",
+			[]string{"5: source A: sftp sources need sftp.host"}},
+		{"no path", "sources:\n  - name: A\n", []string{"2: source A has no path"}},
+		{"encryption without key", "sources:\n  - name: A\n    path: " + a + "\n    encryption:\n      names: true\n",
+			[]string{"4: source A: encryption needs a passphrase or a keyFile"}},
+		{"encryption with both", "sources:\n  - name: A\n    path: " + a + "\n    encryption:\n      passphrase: x\n      keyFile: " + key + "\n",
+			[]string{"4: source A: encryption takes a passphrase or a keyFile, not both"}},
+		{"missing key file", "sources:\n  - name: A\n    path: " + a + "\n    encryption:\n      keyFile: " + key + ".missing\n",
+			[]string{"4: source A: cannot read key file"}},
+		{"overlap", "sources:\n  - name: A\n    path: " + a + "\n  - name: B\n    path: " + filepath.Join(a, "sub") + "\n",
+			[]string{"5: source B lies inside source A (line 3)"}},
+		{"same s3 bucket and prefix", "sources:\n  - name: A\n    type: s3\n    s3:\n      bucket: x\n  - name: B\n    type: s3\n    s3:\n      bucket: x\n      prefix: sub/\n",
+			[]string{"6: source B lies inside source A"}},
+		{"access rules", "sources:\n  - name: A\n    path: " + a + "\naccess:\n  rules:\n" +
+			"    - source: A\n      users: [bob]\n      permissions: [read, ALL]\n" +
+			"    - source: '*'\n      groups: [family]\n" +
+			"    - source: b\n      users: [bob]\n" +
+			"    - users: [bob]\n" +
+			"    - source: a\n      permissions: [execute]\n",
+			[]string{`11: access rule #3: unknown source "b"`, "13: access rule #4 has no source",
+				"14: access rule #5 needs users or groups", `15: access rule #5: unknown permission "execute"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, problems, err := load([]byte(tt.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []Problem
+			for _, p := range problems {
+				if !p.Warning {
+					got = append(got, p)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d problems, want %d: %v", len(got), len(tt.want), got)
+			}
+			for i, p := range got {
+				if s := fmt.Sprintf("%d: %s", p.Line, p.Message); !strings.HasPrefix(s, tt.want[i]) {
+					t.Errorf("problem %q, want %q", s, tt.want[i])
+				}
+			}
+			if _, err := parse([]byte(tt.yaml)); (err == nil) != (len(tt.want) == 0) {
+				t.Errorf("parse error %v with %d problems", err, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestEnvironmentProblems(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		env  map[string]string
+		want []string
+	}{
+		{"port", map[string]string{"ZXFB_PORT": "http"}, []string{`ZXFB_PORT: "http" is not a port number`}},
+		{"log level", map[string]string{"ZXFB_LOG_LEVEL": "loud"}, []string{"ZXFB_LOG_LEVEL: server.logLevel must be one of"}},
+		{"source number", map[string]string{"ZXFB_SOURCE_X_NAME": "A"}, []string{"ZXFB_SOURCE_X_NAME: expected ZXFB_SOURCE_<n>_<SETTING>"}},
+		{"unknown setting", map[string]string{"ZXFB_SOURCE_1_NAME": "A", "ZXFB_SOURCE_1_PATH": dir, "ZXFB_SOURCE_1_COLOR": "red"},
+			[]string{"ZXFB_SOURCE_1_COLOR: unknown setting"}},
+		{"not a number", map[string]string{"ZXFB_SOURCE_1_NAME": "A", "ZXFB_SOURCE_1_PATH": dir, "ZXFB_SOURCE_1_VERSIONING_MAX_VERSIONS": "many"},
+			[]string{`ZXFB_SOURCE_1_VERSIONING_MAX_VERSIONS: "many" is not a number`}},
+		{"source without path", map[string]string{"ZXFB_SOURCE_1_NAME": "A"}, []string{"ZXFB_SOURCE_1: source A has no path"}},
+		{"valid source", map[string]string{"ZXFB_SOURCE_1_NAME": "A", "ZXFB_SOURCE_1_PATH": dir}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, problems, err := load(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(problems) != len(tt.want) {
+				t.Fatalf("got %d problems, want %d: %v", len(problems), len(tt.want), problems)
+			}
+			for i, p := range problems {
+				if s := p.String(); !strings.HasPrefix(s, tt.want[i]) {
+					t.Errorf("problem %q, want %q", s, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"filemanager/utils"
+)
+
+// settle is how long the file has to stay quiet before it is read again,
+// editors often save in several steps
+const settle = 500 * time.Millisecond
+
+// Watch reloads the configuration whenever the file changes or the
+// process gets SIGHUP. A file that fails to load is reported and the
+// running configuration stays active.
+func Watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// The folder is watched rather than the file, since saving often
+	// replaces the file with a new one
+	var changes <-chan fsnotify.Event
+	fsw, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = fsw.Add(filepath.Dir(Path))
+	}
+	if err != nil {
+		utils.Warnf("⚠️  Cannot watch %s, reload with SIGHUP: %v", Path, err)
+	} else {
+		changes = fsw.Events
+	}
+	name := filepath.Clean(Path)
+
+	go func() {
+		var timer <-chan time.Time
+		for {
+			select {
+			case <-hup:
+				reload("SIGHUP")
+			case ev := <-changes:
+				if filepath.Clean(ev.Name) == name && ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					timer = time.After(settle)
+				}
+			case <-timer:
+				timer = nil
+				reload("file change")
+			}
+		}
+	}()
+}
+
+func reload(reason string) {
+	if err := Reload(); err != nil {
+		utils.Errorf("❌ Config reload after %s failed, keeping the running config: %v", reason, err)
+	}
+}
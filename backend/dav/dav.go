@@ -0,0 +1,56 @@
+// Package dav serves the configured sources over WebDAV, so they can be
+// mounted as network drives
+package dav
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/webdav"
+
+	"filemanager/acl"
+	"filemanager/storage"
+	"filemanager/utils"
+)
+
+// Prefix is where the sources are served, each below /dav/<source id>/
+const Prefix = "/dav/"
+
+var (
+	mu    sync.Mutex
+	locks = map[string]webdav.LockSystem{}
+)
+
+// lockSystem returns the locks of a source, shared by all its clients
+func lockSystem(sourceID string) webdav.LockSystem {
+	mu.Lock()
+	defer mu.Unlock()
+
+	ls, ok := locks[sourceID]
+	if !ok {
+		ls = webdav.NewMemLS()
+		locks[sourceID] = ls
+	}
+	return ls
+}
+
+// Handler builds the WebDAV handler for one request against a source
+func Handler(sourceID string, drv storage.Driver, user acl.Identity, r *http.Request) http.Handler {
+	fsys := &FileSystem{SourceID: sourceID, Driver: drv, User: user, ContentLength: -1}
+	if r.Method == http.MethodPut {
+		fsys.ContentLength = r.ContentLength
+	}
+
+	return &webdav.Handler{
+		Prefix:     Prefix + sourceID,
+		FileSystem: fsys,
+		LockSystem: lockSystem(sourceID),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				utils.Warnf("⚠️  WebDAV %s %s (%s): %v", r.Method, r.URL.Path, user.Username, err)
+			}
+		},
+	}
+}
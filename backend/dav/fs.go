@@ -0,0 +1,338 @@
+package dav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"filemanager/acl"
+	"filemanager/events"
+	"filemanager/storage"
+	"filemanager/trash"
+	"filemanager/uploads"
+)
+
+// FileSystem exposes one source to the WebDAV handler as the given user.
+// Every call goes through the same path checks and access rules as the
+// JSON API; reserved and half-uploaded entries do not exist for it.
+type FileSystem struct {
+	SourceID string
+	Driver   storage.Driver
+	User     acl.Identity
+
+	// ContentLength is the size a PUT announced, -1 when unknown. A write
+	// that ends short of it is discarded instead of replacing the file.
+	ContentLength int64
+}
+
+func (f *FileSystem) allowed(name string, perm acl.Permission) bool {
+	return acl.Allowed(f.User, f.SourceID, name, perm)
+}
+
+// resolve cleans a request path and hides what clients must not see
+func (f *FileSystem) resolve(op, name string) (string, error) {
+	name = storage.CleanPath(name)
+	if storage.IsReserved(name) || uploads.IsTemp(name) || !acl.Visible(f.User, f.SourceID, name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return name, nil
+}
+
+func denied(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+}
+
+func (f *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name, err := f.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.Driver.Stat(name)
+}
+
+func (f *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name, err := f.resolve("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if !f.allowed(name, acl.Write) {
+		return denied("mkdir", name)
+	}
+
+	// MKCOL neither creates parents nor succeeds on existing items
+	if _, err := f.Driver.Stat(name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if info, err := f.Driver.Stat(path.Dir(name)); err != nil || !info.IsDir() {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if err := f.Driver.MkdirAll(name); err != nil {
+		return err
+	}
+	events.Publish(events.Event{Type: events.Create, Source: f.SourceID, Path: name})
+	return nil
+}
+
+func (f *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return f.create(name, flag)
+	}
+
+	name, err := f.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Driver.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	readable := f.allowed(name, acl.Read)
+	if info.IsDir() {
+		// Opening is needed to describe the folder itself; listing it
+		// needs read access or a grant further down
+		listable := readable || acl.CanTraverse(f.User, f.SourceID, name)
+		return &dir{fs: f, name: name, info: info, readable: readable, listable: listable}, nil
+	}
+	if !readable {
+		return nil, denied("open", name)
+	}
+
+	file, err := f.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readFile{File: file}, nil
+}
+
+// create opens name for writing. The data goes to a temporary file that
+// replaces name only once it was written completely.
+func (f *FileSystem) create(name string, flag int) (webdav.File, error) {
+	name = storage.CleanPath(name)
+	if storage.IsReserved(name) || uploads.IsTemp(name) || !f.allowed(name, acl.Write) {
+		return nil, denied("open", name)
+	}
+	if flag&os.O_APPEND != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+	}
+
+	info, err := f.Driver.Stat(name)
+	switch {
+	case err == nil && info.IsDir():
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a folder")}
+	case errors.Is(err, fs.ErrNotExist) && flag&os.O_CREATE == 0:
+		return nil, err
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+	existed := err == nil
+
+	// Like MKCOL, PUT does not create missing parents
+	if parent, err := f.Driver.Stat(path.Dir(name)); err != nil || !parent.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	tmp := uploads.TempPath(name)
+	w, err := f.Driver.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	return &writeFile{fs: f, name: name, tmp: tmp, w: w, existed: existed}, nil
+}
+
+func (f *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	name, err := f.resolve("remove", name)
+	if err != nil {
+		return err
+	}
+	if name == "/" || !f.allowed(name, acl.Delete) {
+		return denied("remove", name)
+	}
+	if _, err := f.Driver.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	// Deletes go to the trash, as they do from the web interface
+	if _, err := trash.Move(f.Driver, name, f.User.Username); err != nil {
+		return err
+	}
+	events.Publish(events.Event{Type: events.Delete, Source: f.SourceID, Path: name})
+	return nil
+}
+
+func (f *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, err := f.resolve("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newName = storage.CleanPath(newName)
+	if oldName == "/" || storage.IsReserved(newName) || uploads.IsTemp(newName) {
+		return denied("rename", newName)
+	}
+	if !f.allowed(oldName, acl.Read) || !f.allowed(oldName, acl.Delete) || !f.allowed(newName, acl.Write) {
+		return denied("rename", oldName)
+	}
+
+	if err := f.Driver.Rename(oldName, newName); err != nil {
+		return err
+	}
+	events.Publish(events.Event{Type: events.Rename, Source: f.SourceID, Path: newName, OldPath: oldName})
+	return nil
+}
+
+// readFile is a file opened for reading
+type readFile struct {
+	storage.File
+}
+
+func (f *readFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, fmt.Errorf("not a folder")
+}
+
+func (f *readFile) Write(p []byte) (int, error) {
+	return 0, fs.ErrPermission
+}
+
+// dir lists a folder, leaving out what the user may not see
+type dir struct {
+	fs       *FileSystem
+	name     string
+	info     fs.FileInfo
+	readable bool
+	listable bool
+
+	entries []fs.FileInfo
+	loaded  bool
+}
+
+func (d *dir) load() error {
+	if d.loaded {
+		return nil
+	}
+	if !d.listable {
+		return denied("readdir", d.name)
+	}
+	entries, err := d.fs.Driver.ReadDir(d.name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		child := path.Join(d.name, entry.Name())
+		if storage.IsReserved(child) || uploads.IsTemp(child) {
+			continue
+		}
+		if !d.readable && !acl.Visible(d.fs.User, d.fs.SourceID, child) {
+			continue
+		}
+		d.entries = append(d.entries, entry)
+	}
+	d.loaded = true
+	return nil
+}
+
+func (d *dir) Readdir(count int) ([]fs.FileInfo, error) {
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *dir) Stat() (fs.FileInfo, error)                   { return d.info, nil }
+func (d *dir) Read(p []byte) (int, error)                   { return 0, fmt.Errorf("is a folder") }
+func (d *dir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (d *dir) Write(p []byte) (int, error)                  { return 0, fs.ErrPermission }
+func (d *dir) Close() error                                 { return nil }
+
+// writeFile collects a PUT or COPY into a temporary file and puts it in
+// place when it is closed
+type writeFile struct {
+	fs      *FileSystem
+	name    string
+	tmp     string
+	w       io.WriteCloser
+	n       int64
+	err     error
+	existed bool
+}
+
+func (f *writeFile) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.n += int64(n)
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	return n, err
+}
+
+func (f *writeFile) Close() error {
+	err := f.err
+	if err == nil && f.fs.ContentLength >= 0 && f.n != f.fs.ContentLength {
+		err = fmt.Errorf("received %d of %d bytes", f.n, f.fs.ContentLength)
+	}
+	if err == nil {
+		err = storage.Sync(f.w)
+	}
+	if err != nil {
+		storage.Abort(f.w)
+		f.fs.Driver.RemoveAll(f.tmp)
+		return err
+	}
+	if err := f.w.Close(); err != nil {
+		f.fs.Driver.RemoveAll(f.tmp)
+		return err
+	}
+
+	if _, err := uploads.Place(f.fs.Driver, f.fs.SourceID, f.tmp, f.name, uploads.Replace); err != nil {
+		f.fs.Driver.RemoveAll(f.tmp)
+		return err
+	}
+
+	typ := events.Create
+	if f.existed {
+		typ = events.Modify
+	}
+	events.Publish(events.Event{Type: typ, Source: f.fs.SourceID, Path: f.name})
+	return nil
+}
+
+// Stat describes the file as written so far; the handler asks for it
+// before closing to build the ETag
+func (f *writeFile) Stat() (fs.FileInfo, error) {
+	return &fileInfo{name: path.Base(f.name), size: f.n, modTime: time.Now()}, nil
+}
+
+func (f *writeFile) Read(p []byte) (int, error)                   { return 0, fs.ErrPermission }
+func (f *writeFile) Seek(offset int64, whence int) (int64, error) { return 0, fs.ErrPermission }
+func (f *writeFile) Readdir(count int) ([]fs.FileInfo, error)     { return nil, fmt.Errorf("not a folder") }
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return 0644 }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return false }
+func (fi *fileInfo) Sys() interface{}   { return nil }
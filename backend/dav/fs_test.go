@@ -0,0 +1,131 @@
+package dav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filemanager/acl"
+	"filemanager/config"
+	"filemanager/storage"
+)
+
+func newSource(t *testing.T) (string, storage.Driver) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, body := range map[string]string{
+		"a.txt":                       "first",
+		".zxupload-0123456789abcdef":  "half",
+		".zxfilebrowser/trash/x.json": "{}",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	drv, err := storage.NewLocal(config.Source{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, drv
+}
+
+func TestHandler(t *testing.T) {
+	dir, drv := newSource(t)
+	user := acl.Identity{Username: "alice"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Handler("files", drv, user, r).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header map[string]string
+		code   int
+		has    []string
+		hasNot []string
+	}{
+		{"listing hides temporary and reserved entries", "PROPFIND", "/", map[string]string{"Depth": "1"},
+			http.StatusMultiStatus, []string{"a.txt"}, []string{".zxupload-", ".zxfilebrowser"}},
+		{"half uploaded file does not exist", http.MethodGet, "/.zxupload-0123456789abcdef", nil,
+			http.StatusNotFound, nil, nil},
+		{"reserved folder does not exist", "PROPFIND", "/.zxfilebrowser/", map[string]string{"Depth": "1"},
+			http.StatusNotFound, nil, nil},
+		{"no moving into the reserved folder", "MOVE", "/a.txt", map[string]string{"Destination": "/dav/files/.zxfilebrowser/a.txt"},
+			http.StatusForbidden, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+Prefix+"files"+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.header {
+				if k == "Destination" {
+					v = srv.URL + v
+				}
+				req.Header.Set(k, v)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+
+			if res.StatusCode != tt.code {
+				t.Fatalf("answered %d, want %d: %s", res.StatusCode, tt.code, body)
+			}
+			for _, s := range tt.has {
+				if !strings.Contains(string(body), s) {
+					t.Errorf("answer misses %q", s)
+				}
+			}
+			for _, s := range tt.hasNot {
+				if strings.Contains(string(body), s) {
+					t.Errorf("answer shows %q", s)
+				}
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Errorf("a.txt is gone: %v", err)
+	}
+}
+
+func TestShortWriteIsDiscarded(t *testing.T) {
+	dir, drv := newSource(t)
+	fsys := &FileSystem{SourceID: "files", Driver: drv, User: acl.Identity{Username: "alice"}, ContentLength: 10}
+
+	f, err := fsys.OpenFile(context.Background(), "/a.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("short")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err == nil {
+		t.Fatal("a write short of the announced length was accepted")
+	}
+
+	if b, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(b) != "first" {
+		t.Errorf("a.txt holds %q, want the old content", b)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".zxupload-") && e.Name() != ".zxupload-0123456789abcdef" {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package events
+
+import (
+	"path"
+	"sync"
+	"time"
+)
+
+// Type is the kind of change an event reports
+type Type string
+
+const (
+	Create Type = "create"
+	Modify Type = "modify"
+	Delete Type = "delete"
+	Rename Type = "rename"
+)
+
+// echoWindow is how long a change published by the server itself hides the
+// same change coming back from a file system watcher
+const echoWindow = 2 * time.Second
+
+// Event describes a change to an item inside a source. Renames carry the
+// previous path in OldPath.
+type Event struct {
+	Type    Type      `json:"type"`
+	Source  string    `json:"source"`
+	Path    string    `json:"path"`
+	OldPath string    `json:"oldPath,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Subscription receives the changes to the direct children of one folder
+type Subscription struct {
+	C      <-chan Event
+	ch     chan Event
+	source string
+	dir    string
+}
+
+var (
+	mu        sync.Mutex
+	subs      = map[*Subscription]struct{}{}
+	recent    = map[string]time.Time{}
+	listeners []func(Event)
+)
+
+// Listen calls fn with every change of every source, both the ones made
+// through the server and the ones seen by watchers. fn must not block.
+func Listen(fn func(Event)) {
+	mu.Lock()
+	listeners = append(listeners, fn)
+	mu.Unlock()
+}
+
+// Subscribe starts delivering changes inside dir of a source. Local
+// sources are also watched for changes made outside the server.
+func Subscribe(source, dir string) *Subscription {
+	ch := make(chan Event, 64)
+	s := &Subscription{C: ch, ch: ch, source: source, dir: dir}
+
+	mu.Lock()
+	subs[s] = struct{}{}
+	mu.Unlock()
+
+	watch(source, dir)
+	return s
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	mu.Lock()
+	delete(subs, s)
+	mu.Unlock()
+
+	unwatch(s.source, s.dir)
+}
+
+func (s *Subscription) wants(ev Event) bool {
+	if s.source != ev.Source {
+		return false
+	}
+	return ev.Path == s.dir || path.Dir(ev.Path) == s.dir ||
+		(ev.OldPath != "" && path.Dir(ev.OldPath) == s.dir)
+}
+
+// Publish sends out a change made through the server right away
+func Publish(ev Event) {
+	ev.Time = time.Now()
+
+	mu.Lock()
+	for key, t := range recent {
+		if ev.Time.Sub(t) > echoWindow {
+			delete(recent, key)
+		}
+	}
+	recent[ev.Source+":"+ev.Path] = ev.Time
+	if ev.OldPath != "" {
+		recent[ev.Source+":"+ev.OldPath] = ev.Time
+	}
+	mu.Unlock()
+
+	deliver(ev)
+}
+
+// publishWatched sends out a change seen by a watcher, unless the server
+// already reported it
+func publishWatched(ev Event) {
+	ev.Time = time.Now()
+
+	mu.Lock()
+	t, ok := recent[ev.Source+":"+ev.Path]
+	mu.Unlock()
+
+	if ok && ev.Time.Sub(t) < echoWindow {
+		return
+	}
+	deliver(ev)
+}
+
+func deliver(ev Event) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(ev)
+	}
+	for s := range subs {
+		if !s.wants(ev) {
+			continue
+		}
+		// A client that does not keep up loses events rather than
+		// blocking everyone else
+		select {
+		case s.ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package events
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+
+	"filemanager/storage"
+	"filemanager/utils"
+)
+
+// watcher follows the subscribed folders of one local source
+type watcher struct {
+	fsw    *fsnotify.Watcher
+	source string
+	root   string
+	refs   map[string]int
+}
+
+var (
+	watchMu  sync.Mutex
+	watchers = map[string]*watcher{}
+)
+
+// ErrNotWatchable is returned by Watch for sources that are not on a local disk
+var ErrNotWatchable = errors.New("source cannot be watched")
+
+// Watch follows dir of a local source without a subscription, so that
+// changes made outside the server reach the listeners. Every call needs a
+// matching Unwatch.
+func Watch(source, dir string) error {
+	return add(source, dir)
+}
+
+// Unwatch stops following a folder added with Watch
+func Unwatch(source, dir string) {
+	unwatch(source, dir)
+}
+
+// watch adds dir of a local source to its watcher. Other backends cannot be
+// watched and only report the changes made through the server.
+func watch(source, dir string) {
+	if err := add(source, dir); err != nil && !errors.Is(err, ErrNotWatchable) {
+		utils.Warnf("⚠️  Cannot watch %s%s: %v", source, dir, err)
+	}
+}
+
+func add(source, dir string) error {
+	drv, err := storage.Get(source)
+	if err != nil {
+		return err
+	}
+	local, ok := drv.(*storage.Local)
+	if !ok {
+		return ErrNotWatchable
+	}
+
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	w := watchers[source]
+	if w == nil {
+		root, err := filepath.Abs(local.Root())
+		if err != nil {
+			return err
+		}
+		fsw, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		w = &watcher{fsw: fsw, source: source, root: root, refs: map[string]int{}}
+		watchers[source] = w
+		go w.run()
+	}
+
+	w.refs[dir]++
+	if w.refs[dir] > 1 {
+		return nil
+	}
+	if err := w.fsw.Add(filepath.Join(w.root, filepath.FromSlash(dir))); err != nil {
+		w.refs[dir]--
+		if w.refs[dir] == 0 {
+			delete(w.refs, dir)
+		}
+		if len(w.refs) == 0 {
+			w.fsw.Close()
+			delete(watchers, source)
+		}
+		return err
+	}
+	return nil
+}
+
+func unwatch(source, dir string) {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	w := watchers[source]
+	if w == nil || w.refs[dir] == 0 {
+		return
+	}
+
+	w.refs[dir]--
+	if w.refs[dir] > 0 {
+		return
+	}
+	delete(w.refs, dir)
+	// Fails when the folder is gone already, which is fine
+	w.fsw.Remove(filepath.Join(w.root, filepath.FromSlash(dir)))
+
+	if len(w.refs) == 0 {
+		w.fsw.Close()
+		delete(watchers, source)
+	}
+}
+
+func (w *watcher) run() {
+	for {
+		select {
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			w.handle(ev)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			utils.Warnf("⚠️  Watcher error on %s: %v", w.source, err)
+		}
+	}
+}
+
+func (w *watcher) handle(ev fsnotify.Event) {
+	rel, err := filepath.Rel(w.root, ev.Name)
+	if err != nil {
+		return
+	}
+	name := storage.CleanPath(filepath.ToSlash(rel))
+	if storage.IsReserved(name) {
+		return
+	}
+
+	var typ Type
+	switch {
+	case ev.Has(fsnotify.Create):
+		typ = Create
+	case ev.Has(fsnotify.Remove):
+		typ = Delete
+	case ev.Has(fsnotify.Rename):
+		// The watcher only sees the old name, the new one follows as a
+		// create when it lands in a watched folder
+		typ = Rename
+	case ev.Has(fsnotify.Write):
+		typ = Modify
+	default:
+		return
+	}
+
+	publishWatched(Event{Type: typ, Source: w.source, Path: name})
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"filemanager/acl"
+	"filemanager/auth"
+	"filemanager/config"
+	"filemanager/utils"
+)
+
+// caller returns the identity of the signed in user
+func caller(r *http.Request) acl.Identity {
+	return acl.For(auth.CurrentUser(r))
+}
+
+// can reports whether the caller holds perm on a path inside a source
+func can(r *http.Request, sourceID, name string, perm acl.Permission) bool {
+	return acl.Allowed(caller(r), sourceID, name, perm)
+}
+
+// defaultSource returns the first enabled source visible to the caller
+func defaultSource(r *http.Request) string {
+	id := caller(r)
+	for _, src := range config.GetEnabledSources() {
+		if acl.CanSeeSource(id, src.ID) {
+			return src.ID
+		}
+	}
+	return ""
+}
+
+func sendForbidden(w http.ResponseWriter) {
+	utils.SendJSON(w, http.StatusForbidden, utils.Response{Success: false, Message: "Permission denied"})
+}
+
+// Reload access rules from config.yaml. The whole file is read and checked
+// again, so the rules in use always match config.Get().
+func ReloadAccess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	var invalid *config.ValidationError
+	if err := config.Reload(); errors.As(err, &invalid) {
+		sendInvalidConfig(w, invalid)
+		return
+	} else if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Failed to reload access rules: " + err.Error()})
+		return
+	}
+
+	utils.Infof("🔐 Access rules reloaded by %s", auth.CurrentUser(r).Username)
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Access rules reloaded"})
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"filemanager/acl"
+	"filemanager/config"
+)
+
+func TestReloadAccess(t *testing.T) {
+	original, err := os.ReadFile(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.WriteFile(config.Path, original, 0600)
+		config.Reload()
+	})
+
+	steps := []struct {
+		name   string
+		access string
+		code   int
+		// whether bob may read and write afterwards
+		read, write bool
+	}{
+		{"read only", "access:\n  rules:\n    - source: files\n      users: [bob]\n      permissions: [read]\n", http.StatusOK, true, false},
+		{"unknown source", "access:\n  rules:\n    - source: fils\n      users: [bob]\n      permissions: [all]\n", http.StatusBadRequest, true, false},
+		{"unknown permission", "access:\n  rules:\n    - source: files\n      users: [bob]\n      permissions: [rwx]\n", http.StatusBadRequest, true, false},
+		{"read and write", "access:\n  rules:\n    - source: files\n      users: [bob]\n      permissions: [read, write]\n", http.StatusOK, true, true},
+		{"section removed", "", http.StatusOK, true, true},
+	}
+	for _, st := range steps {
+		if err := os.WriteFile(config.Path, append(append([]byte{}, original...), st.access...), 0600); err != nil {
+			t.Fatal(err)
+		}
+		w := call(t, "alice", ReloadAccess, http.MethodPost, "/api/admin/access/reload", nil)
+		if w.Code != st.code {
+			t.Fatalf("%s: answered %d, want %d: %s", st.name, w.Code, st.code, w.Body)
+		}
+
+		bob := acl.Identity{Username: "bob"}
+		if got := acl.Allowed(bob, "files", "/a.txt", acl.Read); got != st.read {
+			t.Errorf("%s: read %v, want %v", st.name, got, st.read)
+		}
+		if got := acl.Allowed(bob, "files", "/a.txt", acl.Write); got != st.write {
+			t.Errorf("%s: write %v, want %v", st.name, got, st.write)
+		}
+		// The rules in use are the ones of the active configuration
+		if (config.Get().Access == nil) != (st.access == "" && st.code == http.StatusOK) {
+			t.Errorf("%s: active access section %+v", st.name, config.Get().Access)
+		}
+	}
+}
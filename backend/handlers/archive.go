@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"filemanager/acl"
+	"filemanager/archive"
+	"filemanager/jobs"
+	"filemanager/storage"
+	"filemanager/utils"
+)
+
+// Download folders or several items as one zip or tar.gz, streamed while
+// it is being built. Paths come as repeated path parameters, either in the
+// query string or a form body.
+func DownloadArchive(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	sourceID := r.Form.Get("source")
+	paths := r.Form["path"]
+	if sourceID == "" || len(paths) == 0 {
+		http.Error(w, "Missing parameters", http.StatusBadRequest)
+		return
+	}
+
+	format, err := archive.ParseFormat(r.Form.Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	level := archive.DefaultLevel
+	if s := r.Form.Get("level"); s != "" {
+		if level, err = strconv.Atoi(s); err != nil || level < 0 || level > 9 {
+			http.Error(w, "Compression level must be between 0 and 9", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Check every entry before anything is sent
+	drivers := make([]storage.Driver, 0, len(paths))
+	names := make([]string, 0, len(paths))
+	inner := make([]string, 0, len(paths))
+	for _, p := range paths {
+		d, name, err := storage.Resolve(sourceID, strings.ReplaceAll(p, "\\", "/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !can(r, sourceID, name, acl.Read) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		d, in, err := browse(d, sourceID, name, false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := d.Stat(in); err != nil {
+			http.Error(w, "File not found: "+p, http.StatusNotFound)
+			return
+		}
+		drivers = append(drivers, d)
+		names = append(names, name)
+		inner = append(inner, in)
+	}
+
+	aw, err := archive.NewWriter(w, format, level)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fileName := archiveName(sourceID, names) + format.Ext()
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	utils.Infof("Downloading archive: %s (%d items)", fileName, len(names))
+
+	entries := archive.EntryNames(sourceID, names)
+	for i, name := range names {
+		if err := archive.AddTree(aw, drivers[i], inner[i], entries[i]); err != nil {
+			// Headers are out already; break the connection so the client
+			// does not mistake a truncated archive for a complete one
+			utils.Errorf("❌ Archive download failed at %s: %v", name, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	if err := aw.Close(); err != nil {
+		utils.Errorf("❌ Archive download failed: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// browse resolves paths that lead into an archive to a read-only view of
+// it. With into set, an archive itself is opened as a folder.
+func browse(drv storage.Driver, sourceID, name string, into bool) (storage.Driver, string, error) {
+	if into {
+		if info, err := drv.Stat(name); err == nil && archive.Browsable(name, info) {
+			v, err := archive.Open(drv, sourceID, name)
+			return v, "/", err
+		}
+	}
+	return archive.Browse(drv, sourceID, name)
+}
+
+// archiveName names the download after the single item, or after the
+// folder the items were picked from
+func archiveName(sourceID string, names []string) string {
+	name := names[0]
+	if len(names) > 1 {
+		name = path.Dir(name)
+	}
+	if name == "/" {
+		return sourceID
+	}
+	return path.Base(name)
+}
+
+// Unpack an archive of a source into a new folder next to it, or into the
+// folder named by destination
+func ExtractArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		Source      string `json:"source"`
+		Path        string `json:"path"`
+		Destination string `json:"destination"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid request"})
+		return
+	}
+
+	drv, name, err := storage.Resolve(req.Source, req.Path)
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	_, base, err := archive.Detect(name)
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	dst := base
+	if req.Destination != "" {
+		if _, dst, err = storage.Resolve(req.Source, req.Destination); err != nil {
+			utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: err.Error()})
+			return
+		}
+	}
+	if dst == "/" {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid destination"})
+		return
+	}
+
+	params := jobs.Params{SourceID: req.Source, SourcePath: name, Destination: dst}
+	if !allowedJob(r, jobs.Extract, params) {
+		denyJob(w, r, jobs.Extract, params)
+		return
+	}
+
+	info, err := drv.Stat(name)
+	if err != nil {
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: "Archive not found"})
+		return
+	}
+	if info.IsDir() {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Not an archive"})
+		return
+	}
+
+	submitJob(w, r, jobs.Extract, params)
+}
+
+// Pack items of a source into an archive inside the same source. Without a
+// destination the archive is put next to the items.
+func CompressItems(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		Source      string   `json:"source"`
+		Paths       []string `json:"paths"`
+		Destination string   `json:"destination"`
+		Format      string   `json:"format"`
+		Level       *int     `json:"level"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Paths) == 0 {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid request"})
+		return
+	}
+
+	format, err := archive.ParseFormat(req.Format)
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	level := archive.DefaultLevel
+	if req.Level != nil {
+		if level = *req.Level; level < 0 || level > 9 {
+			utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Compression level must be between 0 and 9"})
+			return
+		}
+	}
+
+	var drv storage.Driver
+	names := make([]string, 0, len(req.Paths))
+	for _, p := range req.Paths {
+		d, name, err := storage.Resolve(req.Source, p)
+		if err != nil {
+			utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: err.Error()})
+			return
+		}
+		drv = d
+		names = append(names, name)
+	}
+
+	dst := path.Join(path.Dir(names[0]), archiveName(req.Source, names)+format.Ext())
+	if req.Destination != "" {
+		if _, dst, err = storage.Resolve(req.Source, req.Destination); err != nil || dst == "/" {
+			utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid destination"})
+			return
+		}
+		if !strings.HasSuffix(strings.ToLower(dst), format.Ext()) {
+			dst += format.Ext()
+		}
+	}
+
+	params := jobs.Params{SourceID: req.Source, Paths: names, Destination: dst, Format: string(format), Level: level}
+	if !allowedJob(r, jobs.Compress, params) {
+		denyJob(w, r, jobs.Compress, params)
+		return
+	}
+
+	for _, name := range names {
+		if _, err := drv.Stat(name); err != nil {
+			utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: "Item not found: " + name})
+			return
+		}
+	}
+
+	submitJob(w, r, jobs.Compress, params)
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"filemanager/audit"
+	"filemanager/auth"
+	"filemanager/storage"
+	"filemanager/utils"
+)
+
+// errDenied marks an operation the access rules refused
+var errDenied = errors.New("permission denied")
+
+// maxAuditResults caps the entries one query returns
+const maxAuditResults = 1000
+
+// clientIP returns the address a request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// record writes an operation of the caller to the audit log, taking the
+// outcome from err unless the entry already has one
+func record(r *http.Request, e audit.Entry, err error) {
+	if user := auth.CurrentUser(r); user != nil && e.User == "" {
+		e.User = user.Username
+	}
+	e.IP = clientIP(r)
+	switch {
+	case errors.Is(err, errDenied):
+		e.Outcome = audit.Denied
+	case err != nil:
+		e.Outcome, e.Error = audit.Failure, err.Error()
+	case e.Outcome == "":
+		e.Outcome = audit.Success
+	}
+	audit.Record(e)
+}
+
+// sendDenied records a refused operation and answers with 403
+func sendDenied(w http.ResponseWriter, r *http.Request, e audit.Entry) {
+	record(r, e, errDenied)
+	sendForbidden(w)
+}
+
+// Query the audit log. Filters: user, source, path (prefix), op, from and
+// to (RFC 3339) and limit (default 100).
+func QueryAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	q := r.URL.Query()
+	filter := audit.Filter{
+		User:   q.Get("user"),
+		Source: q.Get("source"),
+		Op:     q.Get("op"),
+		Limit:  100,
+	}
+	if p := q.Get("path"); p != "" {
+		filter.Path = storage.CleanPath(p)
+	}
+
+	var err error
+	if from := q.Get("from"); from != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, from); err != nil {
+			utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid from time"})
+			return
+		}
+	}
+	if to := q.Get("to"); to != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, to); err != nil {
+			utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid to time"})
+			return
+		}
+	}
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid limit"})
+			return
+		}
+		filter.Limit = min(n, maxAuditResults)
+	}
+
+	entries, err := audit.Query(filter)
+	if err != nil {
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to read audit log"})
+		return
+	}
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Data: entries})
+}
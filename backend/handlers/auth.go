@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"filemanager/auth"
+	"filemanager/utils"
+)
+
+// Sign in and start a session
+func Login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid request"})
+		return
+	}
+
+	user, ok := auth.Users.Verify(req.Username, req.Password)
+	if !ok {
+		utils.Warnf("🔒 Failed login for %q from %s", req.Username, r.RemoteAddr)
+		utils.SendJSON(w, http.StatusUnauthorized, utils.Response{Success: false, Message: "Invalid username or password"})
+		return
+	}
+
+	sess, err := auth.NewSession(user.Username)
+	if err != nil {
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to create session"})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.CookieName,
+		Value:    sess.Token,
+		Path:     "/",
+		Expires:  sess.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	utils.Infof("🔓 %s logged in", user.Username)
+	utils.SendJSON(w, http.StatusOK, utils.Response{
+		Success: true,
+		Message: "Logged in",
+		Data: map[string]interface{}{
+			"username": user.Username,
+			"admin":    user.Admin,
+			"token":    sess.Token,
+			"expires":  sess.Expires,
+		},
+	})
+}
+
+// End the current session
+func Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	auth.EndSession(auth.TokenFromRequest(r))
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Logged out"})
+}
+
+// Return the signed in user
+func GetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	user := auth.CurrentUser(r)
+	utils.SendJSON(w, http.StatusOK, utils.Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"username": user.Username,
+			"admin":    user.Admin,
+		},
+	})
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"filemanager/acl"
+	"filemanager/audit"
+	"filemanager/dav"
+	"filemanager/storage"
+)
+
+// Serve a source over WebDAV at /dav/<source id>/. The file system behind
+// the handler enforces the access rules on every item; the checks here only
+// answer plain requests with 403 where the WebDAV library would say 404.
+func WebDAV(w http.ResponseWriter, r *http.Request) {
+	sourceID, inner, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, dav.Prefix), "/")
+	if sourceID == "" || !acl.CanSeeSource(caller(r), sourceID) {
+		http.Error(w, "Source not found", http.StatusNotFound)
+		return
+	}
+
+	drv, err := storage.Get(sourceID)
+	if err != nil {
+		http.Error(w, "Source not found", http.StatusNotFound)
+		return
+	}
+
+	name := storage.CleanPath(inner)
+	if storage.IsReserved(name) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	op, audited := davOps[r.Method]
+	entry := audit.Entry{Op: op, Source: sourceID, Path: name}
+	if dst, ok := davDestination(r, sourceID); ok {
+		entry.Dest = dst
+	}
+
+	if !davAllowed(r, sourceID, name) {
+		if audited {
+			record(r, entry, errDenied)
+		}
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	if !audited {
+		dav.Handler(sourceID, drv, caller(r), r).ServeHTTP(w, r)
+		return
+	}
+
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	dav.Handler(sourceID, drv, caller(r), r).ServeHTTP(sw, r)
+	switch {
+	case sw.status == http.StatusForbidden:
+		err = errDenied
+	case sw.status >= 300:
+		err = errors.New(http.StatusText(sw.status))
+	}
+	record(r, entry, err)
+}
+
+// davOps names the WebDAV methods that change files in the audit log
+var davOps = map[string]string{
+	http.MethodPut:    "upload",
+	http.MethodDelete: "delete",
+	"MKCOL":           "mkdir",
+	"COPY":            "copy",
+	"MOVE":            "move",
+}
+
+// davDestination returns the target of a COPY or MOVE inside the source
+func davDestination(r *http.Request, sourceID string) (string, bool) {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || u.Path == "" {
+		return "", false
+	}
+	dst, ok := strings.CutPrefix(u.Path, dav.Prefix+sourceID)
+	if !ok {
+		return "", false
+	}
+	return storage.CleanPath(dst), true
+}
+
+// statusWriter remembers the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// davAllowed checks the permissions a WebDAV method needs on its target
+func davAllowed(r *http.Request, sourceID, name string) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return can(r, sourceID, name, acl.Read) || acl.CanTraverse(caller(r), sourceID, name)
+	case http.MethodPut, "MKCOL", "PROPPATCH", "LOCK", "UNLOCK":
+		return can(r, sourceID, name, acl.Write)
+	case http.MethodDelete:
+		return can(r, sourceID, name, acl.Delete)
+	case "COPY", "MOVE":
+		if !can(r, sourceID, name, acl.Read) {
+			return false
+		}
+		if r.Method == "MOVE" && !can(r, sourceID, name, acl.Delete) {
+			return false
+		}
+		dst, ok := davDestination(r, sourceID)
+		return !ok || can(r, sourceID, dst, acl.Write) // the handler rejects other destinations
+	}
+	return true
+}
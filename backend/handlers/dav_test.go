@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"filemanager/auth"
+	"filemanager/config"
+	"filemanager/storage"
+	"filemanager/trash"
+)
+
+func TestWebDAV(t *testing.T) {
+	srv := httptest.NewServer(auth.BasicMiddleware("test", WebDAV))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		user   string
+		method string
+		path   string
+		header map[string]string
+		body   string
+		code   int
+		// check looks at the source afterwards
+		check func(t *testing.T, res *http.Response)
+	}{
+		{
+			name: "list a folder", user: "alice", method: "PROPFIND", path: "/dav/",
+			header: map[string]string{"Depth": "1"},
+			code:   http.StatusMultiStatus,
+		},
+		{
+			name: "reserved folder is hidden", user: "alice", method: "PROPFIND", path: "/" + strings.TrimPrefix(storage.MetaDir, "/") + "/",
+			header: map[string]string{"Depth": "1"},
+			code:   http.StatusNotFound,
+		},
+		{
+			name: "upload", user: "alice", method: http.MethodPut, path: "/dav/new.txt", body: "hello",
+			code: http.StatusCreated,
+			check: func(t *testing.T, _ *http.Response) {
+				if got := contents(t, "dav/new.txt"); got != "hello" {
+					t.Errorf("new.txt holds %q", got)
+				}
+			},
+		},
+		{
+			name: "upload without write permission", user: "bob", method: http.MethodPut, path: "/dav/new.txt", body: "hello",
+			code: http.StatusForbidden,
+			check: func(t *testing.T, _ *http.Response) {
+				if got := contents(t, "dav/new.txt"); got != "" {
+					t.Errorf("new.txt was written: %q", got)
+				}
+			},
+		},
+		{
+			name: "move", user: "alice", method: "MOVE", path: "/dav/a.txt",
+			header: map[string]string{"Destination": srv.URL + "/dav/files/dav/b.txt"},
+			code:   http.StatusCreated,
+			check: func(t *testing.T, _ *http.Response) {
+				if contents(t, "dav/a.txt") != "" || contents(t, "dav/b.txt") != "first" {
+					t.Error("a.txt was not moved to b.txt")
+				}
+			},
+		},
+		{
+			name: "move without delete permission", user: "bob", method: "MOVE", path: "/dav/a.txt",
+			header: map[string]string{"Destination": srv.URL + "/dav/files/dav/b.txt"},
+			code:   http.StatusForbidden,
+		},
+		{
+			name: "lock", user: "alice", method: "LOCK", path: "/dav/a.txt",
+			header: map[string]string{"Timeout": "Second-60"},
+			body:   `<?xml version="1.0" encoding="utf-8"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner>alice</D:owner></D:lockinfo>`,
+			code:   http.StatusOK,
+			check: func(t *testing.T, res *http.Response) {
+				token := res.Header.Get("Lock-Token")
+				if token == "" {
+					t.Fatal("no lock token")
+				}
+				req, _ := http.NewRequest("UNLOCK", srv.URL+"/dav/files/dav/a.txt", nil)
+				req.SetBasicAuth("alice", "secret123")
+				req.Header.Set("Lock-Token", token)
+				unlock, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				unlock.Body.Close()
+				if unlock.StatusCode != http.StatusNoContent {
+					t.Errorf("unlock answered %d", unlock.StatusCode)
+				}
+			},
+		},
+		{
+			name: "lock without write permission", user: "bob", method: "LOCK", path: "/dav/a.txt",
+			body: `<?xml version="1.0" encoding="utf-8"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`,
+			code: http.StatusForbidden,
+		},
+		{
+			name: "delete goes to the trash", user: "alice", method: http.MethodDelete, path: "/dav/a.txt",
+			code: http.StatusNoContent,
+			check: func(t *testing.T, _ *http.Response) {
+				if contents(t, "dav/a.txt") != "" {
+					t.Error("a.txt is still there")
+				}
+				drv, err := storage.Get("files")
+				if err != nil {
+					t.Fatal(err)
+				}
+				items, err := trash.List(drv)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, it := range items {
+					if it.OriginalPath == "/dav/a.txt" && it.DeletedBy == "alice" {
+						return
+					}
+				}
+				t.Errorf("a.txt is not in the trash: %+v", items)
+			},
+		},
+		{
+			name: "delete without permission", user: "bob", method: http.MethodDelete, path: "/dav/a.txt",
+			code: http.StatusForbidden,
+			check: func(t *testing.T, _ *http.Response) {
+				if contents(t, "dav/a.txt") != "first" {
+					t.Error("a.txt was deleted")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mkdir(t, "dav")
+			writeFile(t, "dav/a.txt", "first")
+			useRules(t,
+				config.AccessRule{Source: "files", Users: []string{"alice"}, Permissions: []string{"all"}},
+				config.AccessRule{Source: "files", Users: []string{"bob"}, Permissions: []string{"read"}},
+			)
+
+			req, err := http.NewRequest(tt.method, srv.URL+"/dav/files"+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.SetBasicAuth(tt.user, "secret123")
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+
+			if res.StatusCode != tt.code {
+				t.Fatalf("answered %d, want %d: %s", res.StatusCode, tt.code, body)
+			}
+			if tt.code == http.StatusMultiStatus && !strings.Contains(string(body), "a.txt") {
+				t.Errorf("listing misses a.txt: %s", body)
+			}
+			if tt.check != nil {
+				tt.check(t, res)
+			}
+		})
+	}
+}
@@ -1,13 +1,13 @@
 package handlers
 
 import (
-	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"time"
 
-	"filemanager/config"
+	"filemanager/acl"
+	"filemanager/storage"
+	"filemanager/uploads"
 	"filemanager/utils"
 )
 
@@ -23,11 +23,8 @@ type FileInfo struct {
 func ListDirectory(w http.ResponseWriter, r *http.Request) {
 	sourceID := r.URL.Query().Get("source")
 	if sourceID == "" {
-		// Default to first enabled source
-		sources := config.GetEnabledSources()
-		if len(sources) > 0 {
-			sourceID = sources[0].ID
-		}
+		// Default to first source the caller can see
+		sourceID = defaultSource(r)
 	}
 
 	path := r.URL.Query().Get("path")
@@ -35,7 +32,7 @@ func ListDirectory(w http.ResponseWriter, r *http.Request) {
 		path = "/"
 	}
 
-	fullPath, err := utils.GetSafePath(sourceID, path)
+	drv, name, err := storage.Resolve(sourceID, path)
 	if err != nil {
 		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
 			Success: false,
@@ -44,7 +41,24 @@ func ListDirectory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	entries, err := os.ReadDir(fullPath)
+	id := caller(r)
+	readable := acl.Allowed(id, sourceID, name, acl.Read)
+	if !readable && !acl.CanTraverse(id, sourceID, name) {
+		sendForbidden(w)
+		return
+	}
+
+	// Archives open like folders
+	dirDrv, dir, err := browse(drv, sourceID, name, true)
+	if err != nil {
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	entries, err := dirDrv.ReadDir(dir)
 	if err != nil {
 		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
 			Success: false,
@@ -55,8 +69,13 @@ func ListDirectory(w http.ResponseWriter, r *http.Request) {
 
 	files := make([]FileInfo, 0, len(entries))
 	for _, entry := range entries {
-		info, err := entry.Info()
-		if err != nil {
+		child := storage.CleanPath(name + "/" + entry.Name())
+		if storage.IsReserved(child) || uploads.IsTemp(child) {
+			continue
+		}
+
+		// Above the granted paths only show the way down to them
+		if !readable && !acl.Visible(id, sourceID, child) {
 			continue
 		}
 
@@ -65,12 +84,12 @@ func ListDirectory(w http.ResponseWriter, r *http.Request) {
 			Name:    entry.Name(),
 			Path:    relativePath,
 			IsDir:   entry.IsDir(),
-			Size:    info.Size(),
-			ModTime: info.ModTime(),
+			Size:    entry.Size(),
+			ModTime: entry.ModTime(),
 			Ext:     filepath.Ext(entry.Name()),
 		})
 	}
-	log.Printf("Listing directory: %s (%d items)", path, len(files))
+	utils.Debugf("Listing directory: %s (%d items)", path, len(files))
 	utils.SendJSON(w, http.StatusOK, utils.Response{
 		Success: true,
 		Data:    files,
@@ -88,7 +107,7 @@ func GetInfo(w http.ResponseWriter, r *http.Request) {
 
 	sourceID := r.URL.Query().Get("source")
 	path := r.URL.Query().Get("path")
-	fullPath, err := utils.GetSafePath(sourceID, path)
+	drv, name, err := storage.Resolve(sourceID, path)
 	if err != nil {
 		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
 			Success: false,
@@ -97,7 +116,20 @@ func GetInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	info, err := os.Stat(fullPath)
+	if !can(r, sourceID, name, acl.Read) {
+		sendForbidden(w)
+		return
+	}
+
+	if drv, name, err = browse(drv, sourceID, name, false); err != nil {
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	info, err := drv.Stat(name)
 	if err != nil {
 		utils.SendJSON(w, http.StatusNotFound, utils.Response{
 			Success: false,
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"filemanager/acl"
+	"filemanager/events"
+	"filemanager/storage"
+	"filemanager/utils"
+)
+
+// sseHeartbeat keeps idle streams from being closed by proxies
+const sseHeartbeat = 30 * time.Second
+
+// Stream changes inside a folder as Server-Sent Events
+func WatchDirectory(w http.ResponseWriter, r *http.Request) {
+	sourceID := r.URL.Query().Get("source")
+	if sourceID == "" {
+		sourceID = defaultSource(r)
+	}
+
+	_, name, err := storage.Resolve(sourceID, r.URL.Query().Get("path"))
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	id := caller(r)
+	readable := acl.Allowed(id, sourceID, name, acl.Read)
+	if !readable && !acl.CanTraverse(id, sourceID, name) {
+		sendForbidden(w)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
+			Success: false,
+			Message: "Streaming not supported",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	sub := events.Subscribe(sourceID, name)
+	defer sub.Close()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case ev := <-sub.C:
+			// Above the granted paths only the way down is visible
+			if !readable && !acl.Visible(id, sourceID, ev.Path) {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: change\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
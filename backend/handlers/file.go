@@ -2,15 +2,22 @@ package handlers
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
-	"log"
+	"io/fs"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
+	"filemanager/acl"
+	"filemanager/audit"
+	"filemanager/events"
+	"filemanager/jobs"
+	"filemanager/storage"
+	"filemanager/uploads"
 	"filemanager/utils"
+	"filemanager/versions"
 )
 
 // Create file or folder
@@ -37,7 +44,7 @@ func CreateItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fullPath, err := utils.GetSafePath(req.Source, req.Path)
+	drv, name, err := storage.Resolve(req.Source, req.Path)
 	if err != nil {
 		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
 			Success: false,
@@ -46,23 +53,47 @@ func CreateItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	entry := audit.Entry{Op: "create", Source: req.Source, Path: name}
 	if req.IsDir {
-		log.Printf("📁 Creating folder: %s", req.Path)
-		err = os.MkdirAll(fullPath, 0755)
+		entry.Op = "mkdir"
+	}
+	if !can(r, req.Source, name, acl.Write) {
+		sendDenied(w, r, entry)
+		return
+	}
+
+	if req.IsDir {
+		utils.Infof("📁 Creating folder: %s", req.Path)
+		err = drv.MkdirAll(name)
 	} else {
-		log.Printf("📄 Creating file: %s", req.Path)
-		dir := filepath.Dir(fullPath)
-		if err := os.MkdirAll(dir, 0755); err != nil {
+		utils.Infof("📄 Creating file: %s", req.Path)
+		if err := drv.MkdirAll(path.Dir(name)); err != nil {
+			record(r, entry, err)
 			utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
 				Success: false,
 				Message: "Failed to create parent directory",
 			})
 			return
 		}
-		_, err = os.Create(fullPath)
+		// Creating over an existing file empties it
+		var f io.WriteCloser
+		if err = versions.Keep(drv, req.Source, name); err == nil {
+			if f, err = drv.Create(name); err == nil {
+				err = f.Close()
+			}
+		}
 	}
 
+	record(r, entry, err)
+	if errors.Is(err, storage.ErrNameTooLong) {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: storage.ErrNameTooLong.Error(),
+		})
+		return
+	}
 	if err != nil {
+		utils.Errorf("❌ Failed to create %s: %v", name, err)
 		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
 			Success: false,
 			Message: "Failed to create",
@@ -70,6 +101,7 @@ func CreateItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	events.Publish(events.Event{Type: events.Create, Source: req.Source, Path: name})
 	utils.SendJSON(w, http.StatusOK, utils.Response{
 		Success: true,
 		Message: "Created successfully",
@@ -87,8 +119,9 @@ func DeleteItem(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Source string `json:"source"`
-		Path   string `json:"path"`
+		Source    string `json:"source"`
+		Path      string `json:"path"`
+		Permanent bool   `json:"permanent"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -99,9 +132,8 @@ func DeleteItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fullPath, err := utils.GetSafePath(req.Source, req.Path)
+	drv, name, err := storage.Resolve(req.Source, req.Path)
 	if err != nil {
-		log.Printf("🗑️  Deleting: %s", req.Path)
 		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
 			Success: false,
 			Message: err.Error(),
@@ -109,18 +141,29 @@ func DeleteItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := os.RemoveAll(fullPath); err != nil {
-		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
+	if name == "/" {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
 			Success: false,
-			Message: "Failed to delete",
+			Message: "Cannot delete source root",
 		})
 		return
 	}
 
-	utils.SendJSON(w, http.StatusOK, utils.Response{
-		Success: true,
-		Message: "Deleted successfully",
-	})
+	params := jobs.Params{SourceID: req.Source, SourcePath: name, Permanent: req.Permanent}
+	if !allowedJob(r, jobs.Delete, params) {
+		denyJob(w, r, jobs.Delete, params)
+		return
+	}
+
+	if _, err := drv.Stat(name); err != nil {
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{
+			Success: false,
+			Message: "Item not found",
+		})
+		return
+	}
+
+	submitJob(w, r, jobs.Delete, params)
 }
 
 // Rename file or folder
@@ -147,7 +190,7 @@ func RenameItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	oldPath, err := utils.GetSafePath(req.Source, req.Path)
+	drv, oldName, err := storage.Resolve(req.Source, req.Path)
 	if err != nil {
 		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
 			Success: false,
@@ -156,10 +199,49 @@ func RenameItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newPath := filepath.Join(filepath.Dir(oldPath), req.NewName)
-	log.Printf("Renaming: %s -> %s", req.Path, req.NewName)
+	if oldName == "/" || req.NewName == "" || strings.ContainsAny(req.NewName, `/\`) || req.NewName == "." || req.NewName == ".." {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: "Invalid name",
+		})
+		return
+	}
+
+	newName := path.Join(path.Dir(oldName), req.NewName)
+	entry := audit.Entry{Op: "rename", Source: req.Source, Path: oldName, Dest: newName}
+	// The old name goes away, so renaming takes deleting it too
+	if !can(r, req.Source, oldName, acl.Write) || !can(r, req.Source, oldName, acl.Delete) || !can(r, req.Source, newName, acl.Write) {
+		sendDenied(w, r, entry)
+		return
+	}
 
-	if err := os.Rename(oldPath, newPath); err != nil {
+	info, err := drv.Stat(oldName)
+	if err != nil {
+		record(r, entry, err)
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{
+			Success: false,
+			Message: "Item not found",
+		})
+		return
+	}
+	err = renameNoReplace(drv, oldName, newName, info)
+	record(r, entry, err)
+	if errors.Is(err, fs.ErrExist) {
+		utils.SendJSON(w, http.StatusConflict, utils.Response{
+			Success: false,
+			Message: uploads.ErrExists.Error(),
+		})
+		return
+	}
+	if errors.Is(err, storage.ErrNameTooLong) {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: storage.ErrNameTooLong.Error(),
+		})
+		return
+	}
+	if err != nil {
+		utils.Errorf("❌ Failed to rename %s to %s: %v", oldName, newName, err)
 		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
 			Success: false,
 			Message: "Failed to rename",
@@ -167,27 +249,30 @@ func RenameItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	events.Publish(events.Event{Type: events.Rename, Source: req.Source, Path: newName, OldPath: oldName})
 	utils.SendJSON(w, http.StatusOK, utils.Response{
 		Success: true,
 		Message: "Renamed successfully",
 	})
 }
 
-func uniquePath(dst string) (string, error) {
-	if _, err := os.Stat(dst); os.IsNotExist(err) {
-		return dst, nil
-	}
-
-	dir := filepath.Dir(dst)
-	ext := filepath.Ext(dst)
-	base := strings.TrimSuffix(filepath.Base(dst), ext)
-
-	for i := 1; ; i++ {
-		p := filepath.Join(dir, fmt.Sprintf("%s(%d)%s", base, i, ext))
-		if _, err := os.Stat(p); os.IsNotExist(err) {
-			return p, nil
+// renameNoReplace renames an item unless the new name is taken. Changing
+// only the case of a name is fine on file systems that ignore it, where
+// the new name finds the item itself.
+func renameNoReplace(drv storage.Driver, oldName, newName string, info fs.FileInfo) error {
+	if !info.IsDir() && !strings.EqualFold(oldName, newName) {
+		return storage.RenameNoReplace(drv, oldName, newName)
+	}
+	if taken, err := drv.Stat(newName); err == nil {
+		same := strings.EqualFold(oldName, newName) && taken.IsDir() == info.IsDir() &&
+			taken.Size() == info.Size() && taken.ModTime().Equal(info.ModTime())
+		if !same {
+			return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
 		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
 	}
+	return drv.Rename(oldName, newName)
 }
 
 // Copy file or folder
@@ -212,41 +297,30 @@ func CopyItem(w http.ResponseWriter, r *http.Request) {
 	req.SourcePath = strings.TrimLeft(req.SourcePath, `/\`)
 	req.Destination = strings.TrimLeft(req.Destination, `/\`)
 
-	srcPath, err := utils.GetSafePath(req.SourceID, req.SourcePath)
+	srcDrv, srcPath, err := storage.Resolve(req.SourceID, req.SourcePath)
 	if err != nil {
 		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid source"})
 		return
 	}
 
-	dstPath, err := utils.GetSafePath(req.DestID, req.Destination)
+	_, dstPath, err := storage.Resolve(req.DestID, req.Destination)
 	if err != nil {
 		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid destination"})
 		return
 	}
 
-	if _, err := os.Stat(srcPath); err != nil {
-		utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: "Source not found"})
+	params := jobs.Params{SourceID: req.SourceID, SourcePath: srcPath, DestID: req.DestID, Destination: dstPath}
+	if !allowedJob(r, jobs.Copy, params) {
+		denyJob(w, r, jobs.Copy, params)
 		return
 	}
 
-	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
-		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to create destination"})
-		return
-	}
-
-	dstPath, err = uniquePath(dstPath)
-	if err != nil {
-		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to resolve destination"})
-		return
-	}
-
-	if err := copyPath(srcPath, dstPath); err != nil {
-		os.RemoveAll(dstPath)
-		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to copy"})
+	if _, err := srcDrv.Stat(srcPath); err != nil {
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: "Source not found"})
 		return
 	}
 
-	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Copied successfully"})
+	submitJob(w, r, jobs.Copy, params)
 }
 
 // Move file or folder
@@ -271,52 +345,30 @@ func MoveItem(w http.ResponseWriter, r *http.Request) {
 	req.SourcePath = strings.TrimLeft(req.SourcePath, `/\`)
 	req.Destination = strings.TrimLeft(req.Destination, `/\`)
 
-	srcPath, err := utils.GetSafePath(req.SourceID, req.SourcePath)
+	srcDrv, srcPath, err := storage.Resolve(req.SourceID, req.SourcePath)
 	if err != nil {
 		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid source"})
 		return
 	}
 
-	dstPath, err := utils.GetSafePath(req.DestID, req.Destination)
+	_, dstPath, err := storage.Resolve(req.DestID, req.Destination)
 	if err != nil {
 		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid destination"})
 		return
 	}
 
-	if _, err := os.Stat(srcPath); err != nil {
-		utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: "Source not found"})
-		return
-	}
-
-	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
-		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to create destination"})
+	params := jobs.Params{SourceID: req.SourceID, SourcePath: srcPath, DestID: req.DestID, Destination: dstPath}
+	if !allowedJob(r, jobs.Move, params) {
+		denyJob(w, r, jobs.Move, params)
 		return
 	}
 
-	dstPath, err = uniquePath(dstPath)
-	if err != nil {
-		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to resolve destination"})
+	if _, err := srcDrv.Stat(srcPath); err != nil {
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: "Source not found"})
 		return
 	}
 
-	if req.SourceID == req.DestID {
-		if err := os.Rename(srcPath, dstPath); err != nil {
-			utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to move"})
-			return
-		}
-	} else {
-		if err := copyPath(srcPath, dstPath); err != nil {
-			os.RemoveAll(dstPath)
-			utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to Copy and Move"})
-			return
-		}
-		if err := os.RemoveAll(srcPath); err != nil {
-			utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to delete source after Moving"})
-			return
-		}
-	}
-
-	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Moved successfully"})
+	submitJob(w, r, jobs.Move, params)
 }
 
 // Upload file
@@ -337,9 +389,9 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	sourceID := r.URL.Query().Get("source")
-	path := r.URL.Query().Get("path")
-	if path == "" {
-		path = "/"
+	dirPath := r.URL.Query().Get("path")
+	if dirPath == "" {
+		dirPath = "/"
 	}
 
 	file, header, err := r.FormFile("file")
@@ -352,8 +404,8 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	destPath := filepath.Join(path, header.Filename)
-	fullPath, err := utils.GetSafePath(sourceID, destPath)
+	destPath := filepath.Join(dirPath, header.Filename)
+	drv, name, err := storage.Resolve(sourceID, destPath)
 	if err != nil {
 		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
 			Success: false,
@@ -362,26 +414,68 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dir := filepath.Dir(fullPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
+	entry := audit.Entry{Op: "upload", Source: sourceID, Path: name}
+	if !can(r, sourceID, name, acl.Write) {
+		sendDenied(w, r, entry)
+		return
+	}
+
+	policy, err := uploads.ParsePolicy(r.FormValue("overwrite"))
+	if err != nil {
+		record(r, entry, err)
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
 			Success: false,
-			Message: "Failed to create directory",
+			Message: err.Error(),
 		})
 		return
 	}
-
-	dst, err := os.Create(fullPath)
+	sums, err := uploads.ParseChecksums(r.FormValue("sha256"), r.FormValue("md5"))
 	if err != nil {
+		record(r, entry, err)
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if err := drv.MkdirAll(path.Dir(name)); err != nil {
+		record(r, entry, err)
 		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
 			Success: false,
-			Message: "Failed to create file",
+			Message: "Failed to create directory",
 		})
 		return
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, file); err != nil {
+	// Write to a temporary file first so a failed upload never clobbers
+	// the file it was meant to replace
+	final, n, err := uploads.Save(drv, sourceID, name, file, policy, sums)
+	if err == nil {
+		entry.Path = final
+	}
+	record(r, entry, err)
+	switch {
+	case errors.Is(err, uploads.ErrExists):
+		utils.SendJSON(w, http.StatusConflict, utils.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	case errors.Is(err, uploads.ErrChecksum):
+		utils.SendJSON(w, http.StatusUnprocessableEntity, utils.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	case errors.Is(err, storage.ErrNameTooLong):
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: storage.ErrNameTooLong.Error(),
+		})
+		return
+	case err != nil:
+		utils.Errorf("❌ Failed to save upload of %s: %v", name, err)
 		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
 			Success: false,
 			Message: "Failed to save file",
@@ -389,80 +483,14 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Uploading: %s (%d bytes)", header.Filename, header.Size)
+	utils.Infof("📤 Uploaded: %s (%d bytes)", final, n)
+	events.Publish(events.Event{Type: events.Create, Source: sourceID, Path: final})
 	utils.SendJSON(w, http.StatusOK, utils.Response{
 		Success: true,
 		Message: "Uploaded successfully",
 		Data: map[string]string{
-			"path": destPath,
-			"name": header.Filename,
+			"path": final,
+			"name": path.Base(final),
 		},
 	})
 }
-
-// Helper functions for copy operations
-func copyPath(src, dst string) error {
-	srcInfo, err := os.Stat(src)
-	if err != nil {
-		return err
-	}
-
-	if srcInfo.IsDir() {
-		return copyDir(src, dst)
-	}
-	return copyFile(src, dst)
-}
-
-func copyFile(src, dst string) error {
-	srcFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer srcFile.Close()
-
-	dstFile, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer dstFile.Close()
-
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return err
-	}
-
-	srcInfo, _ := os.Stat(src)
-	return os.Chmod(dst, srcInfo.Mode())
-}
-
-func copyDir(src, dst string) error {
-	srcInfo, err := os.Stat(src)
-	if err != nil {
-		return err
-	}
-
-	if err := os.MkdirAll(dst, srcInfo.Mode()); err != nil {
-		return err
-	}
-
-	entries, err := os.ReadDir(src)
-	if err != nil {
-		return err
-	}
-
-	for _, entry := range entries {
-		srcPath := filepath.Join(src, entry.Name())
-		dstPath := filepath.Join(dst, entry.Name())
-
-		if entry.IsDir() {
-			if err := copyDir(srcPath, dstPath); err != nil {
-				return err
-			}
-		} else {
-			if err := copyFile(srcPath, dstPath); err != nil {
-				return err
-			}
-		}
-	}
-
-	return nil
-}
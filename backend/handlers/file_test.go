@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+
+	"filemanager/audit"
+	"filemanager/config"
+)
+
+func TestRenameItem(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		newName string
+		code    int
+		outcome audit.Outcome
+		// what the folder holds afterwards
+		want map[string]string
+	}{
+		{"free name", "alice", "b.txt", http.StatusOK, audit.Success, map[string]string{"a.txt": "", "b.txt": "first"}},
+		{"taken name", "alice", "taken.txt", http.StatusConflict, audit.Failure, map[string]string{"a.txt": "first", "taken.txt": "second"}},
+		{"no delete permission", "bob", "b.txt", http.StatusForbidden, audit.Denied, map[string]string{"a.txt": "first", "b.txt": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mkdir(t, "rename")
+			writeFile(t, "rename/a.txt", "first")
+			writeFile(t, "rename/taken.txt", "second")
+			useRules(t,
+				config.AccessRule{Source: "files", Users: []string{"alice"}, Permissions: []string{"all"}},
+				config.AccessRule{Source: "files", Users: []string{"bob"}, Permissions: []string{"read", "write"}},
+			)
+
+			w := call(t, tt.user, RenameItem, http.MethodPost, "/api/rename", map[string]string{
+				"source": "files", "path": "/rename/a.txt", "newName": tt.newName,
+			})
+			if w.Code != tt.code {
+				t.Fatalf("answered %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			for name, body := range tt.want {
+				if got := contents(t, "rename/"+name); got != body {
+					t.Errorf("%s holds %q, want %q", name, got, body)
+				}
+			}
+			// Refused renames are audited as well
+			entries, err := audit.Query(audit.Filter{User: tt.user, Op: "rename", Limit: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || entries[0].Outcome != tt.outcome || entries[0].Dest != "/rename/"+tt.newName {
+				t.Errorf("audited %+v, want outcome %s", entries, tt.outcome)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"filemanager/acl"
+	"filemanager/audit"
+	"filemanager/auth"
+	"filemanager/jobs"
+	"filemanager/utils"
+)
+
+// submitJob starts a background job for the caller and answers with it
+func submitJob(w http.ResponseWriter, r *http.Request, kind jobs.Kind, params jobs.Params) {
+	job := jobs.Submit(kind, auth.CurrentUser(r).Username, params)
+	utils.Infof("⚙️  Job %s queued: %s %s", job.ID, kind, params.SourcePath)
+	if kind.Audited() {
+		entry := jobs.AuditEntry(job)
+		entry.Outcome = audit.Started
+		record(r, entry, nil)
+	}
+
+	utils.SendJSON(w, http.StatusAccepted, utils.Response{
+		Success: true,
+		Message: "Job started",
+		Data:    job,
+	})
+}
+
+// denyJob records a job the caller may not run and answers with 403
+func denyJob(w http.ResponseWriter, r *http.Request, kind jobs.Kind, params jobs.Params) {
+	if !kind.Audited() {
+		sendForbidden(w)
+		return
+	}
+	sendDenied(w, r, jobs.AuditEntry(jobs.Job{Kind: kind, Params: params}))
+}
+
+// allowedJob reports whether the caller may run a job with these params
+func allowedJob(r *http.Request, kind jobs.Kind, p jobs.Params) bool {
+	switch kind {
+	case jobs.Copy:
+		return can(r, p.SourceID, p.SourcePath, acl.Read) && can(r, p.DestID, p.Destination, acl.Write)
+	case jobs.Move:
+		return can(r, p.SourceID, p.SourcePath, acl.Read) && can(r, p.SourceID, p.SourcePath, acl.Delete) &&
+			can(r, p.DestID, p.Destination, acl.Write)
+	case jobs.Delete:
+		return can(r, p.SourceID, p.SourcePath, acl.Delete)
+	case jobs.Thumbnails:
+		return can(r, p.SourceID, p.SourcePath, acl.Read)
+	case jobs.Extract:
+		return can(r, p.SourceID, p.SourcePath, acl.Read) && can(r, p.SourceID, p.Destination, acl.Write)
+	case jobs.Compress:
+		for _, name := range p.Paths {
+			if !can(r, p.SourceID, name, acl.Read) {
+				return false
+			}
+		}
+		return len(p.Paths) > 0 && can(r, p.SourceID, p.Destination, acl.Write)
+	}
+	return false
+}
+
+// ownJob looks up a job of the caller, answering the request itself when
+// there is none. Admins can reach every job.
+func ownJob(w http.ResponseWriter, r *http.Request, id string) (jobs.Job, bool) {
+	job, err := jobs.Get(id)
+	user := auth.CurrentUser(r)
+	if err != nil || (job.Owner != user.Username && !user.Admin) {
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: "Job not found"})
+		return jobs.Job{}, false
+	}
+	return job, true
+}
+
+// List the caller's jobs, or a single one with ?id=
+func ListJobs(w http.ResponseWriter, r *http.Request) {
+	if id := r.URL.Query().Get("id"); id != "" {
+		job, ok := ownJob(w, r, id)
+		if !ok {
+			return
+		}
+		utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Data: job})
+		return
+	}
+
+	owner := auth.CurrentUser(r).Username
+	if auth.CurrentUser(r).Admin && r.URL.Query().Get("all") == "true" {
+		owner = ""
+	}
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Data: jobs.List(owner)})
+}
+
+// Cancel a queued or running job
+func CancelJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid request"})
+		return
+	}
+
+	job, ok := ownJob(w, r, req.ID)
+	if !ok {
+		return
+	}
+
+	if err := jobs.Cancel(job.ID); err != nil {
+		utils.SendJSON(w, http.StatusConflict, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	utils.Infof("⚙️  Job %s canceled by %s", job.ID, auth.CurrentUser(r).Username)
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Job canceled"})
+}
+
+// Run a failed or canceled job again as a new job
+func RetryJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid request"})
+		return
+	}
+
+	job, ok := ownJob(w, r, req.ID)
+	if !ok {
+		return
+	}
+
+	params, err := jobs.RetryParams(job)
+	if err != nil {
+		utils.SendJSON(w, http.StatusConflict, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	if !allowedJob(r, job.Kind, params) {
+		denyJob(w, r, job.Kind, params)
+		return
+	}
+
+	submitJob(w, r, job.Kind, params)
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filemanager/acl"
+	"filemanager/audit"
+	"filemanager/auth"
+	"filemanager/config"
+	"filemanager/shares"
+)
+
+// root is the folder behind the "files" source the tests work on
+var root string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "zxfb-handlers")
+	if err != nil {
+		log.Fatal(err)
+	}
+	code := run(m, dir)
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func run(m *testing.M, dir string) int {
+	log.SetOutput(io.Discard)
+	root = filepath.Join(dir, "files")
+	data := filepath.Join(dir, "data")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := fmt.Sprintf("server:\n  dataDir: %q\nsources:\n  - id: files\n    name: Files\n    path: %q\n", data, root)
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(cfg), 0600); err != nil {
+		log.Fatal(err)
+	}
+	config.SetPath(path)
+	config.Init()
+
+	if err := auth.Init(data); err != nil {
+		log.Fatal(err)
+	}
+	if err := shares.Init(data); err != nil {
+		log.Fatal(err)
+	}
+	if err := audit.Init(data); err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if err := auth.Users.Add(name, "secret123", false); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	return m.Run()
+}
+
+// call runs handler as a request of the signed in user, with body sent as
+// JSON unless it is a reader already
+func call(t *testing.T, username string, handler http.HandlerFunc, method, target string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	var r io.Reader
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		r = b
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, target, r)
+	s, err := auth.NewSession(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+
+	w := httptest.NewRecorder()
+	auth.Middleware(handler)(w, req)
+	return w
+}
+
+// useRules turns on access control with rules until the test ends
+func useRules(t *testing.T, rules ...config.AccessRule) {
+	t.Helper()
+	if err := acl.Load(&config.AccessConfig{Rules: rules}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { acl.Load(nil) })
+}
+
+// writeFile puts a file into the test source
+func writeFile(t *testing.T, name, body string) {
+	t.Helper()
+	p := filepath.Join(root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// contents returns the content of a file in the test source, or "" when
+// it does not exist
+func contents(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// mkdir creates a folder in the test source and removes it after the test
+func mkdir(t *testing.T, name string) string {
+	t.Helper()
+	p := filepath.Join(root, name)
+	if err := os.MkdirAll(p, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(p) })
+	return p
+}
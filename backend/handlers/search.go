@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"filemanager/acl"
+	"filemanager/config"
+	"filemanager/search"
+	"filemanager/storage"
+	"filemanager/utils"
+)
+
+// maxSearchResults caps the items one search returns
+const maxSearchResults = 1000
+
+// SearchResults is the answer to a search
+type SearchResults struct {
+	Items []search.Result `json:"items"`
+	// Truncated is set when more items matched than the limit allows
+	Truncated bool `json:"truncated"`
+	// Indexing lists sources that are still being crawled for the first
+	// time, whose results may be incomplete
+	Indexing []string `json:"indexing,omitempty"`
+}
+
+// Search the index. Parameters: source (all visible sources when empty),
+// path (folder prefix), name (glob or substring), q (words in the content
+// or name), ext (comma separated), type (file or dir), minSize and
+// maxSize (bytes), from and to (RFC 3339 or YYYY-MM-DD) and limit
+// (default 100).
+func Search(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	q := r.URL.Query()
+	query := search.Query{
+		Name:  q.Get("name"),
+		Text:  q.Get("q"),
+		Type:  q.Get("type"),
+		Limit: 100,
+	}
+	if ext := q.Get("ext"); ext != "" {
+		query.Exts = strings.Split(ext, ",")
+	}
+	if p := q.Get("path"); p != "" {
+		query.Path = storage.CleanPath(p)
+	}
+
+	var err error
+	if query.MinSize, err = sizeParam(q.Get("minSize")); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid minSize"})
+		return
+	}
+	if query.MaxSize, err = sizeParam(q.Get("maxSize")); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid maxSize"})
+		return
+	}
+	if query.Since, err = dateParam(q.Get("from"), false); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid from date"})
+		return
+	}
+	if query.Until, err = dateParam(q.Get("to"), true); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid to date"})
+		return
+	}
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid limit"})
+			return
+		}
+		query.Limit = min(n, maxSearchResults)
+	}
+
+	id := caller(r)
+	var sources []string
+	if sourceID := q.Get("source"); sourceID != "" {
+		if src, ok := config.GetSource(sourceID); !ok || !src.Enabled {
+			utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Source not found"})
+			return
+		}
+		if !acl.CanSeeSource(id, sourceID) {
+			sendForbidden(w)
+			return
+		}
+		sources = []string{sourceID}
+	} else {
+		for _, src := range config.GetEnabledSources() {
+			if acl.CanSeeSource(id, src.ID) {
+				sources = append(sources, src.ID)
+			}
+		}
+	}
+
+	items, truncated, err := search.Search(sources, query, func(source, name string) bool {
+		return acl.Allowed(id, source, name, acl.Read)
+	})
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	result := SearchResults{Items: items, Truncated: truncated}
+	for _, sourceID := range sources {
+		if !search.Ready(sourceID) {
+			result.Indexing = append(result.Indexing, sourceID)
+		}
+	}
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Data: result})
+}
+
+func sizeParam(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err == nil && n < 0 {
+		err = strconv.ErrRange
+	}
+	return n, err
+}
+
+// dateParam parses a time or a plain date. A plain date used as the end of
+// a range includes the whole day.
+func dateParam(s string, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, s, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
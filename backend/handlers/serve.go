@@ -1,15 +1,18 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
 	"mime"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 
+	"filemanager/acl"
+	"filemanager/storage"
 	"filemanager/utils"
 )
 
@@ -26,7 +29,7 @@ func PreviewFile(w http.ResponseWriter, r *http.Request) {
 	sourceID := r.URL.Query().Get("source")
 	path := r.URL.Query().Get("path")
 	path = strings.ReplaceAll(path, "\\", "/")
-	fullPath, err := utils.GetSafePath(sourceID, path)
+	drv, name, err := storage.Resolve(sourceID, path)
 	if err != nil {
 		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
 			Success: false,
@@ -35,7 +38,20 @@ func PreviewFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	info, err := os.Stat(fullPath)
+	if !can(r, sourceID, name, acl.Read) {
+		sendForbidden(w)
+		return
+	}
+
+	if drv, name, err = browse(drv, sourceID, name, false); err != nil {
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	info, err := drv.Stat(name)
 	if err != nil {
 		utils.SendJSON(w, http.StatusNotFound, utils.Response{
 			Success: false,
@@ -62,7 +78,7 @@ func PreviewFile(w http.ResponseWriter, r *http.Request) {
 
 	// Read content for small text files
 	if info.Size() < 1024*1024 {
-		content, err := os.ReadFile(fullPath)
+		content, err := readFile(drv, name)
 		if err == nil && utils.IsTextFile(content) {
 			utils.SendJSON(w, http.StatusOK, utils.Response{
 				Success: true,
@@ -94,15 +110,25 @@ func ServeFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fullPath, err := utils.GetSafePath(sourceID, path)
+	drv, name, err := storage.Resolve(sourceID, path)
 	if err != nil {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
 
-	info, err := os.Stat(fullPath)
+	if !can(r, sourceID, name, acl.Read) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	if drv, name, err = browse(drv, sourceID, name, false); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	info, err := drv.Stat(name)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			http.Error(w, "File not found", http.StatusNotFound)
 		} else {
 			http.Error(w, "Failed to access file", http.StatusInternalServerError)
@@ -115,7 +141,7 @@ func ServeFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, err := os.Open(fullPath)
+	file, err := drv.Open(name)
 	if err != nil {
 		http.Error(w, "Failed to open file", http.StatusInternalServerError)
 		return
@@ -143,7 +169,7 @@ func ServeFile(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
 
-	log.Printf("Serving: %s", fileName)
+	utils.Infof("Serving: %s", fileName)
 
 	http.ServeContent(w, r, fileName, info.ModTime(), file)
 }
@@ -176,27 +202,55 @@ func DownloadFile(w http.ResponseWriter, r *http.Request) {
 	sourceID := r.URL.Query().Get("source")
 	path := r.URL.Query().Get("path")
 	path = strings.ReplaceAll(path, "\\", "/")
-	fullPath, err := utils.GetSafePath(sourceID, path)
+	drv, name, err := storage.Resolve(sourceID, path)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	info, err := os.Stat(fullPath)
+	if !can(r, sourceID, name, acl.Read) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	if drv, name, err = browse(drv, sourceID, name, false); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	info, err := drv.Stat(name)
 	if err != nil {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 
+	// Folders go out as a zip
 	if info.IsDir() {
-		http.Error(w, "Cannot download directory", http.StatusBadRequest)
+		DownloadArchive(w, r)
 		return
 	}
-	log.Printf("Downloading: %s (%d bytes)", info.Name(), info.Size())
+	utils.Infof("Downloading: %s (%d bytes)", info.Name(), info.Size())
 	// Set proper headers for download
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", info.Name()))
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
 
-	http.ServeFile(w, r, fullPath)
+	file, err := drv.Open(name)
+	if err != nil {
+		http.Error(w, "Failed to open file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// readFile reads a whole file through the source driver
+func readFile(drv storage.Driver, name string) ([]byte, error) {
+	f, err := drv.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
 }
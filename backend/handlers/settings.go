@@ -2,61 +2,77 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
-	"os"
-	"path/filepath"
 
-	"filemanager/config"
+	"filemanager/audit"
+	"filemanager/auth"
+	"filemanager/settings"
 	"filemanager/utils"
 )
 
-type UserSettings struct {
-	DarkMode   bool `json:"darkMode"`
-	SidebarPin bool `json:"sidebarPin"`
-	Encryption bool `json:"encryption"`
-}
-
-func getSettingsFile() string {
-	sources := config.GetEnabledSources()
-	if len(sources) > 0 {
-		return filepath.Join(sources[0].Path, ".settings.json")
-	}
-	return ".settings.json"
-}
-
+// Get the settings of the signed in user. With client=ID the settings
+// saved for that client are returned if there are any.
 func GetSettings(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
 		return
 	}
 
-	settings := UserSettings{DarkMode: false, SidebarPin: true, Encryption: false}
-
-	data, err := os.ReadFile(getSettingsFile())
-	if err == nil {
-		json.Unmarshal(data, &settings)
+	client, ok := clientParam(w, r)
+	if !ok {
+		return
 	}
-
-	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Data: settings})
+	s := settings.Get(auth.CurrentUser(r).Username, client)
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Data: s})
 }
 
+// Save settings of the signed in user, or with client=ID only for that
+// client. Fields the request leaves out keep their value.
 func SaveSettings(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
 		return
 	}
 
-	var settings UserSettings
-	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+	client, ok := clientParam(w, r)
+	if !ok {
+		return
+	}
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid request"})
 		return
 	}
 
-	data, _ := json.MarshalIndent(settings, "", "  ")
-	if err := os.WriteFile(getSettingsFile(), data, 0644); err != nil {
+	saved, err := settings.Update(auth.CurrentUser(r).Username, client, func(s *settings.Settings) error {
+		return json.Unmarshal(body, s)
+	})
+	if errors.Is(err, settings.ErrInvalid) {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+	record(r, audit.Entry{Op: "settings"}, err)
+	if err != nil {
 		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to save"})
 		return
 	}
 
-	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Settings saved"})
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Settings saved", Data: saved})
+}
+
+// clientParam reads the optional client ID of a settings request
+func clientParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	client := r.URL.Query().Get("client")
+	if len(client) > settings.MaxClientID {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Client ID is too long"})
+		return "", false
+	}
+	for _, c := range client {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid client ID"})
+			return "", false
+		}
+	}
+	return client, true
 }
@@ -0,0 +1,623 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"filemanager/acl"
+	"filemanager/archive"
+	"filemanager/audit"
+	"filemanager/auth"
+	"filemanager/config"
+	"filemanager/events"
+	"filemanager/shares"
+	"filemanager/storage"
+	"filemanager/uploads"
+	"filemanager/utils"
+)
+
+// shareBase is where share links are served, each at <shareBase><token>
+const shareBase = "/s/"
+
+// shareCookie keeps a visitor unlocked after entering a share's password
+const shareCookie = "zxfb_share"
+
+// ShareInfo is a share as its owner sees it
+type ShareInfo struct {
+	Token        string      `json:"token"`
+	URL          string      `json:"url"`
+	Source       string      `json:"source"`
+	Path         string      `json:"path"`
+	Name         string      `json:"name"`
+	IsDir        bool        `json:"isDir"`
+	Mode         shares.Mode `json:"mode"`
+	Owner        string      `json:"owner"`
+	HasPassword  bool        `json:"hasPassword"`
+	Expires      *time.Time  `json:"expires,omitempty"`
+	MaxDownloads int         `json:"maxDownloads,omitempty"`
+	Downloads    int         `json:"downloads"`
+	Active       bool        `json:"active"`
+	Created      time.Time   `json:"created"`
+	MaxFileSize  int64       `json:"maxFileSize,omitempty"`
+	MaxTotalSize int64       `json:"maxTotalSize,omitempty"`
+	AllowedTypes []string    `json:"allowedTypes,omitempty"`
+	Uploads      int         `json:"uploads"`
+	Uploaded     int64       `json:"uploaded"`
+	Notify       bool        `json:"notify"`
+}
+
+func shareInfo(s shares.Share) ShareInfo {
+	return ShareInfo{
+		Token:        s.Token,
+		URL:          shareBase + s.Token,
+		Source:       s.Source,
+		Path:         s.Path,
+		Name:         path.Base(s.Path),
+		IsDir:        s.IsDir,
+		Mode:         s.Mode,
+		Owner:        s.Owner,
+		HasPassword:  s.HasPassword(),
+		Expires:      s.Expires,
+		MaxDownloads: s.MaxDownloads,
+		Downloads:    s.Downloads,
+		Active:       s.Usable() == nil,
+		Created:      s.Created,
+		MaxFileSize:  s.MaxFileSize,
+		MaxTotalSize: s.MaxTotalSize,
+		AllowedTypes: s.AllowedTypes,
+		Uploads:      s.Uploads,
+		Uploaded:     s.Uploaded,
+		Notify:       s.Notify,
+	}
+}
+
+// List the caller's shares; admins see everyone's with ?all=true
+func ListShares(w http.ResponseWriter, r *http.Request) {
+	user := auth.CurrentUser(r)
+	owner := user.Username
+	if user.Admin && r.URL.Query().Get("all") == "true" {
+		owner = ""
+	}
+
+	list := shares.List(owner)
+	infos := make([]ShareInfo, 0, len(list))
+	for _, s := range list {
+		infos = append(infos, shareInfo(s))
+	}
+
+	utils.SendJSON(w, http.StatusOK, utils.Response{
+		Success: true,
+		Data:    infos,
+	})
+}
+
+// Create a share link for a file or folder. Upload links (file requests)
+// take optional limits for single files, the total and the file types.
+func CreateShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{
+			Success: false,
+			Message: "Method not allowed",
+		})
+		return
+	}
+
+	var req struct {
+		Source       string     `json:"source"`
+		Path         string     `json:"path"`
+		Mode         string     `json:"mode"`
+		Password     string     `json:"password"`
+		Expires      *time.Time `json:"expires"`
+		MaxDownloads int        `json:"maxDownloads"`
+		MaxFileSize  int64      `json:"maxFileSize"`
+		MaxTotalSize int64      `json:"maxTotalSize"`
+		AllowedTypes []string   `json:"allowedTypes"`
+		Notify       bool       `json:"notify"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: "Invalid request",
+		})
+		return
+	}
+
+	mode, err := shares.ParseMode(req.Mode)
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+	if req.Expires != nil && req.Expires.Before(time.Now()) {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: "Expiry must be in the future",
+		})
+		return
+	}
+	if req.MaxDownloads < 0 || req.MaxFileSize < 0 || req.MaxTotalSize < 0 {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: "Limits cannot be negative",
+		})
+		return
+	}
+	if mode != shares.Upload && (req.MaxFileSize > 0 || req.MaxTotalSize > 0 || len(req.AllowedTypes) > 0 || req.Notify) {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: "Upload limits and notifications only apply to upload links",
+		})
+		return
+	}
+	if req.Notify && config.Get().Shares.WebhookURL == "" {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: "Notifications need shares.webhookURL in the server configuration",
+		})
+		return
+	}
+	types, err := shares.ParseTypes(req.AllowedTypes)
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	drv, name, err := storage.Resolve(req.Source, req.Path)
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	perm := acl.Read
+	if mode == shares.Upload {
+		perm = acl.Write
+	}
+	entry := audit.Entry{Op: "share", Source: req.Source, Path: name}
+	if !can(r, req.Source, name, acl.Share) || !can(r, req.Source, name, perm) {
+		sendDenied(w, r, entry)
+		return
+	}
+
+	info, err := drv.Stat(name)
+	if err != nil {
+		record(r, entry, err)
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{
+			Success: false,
+			Message: "Item not found",
+		})
+		return
+	}
+	if mode == shares.Upload && !info.IsDir() {
+		record(r, entry, errors.New("upload links can only be made for folders"))
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: "Upload links can only be made for folders",
+		})
+		return
+	}
+
+	s := &shares.Share{
+		Source:       req.Source,
+		Path:         name,
+		IsDir:        info.IsDir(),
+		Mode:         mode,
+		Owner:        auth.CurrentUser(r).Username,
+		Expires:      req.Expires,
+		MaxDownloads: req.MaxDownloads,
+		MaxFileSize:  req.MaxFileSize,
+		MaxTotalSize: req.MaxTotalSize,
+		AllowedTypes: types,
+		Notify:       req.Notify,
+	}
+	err = shares.Create(s, req.Password)
+	record(r, entry, err)
+	if err != nil {
+		utils.Errorf("❌ Failed to share %s: %v", name, err)
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
+			Success: false,
+			Message: "Failed to create share",
+		})
+		return
+	}
+
+	utils.Infof("🔗 %s shared %s (%s)", s.Owner, name, mode)
+	utils.SendJSON(w, http.StatusOK, utils.Response{
+		Success: true,
+		Message: "Share created",
+		Data:    shareInfo(*s),
+	})
+}
+
+// Revoke a share link of the caller; admins can revoke any
+func RevokeShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{
+			Success: false,
+			Message: "Method not allowed",
+		})
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: "Invalid request",
+		})
+		return
+	}
+
+	user := auth.CurrentUser(r)
+	s, err := shares.Get(req.Token)
+	if err != nil || (s.Owner != user.Username && !user.Admin) {
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{
+			Success: false,
+			Message: "Share not found",
+		})
+		return
+	}
+
+	err = shares.Revoke(s.Token)
+	record(r, audit.Entry{Op: "unshare", Source: s.Source, Path: s.Path}, err)
+	if err != nil {
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{
+			Success: false,
+			Message: "Share not found",
+		})
+		return
+	}
+
+	utils.Infof("🔗 %s revoked the share of %s", user.Username, s.Path)
+	utils.SendJSON(w, http.StatusOK, utils.Response{
+		Success: true,
+		Message: "Share revoked",
+	})
+}
+
+// Public side of a share link at /s/<token>[/<path inside>]. Read links
+// serve the file, or list and serve a folder (?download=zip|tar.gz packs
+// it); upload links take files POSTed as multipart "file". Paths in the
+// answers are relative to the shared item, so the source and the location
+// of the item stay hidden.
+func PublicShare(w http.ResponseWriter, r *http.Request) {
+	token, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, shareBase), "/")
+
+	s, err := shares.Get(token)
+	owner, found := auth.Users.Get(s.Owner)
+	if err != nil || !found {
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: "Share not found"})
+		return
+	}
+	if err := s.Usable(); err != nil {
+		utils.SendJSON(w, http.StatusGone, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		// Stop bodies that could never fit before they fill the disk
+		if limit := uploadLimit(&s); limit >= 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20)
+		}
+		err := r.ParseMultipartForm(32 << 20)
+		var tooBig *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooBig):
+			utils.SendJSON(w, http.StatusRequestEntityTooLarge, utils.Response{Success: false, Message: shares.ErrTooLarge.Error()})
+			return
+		case err != nil && !errors.Is(err, http.ErrNotMultipart):
+			utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Failed to parse form"})
+			return
+		}
+	}
+	if !shareUnlocked(w, r, &s) {
+		return
+	}
+
+	// The link only works as long as its owner could still do the same
+	perm := acl.Read
+	if s.Mode == shares.Upload {
+		perm = acl.Write
+	}
+	drv, err := storage.Get(s.Source)
+	if err != nil || !acl.Allowed(acl.For(&owner), s.Source, s.Path, perm) {
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: "Share not found"})
+		return
+	}
+
+	rel := storage.CleanPath(sub)
+	name := path.Join(s.Path, rel)
+	// Upload links only ever reach the shared folder itself
+	if (!s.IsDir || s.Mode == shares.Upload) && rel != "/" || storage.IsReserved(name) || uploads.IsTemp(name) {
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: "Item not found"})
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && s.Mode == shares.Upload:
+		shareUpload(w, r, drv, &s, name)
+	case r.Method == http.MethodPost && r.MultipartForm != nil && len(r.MultipartForm.File) > 0:
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "This link does not take uploads"})
+	case r.Method == http.MethodPost:
+		// Nothing but unlocking to do here
+		utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Unlocked"})
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+	case s.Mode == shares.Upload:
+		// Visitors may add files but not look around
+		utils.SendJSON(w, http.StatusOK, utils.Response{
+			Success: true,
+			Data: map[string]interface{}{
+				"name":         path.Base(s.Path),
+				"isDir":        true,
+				"mode":         s.Mode,
+				"maxFileSize":  s.MaxFileSize,
+				"remaining":    s.Remaining(),
+				"allowedTypes": s.AllowedTypes,
+				"expires":      s.Expires,
+			},
+		})
+	default:
+		shareRead(w, r, drv, &s, name, rel)
+	}
+}
+
+// shareUnlocked checks the password of a share, answering the request
+// itself when it is missing or wrong. A correct password, sent as the
+// X-Share-Password header or a password form field, sets a cookie so it
+// does not have to be entered again.
+func shareUnlocked(w http.ResponseWriter, r *http.Request, s *shares.Share) bool {
+	if !s.HasPassword() {
+		return true
+	}
+	if c, err := r.Cookie(shareCookie); err == nil && s.CheckUnlockKey(c.Value) {
+		return true
+	}
+
+	password := r.Header.Get("X-Share-Password")
+	if password == "" && r.Method == http.MethodPost {
+		password = r.FormValue("password")
+	}
+	if password == "" || !s.CheckPassword(password) {
+		if password != "" {
+			utils.Warnf("🔒 Wrong password for share %s from %s", s.Token, r.RemoteAddr)
+		}
+		utils.SendJSON(w, http.StatusUnauthorized, utils.Response{
+			Success: false,
+			Message: "Password required",
+			Data:    map[string]bool{"passwordRequired": true},
+		})
+		return false
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareCookie,
+		Value:    s.UnlockKey(),
+		Path:     shareBase + s.Token,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return true
+}
+
+// shareRead serves a file of a read share, or lists or packs a folder
+func shareRead(w http.ResponseWriter, r *http.Request, drv storage.Driver, s *shares.Share, name, rel string) {
+	info, err := drv.Stat(name)
+	if err != nil {
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: "Item not found"})
+		return
+	}
+
+	if info.IsDir() {
+		if format := r.URL.Query().Get("download"); format != "" {
+			shareArchive(w, r, drv, s, name, format)
+			return
+		}
+		shareList(w, drv, name, rel)
+		return
+	}
+
+	// Ranges continue a download that was already counted
+	if r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+		if err := shares.CountDownload(s.Token); err != nil {
+			utils.SendJSON(w, http.StatusGone, utils.Response{Success: false, Message: err.Error()})
+			return
+		}
+	}
+
+	file, err := drv.Open(name)
+	if err != nil {
+		http.Error(w, "Failed to open file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	// Shared files come from outside; never let them run as a page of ours
+	setContentDisposition(w, r, info.Name())
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	utils.Infof("🔗 Share %s: serving %s", s.Token, name)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// shareList lists a folder of a share with paths relative to the share
+func shareList(w http.ResponseWriter, drv storage.Driver, name, rel string) {
+	entries, err := drv.ReadDir(name)
+	if err != nil {
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to read directory"})
+		return
+	}
+
+	files := make([]FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		child := path.Join(name, entry.Name())
+		if storage.IsReserved(child) || uploads.IsTemp(child) {
+			continue
+		}
+		files = append(files, FileInfo{
+			Name:    entry.Name(),
+			Path:    path.Join(rel, entry.Name()),
+			IsDir:   entry.IsDir(),
+			Size:    entry.Size(),
+			ModTime: entry.ModTime(),
+			Ext:     path.Ext(entry.Name()),
+		})
+	}
+
+	utils.SendJSON(w, http.StatusOK, utils.Response{
+		Success: true,
+		Data:    files,
+	})
+}
+
+// shareArchive streams a folder of a share as one archive
+func shareArchive(w http.ResponseWriter, r *http.Request, drv storage.Driver, s *shares.Share, name, format string) {
+	f, err := archive.ParseFormat(format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Type", f.ContentType())
+		return
+	}
+	if err := shares.CountDownload(s.Token); err != nil {
+		utils.SendJSON(w, http.StatusGone, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	aw, err := archive.NewWriter(w, f, archive.DefaultLevel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	root := path.Base(name)
+	if name == "/" {
+		root = "files"
+	}
+	w.Header().Set("Content-Type", f.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", root+f.Ext()))
+	utils.Infof("🔗 Share %s: downloading %s as %s", s.Token, name, f)
+
+	if err := archive.AddTree(aw, drv, name, root); err != nil {
+		utils.Errorf("❌ Share archive download failed at %s: %v", name, err)
+		panic(http.ErrAbortHandler)
+	}
+	if err := aw.Close(); err != nil {
+		utils.Errorf("❌ Share archive download failed: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// uploadLimit is the most a single upload to a share may bring, -1 when
+// there is no limit
+func uploadLimit(s *shares.Share) int64 {
+	if s.Mode != shares.Upload {
+		return -1
+	}
+	limit := s.Remaining()
+	if s.MaxFileSize > 0 && (limit < 0 || s.MaxFileSize < limit) {
+		limit = s.MaxFileSize
+	}
+	return limit
+}
+
+// shareUpload saves a file sent to an upload share. Existing files are
+// never replaced or shown; uploads get a free name instead.
+func shareUpload(w http.ResponseWriter, r *http.Request, drv storage.Driver, s *shares.Share, dir string) {
+	file, header, err := r.FormFile("file")
+	if errors.Is(err, http.ErrMissingFile) {
+		// A password form on its own only unlocks the share
+		utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Unlocked"})
+		return
+	}
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "No file provided"})
+		return
+	}
+	defer file.Close()
+
+	if info, err := drv.Stat(dir); err != nil || !info.IsDir() {
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: "Folder not found"})
+		return
+	}
+
+	fileName := path.Base(strings.ReplaceAll(header.Filename, "\\", "/"))
+	if fileName == "." || fileName == "/" || fileName == ".." {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid file name"})
+		return
+	}
+	name := path.Join(dir, fileName)
+	entry := audit.Entry{User: "share:" + s.Token, Op: "upload", Source: s.Source, Path: name}
+	if storage.IsReserved(name) || uploads.IsTemp(name) {
+		record(r, entry, errors.New("invalid file name"))
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid file name"})
+		return
+	}
+
+	if !s.Accepts(fileName) {
+		record(r, entry, shares.ErrFileType)
+		utils.SendJSON(w, http.StatusUnsupportedMediaType, utils.Response{Success: false, Message: shares.ErrFileType.Error()})
+		return
+	}
+
+	// Book the room first so parallel uploads cannot overrun the limits
+	switch err := shares.Reserve(s.Token, header.Size); {
+	case errors.Is(err, shares.ErrTooLarge), errors.Is(err, shares.ErrFull):
+		record(r, entry, err)
+		utils.SendJSON(w, http.StatusRequestEntityTooLarge, utils.Response{Success: false, Message: err.Error()})
+		return
+	case err != nil:
+		record(r, entry, err)
+		utils.SendJSON(w, http.StatusGone, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	final, n, err := uploads.Save(drv, s.Source, name, file, uploads.Rename, uploads.Checksums{})
+	if err == nil {
+		entry.Path = final
+	}
+	record(r, entry, err)
+	if errors.Is(err, storage.ErrNameTooLong) {
+		shares.Release(s.Token, header.Size)
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: storage.ErrNameTooLong.Error()})
+		return
+	}
+	if err != nil {
+		shares.Release(s.Token, header.Size)
+		utils.Errorf("❌ Share %s: failed to save upload of %s: %v", s.Token, name, err)
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to save file"})
+		return
+	}
+
+	utils.Infof("🔗 Share %s: uploaded %s (%d bytes)", s.Token, final, n)
+	events.Publish(events.Event{Type: events.Create, Source: s.Source, Path: final})
+	if updated, err := shares.Get(s.Token); err == nil {
+		shares.NotifyUpload(updated, final, n)
+	}
+	utils.SendJSON(w, http.StatusOK, utils.Response{
+		Success: true,
+		Message: "Uploaded successfully",
+		// The name it was stored under would tell what else is in there
+		Data: map[string]string{"name": fileName},
+	})
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"filemanager/config"
+	"filemanager/shares"
+)
+
+func shareUploadRequest(t *testing.T, token, name, body string) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(body))
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, shareBase+token, &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestShareUploadsInParallel(t *testing.T) {
+	const uploads = 20
+	dir := mkdir(t, "inbox")
+
+	s := &shares.Share{Source: "files", Path: "/inbox", IsDir: true, Mode: shares.Upload, Owner: "alice"}
+	if err := shares.Create(s, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shares.Revoke(s.Token) })
+
+	var wg sync.WaitGroup
+	codes := make([]int, uploads)
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			PublicShare(w, shareUploadRequest(t, s.Token, "report.txt", fmt.Sprintf("upload %d", i)))
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("upload %d answered %d", i, code)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[string(b)] {
+			t.Errorf("%q was stored twice", b)
+		}
+		seen[string(b)] = true
+	}
+	if len(seen) != uploads {
+		t.Errorf("%d uploads were kept, want %d", len(seen), uploads)
+	}
+
+	got, err := shares.Get(s.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Uploads != uploads {
+		t.Errorf("share counted %d uploads, want %d", got.Uploads, uploads)
+	}
+}
+
+func TestSharePasswordAndDownloadLimit(t *testing.T) {
+	writeFile(t, "shared.txt", "shared contents")
+	t.Cleanup(func() { os.Remove(filepath.Join(root, "shared.txt")) })
+
+	s := &shares.Share{Source: "files", Path: "/shared.txt", Mode: shares.Read, Owner: "alice", MaxDownloads: 2}
+	if err := shares.Create(s, "open sesame"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shares.Revoke(s.Token) })
+
+	var cookie *http.Cookie
+	steps := []struct {
+		name     string
+		password string
+		cookie   bool
+		want     int
+	}{
+		{"no password", "", false, http.StatusUnauthorized},
+		{"wrong password", "open says me", false, http.StatusUnauthorized},
+		{"right password", "open sesame", false, http.StatusOK},
+		{"unlocked by the cookie", "", true, http.StatusOK},
+		{"download limit reached", "", true, http.StatusGone},
+	}
+	for _, st := range steps {
+		r := httptest.NewRequest(http.MethodGet, shareBase+s.Token, nil)
+		if st.password != "" {
+			r.Header.Set("X-Share-Password", st.password)
+		}
+		if st.cookie && cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		PublicShare(w, r)
+		if w.Code != st.want {
+			t.Fatalf("%s: got %d, want %d: %s", st.name, w.Code, st.want, w.Body)
+		}
+		if w.Code == http.StatusOK && w.Body.String() != "shared contents" {
+			t.Errorf("%s: served %q", st.name, w.Body)
+		}
+		for _, c := range w.Result().Cookies() {
+			if c.Name == shareCookie {
+				cookie = c
+			}
+		}
+	}
+
+	// The cookie of one share does not unlock another
+	other := &shares.Share{Source: "files", Path: "/shared.txt", Mode: shares.Read, Owner: "alice"}
+	if err := shares.Create(other, "open sesame"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shares.Revoke(other.Token) })
+	r := httptest.NewRequest(http.MethodGet, shareBase+other.Token, nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	PublicShare(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("cookie of another share: got %d", w.Code)
+	}
+}
+
+func TestShareUploadLimits(t *testing.T) {
+	mkdir(t, "limited")
+	s := &shares.Share{
+		Source: "files", Path: "/limited", IsDir: true, Mode: shares.Upload, Owner: "alice",
+		MaxFileSize: 10, MaxTotalSize: 15, AllowedTypes: []string{".txt"},
+	}
+	if err := shares.Create(s, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shares.Revoke(s.Token) })
+
+	steps := []struct {
+		name string
+		file string
+		body string
+		want int
+	}{
+		{"wrong type", "a.exe", "12345", http.StatusUnsupportedMediaType},
+		{"too large", "a.txt", "12345678901", http.StatusRequestEntityTooLarge},
+		{"fits", "a.txt", "1234567890", http.StatusOK},
+		{"no room left", "b.txt", "123456", http.StatusRequestEntityTooLarge},
+		{"last bytes", "b.txt", "12345", http.StatusOK},
+	}
+	for _, st := range steps {
+		w := httptest.NewRecorder()
+		PublicShare(w, shareUploadRequest(t, s.Token, st.file, st.body))
+		if w.Code != st.want {
+			t.Fatalf("%s: got %d, want %d: %s", st.name, w.Code, st.want, w.Body)
+		}
+	}
+}
+
+func TestShareNotify(t *testing.T) {
+	mkdir(t, "requests")
+	arrived := make(chan shares.Arrival, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a shares.Arrival
+		json.NewDecoder(r.Body).Decode(&a)
+		arrived <- a
+	}))
+	defer hook.Close()
+
+	original, err := os.ReadFile(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.WriteFile(config.Path, original, 0600)
+		config.Reload()
+	})
+	create := func() *httptest.ResponseRecorder {
+		return call(t, "alice", CreateShare, http.MethodPost, "/api/shares/create",
+			map[string]any{"source": "files", "path": "/requests", "mode": "upload", "notify": true})
+	}
+
+	// Without a webhook nobody would hear about the uploads
+	if w := create(); w.Code != http.StatusBadRequest {
+		t.Fatalf("without a webhook: got %d: %s", w.Code, w.Body)
+	}
+
+	withHook := fmt.Sprintf("%s\nshares:\n  webhookURL: %q\n", original, hook.URL)
+	if err := os.WriteFile(config.Path, []byte(withHook), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	w := create()
+	if w.Code != http.StatusOK {
+		t.Fatalf("with a webhook: got %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Data ShareInfo `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shares.Revoke(resp.Data.Token) })
+
+	w = httptest.NewRecorder()
+	PublicShare(w, shareUploadRequest(t, resp.Data.Token, "a.txt", "hello"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: got %d: %s", w.Code, w.Body)
+	}
+	select {
+	case a := <-arrived:
+		if a.Name != "a.txt" || a.Size != 5 || a.Owner != "alice" {
+			t.Errorf("arrival %+v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("webhook not called")
+	}
+}
@@ -1,9 +1,18 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 
+	"filemanager/acl"
+	"filemanager/audit"
+	"filemanager/auth"
 	"filemanager/config"
+	"filemanager/storage"
 	"filemanager/utils"
 )
 
@@ -13,6 +22,306 @@ func GetSources(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sources := config.GetEnabledSources()
+	id := caller(r)
+	sources := []sourceInfo{}
+	for _, src := range config.GetEnabledSources() {
+		if acl.CanSeeSource(id, src.ID) {
+			sources = append(sources, sourceInfo{Source: src, Encrypted: src.Encryption != nil})
+		}
+	}
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Data: sources})
+}
+
+// sourceInfo is a source as users see it
+type sourceInfo struct {
+	config.Source
+	Encrypted bool `json:"encrypted"`
+}
+
+// sourceRequest is a source as the admin API takes it. Secrets left empty
+// keep their current value when a source is updated.
+type sourceRequest struct {
+	ID         string                   `json:"id"`
+	Name       string                   `json:"name"`
+	Path       string                   `json:"path"`
+	Type       string                   `json:"type"`
+	Enabled    *bool                    `json:"enabled"`
+	S3         *config.S3Config         `json:"s3"`
+	SFTP       *config.SFTPConfig       `json:"sftp"`
+	Versioning *config.VersioningConfig `json:"versioning"`
+	Encryption *config.EncryptionConfig `json:"encryption"`
+}
+
+// adminSource is a source as the admin API shows it, with its connection
+// settings but without secrets
+type adminSource struct {
+	config.Source
+	S3         *config.S3Config         `json:"s3,omitempty"`
+	SFTP       *config.SFTPConfig       `json:"sftp,omitempty"`
+	Encryption *config.EncryptionConfig `json:"encryption,omitempty"`
+}
+
+func toAdminSource(src config.Source) adminSource {
+	out := adminSource{Source: src}
+	if src.S3 != nil {
+		s3 := *src.S3
+		s3.SecretKey = ""
+		out.S3 = &s3
+	}
+	if src.SFTP != nil {
+		sftp := *src.SFTP
+		sftp.Password, sftp.Passphrase = "", ""
+		out.SFTP = &sftp
+	}
+	if src.Encryption != nil {
+		enc := *src.Encryption
+		enc.Passphrase = ""
+		out.Encryption = &enc
+	}
+	return out
+}
+
+// source builds the configured source from a request, taking secrets that
+// were left out from prev
+func (req *sourceRequest) source(prev *config.Source) (config.Source, error) {
+	src := config.Source{
+		ID:         req.ID,
+		Name:       strings.TrimSpace(req.Name),
+		Path:       req.Path,
+		Type:       req.Type,
+		Enabled:    req.Enabled == nil || *req.Enabled,
+		S3:         req.S3,
+		SFTP:       req.SFTP,
+		Versioning: req.Versioning,
+		Encryption: req.Encryption,
+	}
+	if src.Type == "" {
+		src.Type = "local"
+	}
+	if prev != nil {
+		if req.Enabled == nil {
+			src.Enabled = prev.Enabled
+		}
+		if src.S3 != nil && prev.S3 != nil && src.S3.SecretKey == "" {
+			src.S3.SecretKey = prev.S3.SecretKey
+		}
+		if src.SFTP != nil && prev.SFTP != nil {
+			if src.SFTP.Password == "" {
+				src.SFTP.Password = prev.SFTP.Password
+			}
+			if src.SFTP.Passphrase == "" {
+				src.SFTP.Passphrase = prev.SFTP.Passphrase
+			}
+		}
+		// Encryption cannot be changed here; leaving it out, or sending
+		// back what ListAllSources showed, keeps it
+		if src.Encryption == nil {
+			src.Encryption = prev.Encryption
+		} else if prev.Encryption != nil && src.Encryption.Passphrase == "" && src.Encryption.KeyFile == "" {
+			enc := *src.Encryption
+			enc.Passphrase, enc.KeyFile = prev.Encryption.Passphrase, prev.Encryption.KeyFile
+			src.Encryption = &enc
+		}
+	}
+
+	switch {
+	case src.Name == "":
+		return src, errors.New("name is required")
+	case !slices.Contains(storage.Types(), src.Type):
+		return src, fmt.Errorf("unknown source type %q", src.Type)
+	case src.Type == "s3" && (src.S3 == nil || src.S3.Bucket == ""):
+		return src, errors.New("s3 sources need s3.bucket")
+	case src.Type == "sftp" && (src.SFTP == nil || src.SFTP.Host == ""):
+		return src, errors.New("sftp sources need sftp.host")
+	case src.Type != "s3" && src.Path == "":
+		return src, errors.New("path is required")
+	}
+	if src.Type != "s3" {
+		src.S3 = nil
+	}
+	if src.Type != "sftp" {
+		src.SFTP = nil
+	}
+	return src, nil
+}
+
+// sendSourceError answers a failed change to the sources
+func sendSourceError(w http.ResponseWriter, err error) {
+	var invalid *config.ValidationError
+	switch {
+	case errors.As(err, &invalid):
+		sendInvalidConfig(w, invalid)
+	case errors.Is(err, config.ErrSourceNotFound):
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: err.Error()})
+	case errors.Is(err, config.ErrSourceFromEnv):
+		utils.SendJSON(w, http.StatusConflict, utils.Response{Success: false, Message: err.Error()})
+	case errors.Is(err, config.ErrEncryptionChange):
+		utils.SendJSON(w, http.StatusConflict, utils.Response{Success: false, Message: err.Error()})
+	case errors.Is(err, config.ErrSourceExists):
+		utils.SendJSON(w, http.StatusConflict, utils.Response{Success: false, Message: err.Error()})
+	default:
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to update config: " + err.Error()})
+	}
+}
+
+// sendInvalidConfig answers with the problems that kept a configuration
+// from being used
+func sendInvalidConfig(w http.ResponseWriter, err *config.ValidationError) {
+	utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: err.Error(), Data: err.Problems})
+}
+
+// List every configured source, enabled or not
+func ListAllSources(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	sources := make([]adminSource, 0)
+	for _, src := range config.Get().Sources {
+		sources = append(sources, toAdminSource(src))
+	}
 	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Data: sources})
 }
+
+// Add a source and save it to config.yaml
+func AddSource(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	var req sourceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid request"})
+		return
+	}
+	src, err := req.source(nil)
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	src, err = config.AddSource(src)
+	record(r, audit.Entry{Op: "source-add", Source: src.ID}, err)
+	if err != nil {
+		sendSourceError(w, err)
+		return
+	}
+
+	utils.Infof("📁 Source %s added by %s", src.Name, auth.CurrentUser(r).Username)
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Source added", Data: toAdminSource(src)})
+}
+
+// Change the settings of a source and save them to config.yaml. The ID
+// stays the same when the source is renamed.
+func UpdateSource(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	var req sourceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid request"})
+		return
+	}
+
+	prev, ok := config.GetSource(req.ID)
+	if !ok {
+		sendSourceError(w, config.ErrSourceNotFound)
+		return
+	}
+	src, err := req.source(&prev)
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	src, err = config.UpdateSource(req.ID, src)
+	record(r, audit.Entry{Op: "source-update", Source: req.ID}, err)
+	if err != nil {
+		sendSourceError(w, err)
+		return
+	}
+
+	utils.Infof("📁 Source %s updated by %s", src.Name, auth.CurrentUser(r).Username)
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Source updated", Data: toAdminSource(src)})
+}
+
+// Turn a source on or off
+func EnableSource(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		ID      string `json:"id"`
+		Enabled bool   `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid request"})
+		return
+	}
+
+	op := "source-disable"
+	if req.Enabled {
+		op = "source-enable"
+	}
+	err := config.SetSourceEnabled(req.ID, req.Enabled)
+	record(r, audit.Entry{Op: op, Source: req.ID}, err)
+	if err != nil {
+		sendSourceError(w, err)
+		return
+	}
+
+	utils.Infof("📁 Source %s %sd by %s", req.ID, strings.TrimPrefix(op, "source-"), auth.CurrentUser(r).Username)
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Source updated"})
+}
+
+// Remove a source from config.yaml. Its files are not touched.
+func RemoveSource(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid request"})
+		return
+	}
+
+	err := config.RemoveSource(req.ID)
+	record(r, audit.Entry{Op: "source-remove", Source: req.ID}, err)
+	if err != nil {
+		sendSourceError(w, err)
+		return
+	}
+
+	utils.Infof("📁 Source %s removed by %s", req.ID, auth.CurrentUser(r).Username)
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Source removed"})
+}
+
+// Read config.yaml again
+func ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	var invalid *config.ValidationError
+	if err := config.Reload(); errors.As(err, &invalid) {
+		sendInvalidConfig(w, invalid)
+		return
+	} else if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Failed to reload config: " + err.Error()})
+		return
+	}
+
+	utils.Infof("🔄 Config reloaded by %s", auth.CurrentUser(r).Username)
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Config reloaded"})
+}
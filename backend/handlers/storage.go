@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
-	"path/filepath"
 
+	"filemanager/acl"
 	"filemanager/config"
+	"filemanager/storage"
 	"filemanager/utils"
 )
 
@@ -20,26 +22,22 @@ type StorageInfo struct {
 func GetStorageInfo(w http.ResponseWriter, r *http.Request) {
 	sourceID := r.URL.Query().Get("source")
 	if sourceID == "" {
-		sources := config.GetEnabledSources()
-		if len(sources) > 0 {
-			sourceID = sources[0].ID
-		}
+		// Default to first source the caller can see
+		sourceID = defaultSource(r)
 	}
 
-	var source *config.Source
-	for _, s := range config.AppConfig.Sources {
-		if s.ID == sourceID {
-			source = &s
-			break
-		}
+	source, ok := config.GetSource(sourceID)
+	if !ok {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Source not found"})
+		return
 	}
 
-	if source == nil {
-		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Source not found"})
+	if !acl.CanSeeSource(caller(r), sourceID) {
+		sendForbidden(w)
 		return
 	}
 
-	info, err := getDiskUsage(source.Path)
+	info, err := getDiskUsage(source)
 	if err != nil {
 		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
 			Success: false,
@@ -54,26 +52,30 @@ func GetStorageInfo(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// getDiskUsage gets disk usage for a given path
-func getDiskUsage(path string) (*StorageInfo, error) {
-	// Get absolute path
-	absPath, err := filepath.Abs(path)
+// getDiskUsage gets disk usage for a source from its driver
+func getDiskUsage(source config.Source) (*StorageInfo, error) {
+	drv, err := storage.Get(source.ID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get disk stats based on OS
-	total, free, err := getDiskStats(absPath)
-	if err != nil {
+	total, free, err := drv.DiskUsage()
+	if errors.Is(err, errors.ErrUnsupported) {
+		// Object stores and remote shares have no fixed capacity to report
+		total, free = 0, 0
+	} else if err != nil {
 		return nil, err
 	}
 
-	used := total - free
+	path := source.Path
+	if local, ok := drv.(*storage.Local); ok {
+		path = local.Root()
+	}
 
 	return &StorageInfo{
 		Total: total,
-		Used:  used,
+		Used:  total - free,
 		Free:  free,
-		Path:  absPath,
+		Path:  path,
 	}, nil
 }
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filemanager/acl"
+	"filemanager/jobs"
+	"filemanager/storage"
+	"filemanager/thumbs"
+	"filemanager/utils"
+)
+
+// Serve a resized image, rendering and caching it on first use
+func ServeThumbnail(w http.ResponseWriter, r *http.Request) {
+	sourceID := r.URL.Query().Get("source")
+	path := strings.ReplaceAll(r.URL.Query().Get("path"), "\\", "/")
+
+	size, ok := thumbs.SizeParam(r.URL.Query().Get("size"))
+	if sourceID == "" || path == "" || !ok {
+		http.Error(w, "Missing or invalid parameters", http.StatusBadRequest)
+		return
+	}
+
+	drv, name, err := storage.Resolve(sourceID, path)
+	if err != nil {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if !can(r, sourceID, name, acl.Read) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	thumb, err := thumbs.Get(drv, sourceID, name, size)
+	if errors.Is(err, thumbs.ErrNotCached) {
+		serveUncachedThumbnail(w, r, drv, name, size)
+		return
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	case errors.Is(err, thumbs.ErrUnsupported), errors.Is(err, thumbs.ErrTooLarge):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case err != nil:
+		utils.Errorf("❌ Thumbnail failed for %s: %v", path, err)
+		http.Error(w, "Failed to create thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	file, err := os.Open(thumb)
+	if err != nil {
+		http.Error(w, "Failed to open thumbnail", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Failed to open thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	// The cache file name changes with the image, so it doubles as an ETag
+	w.Header().Set("ETag", `"`+strings.TrimSuffix(filepath.Base(thumb), filepath.Ext(thumb))+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(w, r, filepath.Base(name), info.ModTime(), file)
+}
+
+// serveUncachedThumbnail renders a thumbnail of an encrypted source for
+// this one request
+func serveUncachedThumbnail(w http.ResponseWriter, r *http.Request, drv storage.Driver, name string, size int) {
+	info, err := drv.Stat(name)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	var buf bytes.Buffer
+	err = thumbs.Render(drv, name, size, &buf)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	case errors.Is(err, thumbs.ErrUnsupported), errors.Is(err, thumbs.ErrTooLarge):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case err != nil:
+		utils.Errorf("❌ Thumbnail failed for %s: %v", name, err)
+		http.Error(w, "Failed to create thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(w, r, filepath.Base(name), info.ModTime(), bytes.NewReader(buf.Bytes()))
+}
+
+// Render the thumbnails below a folder in the background
+func PregenerateThumbnails(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		Source string `json:"source"`
+		Path   string `json:"path"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid request"})
+		return
+	}
+
+	drv, name, err := storage.Resolve(req.Source, req.Path)
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	params := jobs.Params{SourceID: req.Source, SourcePath: name}
+	if !allowedJob(r, jobs.Thumbnails, params) {
+		sendForbidden(w)
+		return
+	}
+
+	if _, err := drv.Stat(name); err != nil {
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: "Item not found"})
+		return
+	}
+
+	submitJob(w, r, jobs.Thumbnails, params)
+}
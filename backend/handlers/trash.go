@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"filemanager/acl"
+	"filemanager/audit"
+	"filemanager/events"
+	"filemanager/storage"
+	"filemanager/trash"
+	"filemanager/utils"
+)
+
+// List the items in the trash of a source
+func ListTrash(w http.ResponseWriter, r *http.Request) {
+	sourceID := r.URL.Query().Get("source")
+	if sourceID == "" {
+		sourceID = defaultSource(r)
+	}
+
+	drv, err := storage.Get(sourceID)
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	items, err := trash.List(drv)
+	if err != nil {
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
+			Success: false,
+			Message: "Failed to read trash",
+		})
+		return
+	}
+
+	// Only show what the caller could read where it came from
+	id := caller(r)
+	visible := make([]trash.Item, 0, len(items))
+	for _, item := range items {
+		if acl.Allowed(id, sourceID, item.OriginalPath, acl.Read) {
+			visible = append(visible, item)
+		}
+	}
+
+	utils.SendJSON(w, http.StatusOK, utils.Response{
+		Success: true,
+		Data:    visible,
+	})
+}
+
+// Restore a trash item to its original location
+func RestoreTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{
+			Success: false,
+			Message: "Method not allowed",
+		})
+		return
+	}
+
+	var req struct {
+		Source string `json:"source"`
+		ID     string `json:"id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: "Invalid request",
+		})
+		return
+	}
+
+	drv, item, ok := trashItem(w, req.Source, req.ID)
+	if !ok {
+		return
+	}
+
+	entry := audit.Entry{Op: "restore", Source: req.Source, Path: item.OriginalPath}
+	if !can(r, req.Source, item.OriginalPath, acl.Write) {
+		sendDenied(w, r, entry)
+		return
+	}
+
+	restored, err := trash.Restore(drv, item.ID)
+	if err == nil {
+		entry.Dest = restored
+	}
+	record(r, entry, err)
+	if err != nil {
+		utils.Errorf("❌ Failed to restore %s: %v", item.OriginalPath, err)
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
+			Success: false,
+			Message: "Failed to restore",
+		})
+		return
+	}
+
+	utils.Infof("♻️  Restored: %s", restored)
+	events.Publish(events.Event{Type: events.Create, Source: req.Source, Path: restored})
+	utils.SendJSON(w, http.StatusOK, utils.Response{
+		Success: true,
+		Message: "Restored successfully",
+		Data:    map[string]string{"path": restored},
+	})
+}
+
+// Permanently delete one trash item, or every item the caller may delete
+// when no id is given
+func PurgeTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{
+			Success: false,
+			Message: "Method not allowed",
+		})
+		return
+	}
+
+	var req struct {
+		Source string `json:"source"`
+		ID     string `json:"id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: "Invalid request",
+		})
+		return
+	}
+
+	if req.ID != "" {
+		drv, item, ok := trashItem(w, req.Source, req.ID)
+		if !ok {
+			return
+		}
+		entry := audit.Entry{Op: "purge", Source: req.Source, Path: item.OriginalPath}
+		if !can(r, req.Source, item.OriginalPath, acl.Delete) {
+			sendDenied(w, r, entry)
+			return
+		}
+		err := trash.Purge(drv, item.ID)
+		record(r, entry, err)
+		if err != nil {
+			utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
+				Success: false,
+				Message: "Failed to delete",
+			})
+			return
+		}
+
+		utils.Infof("🗑️  Purged from trash: %s", item.OriginalPath)
+		utils.SendJSON(w, http.StatusOK, utils.Response{
+			Success: true,
+			Message: "Deleted permanently",
+		})
+		return
+	}
+
+	drv, err := storage.Get(req.Source)
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	items, err := trash.List(drv)
+	if err != nil {
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
+			Success: false,
+			Message: "Failed to read trash",
+		})
+		return
+	}
+
+	id := caller(r)
+	purged := 0
+	for _, item := range items {
+		if !acl.Allowed(id, req.Source, item.OriginalPath, acl.Delete) {
+			continue
+		}
+		err := trash.Purge(drv, item.ID)
+		record(r, audit.Entry{Op: "purge", Source: req.Source, Path: item.OriginalPath}, err)
+		if err != nil {
+			utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
+				Success: false,
+				Message: "Failed to empty trash",
+			})
+			return
+		}
+		purged++
+	}
+
+	utils.Infof("🗑️  Emptied trash of %s (%d items)", req.Source, purged)
+	utils.SendJSON(w, http.StatusOK, utils.Response{
+		Success: true,
+		Message: "Trash emptied",
+		Data:    map[string]int{"purged": purged},
+	})
+}
+
+// trashItem looks up a trash item, answering the request itself when that
+// fails
+func trashItem(w http.ResponseWriter, sourceID, itemID string) (storage.Driver, *trash.Item, bool) {
+	drv, err := storage.Get(sourceID)
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return nil, nil, false
+	}
+
+	item, err := trash.Get(drv, itemID)
+	if errors.Is(err, trash.ErrNotFound) {
+		utils.SendJSON(w, http.StatusNotFound, utils.Response{
+			Success: false,
+			Message: "Trash item not found",
+		})
+		return nil, nil, false
+	}
+	if err != nil {
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{
+			Success: false,
+			Message: "Failed to read trash",
+		})
+		return nil, nil, false
+	}
+	return drv, item, true
+}
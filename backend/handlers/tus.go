@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"filemanager/acl"
+	"filemanager/audit"
+	"filemanager/auth"
+	"filemanager/events"
+	"filemanager/storage"
+	"filemanager/uploads"
+	"filemanager/utils"
+)
+
+// tusVersion is the only version of the tus protocol the server speaks
+const tusVersion = "1.0.0"
+
+// tusBase is where uploads are created; each upload lives below it at
+// <source>/<id>
+const tusBase = "/api/tus/"
+
+// TusHeaders adds the tus protocol headers to every response, including
+// the OPTIONS requests answered by the CORS middleware
+func TusHeaders(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.Header().Set("Tus-Extension", "creation,termination,expiration")
+		}
+		next(w, r)
+	}
+}
+
+// Resumable uploads following the tus protocol: POST creates an upload,
+// HEAD reports how much has arrived, PATCH adds data and DELETE drops it
+func TusUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	// Kept escaped, ownUpload unescapes the parts of <source>/<id>
+	rest := strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), strings.TrimSuffix(tusBase, "/")), "/")
+	if rest == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createUpload(w, r)
+		return
+	}
+
+	drv, u, ok := ownUpload(w, r, rest)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(u.Size, 10))
+		w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		patchUpload(w, r, drv, u)
+	case http.MethodDelete:
+		if err := uploads.Terminate(drv, u.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createUpload starts an upload into the folder given by the source and
+// path query parameters, or the metadata of the same names. The file name
+// comes from the filename metadata.
+func createUpload(w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "Missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+
+	sourceID := r.URL.Query().Get("source")
+	if sourceID == "" {
+		sourceID = meta["source"]
+	}
+	dirPath := r.URL.Query().Get("path")
+	if dirPath == "" {
+		dirPath = meta["path"]
+	}
+	fileName := meta["filename"]
+	if fileName == "" {
+		fileName = meta["name"]
+	}
+	fileName = path.Base(strings.ReplaceAll(fileName, "\\", "/"))
+	if sourceID == "" || fileName == "" || fileName == "." || fileName == "/" || fileName == ".." {
+		http.Error(w, "Missing source or file name", http.StatusBadRequest)
+		return
+	}
+
+	drv, name, err := storage.Resolve(sourceID, path.Join("/", dirPath, fileName))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry := audit.Entry{Op: "upload", Source: sourceID, Path: name}
+	if !can(r, sourceID, name, acl.Write) {
+		record(r, entry, errDenied)
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	policy, err := uploads.ParsePolicy(meta["overwrite"])
+	if err != nil {
+		record(r, entry, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sums, err := uploads.ParseChecksums(meta["sha256"], meta["md5"])
+	if err != nil {
+		record(r, entry, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Say no before any data is sent when the file could not be saved
+	if err := uploads.Check(drv, name, policy); err != nil {
+		record(r, entry, err)
+		sendUploadError(w, name, err)
+		return
+	}
+
+	u := &uploads.Upload{
+		Source:    sourceID,
+		Path:      name,
+		Size:      size,
+		Metadata:  meta,
+		Policy:    policy,
+		Checksums: sums,
+		Owner:     auth.CurrentUser(r).Username,
+	}
+	if err := uploads.Create(drv, u); err != nil {
+		record(r, entry, err)
+		utils.Errorf("❌ Failed to start upload of %s: %v", name, err)
+		http.Error(w, "Failed to start upload", http.StatusInternalServerError)
+		return
+	}
+
+	utils.Infof("Upload started: %s (%d bytes)", name, size)
+	w.Header().Set("Location", tusBase+url.PathEscape(sourceID)+"/"+u.ID)
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+
+	// Empty files are complete right away
+	if size == 0 {
+		if !finishUpload(w, r, drv, u) {
+			return
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func patchUpload(w http.ResponseWriter, r *http.Request, drv storage.Driver, u *uploads.Upload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength > u.Size-u.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		http.Error(w, uploads.ErrTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	newOffset, err := uploads.Write(drv, u, offset, r.Body)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	switch {
+	case errors.Is(err, uploads.ErrOffset):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, uploads.ErrBusy):
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	case errors.Is(err, uploads.ErrTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		utils.Warnf("⚠️  Upload %s stopped at %d bytes: %v", u.ID, newOffset, err)
+		http.Error(w, "Failed to save data", http.StatusInternalServerError)
+		return
+	}
+
+	if newOffset == u.Size && !finishUpload(w, r, drv, u) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload moves a complete upload into place, answering the request
+// itself when that fails
+func finishUpload(w http.ResponseWriter, r *http.Request, drv storage.Driver, u *uploads.Upload) bool {
+	entry := audit.Entry{Op: "upload", Source: u.Source, Path: u.Path}
+
+	// Permissions may have changed while the data was coming in
+	if !can(r, u.Source, u.Path, acl.Write) {
+		record(r, entry, errDenied)
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return false
+	}
+
+	final, err := uploads.Finish(drv, u)
+	if err == nil {
+		entry.Path = final
+	}
+	record(r, entry, err)
+	if err != nil {
+		sendUploadError(w, u.Path, err)
+		return false
+	}
+
+	utils.Infof("Uploaded: %s (%d bytes)", final, u.Size)
+	w.Header().Set("Upload-Path", final)
+	events.Publish(events.Event{Type: events.Create, Source: u.Source, Path: final})
+	return true
+}
+
+// sendUploadError answers an upload that could not be saved
+func sendUploadError(w http.ResponseWriter, name string, err error) {
+	switch {
+	case errors.Is(err, uploads.ErrExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, uploads.ErrChecksum):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, uploads.ErrBusy):
+		http.Error(w, err.Error(), http.StatusLocked)
+	case errors.Is(err, storage.ErrNameTooLong):
+		http.Error(w, storage.ErrNameTooLong.Error(), http.StatusBadRequest)
+	default:
+		utils.Errorf("❌ Failed to save upload of %s: %v", name, err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+	}
+}
+
+// ownUpload looks up an upload of the caller from the escaped
+// <source>/<id>, answering the request itself when there is none
+func ownUpload(w http.ResponseWriter, r *http.Request, rest string) (storage.Driver, *uploads.Upload, bool) {
+	i := strings.LastIndex(rest, "/")
+	sourceID, err := url.PathUnescape(rest[:max(i, 0)])
+	var id string
+	if err == nil {
+		id, err = url.PathUnescape(rest[i+1:])
+	}
+	if i < 0 || err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	drv, err := storage.Get(sourceID)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	u, err := uploads.Get(drv, id)
+	if err != nil || u.Owner != auth.CurrentUser(r).Username || u.Source != sourceID {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if time.Now().After(u.Expires) {
+		http.Error(w, "Upload expired", http.StatusGone)
+		return nil, nil, false
+	}
+	return drv, u, true
+}
+
+// parseUploadMetadata decodes "key base64value,key2 base64value2"
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, " ")
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"filemanager/auth"
+)
+
+// tus sends a tus protocol request of the signed in user
+func tus(t *testing.T, username, method, target string, header map[string]string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, r)
+	s, err := auth.NewSession(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	auth.Middleware(TusHeaders(TusUpload))(w, req)
+	return w
+}
+
+func TestTusUploadPaths(t *testing.T) {
+	mkdir(t, "tus")
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt"))
+	w := tus(t, "alice", http.MethodPost, "/api/tus/?source=files&path=/tus", map[string]string{
+		"Upload-Length":   "5",
+		"Upload-Metadata": meta,
+	}, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	loc := w.Header().Get("Location")
+	id := loc[strings.LastIndex(loc, "/")+1:]
+
+	tests := []struct {
+		name   string
+		user   string
+		target string
+		want   int
+	}{
+		{"location", "alice", loc, http.StatusOK},
+		{"escaped source", "alice", "/api/tus/%66iles/" + id, http.StatusOK},
+		{"escaped twice", "alice", "/api/tus/%2566iles/" + id, http.StatusNotFound},
+		{"escaped id twice", "alice", "/api/tus/files/%25" + id, http.StatusNotFound},
+		{"other user", "bob", loc, http.StatusNotFound},
+		{"no id", "alice", "/api/tus/files", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := tus(t, tt.user, http.MethodHead, tt.target, nil, "")
+			if w.Code != tt.want {
+				t.Fatalf("HEAD %s: %d, want %d", tt.target, w.Code, tt.want)
+			}
+		})
+	}
+
+	w = tus(t, "alice", http.MethodPatch, loc, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	}, "hello")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("patch: %d %s", w.Code, w.Body)
+	}
+	if got := contents(t, "tus/a.txt"); got != "hello" {
+		t.Errorf("uploaded %q, want %q", got, "hello")
+	}
+}
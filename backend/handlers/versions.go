@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"filemanager/acl"
+	"filemanager/audit"
+	"filemanager/events"
+	"filemanager/storage"
+	"filemanager/uploads"
+	"filemanager/utils"
+	"filemanager/versions"
+)
+
+// List the earlier versions of a file, newest first
+func ListVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	sourceID := r.URL.Query().Get("source")
+	drv, name, err := storage.Resolve(sourceID, r.URL.Query().Get("path"))
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	if !can(r, sourceID, name, acl.Read) {
+		sendForbidden(w)
+		return
+	}
+
+	list, err := versions.List(drv, name)
+	if err != nil {
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to read versions"})
+		return
+	}
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Data: list})
+}
+
+// Serve an earlier version of a file, inline or with download=true as an
+// attachment
+func ServeVersion(w http.ResponseWriter, r *http.Request) {
+	sourceID := r.URL.Query().Get("source")
+	id := r.URL.Query().Get("id")
+	p := strings.ReplaceAll(r.URL.Query().Get("path"), "\\", "/")
+	if sourceID == "" || p == "" || id == "" {
+		http.Error(w, "Missing parameters", http.StatusBadRequest)
+		return
+	}
+
+	drv, name, err := storage.Resolve(sourceID, p)
+	if err != nil {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if !can(r, sourceID, name, acl.Read) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	v, err := versions.Get(drv, name, id)
+	if errors.Is(err, versions.ErrNotFound) {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read versions", http.StatusInternalServerError)
+		return
+	}
+
+	file, err := versions.Open(drv, v)
+	if err != nil {
+		http.Error(w, "Failed to open version", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	fileName := path.Base(name)
+	setContentDisposition(w, r, fileName)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.FormatInt(v.Size, 10))
+	// Versions never change, the content hash identifies them
+	w.Header().Set("ETag", `"`+v.Hash+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+
+	utils.Infof("Serving version %s of %s", v.ID, name)
+	http.ServeContent(w, r, fileName, v.ModTime, file)
+}
+
+// Put an earlier version of a file back in place. The contents it
+// replaces become a version themselves.
+func RestoreVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		utils.SendJSON(w, http.StatusMethodNotAllowed, utils.Response{Success: false, Message: "Method not allowed"})
+		return
+	}
+
+	var req struct {
+		Source string `json:"source"`
+		Path   string `json:"path"`
+		ID     string `json:"id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: "Invalid request"})
+		return
+	}
+
+	drv, name, err := storage.Resolve(req.Source, req.Path)
+	if err != nil {
+		utils.SendJSON(w, http.StatusBadRequest, utils.Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	entry := audit.Entry{Op: "restore-version", Source: req.Source, Path: name}
+	if !can(r, req.Source, name, acl.Write) {
+		sendDenied(w, r, entry)
+		return
+	}
+
+	v, err := versions.Get(drv, name, req.ID)
+	if err != nil {
+		record(r, entry, err)
+		if errors.Is(err, versions.ErrNotFound) {
+			utils.SendJSON(w, http.StatusNotFound, utils.Response{Success: false, Message: err.Error()})
+			return
+		}
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to read versions"})
+		return
+	}
+
+	_, statErr := drv.Stat(name)
+	existed := statErr == nil
+
+	err = drv.MkdirAll(path.Dir(name))
+	if err == nil {
+		tmp := uploads.TempPath(name)
+		if err = versions.Copy(drv, v, tmp); err == nil {
+			_, err = uploads.Place(drv, req.Source, tmp, name, uploads.Replace)
+		}
+		if err != nil {
+			drv.RemoveAll(tmp)
+		}
+	}
+	record(r, entry, err)
+	if err != nil {
+		utils.Errorf("❌ Failed to restore version %s of %s: %v", v.ID, name, err)
+		utils.SendJSON(w, http.StatusInternalServerError, utils.Response{Success: false, Message: "Failed to restore version"})
+		return
+	}
+
+	typ := events.Create
+	if existed {
+		typ = events.Modify
+	}
+	events.Publish(events.Event{Type: typ, Source: req.Source, Path: name})
+	utils.Infof("🕘 Restored version %s of %s", v.ID, name)
+	utils.SendJSON(w, http.StatusOK, utils.Response{Success: true, Message: "Version restored"})
+}
@@ -0,0 +1,130 @@
+package jobs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path"
+
+	"filemanager/archive"
+	"filemanager/events"
+	"filemanager/storage"
+)
+
+// runExtract unpacks an archive into a new folder of the same source
+func runExtract(ctx context.Context, t *Task, p Params) error {
+	drv, err := storage.Get(p.SourceID)
+	if err != nil {
+		return err
+	}
+
+	dst, err := prepareTarget(t, drv, p)
+	if err != nil {
+		return err
+	}
+
+	err = archive.Extract(ctx, drv, storage.CleanPath(p.SourcePath), dst, archive.ExtractLimits(), p.Resume, t)
+	events.Publish(events.Event{Type: events.Create, Source: p.SourceID, Path: dst})
+	return err
+}
+
+// runCompress packs items of a source into an archive in the same source.
+// The archive is built in the reserved area first, so it never ends up
+// inside itself and only appears once it is complete.
+func runCompress(ctx context.Context, t *Task, p Params) error {
+	drv, err := storage.Get(p.SourceID)
+	if err != nil {
+		return err
+	}
+	format, err := archive.ParseFormat(p.Format)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, len(p.Paths))
+	var all []item
+	for i, name := range p.Paths {
+		names[i] = storage.CleanPath(name)
+		items, err := scan(t, drv, names[i])
+		if err != nil {
+			return err
+		}
+		all = append(all, items...)
+	}
+	setTotals(t, all)
+
+	dst, err := prepareTarget(t, drv, p)
+	if err != nil {
+		return err
+	}
+
+	tmpDir := storage.MetaDir + "/tmp"
+	if err := drv.MkdirAll(tmpDir); err != nil {
+		return err
+	}
+	tmp := path.Join(tmpDir, t.snapshot().ID+format.Ext())
+
+	out, err := drv.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = writeArchive(ctx, t, out, drv, p.SourceID, names, format, p.Level)
+	if err == nil {
+		err = out.Close()
+	} else {
+		storage.Abort(out)
+	}
+	if err == nil {
+		err = drv.Rename(tmp, dst)
+	}
+	if err != nil {
+		drv.RemoveAll(tmp)
+		return err
+	}
+
+	events.Publish(events.Event{Type: events.Create, Source: p.SourceID, Path: dst})
+	return nil
+}
+
+func writeArchive(ctx context.Context, t *Task, w io.Writer, drv storage.Driver, sourceID string, names []string, format archive.Format, level int) error {
+	aw, err := archive.NewWriter(w, format, level)
+	if err != nil {
+		return err
+	}
+
+	pw := &progressWriter{Writer: aw, ctx: ctx, t: t}
+	entries := archive.EntryNames(sourceID, names)
+	for i, name := range names {
+		if err := archive.AddTree(pw, drv, name, entries[i]); err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+// progressWriter counts archived items on the task and stops once the job
+// is canceled
+type progressWriter struct {
+	archive.Writer
+	ctx context.Context
+	t   *Task
+}
+
+func (p *progressWriter) AddDir(name string, info fs.FileInfo) error {
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	if err := p.Writer.AddDir(name, info); err != nil {
+		return err
+	}
+	p.t.FileDone()
+	return nil
+}
+
+func (p *progressWriter) AddFile(name string, info fs.FileInfo, r io.Reader) error {
+	if err := p.Writer.AddFile(name, info, &progressReader{ctx: p.ctx, r: r, t: p.t}); err != nil {
+		return err
+	}
+	p.t.FileDone()
+	return nil
+}
@@ -0,0 +1,444 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"filemanager/audit"
+	"filemanager/utils"
+)
+
+// Kind names the operation a job performs
+type Kind string
+
+const (
+	Copy       Kind = "copy"
+	Move       Kind = "move"
+	Delete     Kind = "delete"
+	Thumbnails Kind = "thumbnails"
+	Extract    Kind = "extract"
+	Compress   Kind = "compress"
+)
+
+// Status is the state a job is in
+type Status string
+
+const (
+	Queued   Status = "queued"
+	Running  Status = "running"
+	Done     Status = "done"
+	Failed   Status = "failed"
+	Canceled Status = "canceled"
+)
+
+const (
+	// maxRunning caps how many jobs copy data at the same time
+	maxRunning = 2
+	// keepFinished is how long finished jobs stay in the list
+	keepFinished = 24 * time.Hour
+)
+
+var ErrNotFound = errors.New("job not found")
+
+// Params describe what a job works on. Delete jobs only use the source
+// fields; compress jobs pack Paths into the archive at Destination.
+type Params struct {
+	SourceID    string   `json:"sourceId"`
+	SourcePath  string   `json:"sourcePath,omitempty"`
+	Paths       []string `json:"paths,omitempty"`
+	DestID      string   `json:"destId,omitempty"`
+	Destination string   `json:"destination,omitempty"`
+	Permanent   bool     `json:"permanent,omitempty"`
+	Format      string   `json:"format,omitempty"`
+	Level       int      `json:"level,omitempty"`
+	// Resume continues an earlier attempt into the same destination,
+	// skipping files that already made it there
+	Resume bool `json:"resume,omitempty"`
+}
+
+// Progress counts the work done so far
+type Progress struct {
+	FilesDone  int   `json:"filesDone"`
+	FilesTotal int   `json:"filesTotal"`
+	BytesDone  int64 `json:"bytesDone"`
+	BytesTotal int64 `json:"bytesTotal"`
+}
+
+// FileError records a single item a job could not handle
+type FileError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// Job is the state of a background operation as reported to clients
+type Job struct {
+	ID       string      `json:"id"`
+	Kind     Kind        `json:"kind"`
+	Owner    string      `json:"owner"`
+	Params   Params      `json:"params"`
+	Status   Status      `json:"status"`
+	Message  string      `json:"message,omitempty"`
+	Target   string      `json:"target,omitempty"`
+	Progress Progress    `json:"progress"`
+	Errors   []FileError `json:"errors"`
+	Created  time.Time   `json:"created"`
+	Started  *time.Time  `json:"started,omitempty"`
+	Finished *time.Time  `json:"finished,omitempty"`
+}
+
+// Task is a job while it runs; the operations report their progress on it
+type Task struct {
+	mu     sync.Mutex
+	job    Job
+	cancel context.CancelFunc
+}
+
+func (t *Task) snapshot() Job {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	j := t.job
+	j.Errors = append([]FileError{}, t.job.Errors...)
+	return j
+}
+
+func (t *Task) update(fn func(j *Job)) {
+	t.mu.Lock()
+	fn(&t.job)
+	t.mu.Unlock()
+}
+
+// SetTotal sets the amount of work the job has to do
+func (t *Task) SetTotal(files int, bytes int64) {
+	t.update(func(j *Job) {
+		j.Progress.FilesTotal = files
+		j.Progress.BytesTotal = bytes
+	})
+}
+
+// AddBytes counts transferred data
+func (t *Task) AddBytes(n int64) {
+	t.update(func(j *Job) { j.Progress.BytesDone += n })
+}
+
+// FileDone counts a finished item
+func (t *Task) FileDone() {
+	t.update(func(j *Job) { j.Progress.FilesDone++ })
+}
+
+// FileFailed records an item that could not be handled and moves on
+func (t *Task) FileFailed(name string, err error) {
+	utils.Warnf("⚠️  Job %s: %s: %v", t.job.ID, name, err)
+	t.update(func(j *Job) {
+		j.Errors = append(j.Errors, FileError{Path: name, Error: err.Error()})
+	})
+}
+
+// SetTarget records where the job puts its result. It is saved right away
+// so that a retry after a crash continues into the same place.
+func (t *Task) SetTarget(name string) {
+	t.update(func(j *Job) { j.Target = name })
+	persist()
+}
+
+var (
+	mu    sync.Mutex
+	tasks = map[string]*Task{}
+	file  string
+	slots = make(chan struct{}, maxRunning)
+)
+
+// Init loads the job history from the data directory. Jobs that were still
+// running when the server stopped are marked as failed so they can be
+// retried.
+func Init(dataDir string) error {
+	file = filepath.Join(dataDir, "jobs.json")
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []Job
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, j := range list {
+		if j.Status == Queued || j.Status == Running {
+			now := time.Now()
+			j.Status = Failed
+			j.Message = "Interrupted by a server restart"
+			j.Finished = &now
+		}
+		tasks[j.ID] = &Task{job: j}
+	}
+	return nil
+}
+
+func newID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Submit queues a new job and starts it as soon as a slot is free
+func Submit(kind Kind, owner string, params Params) Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Task{
+		job: Job{
+			ID:      newID(),
+			Kind:    kind,
+			Owner:   owner,
+			Params:  params,
+			Status:  Queued,
+			Errors:  []FileError{},
+			Created: time.Now(),
+		},
+		cancel: cancel,
+	}
+
+	mu.Lock()
+	prune()
+	tasks[t.job.ID] = t
+	save()
+	mu.Unlock()
+
+	go run(ctx, t)
+	return t.snapshot()
+}
+
+func run(ctx context.Context, t *Task) {
+	defer t.cancel()
+
+	select {
+	case slots <- struct{}{}:
+		defer func() { <-slots }()
+	case <-ctx.Done():
+		finish(t, ctx.Err())
+		return
+	}
+
+	now := time.Now()
+	t.update(func(j *Job) {
+		j.Status = Running
+		j.Started = &now
+	})
+	persist()
+
+	job := t.snapshot()
+	utils.Infof("⚙️  Job %s started: %s %s", job.ID, job.Kind, job.Params.SourcePath)
+
+	var err error
+	switch job.Kind {
+	case Copy:
+		err = runCopy(ctx, t, job.Params)
+	case Move:
+		err = runMove(ctx, t, job.Params, job.Owner)
+	case Delete:
+		err = runDelete(ctx, t, job.Params, job.Owner)
+	case Thumbnails:
+		err = runThumbnails(ctx, t, job.Params)
+	case Extract:
+		err = runExtract(ctx, t, job.Params)
+	case Compress:
+		err = runCompress(ctx, t, job.Params)
+	default:
+		err = fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	finish(t, err)
+}
+
+func finish(t *Task, err error) {
+	now := time.Now()
+	t.update(func(j *Job) {
+		j.Finished = &now
+		switch {
+		case errors.Is(err, context.Canceled):
+			j.Status = Canceled
+		case err != nil:
+			j.Status = Failed
+			j.Message = err.Error()
+		case len(j.Errors) > 0:
+			j.Status = Failed
+			j.Message = fmt.Sprintf("%d items failed", len(j.Errors))
+		default:
+			j.Status = Done
+		}
+	})
+	persist()
+
+	job := t.snapshot()
+	utils.Infof("⚙️  Job %s %s", job.ID, job.Status)
+
+	if job.Kind.Audited() {
+		e := AuditEntry(job)
+		switch job.Status {
+		case Done:
+			e.Outcome = audit.Success
+		case Canceled:
+			e.Outcome, e.Error = audit.Failure, "canceled"
+		default:
+			e.Outcome, e.Error = audit.Failure, job.Message
+		}
+		audit.Record(e)
+	}
+}
+
+// Audited reports whether jobs of a kind go to the audit log; thumbnail
+// jobs only fill the cache
+func (k Kind) Audited() bool {
+	return k != Thumbnails
+}
+
+// AuditEntry describes a job for the audit log. Compress jobs list the
+// folder of the packed items as their path.
+func AuditEntry(job Job) audit.Entry {
+	p := job.Params
+	e := audit.Entry{
+		User:   job.Owner,
+		Op:     string(job.Kind),
+		Source: p.SourceID,
+		Path:   p.SourcePath,
+		Dest:   p.Destination,
+		Job:    job.ID,
+	}
+	if p.DestID != "" && p.DestID != p.SourceID {
+		e.DestSource = p.DestID
+	}
+	if job.Kind == Delete && p.Permanent {
+		e.Op = "delete.permanent"
+	}
+	if job.Kind == Compress && len(p.Paths) > 0 {
+		e.Path = path.Dir(p.Paths[0])
+		if len(p.Paths) == 1 {
+			e.Path = p.Paths[0]
+		}
+	}
+	return e
+}
+
+// Get returns a job by ID
+func Get(id string) (Job, error) {
+	mu.Lock()
+	t, ok := tasks[id]
+	mu.Unlock()
+
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return t.snapshot(), nil
+}
+
+// List returns the jobs of owner, or of everyone when owner is empty,
+// newest first
+func List(owner string) []Job {
+	mu.Lock()
+	list := make([]Job, 0, len(tasks))
+	for _, t := range tasks {
+		j := t.snapshot()
+		if owner == "" || j.Owner == owner {
+			list = append(list, j)
+		}
+	}
+	mu.Unlock()
+
+	sort.Slice(list, func(i, k int) bool { return list[i].Created.After(list[k].Created) })
+	return list
+}
+
+// Cancel stops a queued or running job
+func Cancel(id string) error {
+	mu.Lock()
+	t, ok := tasks[id]
+	mu.Unlock()
+
+	if !ok {
+		return ErrNotFound
+	}
+
+	job := t.snapshot()
+	if (job.Status != Queued && job.Status != Running) || t.cancel == nil {
+		return fmt.Errorf("job is already %s", job.Status)
+	}
+	t.cancel()
+	return nil
+}
+
+// RetryParams returns the parameters for running a failed or canceled job
+// again. Copies and moves continue into the destination of the first
+// attempt.
+func RetryParams(job Job) (Params, error) {
+	if job.Status != Failed && job.Status != Canceled {
+		return Params{}, fmt.Errorf("only failed or canceled jobs can be retried")
+	}
+
+	params := job.Params
+	if job.Target != "" && job.Kind != Delete {
+		params.Destination = job.Target
+		params.Resume = true
+	}
+	return params, nil
+}
+
+// prune drops finished jobs older than keepFinished; callers hold mu
+func prune() {
+	cutoff := time.Now().Add(-keepFinished)
+	for id, t := range tasks {
+		j := t.snapshot()
+		if j.Finished != nil && j.Finished.Before(cutoff) {
+			delete(tasks, id)
+		}
+	}
+}
+
+func persist() {
+	mu.Lock()
+	defer mu.Unlock()
+	save()
+}
+
+// save writes the job list to disk; callers hold mu
+func save() {
+	if file == "" {
+		return
+	}
+
+	list := make([]Job, 0, len(tasks))
+	for _, t := range tasks {
+		list = append(list, t.snapshot())
+	}
+	sort.Slice(list, func(i, k int) bool { return list[i].Created.Before(list[k].Created) })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		tmp := file + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, file)
+		}
+	}
+	if err != nil {
+		utils.Warnf("⚠️  Failed to save jobs: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filemanager/config"
+	"filemanager/storage"
+	"filemanager/trash"
+)
+
+// useSources sets up the sources "a" and "b" and a fresh job list, and
+// returns their folders and the data directory
+func useSources(t *testing.T) (a, b, data string) {
+	t.Helper()
+	dir := t.TempDir()
+	a, b, data = filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "data")
+	for _, d := range []string{a, b} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := fmt.Sprintf("server:\n  dataDir: %q\nsources:\n  - id: a\n    name: A\n    path: %q\n  - id: b\n    name: B\n    path: %q\n", data, a, b)
+	p := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(p, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.SetPath(p)
+	config.Init()
+	t.Cleanup(storage.Reset)
+
+	mu.Lock()
+	tasks = map[string]*Task{}
+	mu.Unlock()
+	if err := Init(data); err != nil {
+		t.Fatal(err)
+	}
+	return a, b, data
+}
+
+func write(t *testing.T, p, body string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read(p string) string {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return "<missing>"
+	}
+	return string(b)
+}
+
+// wait returns the job once it finished
+func wait(t *testing.T, id string) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Finished != nil {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return Job{}
+}
+
+func TestCopyProgress(t *testing.T) {
+	a, b, _ := useSources(t)
+	write(t, filepath.Join(a, "docs", "one.txt"), "12345")
+	write(t, filepath.Join(a, "docs", "sub", "two.txt"), "1234567890")
+
+	job := wait(t, Submit(Copy, "alice", Params{SourceID: "a", SourcePath: "/docs", DestID: "b", Destination: "/docs"}).ID)
+	if job.Status != Done {
+		t.Fatalf("job %s: %s", job.Status, job.Message)
+	}
+	want := Progress{FilesDone: 4, FilesTotal: 4, BytesDone: 15, BytesTotal: 15}
+	if job.Progress != want {
+		t.Errorf("progress %+v, want %+v", job.Progress, want)
+	}
+	if got := read(filepath.Join(b, "docs", "sub", "two.txt")); got != "1234567890" {
+		t.Errorf("copied %q", got)
+	}
+
+	// A second copy does not overwrite the first one
+	job = wait(t, Submit(Copy, "alice", Params{SourceID: "a", SourcePath: "/docs", DestID: "b", Destination: "/docs"}).ID)
+	if job.Target == "/docs" || read(filepath.Join(b, filepath.FromSlash(job.Target), "one.txt")) != "12345" {
+		t.Errorf("second copy went to %s", job.Target)
+	}
+}
+
+func TestMoveAcrossSourcesUsesTrash(t *testing.T) {
+	a, b, _ := useSources(t)
+	write(t, filepath.Join(a, "docs", "one.txt"), "one")
+
+	job := wait(t, Submit(Move, "alice", Params{SourceID: "a", SourcePath: "/docs", DestID: "b", Destination: "/docs"}).ID)
+	if job.Status != Done {
+		t.Fatalf("job %s: %s", job.Status, job.Message)
+	}
+	if got := read(filepath.Join(b, "docs", "one.txt")); got != "one" {
+		t.Errorf("moved file holds %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(a, "docs")); !os.IsNotExist(err) {
+		t.Errorf("source still there: %v", err)
+	}
+
+	drv, err := storage.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := trash.List(drv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].OriginalPath != "/docs" || items[0].DeletedBy != "alice" {
+		t.Fatalf("trash holds %+v", items)
+	}
+	if _, err := trash.Restore(drv, items[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(filepath.Join(a, "docs", "one.txt")); got != "one" {
+		t.Errorf("restored file holds %q", got)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	a, b, _ := useSources(t)
+	write(t, filepath.Join(a, "one.txt"), "one")
+
+	// With every slot taken the job waits in the queue
+	for i := 0; i < maxRunning; i++ {
+		slots <- struct{}{}
+	}
+	released := false
+	release := func() {
+		if !released {
+			for i := 0; i < maxRunning; i++ {
+				<-slots
+			}
+			released = true
+		}
+	}
+	defer release()
+
+	job := Submit(Copy, "alice", Params{SourceID: "a", SourcePath: "/one.txt", DestID: "b", Destination: "/one.txt"})
+	if job.Status != Queued {
+		t.Fatalf("job is %s", job.Status)
+	}
+	if err := Cancel(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	job = wait(t, job.ID)
+	release()
+
+	if job.Status != Canceled {
+		t.Errorf("job is %s, want %s", job.Status, Canceled)
+	}
+	if _, err := os.Stat(filepath.Join(b, "one.txt")); !os.IsNotExist(err) {
+		t.Errorf("canceled job copied: %v", err)
+	}
+	if err := Cancel(job.ID); err == nil {
+		t.Error("finished job canceled again")
+	}
+	if err := Cancel("no-such-job"); err != ErrNotFound {
+		t.Errorf("unknown job: %v", err)
+	}
+
+	// A copy that is stopped halfway keeps what it did and stops
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	srcDrv, _ := storage.Get("a")
+	dstDrv, _ := storage.Get("b")
+	task := &Task{job: Job{ID: "halfway"}}
+	if err := copyTree(ctx, task, srcDrv, "/one.txt", dstDrv, "/stopped.txt", false); err != context.Canceled {
+		t.Errorf("copy returned %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(b, "stopped.txt")); !os.IsNotExist(err) {
+		t.Errorf("canceled copy wrote: %v", err)
+	}
+}
+
+func TestRetryResumes(t *testing.T) {
+	a, b, _ := useSources(t)
+	write(t, filepath.Join(a, "docs", "one.txt"), "one")
+	write(t, filepath.Join(a, "docs", "two.txt"), "two")
+
+	// A first attempt got one file across before it was stopped
+	write(t, filepath.Join(b, "docs", "one.txt"), "ONE")
+	failed := Job{
+		Kind:   Copy,
+		Status: Canceled,
+		Target: "/docs",
+		Params: Params{SourceID: "a", SourcePath: "/docs", DestID: "b", Destination: "/docs"},
+	}
+
+	params, err := RetryParams(failed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !params.Resume || params.Destination != "/docs" {
+		t.Fatalf("retry params %+v", params)
+	}
+	job := wait(t, Submit(Copy, "alice", params).ID)
+	if job.Status != Done || job.Target != "/docs" {
+		t.Fatalf("job %s into %s: %s", job.Status, job.Target, job.Message)
+	}
+	// Files of the right size are taken as done, the rest is copied
+	if got := read(filepath.Join(b, "docs", "one.txt")); got != "ONE" {
+		t.Errorf("resumed copy rewrote one.txt: %q", got)
+	}
+	if got := read(filepath.Join(b, "docs", "two.txt")); got != "two" {
+		t.Errorf("two.txt holds %q", got)
+	}
+
+	if _, err := RetryParams(job); err == nil {
+		t.Error("finished job retried")
+	}
+	del := Job{Kind: Delete, Status: Failed, Target: "/x", Params: Params{SourceID: "a", SourcePath: "/docs"}}
+	if params, err := RetryParams(del); err != nil || params.Resume {
+		t.Errorf("delete retry %+v, %v", params, err)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	a, _, data := useSources(t)
+	write(t, filepath.Join(a, "one.txt"), "one")
+
+	done := wait(t, Submit(Copy, "alice", Params{SourceID: "a", SourcePath: "/one.txt", DestID: "b", Destination: "/one.txt"}).ID)
+
+	// A job that was running when the server stopped
+	raw, err := os.ReadFile(filepath.Join(data, "jobs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []Job
+	if err := json.Unmarshal(raw, &list); err != nil {
+		t.Fatal(err)
+	}
+	list = append(list, Job{ID: "interrupted", Kind: Copy, Owner: "bob", Status: Running, Created: time.Now()})
+	if raw, err = json.Marshal(list); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(data, "jobs.json"), raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	tasks = map[string]*Task{}
+	mu.Unlock()
+	if err := Init(data); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Get(done.ID)
+	if err != nil || got.Status != Done || got.Progress != done.Progress {
+		t.Errorf("finished job read back as %+v, %v", got, err)
+	}
+	got, err = Get("interrupted")
+	if err != nil || got.Status != Failed || !strings.Contains(got.Message, "restart") || got.Finished == nil {
+		t.Errorf("interrupted job read back as %+v, %v", got, err)
+	}
+	if jobs := List("bob"); len(jobs) != 1 || jobs[0].ID != "interrupted" {
+		t.Errorf("jobs of bob: %+v", jobs)
+	}
+}
@@ -0,0 +1,354 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+
+	"filemanager/events"
+	"filemanager/storage"
+	"filemanager/thumbs"
+	"filemanager/trash"
+)
+
+// item is a file or folder found below the path a job works on
+type item struct {
+	rel   string
+	isDir bool
+	size  int64
+}
+
+// scan lists name and everything below it, parents before their children.
+// Folders that cannot be read are recorded as failed and skipped.
+func scan(t *Task, drv storage.Driver, name string) ([]item, error) {
+	info, err := drv.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []item{{size: info.Size()}}, nil
+	}
+
+	items := []item{{isDir: true}}
+	var walk func(rel string)
+	walk = func(rel string) {
+		entries, err := drv.ReadDir(path.Join(name, rel))
+		if err != nil {
+			t.FileFailed(path.Join(name, rel), err)
+			return
+		}
+		for _, entry := range entries {
+			child := path.Join(rel, entry.Name())
+			if storage.IsReserved(path.Join(name, child)) {
+				continue
+			}
+			if entry.IsDir() {
+				items = append(items, item{rel: child, isDir: true})
+				walk(child)
+				continue
+			}
+			items = append(items, item{rel: child, size: entry.Size()})
+		}
+	}
+	walk("")
+	return items, nil
+}
+
+func setTotals(t *Task, items []item) {
+	var bytes int64
+	for _, it := range items {
+		bytes += it.size
+	}
+	t.SetTotal(len(items), bytes)
+}
+
+// prepareTarget creates the parent of the destination and picks a free
+// name for it, unless an earlier attempt is being resumed
+func prepareTarget(t *Task, drv storage.Driver, p Params) (string, error) {
+	dst := storage.CleanPath(p.Destination)
+	if err := drv.MkdirAll(path.Dir(dst)); err != nil {
+		return "", err
+	}
+	if !p.Resume {
+		var err error
+		if dst, err = storage.UniquePath(drv, dst); err != nil {
+			return "", err
+		}
+	}
+	t.SetTarget(dst)
+	return dst, nil
+}
+
+func runCopy(ctx context.Context, t *Task, p Params) error {
+	srcDrv, err := storage.Get(p.SourceID)
+	if err != nil {
+		return err
+	}
+	dstDrv, err := storage.Get(p.DestID)
+	if err != nil {
+		return err
+	}
+
+	dst, err := prepareTarget(t, dstDrv, p)
+	if err != nil {
+		return err
+	}
+
+	err = copyTree(ctx, t, srcDrv, storage.CleanPath(p.SourcePath), dstDrv, dst, p.Resume)
+	events.Publish(events.Event{Type: events.Create, Source: p.DestID, Path: dst})
+	return err
+}
+
+func runMove(ctx context.Context, t *Task, p Params, owner string) error {
+	srcDrv, err := storage.Get(p.SourceID)
+	if err != nil {
+		return err
+	}
+	dstDrv, err := storage.Get(p.DestID)
+	if err != nil {
+		return err
+	}
+	src := storage.CleanPath(p.SourcePath)
+
+	dst, err := prepareTarget(t, dstDrv, p)
+	if err != nil {
+		return err
+	}
+
+	// Inside one source a move is a rename
+	if p.SourceID == p.DestID {
+		info, err := srcDrv.Stat(src)
+		if err != nil {
+			return err
+		}
+		t.SetTotal(1, info.Size())
+		if err := srcDrv.Rename(src, dst); err != nil {
+			return err
+		}
+		events.Publish(events.Event{Type: events.Rename, Source: p.SourceID, Path: dst, OldPath: src})
+		t.AddBytes(info.Size())
+		t.FileDone()
+		return nil
+	}
+
+	err = copyTree(ctx, t, srcDrv, src, dstDrv, dst, p.Resume)
+	events.Publish(events.Event{Type: events.Create, Source: p.DestID, Path: dst})
+	if err != nil {
+		return err
+	}
+
+	// Keep the source when anything is missing from the copy. Otherwise it
+	// goes to the trash of its source, like a delete, so a move to the
+	// wrong place can be undone.
+	if len(t.snapshot().Errors) > 0 {
+		return fmt.Errorf("some items could not be copied, the source was kept")
+	}
+	if _, err := trash.Move(srcDrv, src, owner); err != nil {
+		return err
+	}
+	events.Publish(events.Event{Type: events.Delete, Source: p.SourceID, Path: src})
+	return nil
+}
+
+func runDelete(ctx context.Context, t *Task, p Params, owner string) error {
+	drv, err := storage.Get(p.SourceID)
+	if err != nil {
+		return err
+	}
+	name := storage.CleanPath(p.SourcePath)
+
+	if !p.Permanent {
+		t.SetTotal(1, 0)
+		if _, err := trash.Move(drv, name, owner); err != nil {
+			return err
+		}
+		events.Publish(events.Event{Type: events.Delete, Source: p.SourceID, Path: name})
+		t.FileDone()
+		return nil
+	}
+
+	items, err := scan(t, drv, name)
+	if err != nil {
+		return err
+	}
+	setTotals(t, items)
+
+	// Remove files one by one for progress, then the emptied folders
+	for _, it := range items {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if it.isDir {
+			continue
+		}
+		if err := drv.RemoveAll(path.Join(name, it.rel)); err != nil {
+			t.FileFailed(path.Join(name, it.rel), err)
+			continue
+		}
+		t.AddBytes(it.size)
+		t.FileDone()
+	}
+
+	if len(t.snapshot().Errors) > 0 {
+		return nil
+	}
+	if err := drv.RemoveAll(name); err != nil {
+		return err
+	}
+	events.Publish(events.Event{Type: events.Delete, Source: p.SourceID, Path: name})
+	for _, it := range items {
+		if it.isDir {
+			t.FileDone()
+		}
+	}
+	return nil
+}
+
+// copyTree copies src to dst item by item. Failed items are recorded on
+// the task and skipped; only a cancellation stops the copy early.
+func copyTree(ctx context.Context, t *Task, srcDrv storage.Driver, src string, dstDrv storage.Driver, dst string, resume bool) error {
+	items, err := scan(t, srcDrv, src)
+	if err != nil {
+		return err
+	}
+	setTotals(t, items)
+
+	for _, it := range items {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var err error
+		from, to := path.Join(src, it.rel), path.Join(dst, it.rel)
+		if it.isDir {
+			err = dstDrv.MkdirAll(to)
+		} else if resume && sameSize(dstDrv, to, it.size) {
+			t.AddBytes(it.size)
+		} else {
+			err = copyFile(ctx, t, srcDrv, from, dstDrv, to)
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			t.FileFailed(from, err)
+			continue
+		}
+		t.FileDone()
+	}
+	return nil
+}
+
+func sameSize(drv storage.Driver, name string, size int64) bool {
+	info, err := drv.Stat(name)
+	return err == nil && !info.IsDir() && info.Size() == size
+}
+
+func copyFile(ctx context.Context, t *Task, srcDrv storage.Driver, src string, dstDrv storage.Driver, dst string) error {
+	// Let the backend copy on its own when both ends live in it
+	if c, ok := srcDrv.(storage.Copier); ok && srcDrv == dstDrv {
+		info, err := srcDrv.Stat(src)
+		if err != nil {
+			return err
+		}
+		if err := c.Copy(src, dst); err != nil {
+			return err
+		}
+		t.AddBytes(info.Size())
+		return nil
+	}
+
+	srcFile, err := srcDrv.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := dstDrv.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dstFile, &progressReader{ctx: ctx, r: srcFile, t: t}); err != nil {
+		// Do not leave a truncated file behind
+		storage.Abort(dstFile)
+		dstDrv.RemoveAll(dst)
+		return err
+	}
+	if err := dstFile.Close(); err != nil {
+		return err
+	}
+
+	if c, ok := dstDrv.(storage.Chmoder); ok {
+		if srcInfo, err := srcFile.Stat(); err == nil {
+			return c.Chmod(dst, srcInfo.Mode())
+		}
+	}
+	return nil
+}
+
+// progressReader counts copied bytes on the task and stops the copy once
+// the job is canceled
+type progressReader struct {
+	ctx context.Context
+	r   io.Reader
+	t   *Task
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.r.Read(b)
+	p.t.AddBytes(int64(n))
+	return n, err
+}
+
+// runThumbnails renders every thumbnail size for the images below a path
+// ahead of time
+func runThumbnails(ctx context.Context, t *Task, p Params) error {
+	if !thumbs.Cached(p.SourceID) {
+		// Rendered on each request instead, there is nothing to prepare
+		return nil
+	}
+	drv, err := storage.Get(p.SourceID)
+	if err != nil {
+		return err
+	}
+	root := storage.CleanPath(p.SourcePath)
+
+	all, err := scan(t, drv, root)
+	if err != nil {
+		return err
+	}
+	var images []item
+	for _, it := range all {
+		if !it.isDir && thumbs.Supported(path.Join(root, it.rel)) {
+			images = append(images, it)
+		}
+	}
+	setTotals(t, images)
+
+	for _, it := range images {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		name := path.Join(root, it.rel)
+		var err error
+		for _, size := range thumbs.Sizes {
+			if _, err = thumbs.Get(drv, p.SourceID, name, size); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			t.FileFailed(name, err)
+			continue
+		}
+		t.AddBytes(it.size)
+		t.FileDone()
+	}
+	return nil
+}
@@ -2,31 +2,80 @@ package main
 
 import (
 	"embed"
-	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 
+	"filemanager/acl"
+	"filemanager/audit"
+	"filemanager/auth"
 	"filemanager/config"
+	"filemanager/jobs"
 	"filemanager/router"
+	"filemanager/search"
+	"filemanager/settings"
+	"filemanager/shares"
+	"filemanager/trash"
+	"filemanager/uploads"
+	"filemanager/utils"
+	"filemanager/versions"
 )
 
 //go:embed all:dist
 var frontendFS embed.FS
 
 func main() {
+	if runCommand(parseFlags(os.Args[1:])) {
+		return
+	}
+
 	// Initialize configuration
 	config.Init()
+	cfg := config.Get()
+	if err := utils.SetLogLevel(cfg.Server.LogLevel); err != nil {
+		log.Fatal(err)
+	}
 
-	// Create root directory if it doesn't exist
-	for _, source := range config.AppConfig.Sources {
-		if source.Enabled && source.Type == "local" {
-			if err := os.MkdirAll(source.Path, 0755); err != nil {
-				log.Printf("Warning: Failed to create directory for %s: %v", source.Name, err)
-			}
-		}
+	// Load user accounts
+	if err := auth.Init(cfg.Server.DataDir); err != nil {
+		log.Fatal("Failed to load users:", err)
+	}
+	if err := jobs.Init(cfg.Server.DataDir); err != nil {
+		log.Fatal("Failed to load jobs:", err)
+	}
+	if err := shares.Init(cfg.Server.DataDir); err != nil {
+		log.Fatal("Failed to load shares:", err)
+	}
+	if err := audit.Init(cfg.Server.DataDir); err != nil {
+		log.Fatal("Failed to open audit log:", err)
+	}
+	if err := search.Init(cfg.Server.DataDir); err != nil {
+		log.Fatal("Failed to open search index:", err)
 	}
+	if err := settings.Init(cfg.Server.DataDir); err != nil {
+		log.Fatal("Failed to load settings:", err)
+	}
+	if err := acl.Load(cfg.Access); err != nil {
+		log.Fatal("Invalid access rules:", err)
+	}
+	if auth.Users.Count() == 0 {
+		utils.Warnf("⚠️  No user accounts yet, create one with: zxfilebrowser user add NAME")
+	}
+
+	// Pick up changes to config.yaml and users.json while running
+	config.Watch()
+	auth.Watch()
+
+	// Empty expired items from the recycle bins
+	trash.StartPurger()
+	uploads.StartPurger()
+	versions.StartPurger()
+
+	// Index every source for search
+	search.Start()
 
 	// Setup API routes
 	router.SetupRoutes()
@@ -36,7 +85,7 @@ func main() {
 	if err == nil {
 		// Production: serve embedded frontend
 		http.Handle("/", http.FileServer(http.FS(distFS)))
-		log.Println("📦 Serving embedded frontend")
+		utils.Infof("📦 Serving embedded frontend")
 	} else {
 		// Development: show API info
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -50,29 +99,65 @@ func main() {
 						<p><strong>Frontend:</strong> <a href="http://localhost:5173">http://localhost:5173</a> (Development)</p>
 						<h2>API Endpoints:</h2>
 						<ul>
+							<li>POST /api/login - Sign in</li>
+							<li>POST /api/logout - Sign out</li>
+							<li>GET /api/me - Current user</li>
 							<li>GET /api/list - List directory contents</li>
 							<li>GET /api/info - Get file/folder info</li>
+							<li>GET /api/events - Stream folder changes (SSE)</li>
+							<li>GET /api/search - Search names and file contents</li>
 							<li>GET /api/preview - Preview file</li>
 							<li>GET /api/serve - Serve file</li>
 							<li>GET /api/download - Download file</li>
+							<li>GET /api/archive - Download items as zip or tar.gz</li>
+							<li>GET /api/thumbnail - Image thumbnail</li>
+							<li>POST /api/thumbnail/pregenerate - Render thumbnails of a folder (job)</li>
 							<li>POST /api/create - Create file/folder</li>
 							<li>POST /api/upload - Upload file</li>
+							<li>POST/HEAD/PATCH/DELETE /api/tus/ - Resumable upload (tus 1.0.0)</li>
 							<li>POST /api/rename - Rename item</li>
-							<li>POST /api/copy - Copy item</li>
-							<li>POST /api/move - Move item</li>
-							<li>DELETE /api/delete - Delete item</li>
+							<li>POST /api/copy - Copy item (job)</li>
+							<li>POST /api/move - Move item (job)</li>
+							<li>DELETE /api/delete - Move item to trash (job)</li>
+							<li>POST /api/extract - Extract an archive (job)</li>
+							<li>POST /api/compress - Pack items into an archive (job)</li>
+							<li>GET /api/jobs - List jobs and their progress</li>
+							<li>POST /api/jobs/cancel - Cancel job</li>
+							<li>POST /api/jobs/retry - Retry job</li>
+							<li>GET /api/versions - List earlier versions of a file</li>
+							<li>GET /api/versions/serve - Preview or download a version</li>
+							<li>POST /api/versions/restore - Restore a version</li>
+							<li>GET /api/trash - List trash</li>
+							<li>POST /api/trash/restore - Restore trash item</li>
+							<li>DELETE /api/trash/purge - Delete trash items permanently</li>
+							<li>GET /api/shares - List share links</li>
+							<li>POST /api/shares/create - Share a file or folder by link</li>
+							<li>DELETE /api/shares/revoke - Revoke share link</li>
+							<li>GET/POST /s/{token} - Open a share link (public)</li>
+							<li>/dav/{source}/ - WebDAV access to a source (Basic auth)</li>
+							<li>GET /api/admin/audit - Query the audit log (admin)</li>
+							<li>POST /api/admin/config/reload - Reload config.yaml (admin)</li>
+							<li>GET /api/admin/sources - List all sources (admin)</li>
+							<li>POST /api/admin/sources/add - Add a source (admin)</li>
+							<li>POST /api/admin/sources/update - Edit a source (admin)</li>
+							<li>POST /api/admin/sources/enable - Enable or disable a source (admin)</li>
+							<li>DELETE /api/admin/sources/remove - Remove a source (admin)</li>
 						</ul>
 					</body>
 				</html>
 			`))
 		})
-		log.Println("⚠️  Running in development mode (frontend not embedded)")
+		utils.Warnf("⚠️  Running in development mode (frontend not embedded)")
 	}
 
-	port := fmt.Sprintf(":%d", config.AppConfig.Server.Port)
-	log.Printf("🚀 Server starting on http://localhost%s", port)
+	addr := net.JoinHostPort(cfg.Server.Address, strconv.Itoa(cfg.Server.Port))
+	host := cfg.Server.Address
+	if host == "" {
+		host = "localhost"
+	}
+	utils.Infof("🚀 Server starting on http://%s", net.JoinHostPort(host, strconv.Itoa(cfg.Server.Port)))
 	for _, src := range config.GetEnabledSources() {
-		log.Printf("📁 Serving: %s from %s", src.Name, src.Path)
+		utils.Infof("📁 Serving: %s from %s", src.Name, src.Path)
 	}
-	log.Fatal(http.ListenAndServe(port, nil))
+	log.Fatal(http.ListenAndServe(addr, nil))
 }
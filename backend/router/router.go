@@ -3,33 +3,85 @@ package router
 import (
 	"net/http"
 
+	"filemanager/auth"
 	"filemanager/handlers"
-	"filemanager/utils"
 )
 
+// api wraps a handler that requires a signed in user
+func api(h http.HandlerFunc) http.HandlerFunc {
+	return corsMiddleware(auth.Middleware(h))
+}
+
 func SetupRoutes() {
+	// Authentication
+	http.HandleFunc("/api/login", corsMiddleware(handlers.Login))
+	http.HandleFunc("/api/logout", api(handlers.Logout))
+	http.HandleFunc("/api/me", api(handlers.GetCurrentUser))
+
 	// Directory operations
-	http.HandleFunc("/api/list", utils.CORSMiddleware(handlers.ListDirectory))
-	http.HandleFunc("/api/info", utils.CORSMiddleware(handlers.GetInfo))
-	http.HandleFunc("/api/sources", utils.CORSMiddleware(handlers.GetSources))
+	http.HandleFunc("/api/list", api(handlers.ListDirectory))
+	http.HandleFunc("/api/info", api(handlers.GetInfo))
+	http.HandleFunc("/api/sources", api(handlers.GetSources))
+	http.HandleFunc("/api/events", api(handlers.WatchDirectory))
+	http.HandleFunc("/api/search", api(handlers.Search))
 
 	// File operations
-	http.HandleFunc("/api/create", utils.CORSMiddleware(handlers.CreateItem))
-	http.HandleFunc("/api/delete", utils.CORSMiddleware(handlers.DeleteItem))
-	http.HandleFunc("/api/rename", utils.CORSMiddleware(handlers.RenameItem))
-	http.HandleFunc("/api/copy", utils.CORSMiddleware(handlers.CopyItem))
-	http.HandleFunc("/api/move", utils.CORSMiddleware(handlers.MoveItem))
-	http.HandleFunc("/api/upload", utils.CORSMiddleware(handlers.UploadFile))
+	http.HandleFunc("/api/create", api(handlers.CreateItem))
+	http.HandleFunc("/api/delete", api(handlers.DeleteItem))
+	http.HandleFunc("/api/rename", api(handlers.RenameItem))
+	http.HandleFunc("/api/copy", api(handlers.CopyItem))
+	http.HandleFunc("/api/move", api(handlers.MoveItem))
+	http.HandleFunc("/api/upload", api(handlers.UploadFile))
+	http.HandleFunc("/api/tus/", handlers.TusHeaders(api(handlers.TusUpload)))
+
+	// Background jobs
+	http.HandleFunc("/api/jobs", api(handlers.ListJobs))
+	http.HandleFunc("/api/jobs/cancel", api(handlers.CancelJob))
+	http.HandleFunc("/api/jobs/retry", api(handlers.RetryJob))
+
+	// Recycle bin
+	http.HandleFunc("/api/trash", api(handlers.ListTrash))
+	http.HandleFunc("/api/trash/restore", api(handlers.RestoreTrash))
+	http.HandleFunc("/api/trash/purge", api(handlers.PurgeTrash))
+
+	// File versions
+	http.HandleFunc("/api/versions", api(handlers.ListVersions))
+	http.HandleFunc("/api/versions/serve", api(handlers.ServeVersion))
+	http.HandleFunc("/api/versions/restore", api(handlers.RestoreVersion))
 
 	// File serving
-	http.HandleFunc("/api/preview", utils.CORSMiddleware(handlers.PreviewFile))
-	http.HandleFunc("/api/serve", utils.CORSMiddleware(handlers.ServeFile))
-	http.HandleFunc("/api/download", utils.CORSMiddleware(handlers.DownloadFile))
+	http.HandleFunc("/api/preview", api(handlers.PreviewFile))
+	http.HandleFunc("/api/serve", api(handlers.ServeFile))
+	http.HandleFunc("/api/download", api(handlers.DownloadFile))
+	http.HandleFunc("/api/archive", api(handlers.DownloadArchive))
+	http.HandleFunc("/api/extract", api(handlers.ExtractArchive))
+	http.HandleFunc("/api/compress", api(handlers.CompressItems))
+	http.HandleFunc("/api/thumbnail", api(handlers.ServeThumbnail))
+	http.HandleFunc("/api/thumbnail/pregenerate", api(handlers.PregenerateThumbnails))
 
 	// Storage info
-	http.HandleFunc("/api/storage", utils.CORSMiddleware(handlers.GetStorageInfo))
+	http.HandleFunc("/api/storage", api(handlers.GetStorageInfo))
+
+	// Share links
+	http.HandleFunc("/api/shares", api(handlers.ListShares))
+	http.HandleFunc("/api/shares/create", api(handlers.CreateShare))
+	http.HandleFunc("/api/shares/revoke", api(handlers.RevokeShare))
+	http.HandleFunc("/s/", corsMiddleware(handlers.PublicShare))
+
+	// WebDAV, for mounting sources as network drives
+	http.HandleFunc("/dav/", auth.BasicMiddleware("ZxFileBrowser", handlers.WebDAV))
+
+	// Administration
+	http.HandleFunc("/api/admin/access/reload", api(auth.AdminOnly(handlers.ReloadAccess)))
+	http.HandleFunc("/api/admin/audit", api(auth.AdminOnly(handlers.QueryAudit)))
+	http.HandleFunc("/api/admin/config/reload", api(auth.AdminOnly(handlers.ReloadConfig)))
+	http.HandleFunc("/api/admin/sources", api(auth.AdminOnly(handlers.ListAllSources)))
+	http.HandleFunc("/api/admin/sources/add", api(auth.AdminOnly(handlers.AddSource)))
+	http.HandleFunc("/api/admin/sources/update", api(auth.AdminOnly(handlers.UpdateSource)))
+	http.HandleFunc("/api/admin/sources/enable", api(auth.AdminOnly(handlers.EnableSource)))
+	http.HandleFunc("/api/admin/sources/remove", api(auth.AdminOnly(handlers.RemoveSource)))
 
 	// Settings
-	http.HandleFunc("/api/settings", utils.CORSMiddleware(handlers.GetSettings))
-	http.HandleFunc("/api/settings/save", utils.CORSMiddleware(handlers.SaveSettings))
+	http.HandleFunc("/api/settings", api(handlers.GetSettings))
+	http.HandleFunc("/api/settings/save", api(handlers.SaveSettings))
 }
@@ -0,0 +1,268 @@
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// formatVersion is bumped whenever the saved index layout changes; older
+// files are dropped and the source is crawled again
+const formatVersion = 1
+
+const (
+	// minTermLength and maxTermLength bound the words that are indexed
+	minTermLength = 2
+	maxTermLength = 64
+)
+
+// Doc is one file or folder in the index
+type Doc struct {
+	Path    string    `json:"path"`
+	IsDir   bool      `json:"isDir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// Text is set when the file content was indexed
+	Text  bool     `json:"text,omitempty"`
+	Terms []string `json:"terms,omitempty"`
+}
+
+// Name returns the base name of the item
+func (d *Doc) Name() string {
+	return path.Base(d.Path)
+}
+
+// index holds the documents of one source together with the words they
+// contain
+type index struct {
+	source string
+	file   string
+
+	mu       sync.RWMutex
+	docs     map[string]*Doc
+	postings map[string]map[string]struct{}
+	dirty    bool
+}
+
+type savedIndex struct {
+	Version int    `json:"version"`
+	Source  string `json:"source"`
+	Docs    []*Doc `json:"docs"`
+}
+
+func newIndex(source, file string) *index {
+	return &index{
+		source:   source,
+		file:     file,
+		docs:     map[string]*Doc{},
+		postings: map[string]map[string]struct{}{},
+	}
+}
+
+// load reads the saved index of a source. A missing or outdated file
+// leaves the index empty.
+func (ix *index) load() error {
+	data, err := os.ReadFile(ix.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved savedIndex
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", ix.file, err)
+	}
+	if saved.Version != formatVersion || saved.Source != ix.source {
+		return nil
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for _, doc := range saved.Docs {
+		ix.put(doc)
+	}
+	return nil
+}
+
+// save writes the index to disk when it changed since the last save
+func (ix *index) save() error {
+	ix.mu.Lock()
+	if !ix.dirty {
+		ix.mu.Unlock()
+		return nil
+	}
+	saved := savedIndex{Version: formatVersion, Source: ix.source, Docs: make([]*Doc, 0, len(ix.docs))}
+	for _, doc := range ix.docs {
+		saved.Docs = append(saved.Docs, doc)
+	}
+	ix.dirty = false
+	ix.mu.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(ix.file), 0700); err == nil {
+			tmp := ix.file + ".tmp"
+			if err = os.WriteFile(tmp, data, 0600); err == nil {
+				err = os.Rename(tmp, ix.file)
+			}
+		}
+	}
+	if err != nil {
+		ix.mu.Lock()
+		ix.dirty = true
+		ix.mu.Unlock()
+	}
+	return err
+}
+
+// get returns the document at name
+func (ix *index) get(name string) (*Doc, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	doc, ok := ix.docs[name]
+	return doc, ok
+}
+
+// update stores doc, replacing what was indexed at its path
+func (ix *index) update(doc *Doc) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(doc.Path)
+	ix.put(doc)
+	ix.dirty = true
+}
+
+// removeTree drops name and everything below it
+func (ix *index) removeTree(name string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for p := range ix.docs {
+		if p == name || strings.HasPrefix(p, prefix) {
+			ix.remove(p)
+			ix.dirty = true
+		}
+	}
+}
+
+// paths returns the indexed paths below and including name
+func (ix *index) paths(name string) []string {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	var list []string
+	for p := range ix.docs {
+		if p == name || strings.HasPrefix(p, prefix) {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// put adds a document; callers hold mu
+func (ix *index) put(doc *Doc) {
+	ix.docs[doc.Path] = doc
+	for _, term := range doc.Terms {
+		set := ix.postings[term]
+		if set == nil {
+			set = map[string]struct{}{}
+			ix.postings[term] = set
+		}
+		set[doc.Path] = struct{}{}
+	}
+}
+
+// remove drops a document; callers hold mu
+func (ix *index) remove(name string) {
+	doc, ok := ix.docs[name]
+	if !ok {
+		return
+	}
+	delete(ix.docs, name)
+	for _, term := range doc.Terms {
+		set := ix.postings[term]
+		delete(set, name)
+		if len(set) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+}
+
+// Terms splits text into the lower-cased words the index is built from,
+// each returned once
+func Terms(text string) []string {
+	seen := map[string]struct{}{}
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), isSeparator) {
+		if len(word) < minTermLength || len(word) > maxTermLength {
+			continue
+		}
+		if _, ok := seen[word]; ok {
+			continue
+		}
+		seen[word] = struct{}{}
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// search returns the documents passing q; callers must not hold mu
+func (ix *index) search(q *Query) []*Doc {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	var candidates map[string]struct{}
+	if len(q.terms) > 0 {
+		// Start from the rarest word, every other word must be there too
+		sorted := append([]string(nil), q.terms...)
+		sort.Slice(sorted, func(i, k int) bool { return len(ix.postings[sorted[i]]) < len(ix.postings[sorted[k]]) })
+		candidates = ix.postings[sorted[0]]
+		if len(candidates) == 0 {
+			return nil
+		}
+		filtered := map[string]struct{}{}
+		for p := range candidates {
+			found := true
+			for _, term := range sorted[1:] {
+				if _, ok := ix.postings[term][p]; !ok {
+					found = false
+					break
+				}
+			}
+			if found {
+				filtered[p] = struct{}{}
+			}
+		}
+		candidates = filtered
+	}
+
+	var result []*Doc
+	if candidates != nil {
+		for p := range candidates {
+			if doc := ix.docs[p]; q.matches(doc) {
+				result = append(result, doc)
+			}
+		}
+	} else {
+		for _, doc := range ix.docs {
+			if q.matches(doc) {
+				result = append(result, doc)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,494 @@
+package search
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"filemanager/config"
+	"filemanager/events"
+	"filemanager/storage"
+	"filemanager/uploads"
+	"filemanager/utils"
+)
+
+const (
+	// DefaultRescan is how often every source is crawled again to pick up
+	// changes no event reported
+	DefaultRescan = time.Hour
+	// DefaultMaxTextKB is how much of a text file is read for its words
+	DefaultMaxTextKB = 1024
+)
+
+// saveInterval is how often changed indexes are written to disk
+const saveInterval = time.Minute
+
+// Result is an item found by Search
+type Result struct {
+	Source  string    `json:"source"`
+	Path    string    `json:"path"`
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"isDir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Ext     string    `json:"ext"`
+}
+
+var (
+	dir string
+
+	mu      sync.Mutex
+	indexes = map[string]*index{}
+	// crawled holds the sources that were crawled since the server started
+	crawled = map[string]bool{}
+	// watched holds the folders of local sources followed for changes
+	watched = map[string]map[string]bool{}
+	// unwatchable holds sources whose folders could not all be watched,
+	// they rely on the rescan instead
+	unwatchable = map[string]bool{}
+	// stale holds sources that lost events and need a crawl
+	stale = map[string]bool{}
+
+	queue = make(chan events.Event, 1024)
+)
+
+// Init loads the saved indexes from the data directory
+func Init(dataDir string) error {
+	dir = filepath.Join(dataDir, "search")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	for _, src := range config.Get().Sources {
+		ix := newIndex(src.ID, indexFile(src.ID))
+		if memoryOnly(src.ID) {
+			os.Remove(ix.file)
+			indexes[src.ID] = ix
+			continue
+		}
+		if err := ix.load(); err != nil {
+			utils.Warnf("⚠️  Dropping search index of %s: %v", src.Name, err)
+			ix = newIndex(src.ID, indexFile(src.ID))
+		}
+		indexes[src.ID] = ix
+	}
+	return nil
+}
+
+// Forget removes the saved index of a source; it is built again on the
+// next start
+func Forget(sourceID string) error {
+	err := os.Remove(filepath.Join(config.Get().Server.DataDir, "search", sourceID+".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func indexFile(sourceID string) string {
+	return filepath.Join(dir, sourceID+".json")
+}
+
+// encrypted reports whether a source stores its files encrypted. Their
+// contents are not indexed, the index would keep them in plain text.
+func encrypted(sourceID string) bool {
+	src, ok := config.GetSource(sourceID)
+	return ok && src.Encryption != nil
+}
+
+// memoryOnly reports whether the index of a source must not be written to
+// disk, which is when the source encrypts names too
+func memoryOnly(sourceID string) bool {
+	src, ok := config.GetSource(sourceID)
+	return ok && src.Encryption != nil && src.Encryption.Names
+}
+
+func rescanInterval() time.Duration {
+	if m := config.Get().Search.RescanMinutes; m > 0 {
+		return time.Duration(m) * time.Minute
+	}
+	return DefaultRescan
+}
+
+func maxText() int64 {
+	if kb := config.Get().Search.MaxTextKB; kb > 0 {
+		return int64(kb) << 10
+	}
+	return DefaultMaxTextKB << 10
+}
+
+// Start crawls every source in the background and then keeps the indexes
+// current from change events, crawling again every rescan interval
+func Start() {
+	// New, re-enabled and moved sources get crawled on the next save tick
+	config.OnReload(func(old, cur *config.Config) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, src := range cur.Sources {
+			prev, found := findSource(old, src.ID)
+			moved := found && (prev.Type != src.Type || prev.Path != src.Path)
+			if found && !moved && (prev.Enabled || !src.Enabled) {
+				continue
+			}
+			if moved {
+				indexes[src.ID] = newIndex(src.ID, indexFile(src.ID))
+				crawled[src.ID] = false
+			}
+			stale[src.ID] = true
+		}
+	})
+
+	events.Listen(func(ev events.Event) {
+		select {
+		case queue <- ev:
+		default:
+			mu.Lock()
+			stale[ev.Source] = true
+			mu.Unlock()
+		}
+	})
+
+	go func() {
+		crawlAll()
+
+		rescan := time.NewTicker(rescanInterval())
+		save := time.NewTicker(saveInterval)
+		for {
+			select {
+			case ev := <-queue:
+				apply(ev)
+			case <-save.C:
+				saveAll()
+				crawlStale()
+			case <-rescan.C:
+				crawlAll()
+			}
+		}
+	}()
+}
+
+func findSource(cfg *config.Config, id string) (config.Source, bool) {
+	for _, src := range cfg.Sources {
+		if src.ID == id {
+			return src, true
+		}
+	}
+	return config.Source{}, false
+}
+
+// get returns the index of an enabled source, creating it when needed
+func get(sourceID string) *index {
+	src, ok := config.GetSource(sourceID)
+	if !ok || !src.Enabled {
+		return nil
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	ix := indexes[sourceID]
+	if ix == nil {
+		ix = newIndex(sourceID, indexFile(sourceID))
+		indexes[sourceID] = ix
+	}
+	return ix
+}
+
+func crawlAll() {
+	for _, src := range config.GetEnabledSources() {
+		crawlSource(src.ID)
+	}
+	saveAll()
+}
+
+func crawlStale() {
+	mu.Lock()
+	var ids []string
+	for id := range stale {
+		ids = append(ids, id)
+		delete(stale, id)
+	}
+	mu.Unlock()
+
+	for _, id := range ids {
+		crawlSource(id)
+	}
+}
+
+func crawlSource(sourceID string) {
+	ix := get(sourceID)
+	if ix == nil {
+		return
+	}
+	drv, err := storage.Get(sourceID)
+	if err != nil {
+		utils.Warnf("⚠️  Cannot index %s: %v", sourceID, err)
+		return
+	}
+
+	start := time.Now()
+	if err := crawl(ix, drv, "/"); err != nil {
+		utils.Warnf("⚠️  Indexing %s failed: %v", sourceID, err)
+		return
+	}
+
+	mu.Lock()
+	first := !crawled[sourceID]
+	crawled[sourceID] = true
+	mu.Unlock()
+	if first {
+		ix.mu.RLock()
+		n := len(ix.docs)
+		ix.mu.RUnlock()
+		utils.Infof("🔎 Indexed %d items of %s in %s", n, sourceID, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// crawl brings the index of the tree at name in line with the backend,
+// reading only the files that changed since they were indexed
+func crawl(ix *index, drv storage.Driver, name string) error {
+	seen := map[string]bool{}
+	if err := walk(ix, drv, name, seen); err != nil {
+		return err
+	}
+	for _, p := range ix.paths(name) {
+		if !seen[p] {
+			forget(ix, p)
+		}
+	}
+	return nil
+}
+
+func walk(ix *index, drv storage.Driver, name string, seen map[string]bool) error {
+	seen[name] = true
+	follow(ix.source, name)
+
+	entries, err := drv.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		child := storage.CleanPath(name + "/" + entry.Name())
+		if skip(child) {
+			continue
+		}
+		seen[child] = true
+		indexEntry(ix, drv, child, entry)
+		if entry.IsDir() {
+			if err := walk(ix, drv, child, seen); err != nil {
+				utils.Warnf("⚠️  Cannot index %s%s: %v", ix.source, child, err)
+			}
+		}
+	}
+	return nil
+}
+
+func skip(name string) bool {
+	return storage.IsReserved(name) || uploads.IsTemp(name)
+}
+
+// indexEntry stores one item, reading its words again only when its size
+// or modification time changed
+func indexEntry(ix *index, drv storage.Driver, name string, info fs.FileInfo) {
+	if old, ok := ix.get(name); ok && old.IsDir == info.IsDir() &&
+		old.Size == info.Size() && old.ModTime.Equal(info.ModTime()) {
+		return
+	}
+
+	doc := &Doc{
+		Path:    name,
+		IsDir:   info.IsDir(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	text := path.Base(name)
+	if !info.IsDir() && !encrypted(ix.source) {
+		if content, ok := readText(drv, name); ok {
+			doc.Text = true
+			text += " " + content
+		}
+	}
+	doc.Terms = Terms(text)
+	ix.update(doc)
+}
+
+// readText returns the start of a file when it holds text
+func readText(drv storage.Driver, name string) (string, bool) {
+	f, err := drv.Open(name)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxText()))
+	if err != nil || !utils.IsTextFile(data) {
+		return "", false
+	}
+	return string(data), true
+}
+
+// apply updates the index of a source from one change event
+func apply(ev events.Event) {
+	ix := get(ev.Source)
+	if ix == nil {
+		return
+	}
+	drv, err := storage.Get(ev.Source)
+	if err != nil {
+		return
+	}
+
+	if ev.OldPath != "" && !skip(ev.OldPath) {
+		forgetTree(ix, ev.OldPath)
+	}
+	if skip(ev.Path) || ev.Path == "/" {
+		return
+	}
+	if ev.Type == events.Delete {
+		forgetTree(ix, ev.Path)
+		return
+	}
+
+	info, err := drv.Stat(ev.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Watchers report renames under the old name
+		forgetTree(ix, ev.Path)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	indexEntry(ix, drv, ev.Path, info)
+	if info.IsDir() && ev.Type != events.Modify {
+		if err := crawl(ix, drv, ev.Path); err != nil {
+			utils.Warnf("⚠️  Cannot index %s%s: %v", ev.Source, ev.Path, err)
+		}
+	}
+}
+
+// forget drops one item from the index
+func forget(ix *index, name string) {
+	ix.removeTree(name)
+	unfollow(ix.source, name)
+}
+
+// forgetTree drops an item and everything below it
+func forgetTree(ix *index, name string) {
+	for _, p := range ix.paths(name) {
+		unfollow(ix.source, p)
+	}
+	ix.removeTree(name)
+}
+
+// follow watches a folder of a local source, so that changes made outside
+// the server reach the index
+func follow(sourceID, name string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	dirs := watched[sourceID]
+	if dirs == nil {
+		dirs = map[string]bool{}
+		watched[sourceID] = dirs
+	}
+	if dirs[name] || unwatchable[sourceID] {
+		return
+	}
+	if err := events.Watch(sourceID, name); err != nil {
+		// Usually the system limit of watches, which the next folder
+		// would run into as well
+		unwatchable[sourceID] = true
+		if !errors.Is(err, events.ErrNotWatchable) {
+			utils.Warnf("⚠️  Cannot watch %s%s for the search index, relying on rescans: %v", sourceID, name, err)
+		}
+		return
+	}
+	dirs[name] = true
+}
+
+func unfollow(sourceID, name string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if dirs := watched[sourceID]; dirs[name] {
+		delete(dirs, name)
+		events.Unwatch(sourceID, name)
+	}
+}
+
+func saveAll() {
+	mu.Lock()
+	list := make([]*index, 0, len(indexes))
+	for _, ix := range indexes {
+		list = append(list, ix)
+	}
+	mu.Unlock()
+
+	for _, ix := range list {
+		if memoryOnly(ix.source) {
+			continue
+		}
+		if err := ix.save(); err != nil {
+			utils.Warnf("⚠️  Failed to save search index of %s: %v", ix.source, err)
+		}
+	}
+}
+
+// Search returns the items of the given sources that match q and that
+// allow accepts, sorted by source and path. The boolean reports whether
+// more results were cut off by the limit.
+func Search(sources []string, q Query, allow func(source, name string) bool) ([]Result, bool, error) {
+	if err := q.compile(); err != nil {
+		return nil, false, err
+	}
+	if q.empty() {
+		return nil, false, errors.New("nothing to search for")
+	}
+
+	results := make([]Result, 0)
+	for _, sourceID := range sources {
+		ix := get(sourceID)
+		if ix == nil {
+			continue
+		}
+		for _, doc := range ix.search(&q) {
+			if !allow(sourceID, doc.Path) {
+				continue
+			}
+			results = append(results, Result{
+				Source:  sourceID,
+				Path:    doc.Path,
+				Name:    doc.Name(),
+				IsDir:   doc.IsDir,
+				Size:    doc.Size,
+				ModTime: doc.ModTime,
+				Ext:     path.Ext(doc.Path),
+			})
+		}
+	}
+
+	sort.Slice(results, func(i, k int) bool {
+		if results[i].Source != results[k].Source {
+			return results[i].Source < results[k].Source
+		}
+		return results[i].Path < results[k].Path
+	})
+	if q.Limit > 0 && len(results) > q.Limit {
+		return results[:q.Limit], true, nil
+	}
+	return results, false, nil
+}
+
+// Ready reports whether a source was crawled since the server started, so
+// that its results are complete
+func Ready(sourceID string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return crawled[sourceID]
+}
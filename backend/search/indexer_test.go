@@ -0,0 +1,75 @@
+package search
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"filemanager/config"
+	"filemanager/storage"
+)
+
+func TestEncryptedContentsAreNotIndexed(t *testing.T) {
+	dir := t.TempDir()
+	cfg := fmt.Sprintf("server:\n  dataDir: %q\nsources:\n"+
+		"  - id: plain\n    name: Plain\n    path: %q\n"+
+		"  - id: secret\n    name: Secret\n    path: %q\n    encryption:\n      passphrase: correct horse\n"+
+		"  - id: hidden\n    name: Hidden\n    path: %q\n    encryption:\n      passphrase: correct horse\n      names: true\n",
+		filepath.Join(dir, "data"), filepath.Join(dir, "plain"), filepath.Join(dir, "secret"), filepath.Join(dir, "hidden"))
+	for _, d := range []string{"plain", "secret", "hidden"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(p, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.SetPath(p)
+	config.Init()
+	if err := Init(filepath.Join(dir, "data")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source string
+		text   bool
+		saved  bool
+	}{
+		{"plain", true, true},
+		{"secret", false, true},
+		{"hidden", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			src, _ := config.GetSource(tt.source)
+			drv, err := storage.NewLocal(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(src.Path, "notes.txt"), []byte("launch codes"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			ix := get(tt.source)
+			if err := crawl(ix, drv, "/"); err != nil {
+				t.Fatal(err)
+			}
+			doc, ok := ix.get("/notes.txt")
+			if !ok {
+				t.Fatal("notes.txt was not indexed")
+			}
+			if doc.Text != tt.text || slices.Contains(doc.Terms, "launch") != tt.text {
+				t.Errorf("contents indexed: %v, want %v", doc.Text, tt.text)
+			}
+
+			saveAll()
+			_, err = os.Stat(indexFile(tt.source))
+			if saved := err == nil; saved != tt.saved {
+				t.Errorf("index saved: %v, want %v", saved, tt.saved)
+			}
+		})
+	}
+}
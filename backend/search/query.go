@@ -0,0 +1,102 @@
+package search
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Query selects items in Search. Empty fields match everything.
+type Query struct {
+	// Name is matched against the base name without regard to case, as a
+	// glob when it holds *, ? or [ and as a substring otherwise
+	Name string
+	// Text holds words that must all appear in the file content or name
+	Text string
+	// Exts are extensions without the dot, any of which may match
+	Exts    []string
+	MinSize int64
+	MaxSize int64
+	Since   time.Time
+	Until   time.Time
+	// Path limits results to this folder and everything below it
+	Path string
+	// Type is "file" or "dir"
+	Type  string
+	Limit int
+
+	name  string
+	glob  bool
+	terms []string
+	exts  map[string]bool
+}
+
+// compile checks the query and prepares it for matching
+func (q *Query) compile() error {
+	q.name = strings.ToLower(q.Name)
+	q.glob = strings.ContainsAny(q.name, "*?[")
+	if q.glob {
+		if _, err := path.Match(q.name, ""); err != nil {
+			return fmt.Errorf("invalid name pattern: %w", err)
+		}
+	}
+
+	q.terms = Terms(q.Text)
+	if strings.TrimSpace(q.Text) != "" && len(q.terms) == 0 {
+		return fmt.Errorf("search text needs words of at least %d characters", minTermLength)
+	}
+
+	q.exts = map[string]bool{}
+	for _, ext := range q.Exts {
+		if ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), ".")); ext != "" {
+			q.exts["."+ext] = true
+		}
+	}
+
+	switch q.Type {
+	case "", "file", "dir":
+	default:
+		return fmt.Errorf("invalid type %q", q.Type)
+	}
+	return nil
+}
+
+// empty reports whether the query has nothing to match on
+func (q *Query) empty() bool {
+	return q.name == "" && len(q.terms) == 0 && len(q.exts) == 0 &&
+		q.MinSize == 0 && q.MaxSize == 0 && q.Since.IsZero() && q.Until.IsZero()
+}
+
+func (q *Query) matches(doc *Doc) bool {
+	if doc == nil || doc.Path == "/" {
+		return false
+	}
+
+	name := strings.ToLower(doc.Name())
+	switch {
+	case q.Type == "file" && doc.IsDir, q.Type == "dir" && !doc.IsDir:
+		return false
+	case q.Path != "" && q.Path != "/" && doc.Path != q.Path && !strings.HasPrefix(doc.Path, q.Path+"/"):
+		return false
+	case len(q.exts) > 0 && (doc.IsDir || !q.exts[path.Ext(name)]):
+		return false
+	case q.MinSize > 0 && doc.Size < q.MinSize:
+		return false
+	case q.MaxSize > 0 && doc.Size > q.MaxSize:
+		return false
+	case !q.Since.IsZero() && doc.ModTime.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && doc.ModTime.After(q.Until):
+		return false
+	}
+
+	if q.name == "" {
+		return true
+	}
+	if q.glob {
+		ok, _ := path.Match(q.name, name)
+		return ok
+	}
+	return strings.Contains(name, q.name)
+}
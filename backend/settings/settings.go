@@ -0,0 +1,318 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"filemanager/config"
+	"filemanager/utils"
+)
+
+// formatVersion is written into settings.json; bump it and convert older
+// files in load when the layout changes
+const formatVersion = 1
+
+// legacyFile is where settings were kept before, in the root of the first
+// source and shared by everyone. Without sources it was in the working
+// directory.
+const legacyFile = ".settings.json"
+
+const (
+	// MaxClients is how many clients of one user keep settings of their
+	// own; saving for another one drops the one saved longest ago
+	MaxClients = 20
+	// MaxClientID is the longest client ID
+	MaxClientID = 64
+)
+
+// ErrInvalid wraps what is wrong with settings a client sends
+var ErrInvalid = errors.New("invalid settings")
+
+var (
+	ViewModes  = []string{"list", "grid", "tiles"}
+	SortFields = []string{"name", "size", "modified", "type"}
+)
+
+// Sort is an order for folder listings
+type Sort struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc"`
+}
+
+// SourceDefaults change the listing preferences for one source. Empty
+// fields fall back to the general ones.
+type SourceDefaults struct {
+	Sort       *Sort  `json:"sort,omitempty"`
+	ViewMode   string `json:"viewMode,omitempty"`
+	ShowHidden *bool  `json:"showHidden,omitempty"`
+}
+
+// Settings are the preferences of a user, or of one of their clients
+type Settings struct {
+	DarkMode   bool `json:"darkMode"`
+	SidebarPin bool `json:"sidebarPin"`
+	// Encryption is kept for older clients; whether files are stored
+	// encrypted is a setting of each source
+	Encryption bool   `json:"encryption"`
+	Sort       Sort   `json:"sort"`
+	ViewMode   string `json:"viewMode"`
+	ShowHidden bool   `json:"showHidden"`
+	// Sources holds per-source defaults by source ID
+	Sources map[string]SourceDefaults `json:"sources,omitempty"`
+}
+
+// Defaults are the settings of someone who never saved any
+func Defaults() Settings {
+	return Settings{SidebarPin: true, Sort: Sort{Field: "name"}, ViewMode: "list"}
+}
+
+// Check reports a setting the clients would not understand
+func (s *Settings) Check() error {
+	if err := checkSort(s.Sort); err != nil {
+		return err
+	}
+	if !slices.Contains(ViewModes, s.ViewMode) {
+		return fmt.Errorf("unknown view mode %q", s.ViewMode)
+	}
+	for id, d := range s.Sources {
+		if d.Sort != nil {
+			if err := checkSort(*d.Sort); err != nil {
+				return fmt.Errorf("source %s: %w", id, err)
+			}
+		}
+		if d.ViewMode != "" && !slices.Contains(ViewModes, d.ViewMode) {
+			return fmt.Errorf("source %s: unknown view mode %q", id, d.ViewMode)
+		}
+	}
+	return nil
+}
+
+func checkSort(s Sort) error {
+	if !slices.Contains(SortFields, s.Field) {
+		return fmt.Errorf("unknown sort field %q", s.Field)
+	}
+	return nil
+}
+
+// record holds what one user saved, for all their clients and for
+// single ones
+type record struct {
+	Settings *Settings           `json:"settings,omitempty"`
+	Clients  map[string]Settings `json:"clients,omitempty"`
+	// Saved is when each client last saved; clients missing here count
+	// as the oldest
+	Saved map[string]time.Time `json:"saved,omitempty"`
+}
+
+type store struct {
+	Version int `json:"version"`
+	// Shared came from a legacy settings file and applies to users who
+	// have not saved settings of their own
+	Shared *Settings          `json:"shared,omitempty"`
+	Users  map[string]*record `json:"users"`
+}
+
+var (
+	mu   sync.Mutex
+	data = store{Version: formatVersion, Users: map[string]*record{}}
+	file string
+)
+
+// Init loads the settings from the data directory. On the first start it
+// takes over the settings file older versions kept in the first source.
+func Init(dataDir string) error {
+	file = filepath.Join(dataDir, "settings.json")
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	raw, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return migrate()
+	}
+	if err != nil {
+		return err
+	}
+	return load(raw)
+}
+
+func load(raw []byte) error {
+	var s store
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	if s.Version > formatVersion {
+		return fmt.Errorf("%s was written by a newer version (format %d)", file, s.Version)
+	}
+	s.Version = formatVersion
+	if s.Users == nil {
+		s.Users = map[string]*record{}
+	}
+	for _, rec := range s.Users {
+		if rec.Clients != nil && rec.Saved == nil {
+			rec.Saved = map[string]time.Time{}
+		}
+	}
+	data = s
+	return nil
+}
+
+// migrate takes over the legacy settings file from where older versions
+// read it: the first source, or the working directory when there were no
+// sources
+func migrate() error {
+	data = store{Version: formatVersion, Users: map[string]*record{}}
+	p := legacyFile
+	if sources := config.GetEnabledSources(); len(sources) > 0 {
+		p = ""
+		if sources[0].Type == "local" {
+			p = filepath.Join(sources[0].Path, legacyFile)
+		}
+		if _, err := os.Stat(legacyFile); err == nil {
+			utils.Warnf("⚠️  Ignoring %s, older versions only read it without sources; remove it", legacyFile)
+		}
+	}
+
+	var legacy string
+	if p != "" {
+		if raw, err := os.ReadFile(p); err == nil {
+			s := Defaults()
+			if err := json.Unmarshal(raw, &s); err != nil {
+				utils.Warnf("⚠️  Skipping unreadable %s: %v", p, err)
+			} else {
+				data.Shared, legacy = &s, p
+			}
+		}
+	}
+
+	if err := save(); err != nil {
+		return err
+	}
+	if legacy != "" {
+		if err := os.Remove(legacy); err != nil {
+			utils.Warnf("⚠️  Cannot remove %s: %v", legacy, err)
+		}
+		utils.Infof("♻️  Moved settings from %s to %s", legacy, file)
+	}
+	return nil
+}
+
+// Get returns the settings of a user, those saved for client when it is
+// not empty and there are any
+func Get(username, client string) Settings {
+	mu.Lock()
+	defer mu.Unlock()
+	return get(username, client)
+}
+
+func get(username, client string) Settings {
+	s := Defaults()
+	if data.Shared != nil {
+		s = *data.Shared
+	}
+	if rec := data.Users[username]; rec != nil {
+		if c, ok := rec.Clients[client]; ok && client != "" {
+			s = c
+		} else if rec.Settings != nil {
+			s = *rec.Settings
+		}
+	}
+	s.Sources = cloneSources(s.Sources)
+	return s
+}
+
+// Update changes the settings of a user, or of one of their clients, with
+// edit. Fields edit leaves alone keep their value. Errors of edit and
+// settings that fail Check are reported as ErrInvalid.
+func Update(username, client string, edit func(*Settings) error) (Settings, error) {
+	if len(client) > MaxClientID {
+		return Settings{}, fmt.Errorf("%w: client ID is too long", ErrInvalid)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	s := get(username, client)
+	if err := edit(&s); err != nil {
+		return Settings{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if err := s.Check(); err != nil {
+		return Settings{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	for id, d := range s.Sources {
+		if d == (SourceDefaults{}) {
+			delete(s.Sources, id)
+		}
+	}
+
+	rec := data.Users[username]
+	if rec == nil {
+		rec = &record{}
+		data.Users[username] = rec
+	}
+	if client != "" {
+		if rec.Clients == nil {
+			rec.Clients = map[string]Settings{}
+			rec.Saved = map[string]time.Time{}
+		}
+		if _, ok := rec.Clients[client]; !ok && len(rec.Clients) >= MaxClients {
+			rec.dropOldestClient()
+		}
+		rec.Clients[client] = s
+		rec.Saved[client] = time.Now()
+	} else {
+		rec.Settings = &s
+	}
+	if err := save(); err != nil {
+		return Settings{}, err
+	}
+	return s, nil
+}
+
+// dropOldestClient forgets the client that saved longest ago
+func (rec *record) dropOldestClient() {
+	oldest := ""
+	for client := range rec.Clients {
+		if oldest == "" || rec.Saved[client].Before(rec.Saved[oldest]) ||
+			rec.Saved[client].Equal(rec.Saved[oldest]) && client < oldest {
+			oldest = client
+		}
+	}
+	delete(rec.Clients, oldest)
+	delete(rec.Saved, oldest)
+}
+
+func cloneSources(m map[string]SourceDefaults) map[string]SourceDefaults {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]SourceDefaults, len(m))
+	for id, d := range m {
+		out[id] = d
+	}
+	return out
+}
+
+func save() error {
+	if file == "" {
+		return nil
+	}
+	raw, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,218 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filemanager/config"
+)
+
+// useSources loads a configuration with a local source in each folder
+func useSources(t *testing.T, dirs ...string) {
+	t.Helper()
+	cfg := "sources:\n"
+	for i, dir := range dirs {
+		cfg += fmt.Sprintf("  - name: S%d\n    path: %q\n", i+1, dir)
+	}
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(p, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.SetPath(p)
+	config.Init()
+}
+
+// inDir runs the rest of the test in dir
+func inDir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func writeLegacy(t *testing.T, dir string, s Settings) string {
+	t.Helper()
+	raw, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, legacyFile)
+	if err := os.WriteFile(p, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestStore(t *testing.T) {
+	useSources(t)
+	inDir(t, t.TempDir())
+	data := t.TempDir()
+	if err := Init(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := Get("alice", ""); got.ViewMode != "list" || !got.SidebarPin || got.Sort.Field != "name" {
+		t.Errorf("defaults %+v", got)
+	}
+
+	// Fields a save leaves out keep their value
+	if _, err := Update("alice", "", func(s *Settings) error { return json.Unmarshal([]byte(`{"darkMode":true}`), s) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Update("alice", "", func(s *Settings) error { return json.Unmarshal([]byte(`{"viewMode":"grid"}`), s) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := Get("alice", ""); !got.DarkMode || got.ViewMode != "grid" {
+		t.Errorf("alice has %+v", got)
+	}
+	if got := Get("bob", ""); got.DarkMode {
+		t.Error("bob got the settings of alice")
+	}
+
+	invalid := []string{`{"viewMode":"huge"}`, `{"sort":{"field":"color"}}`, `{"sources":{"files":{"viewMode":"huge"}}}`, `{"darkMode":"yes"}`}
+	for _, body := range invalid {
+		_, err := Update("alice", "", func(s *Settings) error { return json.Unmarshal([]byte(body), s) })
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: got %v, want ErrInvalid", body, err)
+		}
+	}
+
+	// Settings survive a restart
+	if err := Init(data); err != nil {
+		t.Fatal(err)
+	}
+	if got := Get("alice", ""); !got.DarkMode || got.ViewMode != "grid" {
+		t.Errorf("after restart alice has %+v", got)
+	}
+}
+
+func TestClients(t *testing.T) {
+	useSources(t)
+	inDir(t, t.TempDir())
+	if err := Init(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	view := func(mode string) func(*Settings) error {
+		return func(s *Settings) error { s.ViewMode = mode; return nil }
+	}
+
+	if _, err := Update("alice", "", view("grid")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Update("alice", "phone", view("tiles")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		client string
+		want   string
+	}{
+		{"phone", "tiles"},
+		{"laptop", "grid"}, // a client without settings of its own gets the user's
+		{"", "grid"},
+	}
+	for _, tt := range tests {
+		if got := Get("alice", tt.client).ViewMode; got != tt.want {
+			t.Errorf("client %q: view mode %s, want %s", tt.client, got, tt.want)
+		}
+	}
+
+	// Saving for more clients than allowed drops the one saved longest ago
+	for i := 0; i < MaxClients; i++ {
+		if _, err := Update("alice", fmt.Sprintf("c%d", i), view("list")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(data.Users["alice"].Clients); got != MaxClients {
+		t.Errorf("%d clients kept, want %d", got, MaxClients)
+	}
+	if got := Get("alice", "phone").ViewMode; got != "grid" {
+		t.Errorf("oldest client still has view mode %s", got)
+	}
+	if got := Get("alice", "c0").ViewMode; got != "list" {
+		t.Errorf("newer client lost its settings: %s", got)
+	}
+
+	long := make([]byte, MaxClientID+1)
+	for i := range long {
+		long[i] = 'x'
+	}
+	if _, err := Update("alice", string(long), view("list")); !errors.Is(err, ErrInvalid) {
+		t.Errorf("long client ID: got %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	old := Defaults()
+	old.DarkMode, old.ViewMode = true, "tiles"
+
+	tests := []struct {
+		name string
+		// whether a source is configured and which legacy files exist
+		source, inSource, inWorkDir bool
+		migrated                    bool
+		// which legacy files are left afterwards
+		leftInSource, leftInWorkDir bool
+	}{
+		{"from the first source", true, true, false, true, false, false},
+		{"from the working directory without sources", false, false, true, true, false, false},
+		{"working directory ignored with sources", true, false, true, false, false, true},
+		{"first source wins", true, true, true, true, false, true},
+		{"nothing to migrate", true, false, false, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, wd := t.TempDir(), t.TempDir()
+			if tt.source {
+				useSources(t, src)
+			} else {
+				useSources(t)
+			}
+			inDir(t, wd)
+			if tt.inSource {
+				writeLegacy(t, src, old)
+			}
+			if tt.inWorkDir {
+				writeLegacy(t, wd, old)
+			}
+
+			data := t.TempDir()
+			if err := Init(data); err != nil {
+				t.Fatal(err)
+			}
+			if got := Get("alice", "").DarkMode; got != tt.migrated {
+				t.Errorf("legacy settings in use: %v, want %v", got, tt.migrated)
+			}
+			if _, err := os.Stat(filepath.Join(src, legacyFile)); (err == nil) != tt.leftInSource {
+				t.Errorf("file in the source left: %v, want %v", err == nil, tt.leftInSource)
+			}
+			if _, err := os.Stat(filepath.Join(wd, legacyFile)); (err == nil) != tt.leftInWorkDir {
+				t.Errorf("file in the working directory left: %v, want %v", err == nil, tt.leftInWorkDir)
+			}
+
+			// Own settings win over the migrated ones, which are kept
+			// across restarts
+			if _, err := Update("bob", "", func(s *Settings) error { s.ViewMode = "grid"; return nil }); err != nil {
+				t.Fatal(err)
+			}
+			if err := Init(data); err != nil {
+				t.Fatal(err)
+			}
+			if got := Get("alice", "").DarkMode; got != tt.migrated {
+				t.Errorf("after restart legacy settings in use: %v, want %v", got, tt.migrated)
+			}
+			if got := Get("bob", "").ViewMode; got != "grid" {
+				t.Errorf("bob has view mode %s", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package shares
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path"
+	"time"
+
+	"filemanager/config"
+	"filemanager/utils"
+)
+
+// Arrival tells the owner of an upload link about a file that came in
+type Arrival struct {
+	Event   string    `json:"event"`
+	Token   string    `json:"token"`
+	Owner   string    `json:"owner"`
+	Source  string    `json:"source"`
+	Folder  string    `json:"folder"`
+	Path    string    `json:"path"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Uploads int       `json:"uploads"`
+	Time    time.Time `json:"time"`
+}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// NotifyUpload posts an arrival to the configured webhook when the link
+// asks for notifications. It runs in the background and only logs failures.
+// With a webhook secret the body is signed in the X-Signature-256 header
+// as "sha256=<hex hmac>".
+func NotifyUpload(s Share, name string, size int64) {
+	hook := config.Get().Shares
+	if !s.Notify || hook.WebhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(Arrival{
+		Event:   "share.upload",
+		Token:   s.Token,
+		Owner:   s.Owner,
+		Source:  s.Source,
+		Folder:  s.Path,
+		Path:    name,
+		Name:    path.Base(name),
+		Size:    size,
+		Uploads: s.Uploads,
+		Time:    time.Now(),
+	})
+	if err != nil {
+		return
+	}
+
+	go func() {
+		req, err := http.NewRequest(http.MethodPost, hook.WebhookURL, bytes.NewReader(body))
+		if err != nil {
+			utils.Warnf("⚠️  Share webhook: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if hook.WebhookSecret != "" {
+			mac := hmac.New(sha256.New, []byte(hook.WebhookSecret))
+			mac.Write(body)
+			req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+
+		resp, err := notifyClient.Do(req)
+		if err != nil {
+			utils.Warnf("⚠️  Share webhook failed for %s: %v", s.Owner, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			utils.Warnf("⚠️  Share webhook for %s answered %s", s.Owner, resp.Status)
+		}
+	}()
+}
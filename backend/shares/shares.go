@@ -0,0 +1,345 @@
+package shares
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"filemanager/utils"
+)
+
+// Mode is what visitors of a share can do
+type Mode string
+
+const (
+	// Read lets visitors download the item, or browse and download a folder
+	Read Mode = "read"
+	// Upload makes a file request: visitors add files to a folder without
+	// seeing what is in it, within the limits of the link
+	Upload Mode = "upload"
+)
+
+var (
+	ErrNotFound = errors.New("share not found")
+	ErrExpired  = errors.New("share has expired")
+	ErrLimit    = errors.New("share has reached its download limit")
+	ErrTooLarge = errors.New("file is larger than this link accepts")
+	ErrFull     = errors.New("this link has no room left for the file")
+	ErrFileType = errors.New("this link does not accept files of that type")
+)
+
+// Share is a public link to an item of a source
+type Share struct {
+	Token        string     `json:"token"`
+	Source       string     `json:"source"`
+	Path         string     `json:"path"`
+	IsDir        bool       `json:"isDir"`
+	Mode         Mode       `json:"mode"`
+	Owner        string     `json:"owner"`
+	PasswordHash string     `json:"passwordHash,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	Created      time.Time  `json:"created"`
+
+	// Limits of upload links, zero or empty for none. AllowedTypes holds
+	// extensions (".pdf") and MIME types ("image/*", "application/zip").
+	MaxFileSize  int64    `json:"maxFileSize,omitempty"`
+	MaxTotalSize int64    `json:"maxTotalSize,omitempty"`
+	AllowedTypes []string `json:"allowedTypes,omitempty"`
+	Uploads      int      `json:"uploads"`
+	Uploaded     int64    `json:"uploaded"`
+
+	// Notify sends the owner a notification when files arrive
+	Notify bool `json:"notify,omitempty"`
+}
+
+var (
+	mu     sync.Mutex
+	shares = map[string]*Share{}
+	file   string
+)
+
+// Init loads the shares from the data directory
+func Init(dataDir string) error {
+	file = filepath.Join(dataDir, "shares.json")
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []*Share
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, s := range list {
+		shares[s.Token] = s
+	}
+	return nil
+}
+
+// ParseMode accepts the mode names clients send; nothing means read
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case "":
+		return Read, nil
+	case Read, Upload:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown share mode %q", s)
+}
+
+// Create stores a new share with a fresh token, protecting it with
+// password unless that is empty
+func Create(s *Share, password string) error {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	s.Token = base64.RawURLEncoding.EncodeToString(buf)
+	s.Created = time.Now()
+	s.Downloads = 0
+	s.Uploads, s.Uploaded = 0, 0
+
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		s.PasswordHash = string(hash)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	shares[s.Token] = s
+	save()
+	return nil
+}
+
+// Get returns a copy of a share
+func Get(token string) (Share, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s, ok := shares[token]
+	if !ok {
+		return Share{}, ErrNotFound
+	}
+	return *s, nil
+}
+
+// List returns the shares of a user, or all of them for an empty owner,
+// newest first
+func List(owner string) []Share {
+	mu.Lock()
+	defer mu.Unlock()
+
+	list := make([]Share, 0)
+	for _, s := range shares {
+		if owner == "" || s.Owner == owner {
+			list = append(list, *s)
+		}
+	}
+	sort.Slice(list, func(i, k int) bool { return list[i].Created.After(list[k].Created) })
+	return list
+}
+
+// Revoke deletes a share; its link stops working right away
+func Revoke(token string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := shares[token]; !ok {
+		return ErrNotFound
+	}
+	delete(shares, token)
+	save()
+	return nil
+}
+
+// Usable reports why a share can no longer be used, if it cannot
+func (s *Share) Usable() error {
+	if s.Expires != nil && time.Now().After(*s.Expires) {
+		return ErrExpired
+	}
+	if s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads {
+		return ErrLimit
+	}
+	return nil
+}
+
+// HasPassword reports whether visitors need a password
+func (s *Share) HasPassword() bool {
+	return s.PasswordHash != ""
+}
+
+// CheckPassword compares a password against the one of the share
+func (s *Share) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(password)) == nil
+}
+
+// UnlockKey is what a visitor keeps after entering the password. It is
+// derived from the password hash, so it stops working when the share goes.
+func (s *Share) UnlockKey() string {
+	sum := sha256.Sum256([]byte(s.Token + "\x00" + s.PasswordHash))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckUnlockKey reports whether key was handed out for this share
+func (s *Share) CheckUnlockKey(key string) bool {
+	return subtle.ConstantTimeCompare([]byte(key), []byte(s.UnlockKey())) == 1
+}
+
+// CountDownload uses up one download of a share
+func CountDownload(token string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s, ok := shares[token]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := s.Usable(); err != nil {
+		return err
+	}
+	s.Downloads++
+	save()
+	return nil
+}
+
+// ParseTypes normalizes the file types an upload link accepts: MIME types
+// keep their slash, anything else is taken as an extension
+func ParseTypes(types []string) ([]string, error) {
+	var parsed []string
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch {
+		case t == "":
+			continue
+		case strings.Contains(t, "/"):
+			if _, _, err := mime.ParseMediaType(strings.TrimSuffix(t, "*") + "x"); err != nil {
+				return nil, fmt.Errorf("invalid file type %q", t)
+			}
+		case !strings.HasPrefix(t, "."):
+			t = "." + t
+		}
+		parsed = append(parsed, t)
+	}
+	return parsed, nil
+}
+
+// Accepts reports whether an upload link takes a file of that name. The
+// type is judged by the extension, never by what the visitor claims.
+func (s *Share) Accepts(name string) bool {
+	if len(s.AllowedTypes) == 0 {
+		return true
+	}
+
+	ext := strings.ToLower(path.Ext(name))
+	typ, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+	for _, t := range s.AllowedTypes {
+		switch {
+		case t == ext:
+			return true
+		case typ == "":
+		case t == typ, strings.HasSuffix(t, "/*") && strings.HasPrefix(typ, strings.TrimSuffix(t, "*")):
+			return true
+		}
+	}
+	return false
+}
+
+// Remaining returns how many more bytes an upload link takes, -1 when it
+// has no total limit
+func (s *Share) Remaining() int64 {
+	if s.MaxTotalSize <= 0 {
+		return -1
+	}
+	return max(s.MaxTotalSize-s.Uploaded, 0)
+}
+
+// Reserve books room for an upload of size bytes on a link. The room is
+// given back with Release when the upload fails.
+func Reserve(token string, size int64) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s, ok := shares[token]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := s.Usable(); err != nil {
+		return err
+	}
+	if s.MaxFileSize > 0 && size > s.MaxFileSize {
+		return ErrTooLarge
+	}
+	if s.MaxTotalSize > 0 && s.Uploaded+size > s.MaxTotalSize {
+		return ErrFull
+	}
+	s.Uploaded += size
+	s.Uploads++
+	save()
+	return nil
+}
+
+// Release gives back the room of a failed upload
+func Release(token string, size int64) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if s, ok := shares[token]; ok {
+		s.Uploaded = max(s.Uploaded-size, 0)
+		s.Uploads = max(s.Uploads-1, 0)
+		save()
+	}
+}
+
+// save writes the shares to disk; callers hold mu
+func save() {
+	if file == "" {
+		return
+	}
+
+	list := make([]*Share, 0, len(shares))
+	for _, s := range shares {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, k int) bool { return list[i].Created.Before(list[k].Created) })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		tmp := file + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, file)
+		}
+	}
+	if err != nil {
+		utils.Warnf("⚠️  Failed to save shares: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package shares
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		try      string
+		want     bool
+	}{
+		{"right password", "open sesame", "open sesame", true},
+		{"wrong password", "open sesame", "open sesame ", false},
+		{"empty password", "open sesame", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Share{Source: "files", Path: "/a.txt", Mode: Read, Owner: "alice"}
+			if err := Create(s, tt.password); err != nil {
+				t.Fatal(err)
+			}
+			if !s.HasPassword() {
+				t.Fatal("share has no password")
+			}
+			if got := s.CheckPassword(tt.try); got != tt.want {
+				t.Errorf("CheckPassword(%q) = %v, want %v", tt.try, got, tt.want)
+			}
+		})
+	}
+
+	open := &Share{Source: "files", Path: "/a.txt", Mode: Read, Owner: "alice"}
+	if err := Create(open, ""); err != nil {
+		t.Fatal(err)
+	}
+	if open.HasPassword() {
+		t.Error("share without password asks for one")
+	}
+}
+
+func TestUnlockKey(t *testing.T) {
+	a := &Share{Source: "files", Path: "/a.txt", Owner: "alice"}
+	b := &Share{Source: "files", Path: "/a.txt", Owner: "alice"}
+	for _, s := range []*Share{a, b} {
+		if err := Create(s, "same password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		share *Share
+		key   string
+		want  bool
+	}{
+		{"own key", a, a.UnlockKey(), true},
+		{"key of another share", a, b.UnlockKey(), false},
+		{"the password", a, "same password", false},
+		{"empty", a, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.share.CheckUnlockKey(tt.key); got != tt.want {
+				t.Errorf("CheckUnlockKey = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadLimits(t *testing.T) {
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	tests := []struct {
+		name    string
+		expires *time.Time
+		max     int
+		allowed int
+		err     error
+	}{
+		{"no limits", nil, 0, 5, nil},
+		{"download limit", nil, 2, 2, ErrLimit},
+		{"not expired yet", &future, 3, 3, ErrLimit},
+		{"expired", &past, 0, 0, ErrExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Share{Source: "files", Path: "/a.txt", Owner: "alice", Expires: tt.expires, MaxDownloads: tt.max}
+			if err := Create(s, ""); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.allowed; i++ {
+				if err := CountDownload(s.Token); err != nil {
+					t.Fatalf("download %d: %v", i+1, err)
+				}
+			}
+			if tt.err != nil {
+				if err := CountDownload(s.Token); !errors.Is(err, tt.err) {
+					t.Errorf("got %v, want %v", err, tt.err)
+				}
+				got, _ := Get(s.Token)
+				if err := got.Usable(); !errors.Is(err, tt.err) {
+					t.Errorf("Usable = %v, want %v", err, tt.err)
+				}
+			}
+		})
+	}
+
+	if err := CountDownload("no-such-token"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown token: %v", err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	s := &Share{Source: "files", Path: "/inbox", IsDir: true, Mode: Upload, Owner: "alice", MaxFileSize: 100, MaxTotalSize: 250}
+	if err := Create(s, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		size    int64
+		release bool
+		err     error
+		left    int64
+	}{
+		{"first file", 100, false, nil, 150},
+		{"over the file limit", 101, false, ErrTooLarge, 150},
+		{"second file", 100, false, nil, 50},
+		{"no room left", 60, false, ErrFull, 50},
+		{"failed upload gives room back", 50, true, nil, 50},
+		{"fits again", 50, false, nil, 0},
+	}
+	for _, st := range steps {
+		err := Reserve(s.Token, st.size)
+		if !errors.Is(err, st.err) {
+			t.Fatalf("%s: got %v, want %v", st.name, err, st.err)
+		}
+		if st.release {
+			Release(s.Token, st.size)
+		}
+		got, _ := Get(s.Token)
+		if left := got.Remaining(); left != st.left {
+			t.Fatalf("%s: %d bytes left, want %d", st.name, left, st.left)
+		}
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	types, err := ParseTypes([]string{"PDF", " .docx", "image/*", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Share{AllowedTypes: types}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"report.pdf", true},
+		{"REPORT.PDF", true},
+		{"letter.docx", true},
+		{"photo.jpg", true},
+		{"photo.png", true},
+		{"script.sh", false},
+		{"page.html", false},
+		{"no-extension", false},
+		{"pdf", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.Accepts(tt.name); got != tt.want {
+				t.Errorf("Accepts(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseTypes([]string{"ima ge/png"}); err == nil {
+		t.Error("invalid MIME type accepted")
+	}
+	if !(&Share{}).Accepts("anything.exe") {
+		t.Error("link without types refused a file")
+	}
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+
+	"filemanager/config"
+)
+
+// EncryptSource encrypts the files of a source in place with the key of
+// its encryption settings, including names when those say so. Files that
+// are encrypted already are left alone, so an interrupted run can simply
+// be started again. done is called for each file that changed. The server
+// must not be running.
+func EncryptSource(src config.Source, done func(name string)) error {
+	return convert(src, true, done)
+}
+
+// DecryptSource turns an encrypted source back into plain files; remove
+// its encryption settings afterwards. The server must not be running.
+func DecryptSource(src config.Source, done func(name string)) error {
+	return convert(src, false, done)
+}
+
+func convert(src config.Source, encrypt bool, done func(string)) error {
+	if src.Encryption == nil {
+		return fmt.Errorf("source %s has no encryption settings", src.Name)
+	}
+	factory, ok := factories[src.Type]
+	if !ok {
+		return fmt.Errorf("unknown source type %q for %s", src.Type, src.Name)
+	}
+	inner, err := factory(src)
+	if err != nil {
+		return err
+	}
+	if c, ok := inner.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	c, err := NewCrypt(inner, src.Encryption)
+	if err != nil {
+		return err
+	}
+	conv := &converter{c: c, encrypt: encrypt, done: done}
+	if err := conv.dir("/", "/"); err != nil {
+		return err
+	}
+	if !encrypt {
+		// A later encryption may well use another key
+		return inner.RemoveAll(KeyFile)
+	}
+	return nil
+}
+
+// convertTmp is where a file is written before it replaces the one it was
+// converted from, out of the way of the files of the source
+const convertTmp = MetaDir + "/convert.tmp"
+
+type converter struct {
+	c       *Crypt
+	encrypt bool
+	done    func(string)
+}
+
+// dir converts the entries of a folder, stored at inner and known to the
+// server as plain. Folders are renamed after their content.
+func (v *converter) dir(inner, plain string) error {
+	entries, err := v.c.inner.ReadDir(inner)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		from := path.Join(inner, e.Name())
+		if from == KeyFile || from == convertTmp {
+			continue
+		}
+
+		name, encrypted := v.c.plainName(inner, e.Name())
+		if v.c.names == nil {
+			encrypted = false
+		}
+		if !encrypted {
+			if !v.encrypt && v.c.names != nil {
+				// Not written through the driver, leave it be
+				continue
+			}
+			name = e.Name()
+		}
+
+		stored := name
+		if v.encrypt && v.c.names != nil && !(inner == "/" && "/"+name == MetaDir) {
+			stored = v.c.names.encrypt(name)
+		}
+		to := path.Join(inner, stored)
+		at := path.Join(plain, name)
+
+		if !e.IsDir() {
+			changed, err := v.file(from, to, e.Mode())
+			if err != nil {
+				return fmt.Errorf("%s: %w", at, err)
+			}
+			if changed {
+				v.done(at)
+			}
+			continue
+		}
+		if err := v.dir(from, at); err != nil {
+			return err
+		}
+		if from != to {
+			if err := v.c.inner.Rename(from, to); err != nil {
+				return fmt.Errorf("%s: %w", at, err)
+			}
+		}
+	}
+	return nil
+}
+
+// file converts one file from its stored place to its new one, reporting
+// whether there was anything to do
+func (v *converter) file(from, to string, mode fs.FileMode) (bool, error) {
+	sealed, err := v.isSealed(from)
+	if err != nil {
+		return false, err
+	}
+	if sealed == v.encrypt {
+		if from == to {
+			return false, nil
+		}
+		return true, v.c.inner.Rename(from, to)
+	}
+
+	var r io.ReadCloser
+	var w io.WriteCloser
+	tmp := convertTmp
+	if v.encrypt {
+		var cw *cryptWriter
+		if r, err = v.c.inner.Open(from); err == nil {
+			if cw, err = v.c.createRaw(tmp); err == nil {
+				w = cw
+			}
+		}
+	} else {
+		var f *cryptFile
+		if f, err = v.c.openRaw(from); err == nil {
+			r = f
+			w, err = v.c.inner.Create(tmp)
+		}
+	}
+	if err != nil {
+		if r != nil {
+			r.Close()
+		}
+		return false, err
+	}
+
+	_, err = io.Copy(w, r)
+	r.Close()
+	if err == nil {
+		err = Sync(w)
+	}
+	if err != nil {
+		Abort(w)
+		v.c.inner.RemoveAll(tmp)
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		v.c.inner.RemoveAll(tmp)
+		return false, err
+	}
+	if ch, ok := v.c.inner.(Chmoder); ok {
+		ch.Chmod(tmp, mode.Perm())
+	}
+	if err := v.c.inner.Rename(tmp, to); err != nil {
+		return false, err
+	}
+	if from != to {
+		return true, v.c.inner.RemoveAll(from)
+	}
+	return true, nil
+}
+
+// isSealed reports whether a stored file starts with the header of an
+// encrypted one
+func (v *converter) isSealed(name string) (bool, error) {
+	f, err := v.c.inner.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(cryptMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false, nil
+	}
+	return string(magic) == cryptMagic, nil
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filemanager/config"
+)
+
+func TestConvertKeepsEveryFile(t *testing.T) {
+	files := map[string]string{
+		"a.txt":                 "first",
+		".zxfb-convert.tmp":     "a file of the user",
+		"sub/b.txt":             "second",
+		"sub/.zxfb-convert.tmp": "another one",
+		"sub/deeper/c.txt":      "third",
+		"sub/deeper/empty.txt":  "",
+	}
+
+	for _, names := range []bool{false, true} {
+		t.Run(map[bool]string{false: "contents", true: "names"}[names], func(t *testing.T) {
+			dir := t.TempDir()
+			for name, body := range files {
+				p := filepath.Join(dir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(p, []byte(body), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			src := config.Source{
+				Name: "Test", Path: dir, Type: "local", Enabled: true,
+				Encryption: &config.EncryptionConfig{Passphrase: "correct horse", Names: names},
+			}
+
+			if err := EncryptSource(src, func(string) {}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "a.txt")); !names && err != nil {
+				t.Fatal(err)
+			}
+			if err := DecryptSource(src, func(string) {}); err != nil {
+				t.Fatal(err)
+			}
+
+			for name, want := range files {
+				got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+				if err != nil {
+					t.Errorf("%s: %v", name, err)
+				} else if string(got) != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(convertTmp))); !os.IsNotExist(err) {
+				t.Errorf("temporary file left behind: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,619 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+
+	"filemanager/config"
+)
+
+// Files of an encrypted source are stored as a header followed by chunks
+// sealed with XChaCha20-Poly1305:
+//
+//	"ZXFBENC1" | 16 byte nonce prefix | chunk | chunk | ...
+//
+// A chunk holds up to cryptChunk bytes of the file plus the tag. Its nonce
+// is the prefix followed by the chunk number, and the last chunk is sealed
+// with other associated data, so a file cut short fails to open instead
+// of passing as complete. Chunks open on their own, which makes seeking
+// and Range requests cheap.
+const (
+	cryptMagic    = "ZXFBENC1"
+	cryptPrefix   = 16
+	cryptHeader   = len(cryptMagic) + cryptPrefix
+	cryptChunk    = 64 << 10
+	cryptOverhead = chacha20poly1305.Overhead
+)
+
+// KeyFile is where an encrypted source keeps what is needed to check its
+// key. It is stored as is.
+const KeyFile = MetaDir + "/crypt.json"
+
+// MaxEncryptedName is the longest file or folder name, in bytes, a source
+// with encrypted names can hold. Stored names grow to 8/5 of the name plus
+// its IV, and most file systems stop at 255 bytes.
+const MaxEncryptedName = 255*5/8 - aes.BlockSize
+
+var (
+	ErrWrongKey     = errors.New("wrong passphrase or key file for this source")
+	ErrNotEncrypted = errors.New("file is not encrypted")
+	ErrCorrupt      = errors.New("encrypted file is damaged or was changed")
+	ErrNameTooLong  = fmt.Errorf("names in this encrypted source may be at most %d bytes long", MaxEncryptedName)
+)
+
+// keyInfo is the content of KeyFile
+type keyInfo struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	Check   []byte `json:"check"`
+}
+
+// Crypt encrypts the files of a source on their way into the backend and
+// decrypts them on their way out. With names on, every path element below
+// the root except MetaDir is encrypted too.
+type Crypt struct {
+	inner Driver
+	aead  cipher.AEAD
+	names *nameCipher
+}
+
+// NewCrypt wraps inner with the key of cfg. The first time it stores a
+// fresh salt in KeyFile; after that a different key is refused.
+func NewCrypt(inner Driver, cfg *config.EncryptionConfig) (*Crypt, error) {
+	kdf := "scrypt"
+	if cfg.KeyFile != "" {
+		kdf = "keyfile"
+	}
+
+	info, err := readKeyInfo(inner)
+	if errors.Is(err, fs.ErrNotExist) {
+		info = &keyInfo{Version: 1, KDF: kdf, Salt: make([]byte, 16)}
+		if _, err := rand.Read(info.Salt); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", KeyFile, err)
+	}
+	if info.KDF != kdf {
+		return nil, fmt.Errorf("%w: it was set up with a %s", ErrWrongKey, map[string]string{"scrypt": "passphrase", "keyfile": "key file"}[info.KDF])
+	}
+
+	master, err := masterKey(cfg, info)
+	if err != nil {
+		return nil, err
+	}
+	check := subKey(master, "check", 16)
+	if info.Check == nil {
+		info.Check = check
+		if err := writeKeyInfo(inner, info); err != nil {
+			return nil, fmt.Errorf("cannot write %s: %w", KeyFile, err)
+		}
+	} else if subtle.ConstantTimeCompare(info.Check, check) != 1 {
+		return nil, ErrWrongKey
+	}
+
+	aead, err := chacha20poly1305.NewX(subKey(master, "content", chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+	c := &Crypt{inner: inner, aead: aead}
+	if cfg.Names {
+		nameKey := subKey(master, "names", 64)
+		block, err := aes.NewCipher(nameKey[:32])
+		if err != nil {
+			return nil, err
+		}
+		c.names = &nameCipher{block: block, mac: nameKey[32:]}
+	}
+	return c, nil
+}
+
+func masterKey(cfg *config.EncryptionConfig, info *keyInfo) ([]byte, error) {
+	if info.KDF == "scrypt" {
+		return scrypt.Key([]byte(cfg.Passphrase), info.Salt, 1<<15, 8, 1, 32)
+	}
+	data, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < 16 {
+		return nil, fmt.Errorf("key file %s holds less than 16 bytes", cfg.KeyFile)
+	}
+	return hkdfKey(key, info.Salt, "zxfilebrowser key file", 32), nil
+}
+
+func subKey(master []byte, purpose string, n int) []byte {
+	return hkdfKey(master, nil, "zxfilebrowser "+purpose, n)
+}
+
+func hkdfKey(secret, salt []byte, info string, n int) []byte {
+	key := make([]byte, n)
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key)
+	return key
+}
+
+func readKeyInfo(drv Driver) (*keyInfo, error) {
+	f, err := drv.Open(KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var info keyInfo
+	if err := json.NewDecoder(f).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func writeKeyInfo(drv Driver, info *keyInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := drv.MkdirAll(MetaDir); err != nil {
+		return err
+	}
+	w, err := drv.Create(KeyFile)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		Abort(w)
+		return err
+	}
+	if err := Sync(w); err != nil {
+		Abort(w)
+		return err
+	}
+	return w.Close()
+}
+
+// inner maps a path as the server sees it to the one in the backend
+func (c *Crypt) innerPath(name string) string {
+	if c.names == nil || name == "/" {
+		return name
+	}
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	for i, p := range parts {
+		if i == 0 && "/"+p == MetaDir {
+			continue
+		}
+		parts[i] = c.names.encrypt(p)
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// plainName returns the name of an entry of dir as the server sees it;
+// ok is false for entries that were not written through c
+func (c *Crypt) plainName(dir, name string) (string, bool) {
+	if c.names == nil || (dir == "/" && "/"+name == MetaDir) {
+		return name, true
+	}
+	return c.names.decrypt(name)
+}
+
+// checkName refuses names that would be too long once encrypted, before
+// the backend fails on them with a less helpful error
+func (c *Crypt) checkName(op, name string) error {
+	if c.names == nil {
+		return nil
+	}
+	for _, p := range strings.Split(name, "/") {
+		if len(p) > MaxEncryptedName {
+			return &fs.PathError{Op: op, Path: name, Err: ErrNameTooLong}
+		}
+	}
+	return nil
+}
+
+func (c *Crypt) Stat(name string) (fs.FileInfo, error) {
+	if err := c.checkName("stat", name); err != nil {
+		return nil, err
+	}
+	info, err := c.inner.Stat(c.innerPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return plainInfo(info, path.Base(name)), nil
+}
+
+func (c *Crypt) ReadDir(name string) ([]fs.FileInfo, error) {
+	entries, err := c.inner.ReadDir(c.innerPath(name))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if plain, ok := c.plainName(name, e.Name()); ok {
+			infos = append(infos, plainInfo(e, plain))
+		}
+	}
+	return infos, nil
+}
+
+func (c *Crypt) Open(name string) (File, error) {
+	f, err := c.openRaw(c.innerPath(name))
+	if err != nil {
+		return nil, err
+	}
+	f.info = plainInfo(f.info, path.Base(name))
+	return f, nil
+}
+
+// openRaw opens a file of the backend for decrypting
+func (c *Crypt) openRaw(name string) (*cryptFile, error) {
+	f, err := c.inner.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	header := make([]byte, cryptHeader)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:len(cryptMagic)]) != cryptMagic {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: ErrNotEncrypted}
+	}
+
+	// Every file ends in a sealed chunk, if only an empty one, so a last
+	// chunk too short for its tag means the file was cut off
+	body := info.Size() - int64(cryptHeader)
+	if rest := body % (cryptChunk + cryptOverhead); body < cryptOverhead || rest > 0 && rest < cryptOverhead {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: ErrCorrupt}
+	}
+	return &cryptFile{
+		c:      c,
+		f:      f,
+		info:   info,
+		prefix: header[len(cryptMagic):],
+		size:   plainSize(info.Size()),
+		chunks: (body + cryptChunk + cryptOverhead - 1) / (cryptChunk + cryptOverhead),
+		at:     int64(cryptHeader),
+		chunk:  -1,
+	}, nil
+}
+
+func (c *Crypt) Create(name string) (io.WriteCloser, error) {
+	if err := c.checkName("create", name); err != nil {
+		return nil, err
+	}
+	return c.createRaw(c.innerPath(name))
+}
+
+// createRaw starts an encrypted file in the backend
+func (c *Crypt) createRaw(name string) (*cryptWriter, error) {
+	w, err := c.inner.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, cryptHeader)
+	copy(header, cryptMagic)
+	if _, err := rand.Read(header[len(cryptMagic):]); err != nil {
+		Abort(w)
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		Abort(w)
+		return nil, err
+	}
+	return &cryptWriter{c: c, w: w, prefix: header[len(cryptMagic):], buf: make([]byte, 0, cryptChunk)}, nil
+}
+
+func (c *Crypt) Rename(oldName, newName string) error {
+	if err := c.checkName("rename", newName); err != nil {
+		return err
+	}
+	return c.inner.Rename(c.innerPath(oldName), c.innerPath(newName))
+}
+
+func (c *Crypt) RenameNoReplace(oldName, newName string) error {
+	if err := c.checkName("rename", newName); err != nil {
+		return err
+	}
+	return RenameNoReplace(c.inner, c.innerPath(oldName), c.innerPath(newName))
+}
+
+func (c *Crypt) RemoveAll(name string) error {
+	return c.inner.RemoveAll(c.innerPath(name))
+}
+
+func (c *Crypt) MkdirAll(name string) error {
+	if err := c.checkName("mkdir", name); err != nil {
+		return err
+	}
+	return c.inner.MkdirAll(c.innerPath(name))
+}
+
+func (c *Crypt) DiskUsage() (total, free uint64, err error) {
+	return c.inner.DiskUsage()
+}
+
+// Copy copies inside the backend when it can; the content key is the same
+// for the whole source, so encrypted data stays valid wherever it goes
+func (c *Crypt) Copy(src, dst string) error {
+	if err := c.checkName("copy", dst); err != nil {
+		return err
+	}
+	if cp, ok := c.inner.(Copier); ok {
+		return cp.Copy(c.innerPath(src), c.innerPath(dst))
+	}
+
+	r, err := c.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := c.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		Abort(w)
+		return err
+	}
+	return w.Close()
+}
+
+func (c *Crypt) Chmod(name string, mode fs.FileMode) error {
+	if ch, ok := c.inner.(Chmoder); ok {
+		return ch.Chmod(c.innerPath(name), mode)
+	}
+	return nil
+}
+
+// Close closes the wrapped driver when it holds connections
+func (c *Crypt) Close() error {
+	if cl, ok := c.inner.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+func (c *Crypt) nonce(prefix []byte, chunk int64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[cryptPrefix:], uint64(chunk))
+	return nonce
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// plainSize is the size of the file stored in size bytes
+func plainSize(size int64) int64 {
+	body := size - int64(cryptHeader)
+	if body <= 0 {
+		return 0
+	}
+	chunks := (body + cryptChunk + cryptOverhead - 1) / (cryptChunk + cryptOverhead)
+	return max(body-chunks*cryptOverhead, 0)
+}
+
+// cryptInfo shows an encrypted entry with its plain name and size
+type cryptInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+}
+
+func (i *cryptInfo) Name() string { return i.name }
+func (i *cryptInfo) Size() int64  { return i.size }
+
+func plainInfo(info fs.FileInfo, name string) fs.FileInfo {
+	size := info.Size()
+	if !info.IsDir() {
+		size = plainSize(size)
+	}
+	if name == "/" || name == "." {
+		name = info.Name()
+	}
+	return &cryptInfo{FileInfo: info, name: name, size: size}
+}
+
+// cryptFile decrypts a stored file one chunk at a time
+type cryptFile struct {
+	c      *Crypt
+	f      File
+	info   fs.FileInfo
+	prefix []byte
+	size   int64
+	chunks int64
+
+	pos   int64
+	at    int64 // read position in f
+	chunk int64 // index of the chunk in buf, -1 for none
+	buf   []byte
+}
+
+func (f *cryptFile) Read(p []byte) (int, error) {
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+	index := f.pos / cryptChunk
+	if index != f.chunk {
+		if err := f.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.buf[f.pos-index*cryptChunk:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *cryptFile) load(index int64) error {
+	off := int64(cryptHeader) + index*(cryptChunk+cryptOverhead)
+	if off != f.at {
+		if _, err := f.f.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		f.at = off
+	}
+
+	sealed := make([]byte, cryptChunk+cryptOverhead)
+	n, err := io.ReadFull(f.f, sealed)
+	f.at += int64(n)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	f.buf, err = f.c.aead.Open(f.buf[:0], f.c.nonce(f.prefix, index), sealed[:n], chunkAD(index == f.chunks-1))
+	if err != nil {
+		f.chunk = -1
+		return ErrCorrupt
+	}
+	f.chunk = index
+	return nil
+}
+
+func (f *cryptFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *cryptFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *cryptFile) Close() error {
+	return f.f.Close()
+}
+
+// cryptWriter seals what is written in chunks. A full chunk is only
+// sealed once more data follows, so the one Close seals is always last.
+type cryptWriter struct {
+	c      *Crypt
+	w      io.WriteCloser
+	prefix []byte
+	buf    []byte
+	chunk  int64
+	synced bool
+}
+
+func (w *cryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == cryptChunk {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):cryptChunk], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *cryptWriter) seal(last bool) error {
+	sealed := w.c.aead.Seal(nil, w.c.nonce(w.prefix, w.chunk), w.buf, chunkAD(last))
+	if _, err := w.w.Write(sealed); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.chunk++
+	return nil
+}
+
+// Sync flushes the sealed chunks; the last one follows on Close, which
+// then syncs again
+func (w *cryptWriter) Sync() error {
+	w.synced = true
+	return Sync(w.w)
+}
+
+func (w *cryptWriter) Close() error {
+	if err := w.seal(true); err != nil {
+		Abort(w.w)
+		return err
+	}
+	if w.synced {
+		if err := Sync(w.w); err != nil {
+			Abort(w.w)
+			return err
+		}
+	}
+	return w.w.Close()
+}
+
+func (w *cryptWriter) Abort() error {
+	return Abort(w.w)
+}
+
+// nameCipher encrypts names deterministically, so a path always maps to
+// the same stored one: the HMAC of the name is both the IV for AES-CTR
+// and the proof that a stored name decrypts correctly. Names are written
+// in lower case base32 to survive case-insensitive file systems.
+type nameCipher struct {
+	block cipher.Block
+	mac   []byte
+}
+
+var nameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+func (n *nameCipher) sum(name []byte) []byte {
+	m := hmac.New(sha256.New, n.mac)
+	m.Write(name)
+	return m.Sum(nil)[:aes.BlockSize]
+}
+
+func (n *nameCipher) encrypt(name string) string {
+	iv := n.sum([]byte(name))
+	out := make([]byte, aes.BlockSize+len(name))
+	copy(out, iv)
+	cipher.NewCTR(n.block, iv).XORKeyStream(out[aes.BlockSize:], []byte(name))
+	return nameEncoding.EncodeToString(out)
+}
+
+func (n *nameCipher) decrypt(stored string) (string, bool) {
+	data, err := nameEncoding.DecodeString(stored)
+	if err != nil || len(data) < aes.BlockSize {
+		return "", false
+	}
+	iv, sealed := data[:aes.BlockSize], data[aes.BlockSize:]
+	name := make([]byte, len(sealed))
+	cipher.NewCTR(n.block, iv).XORKeyStream(name, sealed)
+	if !hmac.Equal(n.sum(name), iv) {
+		return "", false
+	}
+	return string(name), true
+}
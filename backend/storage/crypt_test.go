@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filemanager/config"
+)
+
+// newTestCrypt wraps a local driver on a fresh folder
+func newTestCrypt(t *testing.T, cfg *config.EncryptionConfig) (*Crypt, string) {
+	t.Helper()
+	dir := t.TempDir()
+	local, err := NewLocal(config.Source{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCrypt(local, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, dir
+}
+
+// keyFile writes a key file and returns its settings
+func keyFile(t *testing.T, key string, names bool) *config.EncryptionConfig {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(p, []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &config.EncryptionConfig{KeyFile: p, Names: names}
+}
+
+func writeCrypt(t *testing.T, c *Crypt, name string, data []byte) {
+	t.Helper()
+	w, err := c.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readCrypt(c *Crypt, name string) ([]byte, error) {
+	f, err := c.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+	c, dir := newTestCrypt(t, keyFile(t, "0123456789abcdef0123456789abcdef", false))
+
+	sizes := []int{0, 1, cryptChunk - 1, cryptChunk, cryptChunk + 1, 2 * cryptChunk, 2*cryptChunk + 7}
+	for _, size := range sizes {
+		data := bytes.Repeat([]byte("0123456789"), size/10+1)[:size]
+		writeCrypt(t, c, "/a.bin", data)
+
+		got, err := readCrypt(c, "/a.bin")
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("size %d: read back %d different bytes", size, len(got))
+		}
+		info, err := c.Stat("/a.bin")
+		if err != nil || info.Size() != int64(size) {
+			t.Fatalf("size %d: Stat says %v, %v", size, info.Size(), err)
+		}
+		stored, _ := os.ReadFile(filepath.Join(dir, "a.bin"))
+		if size >= 10 && bytes.Contains(stored, data[:10]) {
+			t.Fatalf("size %d: stored in plain", size)
+		}
+	}
+}
+
+func TestCryptDetectsDamage(t *testing.T) {
+	const size = 2*cryptChunk + 100
+	stride := int64(cryptChunk + cryptOverhead)
+	header := int64(cryptHeader)
+
+	tests := []struct {
+		name   string
+		damage func(stored []byte) []byte
+	}{
+		{"last chunk cut off", func(b []byte) []byte { return b[:header+2*stride] }},
+		{"last two chunks cut off", func(b []byte) []byte { return b[:header+stride] }},
+		{"cut inside the last chunk", func(b []byte) []byte { return b[:len(b)-10] }},
+		{"cut leaving part of the tag", func(b []byte) []byte { return b[:header+2*stride+5] }},
+		{"only the header left", func(b []byte) []byte { return b[:header] }},
+		{"bytes appended", func(b []byte) []byte { return append(b, make([]byte, 50)...) }},
+		{"byte flipped", func(b []byte) []byte { b[header+stride+3] ^= 1; return b }},
+		{"chunks swapped", func(b []byte) []byte {
+			first := append([]byte{}, b[header:header+stride]...)
+			copy(b[header:], b[header+stride:header+2*stride])
+			copy(b[header+stride:], first)
+			return b
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, dir := newTestCrypt(t, keyFile(t, "0123456789abcdef0123456789abcdef", false))
+			writeCrypt(t, c, "/a.bin", bytes.Repeat([]byte{'x'}, size))
+
+			p := filepath.Join(dir, "a.bin")
+			stored, err := os.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, tt.damage(stored), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := readCrypt(c, "/a.bin"); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("got %v, want ErrCorrupt", err)
+			}
+		})
+	}
+}
+
+func TestCryptKeys(t *testing.T) {
+	dir := t.TempDir()
+	local, err := NewLocal(config.Source{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCrypt(local, &config.EncryptionConfig{Passphrase: "correct horse"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  *config.EncryptionConfig
+		err  error
+	}{
+		{"same passphrase", &config.EncryptionConfig{Passphrase: "correct horse"}, nil},
+		{"other passphrase", &config.EncryptionConfig{Passphrase: "battery staple"}, ErrWrongKey},
+		{"key file instead", keyFile(t, "0123456789abcdef0123456789abcdef", false), ErrWrongKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewCrypt(local, tt.cfg); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	if _, err := NewCrypt(local, keyFile(t, "too short", false)); err == nil {
+		t.Error("short key file accepted")
+	}
+}
+
+func TestCryptNames(t *testing.T) {
+	c, dir := newTestCrypt(t, keyFile(t, "0123456789abcdef0123456789abcdef", true))
+	other, _ := newTestCrypt(t, keyFile(t, "fedcba9876543210fedcba9876543210", true))
+
+	tests := []string{"a.txt", "Report 2024.PDF", "ünïcødé", strings.Repeat("n", 140), ".hidden"}
+	for _, name := range tests {
+		t.Run(name[:min(len(name), 20)], func(t *testing.T) {
+			stored := c.names.encrypt(name)
+			if stored != c.names.encrypt(name) {
+				t.Error("same name stored differently")
+			}
+			if stored == other.names.encrypt(name) {
+				t.Error("another key stores the same name")
+			}
+			if stored != strings.ToLower(stored) || strings.Contains(stored, name) {
+				t.Errorf("stored name %q", stored)
+			}
+			if got, ok := c.names.decrypt(stored); !ok || got != name {
+				t.Errorf("decrypt = %q, %v", got, ok)
+			}
+			if _, ok := other.names.decrypt(stored); ok {
+				t.Error("another key decrypts the name")
+			}
+			// The last character may only carry padding bits
+			tampered := []byte(stored)
+			if mid := len(tampered) / 2; tampered[mid] == 'a' {
+				tampered[mid] = 'b'
+			} else {
+				tampered[mid] = 'a'
+			}
+			if _, ok := c.names.decrypt(string(tampered)); ok {
+				t.Error("tampered name decrypts")
+			}
+		})
+	}
+
+	// Paths keep their shape, the meta folder keeps its name, and entries
+	// not written through the driver are hidden
+	if err := c.MkdirAll("/docs/2024"); err != nil {
+		t.Fatal(err)
+	}
+	writeCrypt(t, c, "/docs/2024/plan.txt", []byte("plan"))
+	if err := os.WriteFile(filepath.Join(dir, "planted.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	inner := c.innerPath("/docs/2024/plan.txt")
+	if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(inner))); err != nil {
+		t.Errorf("stored at %s: %v", inner, err)
+	}
+	for _, part := range strings.Split(inner, "/") {
+		if part == "docs" || part == "2024" || part == "plan.txt" {
+			t.Errorf("plain name in %s", inner)
+		}
+	}
+	if got := c.innerPath(MetaDir + "/trash"); !strings.HasPrefix(got, MetaDir+"/") || strings.HasSuffix(got, "/trash") {
+		t.Errorf("meta path stored as %s", got)
+	}
+	entries, err := c.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, ",") != ".zxfilebrowser,docs" && strings.Join(names, ",") != "docs,.zxfilebrowser" {
+		t.Errorf("root lists %v", names)
+	}
+	if got, err := readCrypt(c, "/docs/2024/plan.txt"); err != nil || string(got) != "plan" {
+		t.Errorf("read %q, %v", got, err)
+	}
+}
+
+func TestCryptNameTooLong(t *testing.T) {
+	c, _ := newTestCrypt(t, keyFile(t, "0123456789abcdef0123456789abcdef", true))
+	longest := strings.Repeat("n", MaxEncryptedName)
+	tooLong := longest + "n"
+
+	if got := len(c.names.encrypt(longest)); got > 255 {
+		t.Fatalf("longest name stored in %d bytes", got)
+	}
+	writeCrypt(t, c, "/"+longest, []byte("fits"))
+	if err := c.MkdirAll("/docs/" + longest + "/sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name string
+		fn   func() error
+	}{
+		{"create", func() error { _, err := c.Create("/" + tooLong); return err }},
+		{"mkdir", func() error { return c.MkdirAll("/docs/" + tooLong + "/sub") }},
+		{"rename", func() error { return c.Rename("/"+longest, "/"+tooLong) }},
+		{"rename no replace", func() error { return c.RenameNoReplace("/"+longest, "/"+tooLong) }},
+		{"copy", func() error { return c.Copy("/"+longest, "/"+tooLong) }},
+		{"stat", func() error { _, err := c.Stat("/" + tooLong); return err }},
+	}
+	for _, st := range steps {
+		if err := st.fn(); !errors.Is(err, ErrNameTooLong) {
+			t.Errorf("%s: got %v, want ErrNameTooLong", st.name, err)
+		}
+	}
+
+	// Without encrypted names the backend's own limit applies
+	plain, _ := newTestCrypt(t, keyFile(t, "0123456789abcdef0123456789abcdef", false))
+	writeCrypt(t, plain, "/"+tooLong, []byte("fits"))
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"filemanager/config"
+	"filemanager/utils"
+)
+
+func init() {
+	Register("local", NewLocal)
+}
+
+// Local serves a source straight from a directory on disk
+type Local struct {
+	root string
+}
+
+// NewLocal creates a driver rooted at the source path
+func NewLocal(src config.Source) (Driver, error) {
+	root, err := filepath.Abs(src.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &Local{root: root}, nil
+}
+
+// Root returns the absolute directory the driver serves
+func (l *Local) Root() string {
+	return l.root
+}
+
+// LocalPath maps a source path to its absolute location on disk
+func (l *Local) LocalPath(name string) (string, error) {
+	return utils.SafeJoin(l.root, name)
+}
+
+func (l *Local) Stat(name string) (fs.FileInfo, error) {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (l *Local) ReadDir(name string) ([]fs.FileInfo, error) {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (l *Local) Open(name string) (File, error) {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (l *Local) Create(name string) (io.WriteCloser, error) {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(p)
+}
+
+func (l *Local) Append(name string) (io.WriteCloser, error) {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+}
+
+func (l *Local) Rename(oldName, newName string) error {
+	oldPath, err := l.LocalPath(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := l.LocalPath(newName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// RenameNoReplace links the file under its new name, which fails when the
+// name is taken, and then drops the old one. File systems without hard
+// links get the new name claimed with an exclusive create instead.
+func (l *Local) RenameNoReplace(oldName, newName string) error {
+	oldPath, err := l.LocalPath(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := l.LocalPath(newName)
+	if err != nil {
+		return err
+	}
+
+	err = os.Link(oldPath, newPath)
+	if err == nil {
+		return os.Remove(oldPath)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	f, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := os.Rename(oldPath, newPath); err != nil {
+		os.Remove(newPath)
+		return err
+	}
+	return nil
+}
+
+func (l *Local) RemoveAll(name string) error {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (l *Local) MkdirAll(name string) error {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, 0755)
+}
+
+func (l *Local) Chmod(name string, mode fs.FileMode) error {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(p, mode)
+}
+
+func (l *Local) DiskUsage() (total, free uint64, err error) {
+	return getDiskStats(l.root)
+}
@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"filemanager/config"
+)
+
+const (
+	// s3PartSize is the chunk size used for streaming multipart uploads
+	s3PartSize = 16 << 20
+	// s3MaxCopySize is the largest object a single CopyObject can handle
+	s3MaxCopySize = 5 << 30
+)
+
+func init() {
+	Register("s3", NewS3)
+}
+
+// S3 serves a source from a bucket (and optional key prefix) on any
+// S3-compatible object store. Folders are key prefixes split on "/".
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 connects to the endpoint configured for the source
+func NewS3(src config.Source) (Driver, error) {
+	cfg := src.S3
+	if cfg == nil || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 source needs an s3.bucket setting")
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+
+	lookup := minio.BucketLookupAuto
+	if cfg.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure:       u.Scheme == "https",
+		Region:       cfg.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &S3{client: client, bucket: cfg.Bucket, prefix: prefix}, nil
+}
+
+// key maps a source path to its object key
+func (s *S3) key(name string) string {
+	return s.prefix + strings.TrimPrefix(CleanPath(name), "/")
+}
+
+// dirKey maps a source path to the key prefix of its children
+func (s *S3) dirKey(name string) string {
+	k := s.key(name)
+	if k == "" || strings.HasSuffix(k, "/") {
+		return k
+	}
+	return k + "/"
+}
+
+func isNoSuchKey(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+func (s *S3) Stat(name string) (fs.FileInfo, error) {
+	name = CleanPath(name)
+	if name == "/" {
+		return &fileInfo{name: "/", isDir: true}, nil
+	}
+
+	ctx := context.Background()
+	obj, err := s.client.StatObject(ctx, s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err == nil {
+		return &fileInfo{name: path.Base(name), size: obj.Size, modTime: obj.LastModified}, nil
+	}
+	if !isNoSuchKey(err) {
+		return nil, err
+	}
+
+	// No object, but the name may still be a folder prefix
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.dirKey(name), MaxKeys: 1}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		return &fileInfo{name: path.Base(name), isDir: true, modTime: obj.LastModified}, nil
+	}
+	return nil, notExist("stat", name)
+}
+
+func (s *S3) ReadDir(name string) ([]fs.FileInfo, error) {
+	prefix := s.dirKey(name)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var infos []fs.FileInfo
+	seen := map[string]bool{}
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+
+		rel := strings.TrimPrefix(obj.Key, prefix)
+		if rel == "" {
+			// Folder marker of the directory itself
+			continue
+		}
+
+		// Some servers report a folder both as a common prefix and as its
+		// marker object
+		isDir := strings.HasSuffix(rel, "/")
+		rel = strings.TrimSuffix(rel, "/")
+		if seen[rel] {
+			continue
+		}
+		seen[rel] = true
+
+		if isDir {
+			infos = append(infos, &fileInfo{name: rel, isDir: true, modTime: obj.LastModified})
+			continue
+		}
+		infos = append(infos, &fileInfo{name: rel, size: obj.Size, modTime: obj.LastModified})
+	}
+
+	if len(infos) == 0 && CleanPath(name) != "/" {
+		if _, err := s.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+func (s *S3) Open(name string) (File, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{Object: obj, info: info}, nil
+}
+
+func (s *S3) Create(name string) (io.WriteCloser, error) {
+	return &s3Writer{s: s, key: s.key(name)}, nil
+}
+
+func (s *S3) putOptions(key string) minio.PutObjectOptions {
+	// Plain unsigned payloads instead of aws-chunked bodies, which not every
+	// S3-compatible server understands
+	return minio.PutObjectOptions{
+		PartSize:             s3PartSize,
+		ContentType:          mime.TypeByExtension(path.Ext(key)),
+		DisableContentSha256: true,
+	}
+}
+
+func (s *S3) Rename(oldName, newName string) error {
+	if err := s.Copy(oldName, newName); err != nil {
+		return err
+	}
+	return s.RemoveAll(oldName)
+}
+
+// RenameNoReplace writes the object to its new key with If-None-Match, so
+// the bucket refuses it when the key is taken. A copy cannot carry that
+// condition, so the data goes through the server once.
+func (s *S3) RenameNoReplace(oldName, newName string) error {
+	if info, err := s.Stat(newName); err == nil {
+		if info.IsDir() {
+			return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	src, err := s.Open(oldName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	key := s.key(newName)
+	opts := s.putOptions(key)
+	opts.SetMatchETagExcept("*")
+	if _, err := s.client.PutObject(ctx, s.bucket, key, src, info.Size(), opts); err != nil {
+		switch minio.ToErrorResponse(err).Code {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+		}
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, s.key(oldName), minio.RemoveObjectOptions{})
+}
+
+// Copy copies objects server side inside the bucket
+func (s *S3) Copy(src, dst string) error {
+	info, err := s.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if !info.IsDir() {
+		return s.copyObject(ctx, s.key(src), s.key(dst), info.Size())
+	}
+
+	srcPrefix, dstPrefix := s.dirKey(src), s.dirKey(dst)
+	if err := s.MkdirAll(dst); err != nil {
+		return err
+	}
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: srcPrefix, Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if obj.Key == srcPrefix {
+			continue
+		}
+		if err := s.copyObject(ctx, obj.Key, dstPrefix+strings.TrimPrefix(obj.Key, srcPrefix), obj.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3) copyObject(ctx context.Context, srcKey, dstKey string, size int64) error {
+	dst := minio.CopyDestOptions{Bucket: s.bucket, Object: dstKey}
+	src := minio.CopySrcOptions{Bucket: s.bucket, Object: srcKey}
+
+	// A single CopyObject is capped at 5GiB, bigger objects are copied
+	// part by part
+	if size > s3MaxCopySize {
+		_, err := s.client.ComposeObject(ctx, dst, src)
+		return err
+	}
+	_, err := s.client.CopyObject(ctx, dst, src)
+	return err
+}
+
+func (s *S3) RemoveAll(name string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var listErr error
+	listed := make(chan struct{})
+	objects := make(chan minio.ObjectInfo)
+	send := func(obj minio.ObjectInfo) bool {
+		select {
+		case objects <- obj:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	go func() {
+		defer close(listed)
+		defer close(objects)
+		if CleanPath(name) != "/" && !send(minio.ObjectInfo{Key: s.key(name)}) {
+			return
+		}
+		for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.dirKey(name), Recursive: true}) {
+			if obj.Err != nil {
+				listErr = obj.Err
+				return
+			}
+			if !send(obj) {
+				return
+			}
+		}
+	}()
+
+	var err error
+	for rerr := range s.client.RemoveObjects(ctx, s.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if rerr.Err != nil && !isNoSuchKey(rerr.Err) && err == nil {
+			err = rerr.Err
+			cancel()
+		}
+	}
+	cancel()
+	<-listed
+	if err != nil {
+		return err
+	}
+	return listErr
+}
+
+func (s *S3) MkdirAll(name string) error {
+	key := s.dirKey(name)
+	if key == "" {
+		return nil
+	}
+	_, err := s.client.PutObject(context.Background(), s.bucket, key, strings.NewReader(""), 0, s.putOptions(key))
+	return err
+}
+
+func (s *S3) DiskUsage() (total, free uint64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
+
+// s3File adapts a minio object to the File interface
+type s3File struct {
+	*minio.Object
+	info fs.FileInfo
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// s3Writer feeds a streaming multipart PutObject through a pipe. The
+// upload starts on the first write so that empty files can be stored
+// with a plain zero length PUT.
+type s3Writer struct {
+	s      *S3
+	key    string
+	pw     *io.PipeWriter
+	done   chan error
+	closed bool
+	err    error
+}
+
+func (w *s3Writer) start() {
+	pr, pw := io.Pipe()
+	w.pw = pw
+	w.done = make(chan error, 1)
+	go func() {
+		_, err := w.s.client.PutObject(context.Background(), w.s.bucket, w.key, pr, -1, w.s.putOptions(w.key))
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if w.pw == nil {
+		w.start()
+	}
+	return w.pw.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+
+	if w.pw == nil {
+		_, w.err = w.s.client.PutObject(context.Background(), w.s.bucket, w.key, strings.NewReader(""), 0, w.s.putOptions(w.key))
+		return w.err
+	}
+	w.pw.Close()
+	w.err = <-w.done
+	return w.err
+}
+
+func (w *s3Writer) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if w.pw != nil {
+		w.pw.CloseWithError(errors.New("upload aborted"))
+		<-w.done
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"filemanager/config"
+)
+
+// fakeS3 is just enough of the S3 API for the driver: objects in one
+// bucket, listings in pages of pageSize and batch deletes. Listing pages
+// after failAfter pages fail.
+type fakeS3 struct {
+	mu        sync.Mutex
+	objects   map[string][]byte
+	pageSize  int
+	failAfter int
+}
+
+func newFakeS3(t *testing.T, f *fakeS3) *S3 {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	drv, err := NewS3(config.Source{S3: &config.S3Config{
+		Endpoint:  srv.URL,
+		Bucket:    "bucket",
+		Region:    "us-east-1",
+		AccessKey: "key",
+		SecretKey: "secret",
+		PathStyle: true,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return drv.(*S3)
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []listEntry
+}
+
+type listEntry struct {
+	Key          string
+	LastModified string
+	Size         int
+	ETag         string
+}
+
+type deleteRequest struct {
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Deleted []struct {
+		Key string
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && key == "" && q.Get("list-type") == "2":
+		f.list(w, q.Get("prefix"), q.Get("continuation-token"))
+	case r.Method == http.MethodPost && q.Has("delete"):
+		var req deleteRequest
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var res deleteResult
+		for _, o := range req.Objects {
+			delete(f.objects, o.Key)
+			res.Deleted = append(res.Deleted, struct{ Key string }{o.Key})
+		}
+		xml.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = data
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, token string) {
+	page, _ := strconv.Atoi(token)
+	if f.failAfter > 0 && page >= f.failAfter {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+		return
+	}
+
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	size := f.pageSize
+	if size <= 0 {
+		size = 1000
+	}
+	start := min(page*size, len(keys))
+	end := min(start+size, len(keys))
+	res := listResult{Name: "bucket", Prefix: prefix, MaxKeys: size, KeyCount: end - start}
+	for _, k := range keys[start:end] {
+		res.Contents = append(res.Contents, listEntry{Key: k, LastModified: time.Now().UTC().Format(time.RFC3339), Size: len(f.objects[k]), ETag: `"etag"`})
+	}
+	if end < len(keys) {
+		res.IsTruncated = true
+		res.NextContinuationToken = strconv.Itoa(page + 1)
+	}
+	xml.NewEncoder(w).Encode(res)
+}
+
+func TestS3RemoveAll(t *testing.T) {
+	tests := []struct {
+		name      string
+		failAfter int
+		wantErr   bool
+	}{
+		{"complete listing", 0, false},
+		{"listing fails on the second page", 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeS3{objects: map[string][]byte{}, pageSize: 2, failAfter: tt.failAfter}
+			for i := 0; i < 5; i++ {
+				f.objects[fmt.Sprintf("dir/file%d", i)] = []byte("x")
+			}
+			f.objects["other"] = []byte("kept")
+			s := newFakeS3(t, f)
+
+			err := s.RemoveAll("/dir")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RemoveAll error = %v, want error %v", err, tt.wantErr)
+			}
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if _, ok := f.objects["other"]; !ok {
+				t.Error("an object outside the folder was removed")
+			}
+			if !tt.wantErr && len(f.objects) != 1 {
+				t.Errorf("%d objects left, want 1", len(f.objects))
+			}
+		})
+	}
+}
@@ -0,0 +1,405 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"filemanager/config"
+	"filemanager/utils"
+)
+
+const (
+	sftpDefaultPort    = 22
+	sftpDefaultMaxIdle = 4
+	sftpDialTimeout    = 15 * time.Second
+)
+
+func init() {
+	Register("sftp", NewSFTP)
+}
+
+// SFTP serves a source from a directory on a remote SSH server. Idle
+// connections are pooled for reuse and the ones that drop are replaced.
+// Open files hold on to their own connection until they are closed.
+type SFTP struct {
+	addr   string
+	root   string
+	config *ssh.ClientConfig
+
+	mu      sync.Mutex
+	idle    []*sftpConn
+	maxIdle int
+}
+
+type sftpConn struct {
+	ssh    *ssh.Client
+	client *sftp.Client
+}
+
+func (c *sftpConn) close() {
+	c.client.Close()
+	c.ssh.Close()
+}
+
+// NewSFTP prepares a pool for the configured server; connections are
+// opened on first use
+func NewSFTP(src config.Source) (Driver, error) {
+	cfg := src.SFTP
+	if cfg == nil || cfg.Host == "" {
+		return nil, fmt.Errorf("sftp source needs an sftp.host setting")
+	}
+
+	var auth []ssh.AuthMethod
+	if cfg.PrivateKey != "" {
+		key, err := os.ReadFile(cfg.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key: %w", err)
+		}
+		var signer ssh.Signer
+		if cfg.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(cfg.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("sftp source needs a password or a privateKey")
+	}
+
+	hostKey, err := hostKeyCallback(src)
+	if err != nil {
+		return nil, err
+	}
+
+	port := cfg.Port
+	if port == 0 {
+		port = sftpDefaultPort
+	}
+	maxIdle := cfg.PoolSize
+	if maxIdle <= 0 {
+		maxIdle = sftpDefaultMaxIdle
+	}
+
+	root := src.Path
+	if root == "" {
+		root = "."
+	}
+
+	return &SFTP{
+		addr: net.JoinHostPort(cfg.Host, strconv.Itoa(port)),
+		root: root,
+		config: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            auth,
+			HostKeyCallback: hostKey,
+			Timeout:         sftpDialTimeout,
+		},
+		maxIdle: maxIdle,
+	}, nil
+}
+
+// hostKeyCallback checks server keys against the configured known_hosts
+// file, ~/.ssh/known_hosts by default. Skipping the check has to be asked
+// for.
+func hostKeyCallback(src config.Source) (ssh.HostKeyCallback, error) {
+	cfg := src.SFTP
+	if cfg.InsecureIgnoreHostKey {
+		utils.Warnf("⚠️  %s: insecureIgnoreHostKey is set, the host key is not verified", src.Name)
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	file := cfg.KnownHosts
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("no sftp.knownHosts set and no home directory to look in: %w", err)
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	cb, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts, add the key of %s (ssh-keyscan %s >> %s) or set sftp.insecureIgnoreHostKey: %w", cfg.Host, cfg.Host, file, err)
+	}
+	return cb, nil
+}
+
+// remote maps a source path to the path on the server
+func (s *SFTP) remote(name string) string {
+	return path.Join(s.root, "."+CleanPath(name))
+}
+
+func (s *SFTP) dial() (*sftpConn, error) {
+	sshClient, err := ssh.Dial("tcp", s.addr, s.config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	return &sftpConn{ssh: sshClient, client: client}, nil
+}
+
+// acquire takes an idle connection out of the pool, dialing a new one
+// when none is left
+func (s *SFTP) acquire() (*sftpConn, error) {
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		conn := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return conn, nil
+	}
+	s.mu.Unlock()
+
+	return s.dial()
+}
+
+// release hands a connection back, dropping it if err shows it is dead or
+// the pool is already full
+func (s *SFTP) release(conn *sftpConn, err error) {
+	if !isConnLost(err) {
+		s.mu.Lock()
+		if len(s.idle) < s.maxIdle {
+			s.idle = append(s.idle, conn)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+	conn.close()
+}
+
+func isConnLost(err error) bool {
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// do runs fn on a pooled connection, retrying once on a fresh connection
+// when the pooled one turns out to be dead
+func (s *SFTP) do(fn func(c *sftp.Client) error) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *sftpConn
+		conn, err = s.acquire()
+		if err != nil {
+			return err
+		}
+		err = fn(conn.client)
+		s.release(conn, err)
+		if !isConnLost(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *SFTP) Stat(name string) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := s.do(func(c *sftp.Client) (err error) {
+		info, err = c.Stat(s.remote(name))
+		return err
+	})
+	return info, err
+}
+
+func (s *SFTP) ReadDir(name string) ([]fs.FileInfo, error) {
+	var infos []fs.FileInfo
+	err := s.do(func(c *sftp.Client) (err error) {
+		infos, err = c.ReadDir(s.remote(name))
+		return err
+	})
+	return infos, err
+}
+
+func (s *SFTP) Open(name string) (File, error) {
+	return s.openFile(func(c *sftp.Client) (*sftp.File, error) {
+		return c.Open(s.remote(name))
+	})
+}
+
+func (s *SFTP) Create(name string) (io.WriteCloser, error) {
+	return s.openFile(func(c *sftp.Client) (*sftp.File, error) {
+		return c.Create(s.remote(name))
+	})
+}
+
+func (s *SFTP) Append(name string) (io.WriteCloser, error) {
+	return s.openFile(func(c *sftp.Client) (*sftp.File, error) {
+		f, err := c.OpenFile(s.remote(name), os.O_WRONLY|os.O_APPEND|os.O_CREATE)
+		if err != nil {
+			return nil, err
+		}
+		// Servers do not all honour the append flag, so start at the end
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	})
+}
+
+// openFile is do for calls that hand out a file bound to the connection
+func (s *SFTP) openFile(open func(c *sftp.Client) (*sftp.File, error)) (*sftpFile, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *sftpConn
+		conn, err = s.acquire()
+		if err != nil {
+			return nil, err
+		}
+
+		var file *sftp.File
+		file, err = open(conn.client)
+		if err == nil {
+			return &sftpFile{File: file, s: s, conn: conn}, nil
+		}
+		s.release(conn, err)
+		if !isConnLost(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func (s *SFTP) Rename(oldName, newName string) error {
+	return s.do(func(c *sftp.Client) error {
+		if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+			return c.PosixRename(s.remote(oldName), s.remote(newName))
+		}
+		return c.Rename(s.remote(oldName), s.remote(newName))
+	})
+}
+
+// RenameNoReplace uses the plain SFTP rename, which the protocol makes
+// fail when the new name exists
+func (s *SFTP) RenameNoReplace(oldName, newName string) error {
+	return s.do(func(c *sftp.Client) error {
+		err := c.Rename(s.remote(oldName), s.remote(newName))
+		if err != nil && !isConnLost(err) {
+			if _, serr := c.Lstat(s.remote(newName)); serr == nil {
+				return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+			}
+		}
+		return err
+	})
+}
+
+func (s *SFTP) RemoveAll(name string) error {
+	return s.do(func(c *sftp.Client) error {
+		err := c.RemoveAll(s.remote(name))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *SFTP) MkdirAll(name string) error {
+	return s.do(func(c *sftp.Client) error {
+		return c.MkdirAll(s.remote(name))
+	})
+}
+
+func (s *SFTP) Chmod(name string, mode fs.FileMode) error {
+	return s.do(func(c *sftp.Client) error {
+		return c.Chmod(s.remote(name), mode)
+	})
+}
+
+func (s *SFTP) DiskUsage() (total, free uint64, err error) {
+	err = s.do(func(c *sftp.Client) error {
+		if _, ok := c.HasExtension("statvfs@openssh.com"); !ok {
+			return errors.ErrUnsupported
+		}
+		vfs, err := c.StatVFS(s.remote("/"))
+		if err != nil {
+			return err
+		}
+		total, free = vfs.TotalSpace(), vfs.FreeSpace()
+		return nil
+	})
+	return total, free, err
+}
+
+// Close drops every idle connection
+func (s *SFTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.idle {
+		conn.close()
+	}
+	s.idle = nil
+	return nil
+}
+
+// sftpFile holds on to its pooled connection until it is closed
+type sftpFile struct {
+	*sftp.File
+	s    *SFTP
+	conn *sftpConn
+	once sync.Once
+	err  error
+}
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	if err != nil && err != io.EOF {
+		f.err = err
+	}
+	return n, err
+}
+
+func (f *sftpFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// Sync is a no-op on servers without the fsync extension
+func (f *sftpFile) Sync() error {
+	if _, ok := f.conn.client.HasExtension("fsync@openssh.com"); !ok {
+		return nil
+	}
+	return f.File.Sync()
+}
+
+func (f *sftpFile) Stat() (fs.FileInfo, error) {
+	return f.File.Stat()
+}
+
+func (f *sftpFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(func() {
+		if err != nil && f.err == nil {
+			f.err = err
+		}
+		f.s.release(f.conn, f.err)
+	})
+	return err
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filemanager/config"
+)
+
+func TestHostKeyCallback(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	known := filepath.Join(t.TempDir(), "known_hosts")
+	line := "example.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n"
+	if err := os.WriteFile(known, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  config.SFTPConfig
+		ok   bool
+	}{
+		{"no known hosts anywhere", config.SFTPConfig{}, false},
+		{"missing file", config.SFTPConfig{KnownHosts: filepath.Join(home, "nope")}, false},
+		{"known hosts file", config.SFTPConfig{KnownHosts: known}, true},
+		{"insecure on request", config.SFTPConfig{InsecureIgnoreHostKey: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Host = "example.com"
+			_, err := hostKeyCallback(config.Source{Name: "test", SFTP: &cfg})
+			if (err == nil) != tt.ok {
+				t.Errorf("hostKeyCallback error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+
+	// The default location is used when nothing is configured
+	if err := os.MkdirAll(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hostKeyCallback(config.Source{Name: "test", SFTP: &config.SFTPConfig{Host: "example.com"}}); err != nil {
+		t.Errorf("default known_hosts not used: %v", err)
+	}
+}
@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"filemanager/config"
+)
+
+// File is an open file handle returned by a Driver
+type File interface {
+	io.ReadSeekCloser
+	Stat() (fs.FileInfo, error)
+}
+
+// Driver is the storage backend behind a source. Names are slash-separated
+// and relative to the source root, with "/" being the root itself.
+type Driver interface {
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.FileInfo, error)
+	Open(name string) (File, error)
+	Create(name string) (io.WriteCloser, error)
+	Rename(oldName, newName string) error
+	RemoveAll(name string) error
+	MkdirAll(name string) error
+	DiskUsage() (total, free uint64, err error)
+}
+
+// Chmoder is implemented by drivers that keep POSIX permissions
+type Chmoder interface {
+	Chmod(name string, mode fs.FileMode) error
+}
+
+// Copier is implemented by drivers that can copy within the backend
+// without streaming the data through the server
+type Copier interface {
+	Copy(src, dst string) error
+}
+
+// NoReplaceRenamer is implemented by drivers that can move a file to a
+// name only when nothing is there yet, in one step. RenameNoReplace fails
+// with an error matching fs.ErrExist when newName is taken.
+type NoReplaceRenamer interface {
+	RenameNoReplace(oldName, newName string) error
+}
+
+// RenameNoReplace moves a file to newName unless something is there
+// already. Drivers that cannot do this in one step get a check before
+// the rename, which leaves a short window for another writer.
+func RenameNoReplace(drv Driver, oldName, newName string) error {
+	if r, ok := drv.(NoReplaceRenamer); ok {
+		return r.RenameNoReplace(oldName, newName)
+	}
+	if _, err := drv.Stat(newName); err == nil {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return drv.Rename(oldName, newName)
+}
+
+// Appender is implemented by drivers that can add to the end of a file,
+// creating it when it does not exist yet
+type Appender interface {
+	Append(name string) (io.WriteCloser, error)
+}
+
+// Syncer is implemented by writers that can flush their data to stable
+// storage before they are closed
+type Syncer interface {
+	Sync() error
+}
+
+// Sync flushes w to stable storage when the backend supports it
+func Sync(w io.Writer) error {
+	if s, ok := w.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Aborter is implemented by writers that can discard a partial upload
+type Aborter interface {
+	Abort() error
+}
+
+// Abort discards a writer returned by Create without committing it
+func Abort(w io.WriteCloser) error {
+	if a, ok := w.(Aborter); ok {
+		return a.Abort()
+	}
+	return w.Close()
+}
+
+// Factory builds a driver for a configured source
+type Factory func(src config.Source) (Driver, error)
+
+var (
+	factories = map[string]Factory{}
+
+	mu      sync.Mutex
+	drivers = map[string]Driver{}
+	pending = map[string]*pendingDriver{}
+)
+
+// pendingDriver is a driver being opened. Opening can take a while, for a
+// connection or the key of an encrypted source, so it happens outside mu
+// and other callers for the same source wait for the result.
+type pendingDriver struct {
+	done chan struct{}
+	drv  Driver
+	err  error
+	// stale is set when the source was dropped while it opened
+	stale bool
+}
+
+// Register makes a driver available under the given source type
+func Register(typ string, factory Factory) {
+	factories[typ] = factory
+	config.RegisterSourceType(typ)
+}
+
+// Types returns the registered source types
+func Types() []string {
+	types := make([]string, 0, len(factories))
+	for typ := range factories {
+		types = append(types, typ)
+	}
+	return types
+}
+
+// Get returns the driver for an enabled source, creating it on first use
+func Get(sourceID string) (Driver, error) {
+	src, ok := config.GetSource(sourceID)
+	if !ok || !src.Enabled {
+		return nil, fmt.Errorf("source not found or disabled: %s", sourceID)
+	}
+
+	mu.Lock()
+	if drv, ok := drivers[src.ID]; ok {
+		mu.Unlock()
+		return drv, nil
+	}
+	p, waiting := pending[src.ID]
+	if !waiting {
+		p = &pendingDriver{done: make(chan struct{})}
+		pending[src.ID] = p
+	}
+	mu.Unlock()
+
+	if waiting {
+		<-p.done
+		if p.stale {
+			return Get(sourceID)
+		}
+		return p.drv, p.err
+	}
+
+	p.drv, p.err = open(src)
+	mu.Lock()
+	if !p.stale {
+		delete(pending, src.ID)
+		if p.err == nil {
+			drivers[src.ID] = p.drv
+		}
+	}
+	mu.Unlock()
+	close(p.done)
+
+	if p.stale {
+		// Opened with settings that changed meanwhile
+		closeDriver(p.drv)
+		return Get(sourceID)
+	}
+	return p.drv, p.err
+}
+
+// open creates the driver of a source
+func open(src config.Source) (Driver, error) {
+	factory, ok := factories[src.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown source type %q for %s", src.Type, src.Name)
+	}
+
+	drv, err := factory(src)
+	if err == nil && src.Encryption != nil {
+		var crypt *Crypt
+		if crypt, err = NewCrypt(drv, src.Encryption); err != nil {
+			closeDriver(drv)
+		}
+		drv = crypt
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source %s: %w", src.Name, err)
+	}
+	return drv, nil
+}
+
+// closeDriver closes a driver that holds connections
+func closeDriver(drv Driver) {
+	if c, ok := drv.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func init() {
+	// Sources that changed or went away get a fresh driver on next use
+	config.OnReload(func(old, cur *config.Config) {
+		for _, src := range old.Sources {
+			if !slices.ContainsFunc(cur.Sources, func(s config.Source) bool { return reflect.DeepEqual(s, src) }) {
+				Drop(src.ID)
+			}
+		}
+	})
+}
+
+// Drop forgets the cached driver of a source, closing it when it holds
+// connections
+func Drop(sourceID string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if drv, ok := drivers[sourceID]; ok {
+		closeDriver(drv)
+		delete(drivers, sourceID)
+	}
+	if p, ok := pending[sourceID]; ok {
+		p.stale = true
+		delete(pending, sourceID)
+	}
+}
+
+// Reset drops all cached drivers, closing the ones that hold connections
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for id, drv := range drivers {
+		closeDriver(drv)
+		delete(drivers, id)
+	}
+	for id, p := range pending {
+		p.stale = true
+		delete(pending, id)
+	}
+}
+
+// MetaDir is the folder at the root of every source where the server keeps
+// its own per-source data (trash, partial uploads, ...). It is hidden from
+// listings and cannot be addressed through the API.
+const MetaDir = "/.zxfilebrowser"
+
+// IsReserved reports whether a cleaned path points into MetaDir
+func IsReserved(name string) bool {
+	return name == MetaDir || strings.HasPrefix(name, MetaDir+"/")
+}
+
+// Resolve returns the driver for a source together with the cleaned path inside it
+func Resolve(sourceID, name string) (Driver, string, error) {
+	drv, err := Get(sourceID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	name = CleanPath(name)
+	if IsReserved(name) {
+		return nil, "", fmt.Errorf("invalid path: reserved for the server")
+	}
+	return drv, name, nil
+}
+
+// UniquePath returns dst, or the first free "name(n).ext" variant of it
+// when dst already exists
+func UniquePath(drv Driver, dst string) (string, error) {
+	if _, err := drv.Stat(dst); errors.Is(err, fs.ErrNotExist) {
+		return dst, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	dir := path.Dir(dst)
+	ext := path.Ext(dst)
+	base := strings.TrimSuffix(path.Base(dst), ext)
+
+	for i := 1; ; i++ {
+		p := path.Join(dir, fmt.Sprintf("%s(%d)%s", base, i, ext))
+		if _, err := drv.Stat(p); errors.Is(err, fs.ErrNotExist) {
+			return p, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+// notExist builds the error drivers return for missing entries
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// fileInfo is a plain fs.FileInfo for backends without a native one
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.isDir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.isDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// CleanPath normalizes a client supplied path so that it can never climb
+// above the source root
+func CleanPath(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	return path.Clean("/" + name)
+}
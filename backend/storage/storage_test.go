@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"filemanager/config"
+)
+
+func TestGetOpensOutsideTheLock(t *testing.T) {
+	release := make(chan struct{})
+	var opened atomic.Int32
+	Register("slow", func(src config.Source) (Driver, error) {
+		opened.Add(1)
+		<-release
+		return NewLocal(src)
+	})
+
+	dir := t.TempDir()
+	p := filepath.Join(dir, "config.yaml")
+	yaml := "sources:\n" +
+		"  - name: Slow\n    type: slow\n    path: " + dir + "\n" +
+		"  - name: Fast\n    path: " + t.TempDir() + "\n"
+	if err := os.WriteFile(p, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.SetPath(p)
+	config.Init()
+	t.Cleanup(Reset)
+
+	const callers = 5
+	var wg sync.WaitGroup
+	drivers := make([]Driver, callers)
+	for i := range drivers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			drv, err := Get("slow")
+			if err != nil {
+				t.Error(err)
+			}
+			drivers[i] = drv
+		}()
+	}
+
+	for opened.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	got := make(chan error)
+	go func() {
+		_, err := Get("fast")
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("another source waited for the slow one to open")
+	}
+
+	close(release)
+	wg.Wait()
+	if n := opened.Load(); n != 1 {
+		t.Errorf("opened %d times, want once", n)
+	}
+	for _, drv := range drivers[1:] {
+		if drv != drivers[0] {
+			t.Error("callers got different drivers")
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package thumbs
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+
+	"filemanager/config"
+	"filemanager/storage"
+)
+
+// Sizes are the bounding boxes thumbnails are rendered at
+var Sizes = []int{128, 256, 512}
+
+// DefaultSize is used when a request does not ask for one
+const DefaultSize = 256
+
+// maxPixels keeps huge images from exhausting memory while decoding
+const maxPixels = 100_000_000
+
+var (
+	ErrUnsupported = errors.New("not a supported image")
+	ErrTooLarge    = errors.New("image is too large for a thumbnail")
+	// ErrNotCached is returned by Get for sources that store their files
+	// encrypted; a cached thumbnail would be a readable copy of the image.
+	// Render makes one without keeping it.
+	ErrNotCached = errors.New("thumbnails of this source are not cached")
+)
+
+// formats maps the extensions thumbnails are made for to their output
+// format
+var formats = map[string]imaging.Format{
+	".jpg":  imaging.JPEG,
+	".jpeg": imaging.JPEG,
+	".png":  imaging.PNG,
+	".gif":  imaging.GIF,
+}
+
+var (
+	// pending lets concurrent requests for the same thumbnail wait for
+	// a single render
+	pendingMu sync.Mutex
+	pending   = map[string]*sync.WaitGroup{}
+
+	// renders caps how many images are decoded at once
+	renders = make(chan struct{}, 2)
+)
+
+// Supported reports whether a thumbnail can be made for name
+func Supported(name string) bool {
+	_, ok := formats[strings.ToLower(path.Ext(name))]
+	return ok
+}
+
+// ValidSize reports whether size is one of Sizes
+func ValidSize(size int) bool {
+	for _, s := range Sizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// Cached reports whether thumbnails of a source are kept on disk
+func Cached(sourceID string) bool {
+	src, ok := config.GetSource(sourceID)
+	return !ok || src.Encryption == nil
+}
+
+// cacheDir is where the thumbnails of a source are kept
+func cacheDir(sourceID string) string {
+	return filepath.Join(config.Get().Server.DataDir, "thumbnails", sourceID)
+}
+
+// Forget removes the cached thumbnails of a source
+func Forget(sourceID string) error {
+	return os.RemoveAll(cacheDir(sourceID))
+}
+
+// cachePath names the cached thumbnail for one version of a file. Changing
+// the file changes its mtime or size and so the name, which leaves the old
+// thumbnail unused.
+func cachePath(sourceID, name string, info fs.FileInfo, size int) string {
+	key := fmt.Sprintf("%s\x00%d\x00%d\x00%d", name, info.ModTime().UnixNano(), info.Size(), size)
+	sum := sha1.Sum([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+	return filepath.Join(cacheDir(sourceID), hash[:2], hash+strings.ToLower(path.Ext(name)))
+}
+
+// Get returns the path of the cached thumbnail for name, rendering it first
+// when needed
+func Get(drv storage.Driver, sourceID, name string, size int) (string, error) {
+	if !Supported(name) {
+		return "", ErrUnsupported
+	}
+
+	info, err := drv.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", ErrUnsupported
+	}
+	if !Cached(sourceID) {
+		return "", ErrNotCached
+	}
+
+	file := cachePath(sourceID, name, info, size)
+	for {
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+
+		pendingMu.Lock()
+		wg, busy := pending[file]
+		if !busy {
+			wg = &sync.WaitGroup{}
+			wg.Add(1)
+			pending[file] = wg
+		}
+		pendingMu.Unlock()
+
+		if busy {
+			wg.Wait()
+			continue
+		}
+
+		err := render(drv, name, file, size)
+
+		pendingMu.Lock()
+		delete(pending, file)
+		pendingMu.Unlock()
+		wg.Done()
+
+		if err != nil {
+			return "", err
+		}
+		return file, nil
+	}
+}
+
+// Render writes a thumbnail of name to w without caching it
+func Render(drv storage.Driver, name string, size int, w io.Writer) error {
+	if !Supported(name) {
+		return ErrUnsupported
+	}
+	renders <- struct{}{}
+	defer func() { <-renders }()
+	return encode(drv, name, size, w)
+}
+
+func render(drv storage.Driver, name, file string, size int) error {
+	renders <- struct{}{}
+	defer func() { <-renders }()
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := encode(drv, name, size, tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// encode scales the image at name down to fit size and writes it to w
+func encode(drv storage.Driver, name string, size int, w io.Writer) error {
+	src, err := drv.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Check the dimensions before decoding the whole image
+	cfg, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return ErrUnsupported
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return ErrTooLarge
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	img, err := imaging.Decode(src, imaging.AutoOrientation(true))
+	if err != nil {
+		return ErrUnsupported
+	}
+
+	// Never scale up; small images are re-encoded as they are
+	b := img.Bounds()
+	if b.Dx() > size || b.Dy() > size {
+		img = imaging.Fit(img, size, size, imaging.Lanczos)
+	}
+
+	format := formats[strings.ToLower(path.Ext(name))]
+	return imaging.Encode(w, img, format, imaging.JPEGQuality(85))
+}
+
+// SizeParam parses the size query parameter
+func SizeParam(s string) (int, bool) {
+	if s == "" {
+		return DefaultSize, true
+	}
+	size, err := strconv.Atoi(s)
+	if err != nil || !ValidSize(size) {
+		return 0, false
+	}
+	return size, true
+}
@@ -0,0 +1,80 @@
+package thumbs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filemanager/config"
+	"filemanager/storage"
+)
+
+func TestEncryptedSourcesAreNotCached(t *testing.T) {
+	dir := t.TempDir()
+	plain, secret, data := filepath.Join(dir, "plain"), filepath.Join(dir, "secret"), filepath.Join(dir, "data")
+	for _, d := range []string{plain, secret} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := fmt.Sprintf("server:\n  dataDir: %q\nsources:\n"+
+		"  - id: plain\n    name: Plain\n    path: %q\n"+
+		"  - id: secret\n    name: Secret\n    path: %q\n    encryption:\n      passphrase: correct horse\n", data, plain, secret)
+	p := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(p, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.SetPath(p)
+	config.Init()
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 600, 300))); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source string
+		err    error
+		cached bool
+	}{
+		{"plain", nil, true},
+		{"secret", ErrNotCached, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			src, _ := config.GetSource(tt.source)
+			drv, err := storage.NewLocal(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(src.Path, "photo.png"), img.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := Get(drv, tt.source, "/photo.png", 128); !errors.Is(err, tt.err) {
+				t.Fatalf("Get = %v, want %v", err, tt.err)
+			}
+			_, err = os.Stat(cacheDir(tt.source))
+			if cached := err == nil; cached != tt.cached {
+				t.Errorf("cache folder exists: %v, want %v", cached, tt.cached)
+			}
+
+			var out bytes.Buffer
+			if err := Render(drv, "/photo.png", 128, &out); err != nil {
+				t.Fatal(err)
+			}
+			thumb, err := png.Decode(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := thumb.Bounds(); b.Dx() != 128 || b.Dy() != 64 {
+				t.Errorf("thumbnail is %dx%d, want 128x64", b.Dx(), b.Dy())
+			}
+		})
+	}
+}
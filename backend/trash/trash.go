@@ -0,0 +1,245 @@
+package trash
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"filemanager/config"
+	"filemanager/storage"
+	"filemanager/utils"
+)
+
+// Dir is where deleted items of a source are kept
+const Dir = storage.MetaDir + "/trash"
+
+// DefaultRetention is used when trash.retentionDays is not configured
+const DefaultRetention = 30 * 24 * time.Hour
+
+var ErrNotFound = errors.New("trash item not found")
+
+// Item describes something sitting in the trash
+type Item struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	OriginalPath string    `json:"originalPath"`
+	IsDir        bool      `json:"isDir"`
+	Size         int64     `json:"size"`
+	DeletedAt    time.Time `json:"deletedAt"`
+	DeletedBy    string    `json:"deletedBy"`
+}
+
+func itemPath(id string) string { return path.Join(Dir, id) }
+func metaPath(id string) string { return path.Join(Dir, id+".json") }
+
+func newID() string {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(buf))
+}
+
+// Move puts name into the trash of its source instead of deleting it
+func Move(drv storage.Driver, name, user string) (*Item, error) {
+	info, err := drv.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &Item{
+		ID:           newID(),
+		Name:         path.Base(name),
+		OriginalPath: name,
+		IsDir:        info.IsDir(),
+		Size:         info.Size(),
+		DeletedAt:    time.Now(),
+		DeletedBy:    user,
+	}
+
+	if err := drv.MkdirAll(Dir); err != nil {
+		return nil, err
+	}
+	if err := writeMeta(drv, item); err != nil {
+		return nil, err
+	}
+	if err := drv.Rename(name, itemPath(item.ID)); err != nil {
+		drv.RemoveAll(metaPath(item.ID))
+		return nil, err
+	}
+	return item, nil
+}
+
+func writeMeta(drv storage.Driver, item *Item) error {
+	data, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	w, err := drv.Create(metaPath(item.ID))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		storage.Abort(w)
+		return err
+	}
+	return w.Close()
+}
+
+// Get returns a single trash item
+func Get(drv storage.Driver, id string) (*Item, error) {
+	if !isValidID(id) {
+		return nil, ErrNotFound
+	}
+
+	f, err := drv.Open(metaPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var item Item
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// isValidID keeps ids coming from requests from pointing outside Dir
+func isValidID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// List returns the items in the trash of a source, newest first
+func List(drv storage.Driver) ([]Item, error) {
+	entries, err := drv.ReadDir(Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Item{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items := []Item{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		item, err := Get(drv, id)
+		if err != nil {
+			utils.Warnf("⚠️  Skipping unreadable trash entry %s: %v", entry.Name(), err)
+			continue
+		}
+		items = append(items, *item)
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+	return items, nil
+}
+
+// Restore moves an item back to where it was deleted from. If that path
+// is taken by now, the item comes back under a numbered name instead.
+func Restore(drv storage.Driver, id string) (string, error) {
+	item, err := Get(drv, id)
+	if err != nil {
+		return "", err
+	}
+
+	if err := drv.MkdirAll(path.Dir(item.OriginalPath)); err != nil {
+		return "", err
+	}
+
+	dst, err := storage.UniquePath(drv, item.OriginalPath)
+	if err != nil {
+		return "", err
+	}
+	if err := drv.Rename(itemPath(id), dst); err != nil {
+		return "", err
+	}
+	return dst, drv.RemoveAll(metaPath(id))
+}
+
+// Purge deletes an item from the trash for good
+func Purge(drv storage.Driver, id string) error {
+	if _, err := Get(drv, id); err != nil {
+		return err
+	}
+	if err := drv.RemoveAll(itemPath(id)); err != nil {
+		return err
+	}
+	return drv.RemoveAll(metaPath(id))
+}
+
+// Retention returns how long items stay in the trash
+func Retention() time.Duration {
+	if days := config.Get().Trash.RetentionDays; days > 0 {
+		return time.Duration(days) * 24 * time.Hour
+	}
+	return DefaultRetention
+}
+
+// PurgeExpired removes every item older than the retention period
+func PurgeExpired(drv storage.Driver) (int, error) {
+	items, err := List(drv)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-Retention())
+	purged := 0
+	for _, item := range items {
+		if item.DeletedAt.After(cutoff) {
+			continue
+		}
+		if err := Purge(drv, item.ID); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// StartPurger empties expired trash items of every source once an hour
+func StartPurger() {
+	go func() {
+		for {
+			for _, src := range config.GetEnabledSources() {
+				drv, err := storage.Get(src.ID)
+				if err != nil {
+					continue
+				}
+				n, err := PurgeExpired(drv)
+				if err != nil {
+					utils.Warnf("⚠️  Trash purge failed for %s: %v", src.Name, err)
+				} else if n > 0 {
+					utils.Infof("🗑️  Purged %d expired trash items from %s", n, src.Name)
+				}
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
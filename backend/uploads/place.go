@@ -0,0 +1,247 @@
+package uploads
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"filemanager/storage"
+	"filemanager/versions"
+)
+
+// Policy says what happens when the destination of an upload exists
+type Policy string
+
+const (
+	Reject  Policy = "reject"
+	Replace Policy = "replace"
+	Rename  Policy = "rename"
+)
+
+var (
+	ErrExists   = errors.New("an item with that name already exists")
+	ErrChecksum = errors.New("checksum mismatch")
+)
+
+// tempPrefix starts the names of files that are still being uploaded
+const tempPrefix = ".zxupload-"
+
+// IsTemp reports whether name is an upload in progress
+func IsTemp(name string) bool {
+	return strings.HasPrefix(path.Base(name), tempPrefix)
+}
+
+// TempPath returns a fresh name next to name to write an upload to before
+// it is put in place
+func TempPath(name string) string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return path.Join(path.Dir(name), tempPrefix+hex.EncodeToString(buf))
+}
+
+// ParsePolicy accepts the policy names clients send; nothing means reject
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case "":
+		return Reject, nil
+	case Reject, Replace, Rename:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown overwrite policy %q", s)
+}
+
+// Checksums are hex digests a client sends along to verify an upload
+type Checksums struct {
+	SHA256 string `json:"sha256,omitempty"`
+	MD5    string `json:"md5,omitempty"`
+}
+
+// ParseChecksums checks that the digests look right
+func ParseChecksums(sha, md string) (Checksums, error) {
+	c := Checksums{SHA256: strings.ToLower(sha), MD5: strings.ToLower(md)}
+	if c.SHA256 != "" && !isHex(c.SHA256, sha256.Size) {
+		return Checksums{}, errors.New("invalid sha256 checksum")
+	}
+	if c.MD5 != "" && !isHex(c.MD5, md5.Size) {
+		return Checksums{}, errors.New("invalid md5 checksum")
+	}
+	return c, nil
+}
+
+func isHex(s string, size int) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == size
+}
+
+// verifier hashes data as it is written
+type verifier struct {
+	sums Checksums
+	sha  hash.Hash
+	md   hash.Hash
+}
+
+func (c Checksums) verifier() *verifier {
+	return &verifier{sums: c, sha: sha256.New(), md: md5.New()}
+}
+
+func (v *verifier) Write(p []byte) (int, error) {
+	if v.sums.SHA256 != "" {
+		v.sha.Write(p)
+	}
+	if v.sums.MD5 != "" {
+		v.md.Write(p)
+	}
+	return len(p), nil
+}
+
+func (v *verifier) check() error {
+	if v.sums.SHA256 != "" && hex.EncodeToString(v.sha.Sum(nil)) != v.sums.SHA256 {
+		return ErrChecksum
+	}
+	if v.sums.MD5 != "" && hex.EncodeToString(v.md.Sum(nil)) != v.sums.MD5 {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// Verify reads a stored file and compares it against the checksums
+func (c Checksums) Verify(drv storage.Driver, name string) error {
+	if c.SHA256 == "" && c.MD5 == "" {
+		return nil
+	}
+	f, err := drv.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	v := c.verifier()
+	if _, err := io.Copy(v, f); err != nil {
+		return err
+	}
+	return v.check()
+}
+
+// Check tells early whether an upload to name can go ahead under policy
+func Check(drv storage.Driver, name string, policy Policy) error {
+	info, err := drv.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if policy == Reject || (policy == Replace && info.IsDir()) {
+		return ErrExists
+	}
+	return nil
+}
+
+// placeAttempts bounds how often Rename looks for another free name when
+// uploads of the same name keep taking the one it found
+const placeAttempts = 100
+
+// Place moves a finished upload from staged to name and returns where it
+// ended up. Replacing a file is a single rename, so readers see either the
+// old or the new file, never a partial one. The replaced file is kept as a
+// version when the source has versioning on. Under the other policies the
+// name is only taken when it is free at the moment of the move, so
+// concurrent uploads never overwrite each other.
+func Place(drv storage.Driver, sourceID, staged, name string, policy Policy) (string, error) {
+	if err := drv.MkdirAll(path.Dir(name)); err != nil {
+		return "", err
+	}
+	if policy == Replace {
+		return name, replace(drv, sourceID, staged, name)
+	}
+
+	for i := 0; i < placeAttempts; i++ {
+		target := name
+		if policy == Rename {
+			var err error
+			if target, err = storage.UniquePath(drv, name); err != nil {
+				return "", err
+			}
+		}
+		err := storage.RenameNoReplace(drv, staged, target)
+		if err == nil {
+			return target, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		if policy == Reject {
+			return "", ErrExists
+		}
+		// Another upload took the name in the meantime, find the next one
+	}
+	return "", ErrExists
+}
+
+func replace(drv storage.Driver, sourceID, staged, name string) error {
+	if err := Check(drv, name, Replace); err != nil {
+		return err
+	}
+	if err := versions.Keep(drv, sourceID, name); err != nil {
+		return fmt.Errorf("failed to keep the previous version: %w", err)
+	}
+
+	err := drv.Rename(staged, name)
+	if err != nil {
+		// Some backends will not rename over an existing file
+		if info, serr := drv.Stat(name); serr == nil && !info.IsDir() {
+			if err = drv.RemoveAll(name); err == nil {
+				err = drv.Rename(staged, name)
+			}
+		}
+	}
+	return err
+}
+
+// Save stores r at name. The data goes to a temporary file next to it
+// first, which is synced, verified and then put in place.
+func Save(drv storage.Driver, sourceID, name string, r io.Reader, policy Policy, sums Checksums) (string, int64, error) {
+	if err := Check(drv, name, policy); err != nil {
+		return "", 0, err
+	}
+
+	tmp := TempPath(name)
+	w, err := drv.Create(tmp)
+	if err != nil {
+		return "", 0, err
+	}
+
+	v := sums.verifier()
+	n, err := io.Copy(io.MultiWriter(w, v), r)
+	if err == nil {
+		err = storage.Sync(w)
+	}
+	if err != nil {
+		storage.Abort(w)
+		drv.RemoveAll(tmp)
+		return "", n, err
+	}
+	if err := w.Close(); err != nil {
+		drv.RemoveAll(tmp)
+		return "", n, err
+	}
+	if err := v.check(); err != nil {
+		drv.RemoveAll(tmp)
+		return "", n, err
+	}
+
+	final, err := Place(drv, sourceID, tmp, name, policy)
+	if err != nil {
+		drv.RemoveAll(tmp)
+		return "", n, err
+	}
+	return final, n, nil
+}
@@ -0,0 +1,123 @@
+package uploads
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"filemanager/config"
+	"filemanager/storage"
+)
+
+func newLocal(t *testing.T) storage.Driver {
+	t.Helper()
+	drv, err := storage.NewLocal(config.Source{Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return drv
+}
+
+func readFile(t *testing.T, drv storage.Driver, name string) string {
+	t.Helper()
+	f, err := drv.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestConcurrentSave(t *testing.T) {
+	const uploads = 20
+
+	tests := []struct {
+		policy Policy
+		placed int
+	}{
+		{Rename, uploads},
+		{Reject, 1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			drv := newLocal(t)
+			if err := drv.MkdirAll("/dir"); err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				wg    sync.WaitGroup
+				mu    sync.Mutex
+				names = map[string]string{}
+				fails int
+			)
+			for i := 0; i < uploads; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					body := fmt.Sprintf("upload %d", i)
+					final, _, err := Save(drv, "test", "/dir/report.txt", strings.NewReader(body), tt.policy, Checksums{})
+
+					mu.Lock()
+					defer mu.Unlock()
+					if errors.Is(err, ErrExists) {
+						fails++
+						return
+					}
+					if err != nil {
+						t.Errorf("upload %d: %v", i, err)
+						return
+					}
+					if prev, ok := names[final]; ok {
+						t.Errorf("%s was placed by %q and %q", final, prev, body)
+					}
+					names[final] = body
+				}(i)
+			}
+			wg.Wait()
+
+			if len(names) != tt.placed || fails != uploads-tt.placed {
+				t.Fatalf("placed %d and rejected %d, want %d and %d", len(names), fails, tt.placed, uploads-tt.placed)
+			}
+			for name, body := range names {
+				if got := readFile(t, drv, name); got != body {
+					t.Errorf("%s holds %q, want %q", name, got, body)
+				}
+			}
+			entries, err := drv.ReadDir("/dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.placed {
+				t.Errorf("%d entries left in the folder, want %d", len(entries), tt.placed)
+			}
+		})
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Policy
+		err  bool
+	}{
+		{"", Reject, false},
+		{"reject", Reject, false},
+		{"REPLACE", Replace, false},
+		{"rename", Rename, false},
+		{"merge", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePolicy(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParsePolicy(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package uploads
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"filemanager/config"
+	"filemanager/storage"
+	"filemanager/utils"
+)
+
+// Dir is where partial uploads of a source are staged
+const Dir = storage.MetaDir + "/uploads"
+
+// DefaultExpiry is used when uploads.expiryHours is not configured
+const DefaultExpiry = 24 * time.Hour
+
+var (
+	ErrNotFound = errors.New("upload not found")
+	ErrOffset   = errors.New("upload offset does not match")
+	ErrTooLarge = errors.New("data goes past the upload length")
+	ErrBusy     = errors.New("upload is being written to")
+)
+
+// Upload is a file being uploaded in several requests. The data received
+// so far is kept in chunks named after their starting offset; drivers that
+// can append keep a single chunk that grows.
+type Upload struct {
+	ID        string            `json:"id"`
+	Source    string            `json:"source"`
+	Path      string            `json:"path"`
+	Size      int64             `json:"size"`
+	Offset    int64             `json:"-"`
+	Metadata  map[string]string `json:"metadata"`
+	Policy    Policy            `json:"policy"`
+	Checksums Checksums         `json:"checksums"`
+	Owner     string            `json:"owner"`
+	Created   time.Time         `json:"created"`
+	Expires   time.Time         `json:"expires"`
+}
+
+func chunkDir(id string) string  { return path.Join(Dir, id) }
+func metaPath(id string) string  { return path.Join(Dir, id+".json") }
+func chunkName(off int64) string { return fmt.Sprintf("%020d", off) }
+
+func newID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// isValidID keeps ids coming from requests from pointing outside Dir
+func isValidID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	mu   sync.Mutex
+	busy = map[string]bool{}
+)
+
+// lock makes sure only one request writes to an upload at a time
+func lock(u *Upload) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	key := u.Source + ":" + u.ID
+	if busy[key] {
+		return false
+	}
+	busy[key] = true
+	return true
+}
+
+func unlock(u *Upload) {
+	mu.Lock()
+	delete(busy, u.Source+":"+u.ID)
+	mu.Unlock()
+}
+
+// Create starts a new upload in the staging area of its source
+func Create(drv storage.Driver, u *Upload) error {
+	u.ID = newID()
+	u.Created = time.Now()
+	u.Expires = u.Created.Add(Expiry())
+
+	if err := drv.MkdirAll(chunkDir(u.ID)); err != nil {
+		return err
+	}
+	return writeMeta(drv, u)
+}
+
+func writeMeta(drv storage.Driver, u *Upload) error {
+	data, err := json.MarshalIndent(u, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	w, err := drv.Create(metaPath(u.ID))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		storage.Abort(w)
+		return err
+	}
+	return w.Close()
+}
+
+// Get returns an upload together with how much of it has arrived
+func Get(drv storage.Driver, id string) (*Upload, error) {
+	if !isValidID(id) {
+		return nil, ErrNotFound
+	}
+
+	f, err := drv.Open(metaPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var u Upload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+
+	chunks, err := listChunks(drv, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range chunks {
+		u.Offset += c.Size()
+	}
+	return &u, nil
+}
+
+// listChunks returns the chunks of an upload in order. Chunks have to
+// follow each other without gaps.
+func listChunks(drv storage.Driver, id string) ([]fs.FileInfo, error) {
+	entries, err := drv.ReadDir(chunkDir(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, k int) bool { return entries[i].Name() < entries[k].Name() })
+
+	var off int64
+	for _, e := range entries {
+		start, err := strconv.ParseInt(e.Name(), 10, 64)
+		if err != nil || start != off {
+			return nil, fmt.Errorf("upload %s has a damaged chunk %s", id, e.Name())
+		}
+		off += e.Size()
+	}
+	return entries, nil
+}
+
+// Write adds data at offset, which has to be where the upload currently
+// ends. It returns the new offset; data that arrived before a broken
+// connection is kept where the driver allows it.
+func Write(drv storage.Driver, u *Upload, offset int64, r io.Reader) (int64, error) {
+	if !lock(u) {
+		return u.Offset, ErrBusy
+	}
+	defer unlock(u)
+
+	// Read the state again now that nobody else can change it
+	cur, err := Get(drv, u.ID)
+	if err != nil {
+		return u.Offset, err
+	}
+	*u = *cur
+	if offset != u.Offset {
+		return u.Offset, ErrOffset
+	}
+
+	var w io.WriteCloser
+	a, canAppend := drv.(storage.Appender)
+	if canAppend {
+		w, err = a.Append(path.Join(chunkDir(u.ID), chunkName(0)))
+	} else {
+		w, err = drv.Create(path.Join(chunkDir(u.ID), chunkName(offset)))
+	}
+	if err != nil {
+		return u.Offset, err
+	}
+
+	_, err = io.Copy(w, io.LimitReader(r, u.Size-u.Offset))
+	if err == nil {
+		// The body must not go on past the announced length
+		var b [1]byte
+		if _, rerr := io.ReadFull(r, b[:]); rerr != io.EOF {
+			err = ErrTooLarge
+		}
+	}
+	if err != nil && !canAppend {
+		storage.Abort(w)
+		drv.RemoveAll(path.Join(chunkDir(u.ID), chunkName(offset)))
+		return u.Offset, err
+	}
+	if err == nil {
+		err = storage.Sync(w)
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+
+	if cur, gerr := Get(drv, u.ID); gerr == nil {
+		*u = *cur
+	}
+
+	u.Expires = time.Now().Add(Expiry())
+	if merr := writeMeta(drv, u); err == nil {
+		err = merr
+	}
+	return u.Offset, err
+}
+
+// Finish verifies a complete upload and moves it to its destination
+// following its overwrite policy. It returns where the file ended up.
+func Finish(drv storage.Driver, u *Upload) (string, error) {
+	if u.Offset != u.Size {
+		return "", fmt.Errorf("upload %s is not complete", u.ID)
+	}
+	if !lock(u) {
+		return "", ErrBusy
+	}
+	defer unlock(u)
+
+	chunks, err := listChunks(drv, u.ID)
+	if err != nil {
+		return "", err
+	}
+
+	// Join chunks into one staged file first, so the destination only ever
+	// sees a complete file
+	staged := path.Join(chunkDir(u.ID), chunkName(0))
+	if len(chunks) != 1 {
+		staged = path.Join(Dir, u.ID+".data")
+		if err := join(drv, u.ID, chunks, staged); err != nil {
+			drv.RemoveAll(staged)
+			return "", err
+		}
+	}
+
+	if err := u.Checksums.Verify(drv, staged); err != nil {
+		// The data is of no use anymore
+		remove(drv, u.ID)
+		return "", err
+	}
+
+	final, err := Place(drv, u.Source, staged, u.Path, u.Policy)
+	if err != nil {
+		return "", err
+	}
+	return final, remove(drv, u.ID)
+}
+
+func join(drv storage.Driver, id string, chunks []fs.FileInfo, dst string) error {
+	w, err := drv.Create(dst)
+	if err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		f, err := drv.Open(path.Join(chunkDir(id), c.Name()))
+		if err != nil {
+			storage.Abort(w)
+			return err
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			storage.Abort(w)
+			return err
+		}
+	}
+	if err := storage.Sync(w); err != nil {
+		storage.Abort(w)
+		return err
+	}
+	return w.Close()
+}
+
+// Terminate throws away an upload and everything received for it
+func Terminate(drv storage.Driver, id string) error {
+	if _, err := Get(drv, id); err != nil {
+		return err
+	}
+	return remove(drv, id)
+}
+
+func remove(drv storage.Driver, id string) error {
+	if err := drv.RemoveAll(chunkDir(id)); err != nil {
+		return err
+	}
+	drv.RemoveAll(path.Join(Dir, id+".data"))
+	return drv.RemoveAll(metaPath(id))
+}
+
+// Expiry returns how long an upload may sit idle before it is dropped
+func Expiry() time.Duration {
+	if hours := config.Get().Uploads.ExpiryHours; hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return DefaultExpiry
+}
+
+// PurgeExpired removes uploads that have not received data in time
+func PurgeExpired(drv storage.Driver) (int, error) {
+	entries, err := drv.ReadDir(Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	purged := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		u, err := Get(drv, id)
+		if err == nil && u.Expires.After(now) {
+			continue
+		}
+		if err != nil && entry.ModTime().Add(Expiry()).After(now) {
+			continue
+		}
+		if err := remove(drv, id); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// StartPurger drops abandoned uploads of every source once an hour
+func StartPurger() {
+	go func() {
+		for {
+			for _, src := range config.GetEnabledSources() {
+				drv, err := storage.Get(src.ID)
+				if err != nil {
+					continue
+				}
+				n, err := PurgeExpired(drv)
+				if err != nil {
+					utils.Warnf("⚠️  Upload cleanup failed for %s: %v", src.Name, err)
+				} else if n > 0 {
+					utils.Infof("🗑️  Removed %d abandoned uploads from %s", n, src.Name)
+				}
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
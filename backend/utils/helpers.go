@@ -3,12 +3,9 @@ package utils
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"path/filepath"
 	"strings"
-
-	"filemanager/config"
 )
 
 type Response struct {
@@ -17,24 +14,13 @@ type Response struct {
 	Data    interface{} `json:"data,omitempty"`
 }
 
-func GetSafePath(sourceID, path string) (string, error) {
-	// Find the source
-	var source *config.Source
-	for _, s := range config.AppConfig.Sources {
-		if s.ID == sourceID && s.Enabled {
-			source = &s
-			break
-		}
-	}
-
-	if source == nil {
-		return "", fmt.Errorf("source not found or disabled: %s", sourceID)
-	}
-
-	cleanPath := filepath.Clean(path)
-	fullPath := filepath.Join(source.Path, cleanPath)
+// SafeJoin joins a slash-separated path onto root and rejects anything that
+// would end up outside of it
+func SafeJoin(root, path string) (string, error) {
+	cleanPath := filepath.Clean("/" + filepath.FromSlash(strings.ReplaceAll(path, "\\", "/")))
+	fullPath := filepath.Join(root, cleanPath)
 
-	absRoot, err := filepath.Abs(source.Path)
+	absRoot, err := filepath.Abs(root)
 	if err != nil {
 		return "", err
 	}
@@ -44,7 +30,8 @@ func GetSafePath(sourceID, path string) (string, error) {
 		return "", err
 	}
 
-	if !strings.HasPrefix(absPath, absRoot) {
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
 		return "", fmt.Errorf("invalid path: outside source directory")
 	}
 
@@ -56,26 +43,15 @@ func SendJSON(w http.ResponseWriter, status int, response Response) {
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(response)
 
-	// Log response
-	statusText := "SUCCESS"
-	if status >= 400 {
-		statusText = "ERROR"
-	}
-	log.Printf("[%s] %d - %s", statusText, status, response.Message)
-}
-
-func CORSMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		next(w, r)
+	// Log response: server failures are errors, refused requests the
+	// usual activity and successful ones only worth seeing when debugging
+	switch {
+	case status >= 500:
+		Errorf("[ERROR] %d - %s", status, response.Message)
+	case status >= 400:
+		Infof("[ERROR] %d - %s", status, response.Message)
+	default:
+		Debugf("[SUCCESS] %d - %s", status, response.Message)
 	}
 }
 
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Log levels, from the most to the least talkative
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[string]int{"debug": LevelDebug, "info": LevelInfo, "warn": LevelWarn, "error": LevelError}
+
+// minLevel is the lowest level that gets written
+var minLevel atomic.Int32
+
+func init() {
+	minLevel.Store(LevelInfo)
+}
+
+// SetLogLevel drops log lines below level: "debug" shows every API
+// response, "info" the usual activity, "warn" only what went wrong or
+// may need a look and "error" only failures
+func SetLogLevel(level string) error {
+	min, ok := levelNames[level]
+	if !ok {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	minLevel.Store(int32(min))
+	return nil
+}
+
+// Debugf logs what is only worth seeing while looking into a problem
+func Debugf(format string, v ...any) { logf(LevelDebug, format, v...) }
+
+// Infof logs the usual activity
+func Infof(format string, v ...any) { logf(LevelInfo, format, v...) }
+
+// Warnf logs what went wrong without stopping anything, or may need a look
+func Warnf(format string, v ...any) { logf(LevelWarn, format, v...) }
+
+// Errorf logs failures
+func Errorf(format string, v ...any) { logf(LevelError, format, v...) }
+
+func logf(level int, format string, v ...any) {
+	if int32(level) < minLevel.Load() {
+		return
+	}
+	// Skip logf and Debugf and the like, so file and line flags name the caller
+	log.Output(3, fmt.Sprintf(format, v...))
+}
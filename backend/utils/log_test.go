@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogLevels(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		SetLogLevel("info")
+	})
+
+	// The level comes from the call, not from what the line says
+	write := func() {
+		Debugf("debug ❌ Failed %s", "[ERROR] 500")
+		Infof("info %s", "⚠️")
+		Warnf("warn %s", "[SUCCESS]")
+		Errorf("error %s", "plain")
+	}
+
+	tests := []struct {
+		level string
+		want  []string
+	}{
+		{"debug", []string{"debug", "info", "warn", "error"}},
+		{"info", []string{"info", "warn", "error"}},
+		{"warn", []string{"warn", "error"}},
+		{"error", []string{"error"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			if err := SetLogLevel(tt.level); err != nil {
+				t.Fatal(err)
+			}
+			buf.Reset()
+			write()
+
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				if fields := strings.Fields(line); len(fields) > 2 {
+					got = append(got, fields[2])
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("wrote %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if err := SetLogLevel("loud"); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
@@ -0,0 +1,463 @@
+package versions
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"filemanager/config"
+	"filemanager/storage"
+	"filemanager/utils"
+)
+
+// Dir is where the old versions of files of a source are kept. Contents
+// live in blobs named by their SHA-256, so identical versions are stored
+// once; history holds the list of versions of every path.
+const Dir = storage.MetaDir + "/versions"
+
+const (
+	blobDir    = Dir + "/blobs"
+	historyDir = Dir + "/history"
+	// tmpPrefix starts the names of blobs and histories still being
+	// written
+	tmpPrefix = "tmp-"
+)
+
+const (
+	// DefaultMaxVersions is how many versions of a file are kept when
+	// versioning.maxVersions is not configured
+	DefaultMaxVersions = 10
+	// DefaultMaxAge is how long versions are kept when versioning.maxAgeDays
+	// is not configured
+	DefaultMaxAge = 30 * 24 * time.Hour
+)
+
+var ErrNotFound = errors.New("version not found")
+
+// Version is an earlier state of a file
+type Version struct {
+	ID      string    `json:"id"`
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Created time.Time `json:"created"`
+}
+
+// history is the saved list of versions of one path, oldest first
+type history struct {
+	Path     string    `json:"path"`
+	Versions []Version `json:"versions"`
+}
+
+// mu serializes changes to the version store. Contents are copied into
+// temporary blobs without it, so a large file does not hold up every
+// other save; only moving them in place and editing the history take it.
+var mu sync.Mutex
+
+// Enabled reports whether a source keeps old versions of its files
+func Enabled(sourceID string) bool {
+	src, ok := config.GetSource(sourceID)
+	return ok && src.Versioning != nil
+}
+
+func maxVersions(sourceID string) int {
+	if src, ok := config.GetSource(sourceID); ok && src.Versioning != nil && src.Versioning.MaxVersions > 0 {
+		return src.Versioning.MaxVersions
+	}
+	return DefaultMaxVersions
+}
+
+func maxAge(sourceID string) time.Duration {
+	if src, ok := config.GetSource(sourceID); ok && src.Versioning != nil && src.Versioning.MaxAgeDays > 0 {
+		return time.Duration(src.Versioning.MaxAgeDays) * 24 * time.Hour
+	}
+	return DefaultMaxAge
+}
+
+func blobPath(hash string) string {
+	return path.Join(blobDir, hash[:2], hash)
+}
+
+func historyPath(name string) string {
+	sum := sha1.Sum([]byte(name))
+	return path.Join(historyDir, hex.EncodeToString(sum[:])+".json")
+}
+
+func newID() string {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(buf))
+}
+
+// Keep saves the current contents of name as a version before it gets
+// replaced. It does nothing when the source has versioning off or name is
+// not an existing file, and skips contents equal to the newest version.
+func Keep(drv storage.Driver, sourceID, name string) error {
+	if !Enabled(sourceID) {
+		return nil
+	}
+	info, err := drv.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	tmp, hash, err := copyBlob(drv, name)
+	if err != nil {
+		return err
+	}
+
+	// Placing the blob and recording it happen under one lock, so Prune
+	// cannot remove it before the history refers to it
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := placeBlob(drv, tmp, hash); err != nil {
+		return err
+	}
+	h, err := readHistory(drv, name)
+	if err != nil {
+		return err
+	}
+	if n := len(h.Versions); n > 0 && h.Versions[n-1].Hash == hash {
+		return nil
+	}
+	h.Versions = append(h.Versions, Version{
+		ID:      newID(),
+		Hash:    hash,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Created: time.Now(),
+	})
+	if limit := maxVersions(sourceID); len(h.Versions) > limit {
+		h.Versions = h.Versions[len(h.Versions)-limit:]
+	}
+	return writeHistory(drv, h)
+}
+
+// copyBlob copies a file to a temporary blob and returns where it is and
+// the hash of its contents. Prune leaves temporary blobs alone while they
+// are being written.
+func copyBlob(drv storage.Driver, name string) (string, string, error) {
+	src, err := drv.Open(name)
+	if err != nil {
+		return "", "", err
+	}
+	defer src.Close()
+
+	if err := drv.MkdirAll(blobDir); err != nil {
+		return "", "", err
+	}
+	tmp := path.Join(blobDir, tmpPrefix+newID())
+	w, err := drv.Create(tmp)
+	if err != nil {
+		return "", "", err
+	}
+
+	sum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, sum), src); err != nil {
+		storage.Abort(w)
+		drv.RemoveAll(tmp)
+		return "", "", err
+	}
+	if err := w.Close(); err != nil {
+		drv.RemoveAll(tmp)
+		return "", "", err
+	}
+	return tmp, hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// placeBlob moves a temporary blob to its place in the blob store, or
+// drops it when the same contents are stored already. The blob is named
+// by its contents, so it does not matter who places it first. Callers
+// hold mu.
+func placeBlob(drv storage.Driver, tmp, hash string) error {
+	blob := blobPath(hash)
+	if _, err := drv.Stat(blob); err == nil {
+		drv.RemoveAll(tmp)
+		return nil
+	}
+	if err := drv.MkdirAll(path.Dir(blob)); err != nil {
+		drv.RemoveAll(tmp)
+		return err
+	}
+	if err := drv.Rename(tmp, blob); err != nil {
+		drv.RemoveAll(tmp)
+		return err
+	}
+	return nil
+}
+
+// readHistory loads the versions of name; callers hold mu
+func readHistory(drv storage.Driver, name string) (*history, error) {
+	h, err := loadHistory(drv, historyPath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return &history{Path: name}, nil
+	}
+	return h, err
+}
+
+func loadHistory(drv storage.Driver, file string) (*history, error) {
+	f, err := drv.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	var h history
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// writeHistory saves the versions of a path, removing the file once none
+// are left. The file is written next to it first and renamed over it, so
+// a failed write never loses the versions recorded before. Callers hold
+// mu.
+func writeHistory(drv storage.Driver, h *history) error {
+	file := historyPath(h.Path)
+	if len(h.Versions) == 0 {
+		return drv.RemoveAll(file)
+	}
+
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := drv.MkdirAll(historyDir); err != nil {
+		return err
+	}
+	tmp := path.Join(historyDir, tmpPrefix+newID())
+	w, err := drv.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		storage.Abort(w)
+		drv.RemoveAll(tmp)
+		return err
+	}
+	if err := storage.Sync(w); err != nil {
+		storage.Abort(w)
+		drv.RemoveAll(tmp)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		drv.RemoveAll(tmp)
+		return err
+	}
+
+	if err := drv.Rename(tmp, file); err != nil {
+		// Some backends will not rename over an existing file
+		if err = drv.RemoveAll(file); err == nil {
+			err = drv.Rename(tmp, file)
+		}
+		if err != nil {
+			drv.RemoveAll(tmp)
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the versions of name, newest first
+func List(drv storage.Driver, name string) ([]Version, error) {
+	mu.Lock()
+	h, err := readHistory(drv, name)
+	mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Version, 0, len(h.Versions))
+	for i := len(h.Versions) - 1; i >= 0; i-- {
+		list = append(list, h.Versions[i])
+	}
+	return list, nil
+}
+
+// Get returns one version of name
+func Get(drv storage.Driver, name, id string) (*Version, error) {
+	list, err := List(drv, name)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if list[i].ID == id {
+			return &list[i], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Open opens the contents of a version
+func Open(drv storage.Driver, v *Version) (storage.File, error) {
+	return drv.Open(blobPath(v.Hash))
+}
+
+// Copy writes the contents of a version to dst
+func Copy(drv storage.Driver, v *Version, dst string) error {
+	src, err := Open(drv, v)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	w, err := drv.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		storage.Abort(w)
+		return err
+	}
+	if err := storage.Sync(w); err != nil {
+		storage.Abort(w)
+		return err
+	}
+	return w.Close()
+}
+
+// Prune drops versions older than the retention of the source and then
+// removes the contents no version refers to anymore. It returns how many
+// versions were dropped.
+func Prune(drv storage.Driver, sourceID string) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	entries, err := drv.ReadDir(historyDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-maxAge(sourceID))
+	limit := maxVersions(sourceID)
+	used := map[string]bool{}
+	dropped := 0
+	var unreadable error
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			// A temporary history left behind by a crash
+			if time.Since(entry.ModTime()) > time.Hour {
+				drv.RemoveAll(path.Join(historyDir, entry.Name()))
+			}
+			continue
+		}
+		h, err := loadHistory(drv, path.Join(historyDir, entry.Name()))
+		if err != nil {
+			utils.Warnf("⚠️  Skipping version history %s: %v", entry.Name(), err)
+			unreadable = fmt.Errorf("version history %s: %w", entry.Name(), err)
+			continue
+		}
+
+		kept := h.Versions[:0]
+		for _, v := range h.Versions {
+			if v.Created.After(cutoff) {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) > limit {
+			kept = kept[len(kept)-limit:]
+		}
+		if n := len(h.Versions) - len(kept); n > 0 {
+			dropped += n
+			h.Versions = kept
+			if err := writeHistory(drv, h); err != nil {
+				return dropped, err
+			}
+		}
+		for _, v := range h.Versions {
+			used[v.Hash] = true
+		}
+	}
+
+	if unreadable != nil {
+		// The contents that history refers to would look unused
+		return dropped, fmt.Errorf("kept all stored contents: %w", unreadable)
+	}
+	return dropped, removeUnused(drv, used)
+}
+
+// removeUnused deletes the blobs missing from used; callers hold mu
+func removeUnused(drv storage.Driver, used map[string]bool) error {
+	dirs, err := drv.ReadDir(blobDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dirs {
+		if strings.HasPrefix(d.Name(), tmpPrefix) {
+			// Being copied by Keep, or left behind by a crash when it
+			// has not changed for an hour
+			if time.Since(d.ModTime()) > time.Hour {
+				drv.RemoveAll(path.Join(blobDir, d.Name()))
+			}
+			continue
+		}
+		if !d.IsDir() {
+			continue
+		}
+		blobs, err := drv.ReadDir(path.Join(blobDir, d.Name()))
+		if err != nil {
+			return err
+		}
+		for _, b := range blobs {
+			if !used[b.Name()] {
+				if err := drv.RemoveAll(path.Join(blobDir, d.Name(), b.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// StartPurger applies the retention of every versioned source once an hour
+func StartPurger() {
+	go func() {
+		for {
+			for _, src := range config.GetEnabledSources() {
+				if src.Versioning == nil {
+					continue
+				}
+				drv, err := storage.Get(src.ID)
+				if err != nil {
+					continue
+				}
+				n, err := Prune(drv, src.ID)
+				if err != nil {
+					utils.Warnf("⚠️  Version purge failed for %s: %v", src.Name, err)
+				} else if n > 0 {
+					utils.Infof("🗂️  Dropped %d expired versions from %s", n, src.Name)
+				}
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
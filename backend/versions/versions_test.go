@@ -0,0 +1,180 @@
+package versions
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filemanager/config"
+	"filemanager/storage"
+)
+
+// storeBlob copies a file into the blob store and returns its hash
+func storeBlob(drv storage.Driver, name string) (string, error) {
+	tmp, hash, err := copyBlob(drv, name)
+	if err != nil {
+		return "", err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return hash, placeBlob(drv, tmp, hash)
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name      string
+		corrupt   bool
+		wantErr   bool
+		blobsLeft int
+	}{
+		{"unused contents go", false, false, 1},
+		{"unreadable history keeps contents", true, true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			drv, err := storage.NewLocal(config.Source{Path: dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, body := range map[string]string{"a.txt": "kept", "b.txt": "orphan"} {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			kept, err := storeBlob(drv, "/a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := storeBlob(drv, "/b.txt"); err != nil {
+				t.Fatal(err)
+			}
+			h := &history{Path: "/a.txt", Versions: []Version{{ID: newID(), Hash: kept, Created: time.Now()}}}
+			if err := writeHistory(drv, h); err != nil {
+				t.Fatal(err)
+			}
+			if tt.corrupt {
+				// A history for b.txt that cannot be read any more
+				bad := filepath.Join(dir, filepath.FromSlash(historyPath("/b.txt")))
+				if err := os.WriteFile(bad, []byte("{"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err = Prune(drv, "test")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Prune error = %v, want error %v", err, tt.wantErr)
+			}
+			blobs, _ := filepath.Glob(filepath.Join(dir, filepath.FromSlash(blobDir), "*", "*"))
+			if len(blobs) != tt.blobsLeft {
+				t.Errorf("%d stored contents left, want %d", len(blobs), tt.blobsLeft)
+			}
+			if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(blobPath(kept)))); err != nil {
+				t.Errorf("contents of a kept version are gone: %v", err)
+			}
+		})
+	}
+}
+
+func TestWriteHistoryLeavesNoTemporaryFile(t *testing.T) {
+	dir := t.TempDir()
+	drv, err := storage.NewLocal(config.Source{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		h := &history{Path: "/a.txt"}
+		for k := 0; k < i; k++ {
+			h.Versions = append(h.Versions, Version{ID: newID(), Hash: "00"})
+		}
+		if err := writeHistory(drv, h); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readHistory(drv, "/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Versions) != i {
+			t.Errorf("read %d versions, want %d", len(got.Versions), i)
+		}
+	}
+
+	entries, err := drv.ReadDir(historyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in the history folder, want 1", len(entries))
+	}
+}
+
+func TestKeepCopiesWithoutLock(t *testing.T) {
+	dir := t.TempDir()
+	cfg := fmt.Sprintf("sources:\n  - id: test\n    name: Test\n    path: %q\n    versioning:\n      maxVersions: 5\n", dir)
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(p, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.SetPath(p)
+	config.Init()
+	drv, err := storage.NewLocal(config.Source{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// While something else holds the store, Keep still copies the file
+	// and then waits to record it
+	mu.Lock()
+	done := make(chan error, 1)
+	go func() { done <- Keep(drv, "test", "/a.txt") }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tmps, _ := filepath.Glob(filepath.Join(dir, filepath.FromSlash(blobDir), tmpPrefix+"*"))
+		if len(tmps) == 1 {
+			if b, _ := os.ReadFile(tmps[0]); string(b) == "old" {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			mu.Unlock()
+			t.Fatal("Keep did not copy the file while the store was locked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Keep finished without the lock: %v", err)
+	default:
+	}
+	mu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// A prune right after keeps the contents the version refers to
+	if _, err := Prune(drv, "test"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := List(drv, "/a.txt")
+	if err != nil || len(list) != 1 {
+		t.Fatalf("versions %+v, %v", list, err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(blobPath(list[0].Hash))))
+	if err != nil || string(b) != "old" {
+		t.Errorf("stored contents %q, %v", b, err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, filepath.FromSlash(blobDir)))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), tmpPrefix) {
+			t.Errorf("temporary blob %s left", e.Name())
+		}
+	}
+}
@@ -1,13 +1,45 @@
 import axios from 'axios'
+import router from '@/router'
 
 const API_BASE = import.meta.env.VITE_API_URL || '/api'
 
 const api = axios.create({
   baseURL: API_BASE,
   timeout: 30000,
+  withCredentials: true,
 })
 
+// Send the user to the login page whenever the session is missing or expired
+api.interceptors.response.use(
+  (response) => response,
+  (error) => {
+    const route = router.currentRoute.value
+    if (error.response?.status === 401 && route.name !== 'login') {
+      router.push({ name: 'login', query: { redirect: route.fullPath } })
+    }
+    return Promise.reject(error)
+  },
+)
+
 export const fileService = {
+  // Sign in
+  async login(username, password) {
+    const response = await api.post('/login', { username, password })
+    return response.data
+  },
+
+  // Sign out
+  async logout() {
+    const response = await api.post('/logout')
+    return response.data
+  },
+
+  // Get the signed in user
+  async me() {
+    const response = await api.get('/me')
+    return response.data
+  },
+
   // List files in a directory
   async list(sourceID, path = '/') {
     const response = await api.get('/list', { params: { source: sourceID, path } })
@@ -37,6 +69,56 @@ export const fileService = {
     return response.data
   },
 
+  // List background jobs
+  async listJobs() {
+    const response = await api.get('/jobs')
+    return response.data
+  },
+
+  // Get a single job with its progress
+  async getJob(id) {
+    const response = await api.get('/jobs', { params: { id } })
+    return response.data
+  },
+
+  async cancelJob(id) {
+    const response = await api.post('/jobs/cancel', { id })
+    return response.data
+  },
+
+  async retryJob(id) {
+    const response = await api.post('/jobs/retry', { id })
+    return response.data
+  },
+
+  // Poll a job until it finishes, reporting progress along the way
+  async waitForJob(id, onProgress) {
+    for (;;) {
+      const { data: job } = await this.getJob(id)
+      if (onProgress) onProgress(job)
+      if (!['queued', 'running'].includes(job.status)) return job
+      await new Promise((resolve) => setTimeout(resolve, 1000))
+    }
+  },
+
+  // List items in the trash of a source
+  async listTrash(sourceID) {
+    const response = await api.get('/trash', { params: { source: sourceID } })
+    return response.data
+  },
+
+  // Restore a trash item to where it was deleted from
+  async restoreTrash(sourceID, id) {
+    const response = await api.post('/trash/restore', { source: sourceID, id })
+    return response.data
+  },
+
+  // Permanently delete a trash item, or the whole trash without an id
+  async purgeTrash(sourceID, id = '') {
+    const response = await api.delete('/trash/purge', { data: { source: sourceID, id } })
+    return response.data
+  },
+
   // Copy file or folder
   async copy(sourceId, sourcePath, destId, destination) {
     const response = await api.post('/copy', { 
@@ -59,19 +141,109 @@ export const fileService = {
     return response.data
   },
 
+  // Extract an archive into a new folder (runs as a job)
+  async extract(sourceID, path, destination = '') {
+    const response = await api.post('/extract', { source: sourceID, path, destination })
+    return response.data
+  },
+
+  // Pack items into an archive in the same source (runs as a job)
+  async compress(sourceID, paths, format = 'zip', destination = '') {
+    const response = await api.post('/compress', { source: sourceID, paths, format, destination })
+    return response.data
+  },
+
+  // List share links, everyone's for admins with all
+  async listShares(all = false) {
+    const response = await api.get('/shares', { params: all ? { all: true } : {} })
+    return response.data
+  },
+
+  // Share a file or folder by link. options: mode ('read' or 'upload'),
+  // password, expires (Date) and maxDownloads; upload links (file requests)
+  // also take maxFileSize, maxTotalSize, allowedTypes and notify, which
+  // the server refuses unless it has a webhook configured
+  async createShare(sourceID, path, options = {}) {
+    const response = await api.post('/shares/create', { source: sourceID, path, ...options })
+    return response.data
+  },
+
+  async revokeShare(token) {
+    const response = await api.delete('/shares/revoke', { data: { token } })
+    return response.data
+  },
+
+  // Get the public address of a share link
+  getShareUrl(share) {
+    return new URL(share.url, window.location.origin).href
+  },
+
+  // Search the index. filters: source, path, name (glob or substring),
+  // q (words), ext, type, minSize, maxSize, from, to and limit
+  async search(filters = {}) {
+    const response = await api.get('/search', { params: filters })
+    return response.data
+  },
+
+  // List the earlier versions of a file, newest first
+  async listVersions(sourceID, path) {
+    const response = await api.get('/versions', { params: { source: sourceID, path } })
+    return response.data
+  },
+
+  // Put an earlier version of a file back in place
+  async restoreVersion(sourceID, path, id) {
+    const response = await api.post('/versions/restore', { source: sourceID, path, id })
+    return response.data
+  },
+
+  // Query the audit log (admins only). filters: user, source, path, op,
+  // from and to (ISO times) and limit
+  async getAuditLog(filters = {}) {
+    const response = await api.get('/admin/audit', { params: filters })
+    return response.data
+  },
+
+  // List every configured source, including disabled ones (admins only)
+  async listAllSources() {
+    const response = await api.get('/admin/sources')
+    return response.data
+  },
+
+  // Add a source (admins only). Secrets left empty on update keep their value
+  async addSource(source) {
+    const response = await api.post('/admin/sources/add', source)
+    return response.data
+  },
+
+  async updateSource(id, source) {
+    const response = await api.post('/admin/sources/update', { id, ...source })
+    return response.data
+  },
+
+  async setSourceEnabled(id, enabled) {
+    const response = await api.post('/admin/sources/enable', { id, enabled })
+    return response.data
+  },
+
+  async removeSource(id) {
+    const response = await api.delete('/admin/sources/remove', { data: { id } })
+    return response.data
+  },
+
   // Rename file or folder
   async rename(sourceID, path, newName) {
     const response = await api.post('/rename', { source: sourceID, path, newName })
     return response.data
   },
 
-  // Upload file
-  async upload(sourceID, path, file, onProgress) {
+  // Upload file. overwrite is 'reject' (default), 'replace' or 'rename'
+  async upload(sourceID, path, file, onProgress, overwrite = '') {
     const formData = new FormData()
     formData.append('file', file)
 
     const response = await api.post('/upload', formData, {
-      params: { source: sourceID, path },
+      params: { source: sourceID, path, overwrite },
       headers: { 'Content-Type': 'multipart/form-data' },
       onUploadProgress: (progressEvent) => {
         if (onProgress && progressEvent.total) {
@@ -83,18 +255,79 @@ export const fileService = {
     return response.data
   },
 
+  // Upload through the resumable (tus) endpoint in chunks. An upload of the
+  // same file that was interrupted continues where it stopped.
+  async uploadResumable(sourceID, path, file, onProgress, overwrite = '', chunkSize = 8 << 20) {
+    const tus = { 'Tus-Resumable': '1.0.0' }
+    const key = `tus:${sourceID}:${path}:${file.name}:${file.size}:${file.lastModified}:${overwrite}`
+    const meta = (value) => btoa(unescape(encodeURIComponent(value)))
+    const absolute = (location) => new URL(location, new URL(API_BASE, window.location.href)).href
+
+    let url = localStorage.getItem(key)
+    let offset = 0
+    const resync = async () => {
+      const head = await api.head(url, { headers: tus })
+      offset = Number(head.headers['upload-offset'])
+    }
+
+    if (url) {
+      try {
+        await resync()
+      } catch {
+        url = null
+      }
+    }
+    if (!url) {
+      const created = await api.post('/tus/', null, {
+        params: { source: sourceID, path },
+        headers: {
+          ...tus,
+          'Upload-Length': file.size,
+          'Upload-Metadata': `filename ${meta(file.name)},overwrite ${meta(overwrite)}`,
+        },
+      })
+      url = absolute(created.headers.location)
+      localStorage.setItem(key, url)
+    }
+
+    let retries = 0
+    while (offset < file.size) {
+      try {
+        const response = await api.patch(url, file.slice(offset, offset + chunkSize), {
+          timeout: 0,
+          headers: { ...tus, 'Content-Type': 'application/offset+octet-stream', 'Upload-Offset': offset },
+          onUploadProgress: (progressEvent) => {
+            if (onProgress) onProgress(Math.round(((offset + progressEvent.loaded) * 100) / file.size))
+          },
+        })
+        offset = Number(response.headers['upload-offset'])
+        retries = 0
+      } catch (error) {
+        // Give up on answers from the server, retry dropped connections
+        if (error.response?.status !== 409 && (error.response || ++retries > 5)) throw error
+        await new Promise((resolve) => setTimeout(resolve, 1000 * retries))
+        await resync()
+      }
+    }
+
+    localStorage.removeItem(key)
+    if (onProgress) onProgress(100)
+  },
+
   async getStorageInfo(sourceID) {
     const response = await api.get('/storage', { params: { source: sourceID } })
     return response.data
   },
 
-   async getSettings() {
-    const response = await api.get('/settings')
+  // Settings are kept per user; pass a client ID to keep separate ones
+  // for this device. Fields left out of a save keep their value.
+  async getSettings(client) {
+    const response = await api.get('/settings', { params: { client } })
     return response.data
   },
 
-  async saveSettings(settings) {
-    const response = await api.post('/settings/save', settings)
+  async saveSettings(settings, client) {
+    const response = await api.post('/settings/save', settings, { params: { client } })
     return response.data
   },
 
@@ -104,15 +337,39 @@ export const fileService = {
     return response.data
   },
 
+  // Subscribe to changes inside a folder; returns the EventSource so the
+  // caller can close it
+  watch(sourceID, path, onChange) {
+    const url = `${API_BASE}/events?source=${sourceID}&path=${encodeURIComponent(path)}`
+    const source = new EventSource(url, { withCredentials: true })
+    source.addEventListener('change', (e) => onChange(JSON.parse(e.data)))
+    return source
+  },
+
   // Get download URL
   getDownloadUrl(sourceID, path) {
     return `${API_BASE}/download?source=${sourceID}&path=${encodeURIComponent(path)}`
   },
 
+  // Get archive URL for downloading several items or folders at once
+  getArchiveUrl(sourceID, paths, format = 'zip', level = '') {
+    const params = new URLSearchParams({ source: sourceID, format })
+    if (level !== '') params.set('level', level)
+    paths.forEach((path) => params.append('path', path))
+    return `${API_BASE}/archive?${params}`
+  },
+
   // Get serve URL (for viewing)
   getServeUrl(sourceID, path) {
     return `${API_BASE}/serve?source=${sourceID}&path=${encodeURIComponent(path)}`
   },
+
+  // Get URL of an earlier version, for viewing or with download for saving
+  getVersionUrl(sourceID, path, id, download = false) {
+    const params = new URLSearchParams({ source: sourceID, path, id })
+    if (download) params.set('download', 'true')
+    return `${API_BASE}/versions/serve?${params}`
+  },
   
 }
 
@@ -1,5 +1,6 @@
 import { createRouter, createWebHistory } from 'vue-router'
 import FileBrowser from '../views/FileBrowser.vue'
+import LoginView from '../views/LoginView.vue'
 
 const router = createRouter({
   history: createWebHistory(import.meta.env.BASE_URL),
@@ -8,8 +9,13 @@ const router = createRouter({
       path: '/',
       name: 'home',
       component: FileBrowser
+    },
+    {
+      path: '/login',
+      name: 'login',
+      component: LoginView
     }
   ]
 })
 
-export default router
\ No newline at end of file
+export default router